@@ -12,6 +12,7 @@ func main() {
 		"GoVersions": []string{"1.11"},
 		"Binary":     []string{"controller", "speaker", "test-bgp-router"},
 		"Arch":       []string{"amd64", "arm", "arm64", "ppc64le", "s390x"},
+		"CrossGOOS":  []string{"darwin", "freebsd", "windows"},
 	}
 	if err := tmpl.Execute(os.Stdout, v); err != nil {
 		log.Fatalf("Error executing template: %s", err)
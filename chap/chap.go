@@ -0,0 +1,38 @@
+// Package chap encodes and decodes packets of the PPP Challenge
+// Handshake Authentication Protocol, as described in RFC 1994, for
+// tools and tests that generate or check CHAP traffic.
+package chap
+
+import "go.universe.tf/ppp/internal/chap"
+
+// Protocol is the PPP protocol number of CHAP.
+const Protocol = chap.Protocol
+
+// Code is the kind of a CHAP packet.
+type Code = chap.Code
+
+// CHAP packet codes.
+const (
+	Challenge = chap.Challenge
+	Response  = chap.Response
+	Success   = chap.Success
+	Failure   = chap.Failure
+)
+
+// Packet is a CHAP packet. Challenge and Response packets carry a
+// Value and the sender's Name, Success and Failure packets a Message.
+type Packet = chap.Packet
+
+// ParsePacket parses a CHAP packet, without the PPP protocol
+// field. Bytes past the packet's length field are padding, and are
+// ignored.
+func ParsePacket(b []byte) (*Packet, error) {
+	return chap.ParsePacket(b)
+}
+
+// MD5Response returns the CHAP-MD5 response value to challenge, for
+// the given packet ID and secret. A Response to a Challenge carries
+// it as its Value, with the Challenge's ID.
+func MD5Response(id uint8, secret string, challenge []byte) []byte {
+	return chap.MD5Response(id, secret, challenge)
+}
@@ -0,0 +1,269 @@
+// Command ppp-bench measures the throughput of the userspace PPPoE
+// data plane, so that changes to it can be compared on a standard
+// benchmark.
+//
+// It runs both ends of the link: a client, using pppoe.Conn with
+// Config.Userspace on one network interface, and a minimal
+// concentrator on another, which answers discovery and counts the
+// session frames that reach it. The two interfaces are normally the
+// ends of a veth pair, with an MTU large enough for the biggest PPP
+// MTU to test, plus 8 bytes of PPPoE and PPP headers:
+//
+//	ip link add pppb0 mtu 9008 type veth peer name pppb1 mtu 9008
+//	ip link set pppb0 up
+//	ip link set pppb1 up
+//	ppp-bench -client pppb0 -ac pppb1 -mtu 576,1492,1500,9000
+//
+// For each MTU, ppp-bench sets up a session whose PPP-Max-Payload is
+// that MTU, writes full-sized frames on it as fast as it can for
+// -duration, and reports the frames per second and Gbit/s of PPP
+// frames that the client sent, and the share of them that reached the
+// concentrator. The concentrator reads with one syscall per frame, so
+// it usually falls behind first; the sending rate is the figure to
+// compare.
+package main // import "go.universe.tf/ppp/cmd/ppp-bench"
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdlayher/raw"
+	"go.universe.tf/ppp/pppoe"
+)
+
+var (
+	clientIf = flag.String("client", "", "network interface to run the PPPoE client on")
+	acIf     = flag.String("ac", "", "network interface to run the concentrator on")
+	mtus     = flag.String("mtu", "1492", "comma-separated PPP MTUs to benchmark")
+	duration = flag.Duration("duration", 5*time.Second, "how long to send frames at each MTU")
+)
+
+// PPPoE and PPP constants that the concentrator needs.
+const (
+	protoDiscovery = 0x8863
+	protoSession   = 0x8864
+
+	codePADI = 0x09
+	codePADR = 0x19
+
+	tagServiceName   = 0x0101
+	tagHostUniq      = 0x0103
+	tagPPPMaxPayload = 0x0120
+
+	protoIPv4 = 0x0021
+)
+
+func main() {
+	flag.Parse()
+
+	if *clientIf == "" || *acIf == "" {
+		log.Fatal("-client and -ac are required")
+	}
+	var sizes []int
+	for _, f := range strings.Split(*mtus, ",") {
+		mtu, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || mtu < 1 || mtu > 0xffff-8 {
+			log.Fatalf("invalid MTU %q in -mtu", f)
+		}
+		sizes = append(sizes, mtu)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ac, err := startConcentrator(ctx, *acIf)
+	if err != nil {
+		log.Fatalf("starting concentrator on %s: %v", *acIf, err)
+	}
+
+	fmt.Printf("%6s %12s %8s %10s\n", "MTU", "frames/s", "Gbit/s", "delivered")
+	for _, mtu := range sizes {
+		res, err := bench(ctx, ac, mtu)
+		if err != nil {
+			log.Fatalf("benchmarking MTU %d: %v", mtu, err)
+		}
+		secs := res.elapsed.Seconds()
+		frames := float64(res.sent) / secs
+		gbps := frames * float64(2+mtu) * 8 / 1e9
+		delivered := 100 * float64(res.received) / float64(res.sent)
+		fmt.Printf("%6d %12.0f %8.3f %9.1f%%\n", mtu, frames, gbps, delivered)
+	}
+}
+
+// result is the outcome of benchmarking one MTU.
+type result struct {
+	elapsed        time.Duration
+	sent, received uint64
+}
+
+// bench sets up a session with PPP MTU mtu on the client interface,
+// and sends frames on it for the benchmark's duration.
+func bench(ctx context.Context, ac *concentrator, mtu int) (*result, error) {
+	conn, err := pppoe.New(ctx, *clientIf, &pppoe.Config{
+		Userspace:  true,
+		MaxPayload: mtu,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if got := conn.MaxPayload(); got < mtu {
+		return nil, fmt.Errorf("session only carries %d-byte payloads", got)
+	}
+
+	frame := make([]byte, 2+mtu)
+	binary.BigEndian.PutUint16(frame, protoIPv4)
+
+	received := ac.received()
+	var ret result
+	start := time.Now()
+	end := start.Add(*duration)
+	for {
+		// Checking the time is slow enough to skew small frames, so
+		// it's only done every so often.
+		for i := 0; i < 64; i++ {
+			if _, err := conn.Write(frame); err != nil {
+				return nil, fmt.Errorf("writing frame: %v", err)
+			}
+		}
+		ret.sent += 64
+		if time.Now().After(end) {
+			break
+		}
+	}
+	ret.elapsed = time.Since(start)
+
+	// Let the concentrator drain what's still in flight.
+	time.Sleep(100 * time.Millisecond)
+	ret.received = ac.received() - received
+	return &ret, nil
+}
+
+// concentrator is a minimal PPPoE concentrator. It offers a session
+// to every client, echoing their Service-Name, Host-Uniq and
+// PPP-Max-Payload tags, and counts the session frames it receives.
+// It never sends session frames, so it doesn't run LCP.
+type concentrator struct {
+	disc net.PacketConn
+	sess net.PacketConn
+
+	nextSession uint16
+	// frames counts the session frames received.
+	frames uint64
+}
+
+// startConcentrator runs a concentrator on ifName until ctx is
+// canceled.
+func startConcentrator(ctx context.Context, ifName string) (*concentrator, error) {
+	intf, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, err
+	}
+	disc, err := raw.ListenPacket(intf, protoDiscovery, &raw.Config{LinuxSockDGRAM: true})
+	if err != nil {
+		return nil, fmt.Errorf("creating PPPoE Discovery conn: %v", err)
+	}
+	// Without timeouts, raw reads take one syscall rather than two,
+	// which helps the sink keep up.
+	sess, err := raw.ListenPacket(intf, protoSession, &raw.Config{LinuxSockDGRAM: true, NoTimeouts: true})
+	if err != nil {
+		disc.Close()
+		return nil, fmt.Errorf("creating PPPoE Session conn: %v", err)
+	}
+	ac := &concentrator{
+		disc:        disc,
+		sess:        sess,
+		nextSession: 1,
+	}
+
+	events := make(chan *pppoe.DiscoveryEvent)
+	go func() {
+		if err := pppoe.RunMonitor(ctx, ifName, events); err != nil && ctx.Err() == nil {
+			log.Fatalf("watching PPPoE Discovery on %s: %v", ifName, err)
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case ev := <-events:
+				if err := ac.handleDiscovery(ev); err != nil {
+					log.Fatalf("answering %s: %v", ev, err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go ac.sink()
+	go ac.drain()
+	go func() {
+		<-ctx.Done()
+		disc.Close()
+		sess.Close()
+	}()
+	return ac, nil
+}
+
+// handleDiscovery answers PADIs with a PADO, and PADRs with a PADS.
+func (ac *concentrator) handleDiscovery(ev *pppoe.DiscoveryEvent) error {
+	var reply *pppoe.PacketBuilder
+	switch {
+	case ev.Err != nil:
+		return nil
+	case ev.Code == codePADI:
+		reply = pppoe.NewPADO().WithACName("ppp-bench")
+	case ev.Code == codePADR:
+		reply = pppoe.NewPADS(ac.nextSession)
+		ac.nextSession++
+	default:
+		return nil
+	}
+	for _, tag := range ev.Tags {
+		switch tag.Type {
+		case tagServiceName, tagHostUniq, tagPPPMaxPayload:
+			reply.WithTag(tag.Type, tag.Value)
+		}
+	}
+	_, err := ac.disc.WriteTo(reply.Bytes(), &raw.Addr{HardwareAddr: ev.Source})
+	return err
+}
+
+// sink counts session frames until the session conn is closed.
+func (ac *concentrator) sink() {
+	b := make([]byte, 0x10000)
+	for {
+		n, _, err := ac.sess.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		if n < 6 || b[0] != 0x11 || b[1] != 0 || int(binary.BigEndian.Uint16(b[4:6])) > n-6 {
+			continue
+		}
+		atomic.AddUint64(&ac.frames, 1)
+	}
+}
+
+// drain reads and drops the Discovery packets that reach the
+// concentrator's Discovery conn, which it only uses to send, so that
+// they don't pile up in its socket. RunMonitor has its own socket to
+// see them.
+func (ac *concentrator) drain() {
+	b := make([]byte, 1500)
+	for {
+		if _, _, err := ac.disc.ReadFrom(b); err != nil {
+			return
+		}
+	}
+}
+
+// received returns the number of session frames received so far.
+func (ac *concentrator) received() uint64 {
+	return atomic.LoadUint64(&ac.frames)
+}
@@ -0,0 +1,63 @@
+// Command pppoe-kill sends a PADT to force a PPPoE concentrator to
+// tear down a session.
+//
+// It's useful for clearing stuck sessions left behind by crashed
+// clients, which strict concentrators otherwise hold on to until they
+// time out, refusing new sessions in the meantime.
+//
+// Usage:
+//
+//	pppoe-kill -interface eth0 -session 491 -ac 00:11:22:33:44:55
+//
+// If the session ran on a VLAN, or from an Ethernet address other than
+// the interface's, -vlan and -mac must say so, since concentrators
+// ignore PADTs from elsewhere.
+package main // import "go.universe.tf/ppp/cmd/pppoe-kill"
+
+import (
+	"flag"
+	"log"
+	"net"
+
+	"go.universe.tf/ppp/pppoe"
+)
+
+var (
+	ifName    = flag.String("interface", "", "network interface the session is running on")
+	sessionID = flag.Uint("session", 0, "PPPoE session ID to terminate")
+	acAddr    = flag.String("ac", "", "Ethernet address of the PPPoE concentrator")
+	vlanID    = flag.Int("vlan", 0, "802.1Q VLAN ID the session is running on, if any")
+	srcAddr   = flag.String("mac", "", "Ethernet address the session is running from, if not the interface's")
+)
+
+func main() {
+	flag.Parse()
+
+	if *ifName == "" {
+		log.Fatal("-interface is required")
+	}
+	if *sessionID == 0 || *sessionID > 0xffff {
+		log.Fatalf("-session must be a PPPoE session ID between 1 and 65535, got %d", *sessionID)
+	}
+	concentrator, err := net.ParseMAC(*acAddr)
+	if err != nil {
+		log.Fatalf("parsing -ac: %v", err)
+	}
+	if len(concentrator) != 6 {
+		log.Fatalf("-ac must be an Ethernet address, got %s", concentrator)
+	}
+	cfg := &pppoe.Config{VLANID: *vlanID}
+	if *srcAddr != "" {
+		if cfg.HardwareAddr, err = net.ParseMAC(*srcAddr); err != nil {
+			log.Fatalf("parsing -mac: %v", err)
+		}
+		if len(cfg.HardwareAddr) != 6 {
+			log.Fatalf("-mac must be an Ethernet address, got %s", cfg.HardwareAddr)
+		}
+	}
+
+	if err := pppoe.Terminate(*ifName, concentrator, uint16(*sessionID), cfg); err != nil {
+		log.Fatalf("sending PADT: %v", err)
+	}
+	log.Printf("sent PADT for session %d to %s on %s", *sessionID, concentrator, *ifName)
+}
@@ -0,0 +1,43 @@
+// Package auth authenticates to a PPP peer, with the protocol that
+// the peer asked for during LCP negotiation.
+package auth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"go.universe.tf/ppp/internal/chap"
+	"go.universe.tf/ppp/internal/cp"
+	"go.universe.tf/ppp/internal/pap"
+	"go.universe.tf/ppp/lcp"
+)
+
+// Authenticate authenticates to the peer on conn as name, using the
+// authentication protocol proto. proto is typically the AuthProto of
+// the Peer options that lcp.Negotiate returned. If it's nil, the peer
+// didn't ask for authentication, and Authenticate does nothing.
+// logger, if not nil, receives the authentication packets that are
+// sent and received, without secrets, and the outcome.
+func Authenticate(ctx context.Context, conn lcp.Conn, proto *lcp.AuthProto, name, secret string, logger cp.Logger) error {
+	var err error
+	switch {
+	case proto == nil:
+		cp.Log(logger, "peer didn't ask for authentication")
+		return nil
+	case proto.Protocol == lcp.ProtoPAP:
+		c := &pap.Client{Name: name, Password: secret, Logger: logger}
+		err = c.Authenticate(ctx, conn)
+	case proto.Protocol == lcp.ProtoCHAP && bytes.Equal(proto.Data, []byte{lcp.CHAPMD5}):
+		c := &chap.Client{Name: name, Secret: secret, Logger: logger}
+		err = c.Authenticate(ctx, conn)
+	default:
+		err = fmt.Errorf("unsupported authentication protocol 0x%04x (data %x)", proto.Protocol, proto.Data)
+	}
+	if err != nil {
+		cp.Log(logger, "authentication failed", "error", err)
+		return err
+	}
+	cp.Log(logger, "authenticated", "name", name)
+	return nil
+}
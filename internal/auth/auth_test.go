@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.universe.tf/ppp/internal/chap"
+	"go.universe.tf/ppp/lcp"
+)
+
+// scriptedConn is a PPP link on which the peer sends a fixed list of
+// frames, then goes away.
+type scriptedConn struct {
+	in [][]byte
+	// sent are the protocols of the frames written to the conn.
+	sent []uint16
+}
+
+func (c *scriptedConn) Read(b []byte) (int, error) {
+	if len(c.in) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.in[0])
+	c.in = c.in[1:]
+	return n, nil
+}
+
+func (c *scriptedConn) WriteProtocol(proto uint16, payload []byte) error {
+	c.sent = append(c.sent, proto)
+	return nil
+}
+
+func (c *scriptedConn) SetReadDeadline(time.Time) error { return nil }
+
+func TestAuthenticate(t *testing.T) {
+	challenge := &chap.Packet{Code: chap.Challenge, ID: 1, Value: []byte{1, 2, 3, 4}}
+	challengeFrame := make([]byte, 2)
+	binary.BigEndian.PutUint16(challengeFrame, chap.Protocol)
+	challengeFrame = append(challengeFrame, challenge.Marshal()...)
+
+	// The peer goes away after its scripted frames, so Authenticate
+	// fails even when it picked the right protocol. What matters is
+	// what it sent.
+	tests := []struct {
+		desc     string
+		proto    *lcp.AuthProto
+		in       [][]byte
+		wantSent []uint16
+		wantErr  bool
+	}{
+		{
+			desc: "no authentication",
+		},
+		{
+			desc:     "PAP",
+			proto:    &lcp.AuthProto{Protocol: lcp.ProtoPAP},
+			wantSent: []uint16{lcp.ProtoPAP},
+			wantErr:  true,
+		},
+		{
+			desc:     "CHAP-MD5",
+			proto:    &lcp.AuthProto{Protocol: lcp.ProtoCHAP, Data: []byte{lcp.CHAPMD5}},
+			in:       [][]byte{challengeFrame},
+			wantSent: []uint16{lcp.ProtoCHAP},
+			wantErr:  true,
+		},
+		{
+			desc:    "MS-CHAPv2",
+			proto:   &lcp.AuthProto{Protocol: lcp.ProtoCHAP, Data: []byte{0x81}},
+			wantErr: true,
+		},
+		{
+			desc:    "EAP",
+			proto:   &lcp.AuthProto{Protocol: 0xc227},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			conn := &scriptedConn{in: test.in}
+			err := Authenticate(context.Background(), conn, test.proto, "bob", "hunter2", nil)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Authenticate returned %v, want error %v", err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.wantSent, conn.sent); diff != "" {
+				t.Fatalf("wrong frames sent (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
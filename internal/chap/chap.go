@@ -0,0 +1,123 @@
+// Package chap implements the client side of the PPP Challenge
+// Handshake Authentication Protocol, as described in RFC 1994.
+package chap
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+)
+
+// Protocol is the PPP protocol number of CHAP.
+const Protocol = 0xc223
+
+// Code is the kind of a CHAP packet.
+type Code uint8
+
+// CHAP packet codes.
+const (
+	Challenge Code = 1
+	Response  Code = 2
+	Success   Code = 3
+	Failure   Code = 4
+)
+
+var codeNames = map[Code]string{
+	Challenge: "Challenge",
+	Response:  "Response",
+	Success:   "Success",
+	Failure:   "Failure",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Code(%d)", uint8(c))
+}
+
+// Packet is a CHAP packet.
+type Packet struct {
+	// Code is the kind of packet.
+	Code Code
+	// ID matches Responses to Challenges, and Success or Failure to
+	// Responses.
+	ID uint8
+	// Value is the challenge or response value. It's only used in
+	// Challenge and Response packets.
+	Value []byte
+	// Name is the name of the system sending the packet. It's only
+	// used in Challenge and Response packets.
+	Name string
+	// Message is a human-readable message. It's only used in Success
+	// and Failure packets.
+	Message string
+}
+
+// ParsePacket parses a CHAP packet, without the PPP protocol
+// field. Bytes past the packet's length field are padding, and are
+// ignored.
+func ParsePacket(b []byte) (*Packet, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("CHAP packet too short (%d bytes)", len(b))
+	}
+	l := int(binary.BigEndian.Uint16(b[2:4]))
+	if l < 4 || l > len(b) {
+		return nil, fmt.Errorf("invalid CHAP packet length %d for %d-byte packet", l, len(b))
+	}
+	ret := &Packet{
+		Code: Code(b[0]),
+		ID:   b[1],
+	}
+	data := b[4:l]
+
+	switch ret.Code {
+	case Challenge, Response:
+		if len(data) < 1 {
+			return nil, fmt.Errorf("CHAP %s has no value", ret.Code)
+		}
+		vl := int(data[0])
+		if vl == 0 || 1+vl > len(data) {
+			return nil, fmt.Errorf("invalid value length %d in %d-byte CHAP %s", vl, len(data), ret.Code)
+		}
+		ret.Value = append([]byte(nil), data[1:1+vl]...)
+		ret.Name = string(data[1+vl:])
+	case Success, Failure:
+		ret.Message = string(data)
+	default:
+		return nil, fmt.Errorf("unknown CHAP code %d", uint8(ret.Code))
+	}
+
+	return ret, nil
+}
+
+// Marshal returns the wire encoding of the packet, without the PPP
+// protocol field.
+func (p *Packet) Marshal() []byte {
+	var data []byte
+	switch p.Code {
+	case Challenge, Response:
+		data = append(data, byte(len(p.Value)))
+		data = append(data, p.Value...)
+		data = append(data, p.Name...)
+	default:
+		data = append(data, p.Message...)
+	}
+
+	ret := make([]byte, 4+len(data))
+	ret[0] = byte(p.Code)
+	ret[1] = p.ID
+	binary.BigEndian.PutUint16(ret[2:4], uint16(len(ret)))
+	copy(ret[4:], data)
+	return ret
+}
+
+// MD5Response returns the CHAP-MD5 response value to challenge, for
+// the given packet ID and secret.
+func MD5Response(id uint8, secret string, challenge []byte) []byte {
+	h := md5.New()
+	h.Write([]byte{id})
+	h.Write([]byte(secret))
+	h.Write(challenge)
+	return h.Sum(nil)
+}
@@ -0,0 +1,209 @@
+package chap
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParsePacket(t *testing.T) {
+	tests := []struct {
+		desc    string
+		raw     []byte
+		want    *Packet
+		wantErr bool
+	}{
+		{
+			desc: "Challenge",
+			raw:  []byte{1, 3, 0, 11, 4, 1, 2, 3, 4, 'a', 'c'},
+			want: &Packet{
+				Code:  Challenge,
+				ID:    3,
+				Value: []byte{1, 2, 3, 4},
+				Name:  "ac",
+			},
+		},
+		{
+			desc: "Response without name",
+			raw:  []byte{2, 3, 0, 7, 2, 0xaa, 0xbb},
+			want: &Packet{
+				Code:  Response,
+				ID:    3,
+				Value: []byte{0xaa, 0xbb},
+			},
+		},
+		{
+			desc: "Success with padding",
+			raw:  []byte{3, 3, 0, 6, 'o', 'k', 0, 0},
+			want: &Packet{
+				Code:    Success,
+				ID:      3,
+				Message: "ok",
+			},
+		},
+		{
+			desc: "Failure without message",
+			raw:  []byte{4, 3, 0, 4},
+			want: &Packet{
+				Code: Failure,
+				ID:   3,
+			},
+		},
+		{
+			desc:    "too short",
+			raw:     []byte{1, 1, 0},
+			wantErr: true,
+		},
+		{
+			desc:    "length too long",
+			raw:     []byte{3, 1, 0, 5},
+			wantErr: true,
+		},
+		{
+			desc:    "Challenge without value",
+			raw:     []byte{1, 1, 0, 4},
+			wantErr: true,
+		},
+		{
+			desc:    "Challenge with empty value",
+			raw:     []byte{1, 1, 0, 5, 0},
+			wantErr: true,
+		},
+		{
+			desc:    "truncated value",
+			raw:     []byte{1, 1, 0, 7, 4, 1, 2},
+			wantErr: true,
+		},
+		{
+			desc:    "unknown code",
+			raw:     []byte{5, 1, 0, 4},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := ParsePacket(test.raw)
+			if err != nil {
+				if !test.wantErr {
+					t.Fatalf("unexpected parse error: %v", err)
+				}
+				return
+			}
+			if test.wantErr {
+				t.Fatalf("parse succeeded, want error")
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Fatalf("wrong parse (-want +got)\n%s", diff)
+			}
+			l := int(test.raw[2])<<8 | int(test.raw[3])
+			if diff := cmp.Diff(test.raw[:l], got.Marshal()); diff != "" {
+				t.Fatalf("wrong marshal (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMD5Response(t *testing.T) {
+	challenge := make([]byte, 16)
+	for i := range challenge {
+		challenge[i] = byte(i)
+	}
+	got := hex.EncodeToString(MD5Response(7, "hunter2", challenge))
+	want := "624f9dcb5f700137837398d391a7b1a8"
+	if got != want {
+		t.Fatalf("MD5Response = %s, want %s", got, want)
+	}
+}
+
+// goldenHandshake is a CHAP handshake, as stored in testdata/*.json.
+// Secret is the placeholder secret that the Responses answer the
+// Challenges with.
+type goldenHandshake struct {
+	Description string
+	Secret      string
+	Packets     []struct {
+		Desc    string
+		Raw     string
+		Code    uint8
+		ID      uint8
+		Value   string
+		Name    string
+		Message string
+	}
+}
+
+// decodeHex decodes a hex string, ignoring whitespace.
+func decodeHex(s string) ([]byte, error) {
+	return hex.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// TestParsePacketGolden checks that the CHAP handshakes in testdata/
+// parse and unparse as expected, and that their Responses are the
+// MD5 responses to the Challenges before them.
+func TestParsePacketGolden(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.json")
+	if err != nil {
+		t.Fatalf("listing golden files: %v", err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no golden files found in testdata/")
+	}
+
+	for _, file := range files {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading %s: %v", file, err)
+		}
+		var handshake goldenHandshake
+		if err := json.Unmarshal(bs, &handshake); err != nil {
+			t.Fatalf("decoding %s: %v", file, err)
+		}
+
+		var challenge []byte
+		for _, pkt := range handshake.Packets {
+			t.Run(filepath.Base(file)+"/"+pkt.Desc, func(t *testing.T) {
+				raw, err := decodeHex(pkt.Raw)
+				if err != nil {
+					t.Fatalf("decoding raw packet: %v", err)
+				}
+				want := &Packet{
+					Code:    Code(pkt.Code),
+					ID:      pkt.ID,
+					Name:    pkt.Name,
+					Message: pkt.Message,
+				}
+				if pkt.Value != "" {
+					if want.Value, err = decodeHex(pkt.Value); err != nil {
+						t.Fatalf("decoding value: %v", err)
+					}
+				}
+
+				got, err := ParsePacket(raw)
+				if err != nil {
+					t.Fatalf("parsing packet: %v", err)
+				}
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Errorf("wrong packet (-want +got)\n%s", diff)
+				}
+				if diff := cmp.Diff(raw, got.Marshal()); diff != "" {
+					t.Errorf("wrong marshal (-want +got)\n%s", diff)
+				}
+
+				switch got.Code {
+				case Challenge:
+					challenge = got.Value
+				case Response:
+					if diff := cmp.Diff(MD5Response(got.ID, handshake.Secret, challenge), got.Value); diff != "" {
+						t.Errorf("wrong response value (-want +got)\n%s", diff)
+					}
+				}
+			})
+		}
+	}
+}
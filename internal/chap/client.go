@@ -0,0 +1,87 @@
+package chap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.universe.tf/ppp/internal/cp"
+)
+
+// Client authenticates to a peer with CHAP-MD5.
+type Client struct {
+	// Name is the name we send in Responses, typically the account's
+	// username.
+	Name string
+	// Secret is the secret shared with the peer, typically the
+	// account's password.
+	Secret string
+	// Logger, if not nil, receives the CHAP packets that
+	// Authenticate sends and receives, without their values.
+	Logger cp.Logger
+}
+
+// Authenticate answers the peer's Challenges on conn, until the peer
+// reports Success or Failure.
+//
+// The peer may send a Challenge again if our Response got lost, so
+// Authenticate keeps answering until it gets a verdict, or ctx is
+// done. Frames of other protocols are discarded.
+func (c *Client) Authenticate(ctx context.Context, conn cp.Conn) error {
+	stop := cp.WatchContext(ctx, conn)
+	defer stop()
+
+	// respID is the ID of our latest Response. Success or Failure must
+	// carry the same ID.
+	var (
+		respID    uint8
+		responded bool
+	)
+	var b [1500]byte
+	for {
+		n, err := conn.Read(b[:])
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil && os.IsTimeout(err) {
+				return ctxErr
+			}
+			return err
+		}
+		if n < 2 || binary.BigEndian.Uint16(b[:2]) != Protocol {
+			continue
+		}
+		pkt, err := ParsePacket(b[2:n])
+		if err != nil {
+			cp.Log(c.Logger, "received malformed CHAP packet", "error", err)
+			continue
+		}
+		cp.Log(c.Logger, "received CHAP packet", "code", pkt.Code, "id", pkt.ID, "name", pkt.Name, "message", pkt.Message)
+
+		switch pkt.Code {
+		case Challenge:
+			resp := &Packet{
+				Code:  Response,
+				ID:    pkt.ID,
+				Value: MD5Response(pkt.ID, c.Secret, pkt.Value),
+				Name:  c.Name,
+			}
+			if err := conn.WriteProtocol(Protocol, resp.Marshal()); err != nil {
+				return fmt.Errorf("sending CHAP Response: %v", err)
+			}
+			cp.Log(c.Logger, "sent CHAP packet", "code", resp.Code, "id", resp.ID, "name", resp.Name)
+			respID, responded = pkt.ID, true
+		case Success:
+			if responded && pkt.ID == respID {
+				return nil
+			}
+		case Failure:
+			if responded && pkt.ID == respID {
+				if pkt.Message == "" {
+					return errors.New("CHAP authentication failed")
+				}
+				return fmt.Errorf("CHAP authentication failed: %q", pkt.Message)
+			}
+		}
+	}
+}
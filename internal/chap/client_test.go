@@ -0,0 +1,186 @@
+package chap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"go.universe.tf/ppp/internal/cp"
+)
+
+// fakeConn is a PPP link whose peer is driven by the test.
+type fakeConn struct {
+	in, out chan []byte
+	// cancel is closed when a read deadline in the past is set.
+	cancel chan struct{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		in:     make(chan []byte, 10),
+		out:    make(chan []byte, 10),
+		cancel: make(chan struct{}),
+	}
+}
+
+type fakeTimeoutError struct{}
+
+func (fakeTimeoutError) Error() string { return "i/o timeout" }
+func (fakeTimeoutError) Timeout() bool { return true }
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	select {
+	case frame := <-c.in:
+		return copy(b, frame), nil
+	case <-c.cancel:
+		return 0, fakeTimeoutError{}
+	}
+}
+
+func (c *fakeConn) WriteProtocol(proto uint16, payload []byte) error {
+	frame := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(frame, proto)
+	copy(frame[2:], payload)
+	c.out <- frame
+	return nil
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	if !t.IsZero() && t.Before(time.Now()) {
+		close(c.cancel)
+	}
+	return nil
+}
+
+// send makes the peer send pkt to the client.
+func (c *fakeConn) send(proto uint16, pkt *Packet) {
+	frame := make([]byte, 2)
+	binary.BigEndian.PutUint16(frame, proto)
+	c.in <- append(frame, pkt.Marshal()...)
+}
+
+// expectResponse reads the client's answer to a Challenge, and checks
+// that it's the right Response.
+func expectResponse(t *testing.T, c *fakeConn, id uint8, challenge []byte) {
+	t.Helper()
+	select {
+	case frame := <-c.out:
+		if proto := binary.BigEndian.Uint16(frame); proto != Protocol {
+			t.Fatalf("got frame for protocol 0x%04x, want CHAP", proto)
+		}
+		got, err := ParsePacket(frame[2:])
+		if err != nil {
+			t.Fatalf("parsing CHAP packet: %v", err)
+		}
+		want := &Packet{
+			Code:  Response,
+			ID:    id,
+			Value: MD5Response(id, "hunter2", challenge),
+			Name:  "bob",
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("wrong Response (-want +got)\n%s", diff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for CHAP Response")
+	}
+}
+
+func startAuthenticate(ctx context.Context, conn cp.Conn) <-chan error {
+	ret := make(chan error, 1)
+	go func() {
+		c := &Client{Name: "bob", Secret: "hunter2"}
+		ret <- c.Authenticate(ctx, conn)
+	}()
+	return ret
+}
+
+func waitResult(t *testing.T, res <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Authenticate")
+		return nil
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	conn := newFakeConn()
+	res := startAuthenticate(context.Background(), conn)
+
+	// Frames of other protocols and garbage are ignored.
+	conn.in <- []byte{0xc0, 0x21, 9, 1, 0, 8, 0, 0, 0, 0}
+	conn.in <- []byte{0xc2, 0x23, 1}
+
+	// A Success before any Response is bogus.
+	conn.send(Protocol, &Packet{Code: Success, ID: 1})
+
+	challenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	conn.send(Protocol, &Packet{Code: Challenge, ID: 1, Value: challenge, Name: "ac"})
+	expectResponse(t, conn, 1, challenge)
+
+	// The authenticator didn't get our Response, and challenges
+	// again.
+	challenge = []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	conn.send(Protocol, &Packet{Code: Challenge, ID: 2, Value: challenge, Name: "ac"})
+	expectResponse(t, conn, 2, challenge)
+
+	// Verdicts for the stale Response are ignored.
+	conn.send(Protocol, &Packet{Code: Failure, ID: 1})
+	conn.send(Protocol, &Packet{Code: Success, ID: 2, Message: "welcome"})
+
+	if err := waitResult(t, res); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+}
+
+func TestAuthenticateFailure(t *testing.T) {
+	conn := newFakeConn()
+	res := startAuthenticate(context.Background(), conn)
+
+	challenge := []byte{1, 2, 3, 4}
+	conn.send(Protocol, &Packet{Code: Challenge, ID: 42, Value: challenge})
+	expectResponse(t, conn, 42, challenge)
+	conn.send(Protocol, &Packet{Code: Failure, ID: 42, Message: "bad password"})
+
+	err := waitResult(t, res)
+	if err == nil {
+		t.Fatal("Authenticate succeeded, want error")
+	}
+	if want := `CHAP authentication failed: "bad password"`; err.Error() != want {
+		t.Fatalf("got error %q, want %q", err, want)
+	}
+}
+
+func TestAuthenticateCancel(t *testing.T) {
+	conn := newFakeConn()
+	ctx, cancel := context.WithCancel(context.Background())
+	res := startAuthenticate(ctx, conn)
+	cancel()
+	if err := waitResult(t, res); err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+type failingConn struct {
+	*fakeConn
+}
+
+func (failingConn) WriteProtocol(uint16, []byte) error {
+	return errors.New("link down")
+}
+
+func TestAuthenticateSendError(t *testing.T) {
+	conn := failingConn{newFakeConn()}
+	res := startAuthenticate(context.Background(), conn)
+	conn.send(Protocol, &Packet{Code: Challenge, ID: 1, Value: []byte{1}})
+	if err := waitResult(t, res); err == nil {
+		t.Fatal("Authenticate succeeded, want error")
+	}
+}
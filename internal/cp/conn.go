@@ -0,0 +1,49 @@
+package cp
+
+import (
+	"context"
+	"time"
+)
+
+// Conn is a PPP link that control protocols run over, such as a
+// *pppoe.Conn. Read must return whole PPP frames, starting with the
+// protocol field.
+type Conn interface {
+	Read(b []byte) (int, error)
+	WriteProtocol(proto uint16, payload []byte) error
+	SetReadDeadline(t time.Time) error
+}
+
+// aLongTimeAgo is a read deadline in the past, used to make blocked
+// reads return immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// WatchContext makes reads on conn fail with a timeout once ctx is
+// done. The returned function must be called once reading is over,
+// and clears the read deadline.
+//
+// Some conns, including mdlayher/raw's, only look at the read
+// deadline when a read starts. For those, ctx's deadline is also set
+// upfront, so that reads still end on time; only cancellation has to
+// wait for the next read to be noticed.
+func WatchContext(ctx context.Context, conn interface {
+	SetReadDeadline(t time.Time) error
+}) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	stopCh, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(aLongTimeAgo)
+		case <-stopCh:
+		}
+	}()
+	return func() {
+		close(stopCh)
+		<-done
+		conn.SetReadDeadline(time.Time{})
+	}
+}
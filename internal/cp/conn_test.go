@@ -0,0 +1,57 @@
+package cp
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// deadlineRecorder records the read deadlines set on it.
+type deadlineRecorder struct {
+	mu        sync.Mutex
+	deadlines []time.Time
+}
+
+func (r *deadlineRecorder) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deadlines = append(r.deadlines, t)
+	return nil
+}
+
+func (r *deadlineRecorder) last() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.deadlines) == 0 {
+		return time.Time{}
+	}
+	return r.deadlines[len(r.deadlines)-1]
+}
+
+func TestWatchContext(t *testing.T) {
+	// A context deadline is set upfront.
+	var conn deadlineRecorder
+	deadline := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	stop := WatchContext(ctx, &conn)
+	if got := conn.last(); !got.Equal(deadline) {
+		t.Errorf("read deadline is %v, want %v", got, deadline)
+	}
+
+	// Cancellation sets a deadline in the past.
+	cancel()
+	timeout := time.Now().Add(5 * time.Second)
+	for !conn.last().Before(time.Now()) {
+		if time.Now().After(timeout) {
+			t.Fatal("cancellation didn't set a past read deadline")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Stopping clears the deadline.
+	stop()
+	if got := conn.last(); !got.IsZero() {
+		t.Errorf("read deadline is %v after stop, want none", got)
+	}
+}
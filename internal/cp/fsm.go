@@ -0,0 +1,496 @@
+package cp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// state is a state of the option negotiation automaton, as described
+// in RFC 1661 section 4.2.
+type state int
+
+const (
+	stateInitial state = iota
+	stateStarting
+	stateClosed
+	stateStopped
+	stateClosing
+	stateStopping
+	stateReqSent
+	stateAckRcvd
+	stateAckSent
+	stateOpened
+)
+
+var stateNames = [...]string{
+	stateInitial:  "Initial",
+	stateStarting: "Starting",
+	stateClosed:   "Closed",
+	stateStopped:  "Stopped",
+	stateClosing:  "Closing",
+	stateStopping: "Stopping",
+	stateReqSent:  "Req-Sent",
+	stateAckRcvd:  "Ack-Rcvd",
+	stateAckSent:  "Ack-Sent",
+	stateOpened:   "Opened",
+}
+
+func (s state) String() string { return stateNames[s] }
+
+// timerRunning returns whether the restart timer runs in s.
+func (s state) timerRunning() bool {
+	switch s {
+	case stateClosing, stateStopping, stateReqSent, stateAckRcvd, stateAckSent:
+		return true
+	default:
+		return false
+	}
+}
+
+// Timers are the counters and timers of RFC 1661 section 4.6.
+type Timers struct {
+	// Restart is how long to wait for a reply to a Configure-Request
+	// or Terminate-Request before sending it again.
+	Restart time.Duration
+	// MaxConfigure is how many Configure-Requests to send without
+	// getting an answer before giving up.
+	MaxConfigure int
+	// MaxTerminate is how many Terminate-Requests to send without
+	// getting an answer before giving up.
+	MaxTerminate int
+	// MaxFailure is how many Configure-Naks to send without sending a
+	// Configure-Ack before rejecting options instead of nakking them.
+	MaxFailure int
+}
+
+// DefaultTimers are the defaults suggested by RFC 1661.
+var DefaultTimers = Timers{
+	Restart:      3 * time.Second,
+	MaxConfigure: 10,
+	MaxTerminate: 2,
+	MaxFailure:   5,
+}
+
+// WithDefaults returns t, with its zero fields replaced by those of
+// DefaultTimers.
+func (t Timers) WithDefaults() Timers {
+	if t.Restart == 0 {
+		t.Restart = DefaultTimers.Restart
+	}
+	if t.MaxConfigure == 0 {
+		t.MaxConfigure = DefaultTimers.MaxConfigure
+	}
+	if t.MaxTerminate == 0 {
+		t.MaxTerminate = DefaultTimers.MaxTerminate
+	}
+	if t.MaxFailure == 0 {
+		t.MaxFailure = DefaultTimers.MaxFailure
+	}
+	return t
+}
+
+// Negotiator implements the option-specific parts of negotiation.
+type Negotiator interface {
+	// Request returns the options for our next Configure-Request.
+	Request() []Option
+	// CheckRequest examines the options of a Configure-Request from
+	// the peer, and returns the code and options of our
+	// reply. Unless nakAllowed is true, it must reject options
+	// instead of nakking them.
+	CheckRequest(opts []Option, nakAllowed bool) (Code, []Option)
+	// Acked is called when the peer acks our request, and
+	// PeerAcked when we ack the peer's.
+	Acked(opts []Option)
+	PeerAcked(opts []Option)
+	// Nakked and Rejected are called when the peer naks or rejects
+	// our request. Rejected returns false if the peer rejected
+	// options that we didn't request.
+	Nakked(opts []Option)
+	Rejected(opts []Option) bool
+}
+
+// errPeerTerminated is the error of an automaton that stopped because
+// the peer asked to terminate the link.
+var errPeerTerminated = errors.New("peer terminated the link")
+
+// FSM is the option negotiation automaton of RFC 1661 section 4.1.
+type FSM struct {
+	// Protocol is the PPP protocol number of the control protocol,
+	// and Name its name, for error messages.
+	Protocol uint16
+	Name     string
+	Neg      Negotiator
+	Timers   Timers
+	// Magic is our LCP Magic-Number, to put in Echo-Replies. It's
+	// zero if we didn't negotiate one.
+	Magic uint32
+	// Logger, if not nil, receives the packets that the automaton
+	// sends and receives, and the outcome of Run.
+	Logger Logger
+
+	state state
+	// send sends a packet to the peer.
+	send func(*Packet) error
+	// startTimer (re)starts the restart timer.
+	startTimer func()
+
+	restartCount int
+	failureCount int
+
+	nextID uint8
+	// reqID and req are the ID and Data of our outstanding
+	// Configure-Request, to match replies against.
+	reqID uint8
+	req   []byte
+
+	// err is the first error the automaton ran into: why it finished,
+	// or why it failed to send a packet.
+	err error
+}
+
+func (f *FSM) setErr(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+// Events, from RFC 1661 section 4.3.
+
+func (f *FSM) up() {
+	switch f.state {
+	case stateInitial:
+		f.state = stateClosed
+	case stateStarting:
+		f.irc(false)
+		f.scr()
+		f.state = stateReqSent
+	}
+}
+
+func (f *FSM) down() {
+	switch f.state {
+	case stateClosed, stateClosing:
+		f.state = stateInitial
+	case stateStopped, stateStopping, stateReqSent, stateAckRcvd, stateAckSent, stateOpened:
+		f.state = stateStarting
+	}
+}
+
+func (f *FSM) open() {
+	switch f.state {
+	case stateInitial:
+		f.state = stateStarting
+	case stateClosed:
+		f.irc(false)
+		f.scr()
+		f.state = stateReqSent
+	case stateClosing:
+		f.state = stateStopping
+	}
+}
+
+func (f *FSM) close() {
+	switch f.state {
+	case stateStarting:
+		f.state = stateInitial
+	case stateStopped:
+		f.state = stateClosed
+	case stateStopping:
+		f.state = stateClosing
+	case stateReqSent, stateAckRcvd, stateAckSent, stateOpened:
+		f.irc(true)
+		f.str()
+		f.state = stateClosing
+	}
+}
+
+// timeout handles the expiry of the restart timer.
+func (f *FSM) timeout() {
+	if !f.state.timerRunning() {
+		return
+	}
+	if f.restartCount > 0 {
+		// TO+
+		switch f.state {
+		case stateClosing, stateStopping:
+			f.str()
+		case stateReqSent, stateAckRcvd:
+			f.scr()
+			f.state = stateReqSent
+		case stateAckSent:
+			f.scr()
+		}
+		return
+	}
+
+	// TO-
+	switch f.state {
+	case stateClosing:
+		f.state = stateClosed
+	case stateStopping:
+		f.state = stateStopped
+	default:
+		f.setErr(fmt.Errorf("no answer to %d Configure-Requests", f.Timers.MaxConfigure))
+		f.state = stateStopped
+	}
+}
+
+// receive handles a packet from the peer.
+func (f *FSM) receive(pkt *Packet) {
+	if f.state == stateInitial || f.state == stateStarting {
+		// The link isn't up, we shouldn't be receiving anything.
+		return
+	}
+	if pkt.Code > CodeReject && f.Protocol != LCPProtocol {
+		// The remaining codes only exist in LCP.
+		f.ruc(pkt)
+		return
+	}
+
+	switch pkt.Code {
+	case ConfigureRequest:
+		f.rcr(pkt)
+	case ConfigureAck, ConfigureNak, ConfigureReject:
+		if f.state == stateClosed || f.state == stateStopped {
+			f.sta(pkt.ID)
+			return
+		}
+		if pkt.ID != f.reqID {
+			return
+		}
+		opts, err := ParseOptions(pkt.Data)
+		if err != nil {
+			return
+		}
+		switch pkt.Code {
+		case ConfigureAck:
+			if !bytes.Equal(pkt.Data, f.req) {
+				return
+			}
+			f.Neg.Acked(opts)
+			f.rca()
+		case ConfigureNak:
+			f.Neg.Nakked(opts)
+			f.rcn()
+		case ConfigureReject:
+			if !f.Neg.Rejected(opts) {
+				return
+			}
+			f.rcn()
+		}
+	case TerminateRequest:
+		f.rtr(pkt)
+	case TerminateAck:
+		f.rta()
+	case CodeReject:
+		if len(pkt.Data) > 0 && Code(pkt.Data[0]) <= CodeReject {
+			// The peer can't do basic negotiation, there's no
+			// hope.
+			f.rxjBad(fmt.Errorf("peer rejected %s packets", Code(pkt.Data[0])))
+		} else {
+			f.rxjGood()
+		}
+	case ProtocolReject:
+		if len(pkt.Data) >= 2 && binary.BigEndian.Uint16(pkt.Data) == LCPProtocol {
+			f.rxjBad(errors.New("peer rejected LCP"))
+		} else {
+			// Rejections of other protocols concern their own
+			// automatons, see Run.
+			f.rxjGood()
+		}
+	case EchoRequest:
+		if f.state == stateOpened && len(pkt.Data) >= 4 {
+			data := append([]byte(nil), pkt.Data...)
+			binary.BigEndian.PutUint32(data, f.Magic)
+			f.sendPacket(EchoReply, pkt.ID, data)
+		}
+	case EchoReply, DiscardRequest:
+	default:
+		f.ruc(pkt)
+	}
+}
+
+func (f *FSM) rcr(pkt *Packet) {
+	switch f.state {
+	case stateClosed:
+		f.sta(pkt.ID)
+		return
+	case stateClosing, stateStopping:
+		return
+	case stateStopped:
+		// The peer wants to talk after all, restart negotiation.
+		f.irc(false)
+		f.scr()
+		f.state = stateReqSent
+	}
+
+	opts, err := ParseOptions(pkt.Data)
+	if err != nil {
+		return
+	}
+	code, reply := f.Neg.CheckRequest(opts, f.failureCount < f.Timers.MaxFailure)
+	if f.state == stateOpened {
+		// The peer is renegotiating, so must we.
+		f.scr()
+	}
+
+	if code == ConfigureAck {
+		f.Neg.PeerAcked(opts)
+		f.failureCount = 0
+		f.sendPacket(ConfigureAck, pkt.ID, pkt.Data)
+		switch f.state {
+		case stateReqSent, stateOpened:
+			f.state = stateAckSent
+		case stateAckRcvd:
+			f.state = stateOpened
+		}
+		return
+	}
+
+	if code == ConfigureNak {
+		f.failureCount++
+	}
+	f.sendPacket(code, pkt.ID, MarshalOptions(reply))
+	switch f.state {
+	case stateAckSent, stateOpened:
+		f.state = stateReqSent
+	}
+}
+
+func (f *FSM) rca() {
+	switch f.state {
+	case stateReqSent:
+		f.irc(false)
+		f.state = stateAckRcvd
+	case stateAckRcvd, stateOpened:
+		// Crossed connection, or the peer is renegotiating.
+		f.scr()
+		f.state = stateReqSent
+	case stateAckSent:
+		f.irc(false)
+		f.state = stateOpened
+	}
+}
+
+func (f *FSM) rcn() {
+	switch f.state {
+	case stateReqSent, stateAckSent:
+		f.irc(false)
+		f.scr()
+	case stateAckRcvd, stateOpened:
+		f.scr()
+		f.state = stateReqSent
+	}
+}
+
+func (f *FSM) rtr(pkt *Packet) {
+	f.sta(pkt.ID)
+	switch f.state {
+	case stateAckRcvd, stateAckSent:
+		f.state = stateReqSent
+	case stateOpened:
+		f.setErr(errPeerTerminated)
+		f.zrc()
+		f.state = stateStopping
+	}
+}
+
+func (f *FSM) rta() {
+	switch f.state {
+	case stateClosing:
+		f.state = stateClosed
+	case stateStopping:
+		f.state = stateStopped
+	case stateAckRcvd:
+		f.state = stateReqSent
+	case stateOpened:
+		f.scr()
+		f.state = stateReqSent
+	}
+}
+
+func (f *FSM) ruc(pkt *Packet) {
+	f.sendPacket(CodeReject, f.newID(), pkt.Marshal())
+}
+
+// rxjGood handles a Code-Reject or Protocol-Reject that we can live
+// with.
+func (f *FSM) rxjGood() {
+	if f.state == stateAckRcvd {
+		f.state = stateReqSent
+	}
+}
+
+// rxjBad handles a catastrophic Code-Reject or Protocol-Reject.
+func (f *FSM) rxjBad(err error) {
+	switch f.state {
+	case stateClosed, stateStopped:
+	case stateClosing:
+		f.state = stateClosed
+	case stateStopping, stateReqSent, stateAckRcvd, stateAckSent:
+		f.setErr(err)
+		f.state = stateStopped
+	case stateOpened:
+		f.setErr(err)
+		f.irc(true)
+		f.str()
+		f.state = stateStopping
+	}
+}
+
+// Actions, from RFC 1661 section 4.4.
+
+// irc initializes the restart counter, for sending Terminate-Requests
+// if terminate is true, Configure-Requests otherwise.
+func (f *FSM) irc(terminate bool) {
+	if terminate {
+		f.restartCount = f.Timers.MaxTerminate
+	} else {
+		f.restartCount = f.Timers.MaxConfigure
+	}
+}
+
+// zrc zeroes the restart counter, and starts the restart timer, to
+// give the peer time to process our Terminate-Ack.
+func (f *FSM) zrc() {
+	f.restartCount = 0
+	f.startTimer()
+}
+
+// scr sends a Configure-Request.
+func (f *FSM) scr() {
+	f.restartCount--
+	f.reqID = f.newID()
+	f.req = MarshalOptions(f.Neg.Request())
+	f.sendPacket(ConfigureRequest, f.reqID, f.req)
+	f.startTimer()
+}
+
+// str sends a Terminate-Request.
+func (f *FSM) str() {
+	f.restartCount--
+	f.sendPacket(TerminateRequest, f.newID(), nil)
+	f.startTimer()
+}
+
+// sta sends a Terminate-Ack.
+func (f *FSM) sta(id uint8) {
+	f.sendPacket(TerminateAck, id, nil)
+}
+
+func (f *FSM) newID() uint8 {
+	f.nextID++
+	return f.nextID
+}
+
+func (f *FSM) sendPacket(code Code, id uint8, data []byte) {
+	pkt := &Packet{Code: code, ID: id, Data: data}
+	if err := f.send(pkt); err != nil {
+		f.setErr(fmt.Errorf("sending %s: %v", code, err))
+		return
+	}
+	f.logPacket("sent %s packet", pkt)
+}
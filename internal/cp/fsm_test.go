@@ -0,0 +1,156 @@
+package cp
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// stubNegotiator acks the peer's requests if ack is true, and naks
+// them otherwise.
+type stubNegotiator struct {
+	ack bool
+}
+
+func (n *stubNegotiator) Request() []Option { return nil }
+func (n *stubNegotiator) CheckRequest(opts []Option, nakAllowed bool) (Code, []Option) {
+	if n.ack {
+		return ConfigureAck, nil
+	}
+	return ConfigureNak, nil
+}
+func (n *stubNegotiator) Acked([]Option)         {}
+func (n *stubNegotiator) PeerAcked([]Option)     {}
+func (n *stubNegotiator) Nakked([]Option)        {}
+func (n *stubNegotiator) Rejected([]Option) bool { return true }
+
+func TestFSM(t *testing.T) {
+	rcr := func(f *FSM) { f.receive(&Packet{Code: ConfigureRequest, ID: 9}) }
+	rca := func(f *FSM) { f.receive(&Packet{Code: ConfigureAck, ID: f.reqID}) }
+	rcn := func(f *FSM) { f.receive(&Packet{Code: ConfigureNak, ID: f.reqID}) }
+	rtr := func(f *FSM) { f.receive(&Packet{Code: TerminateRequest, ID: 9}) }
+	rta := func(f *FSM) { f.receive(&Packet{Code: TerminateAck, ID: 9}) }
+	ruc := func(f *FSM) { f.receive(&Packet{Code: 42, ID: 9}) }
+	rxjGood := func(f *FSM) { f.receive(&Packet{Code: CodeReject, ID: 9, Data: []byte{byte(EchoRequest)}}) }
+	rxjBad := func(f *FSM) { f.receive(&Packet{Code: ProtocolReject, ID: 9, Data: []byte{0xc0, 0x21}}) }
+	echo := func(f *FSM) { f.receive(&Packet{Code: EchoRequest, ID: 9, Data: []byte{0, 0, 0, 0}}) }
+	timeout := func(f *FSM) { f.timeout() }
+
+	tests := []struct {
+		desc     string
+		start    state
+		restarts int
+		nak      bool
+		event    func(*FSM)
+		want     state
+		wantSent []Code
+	}{
+		{"Initial Up", stateInitial, 0, false, (*FSM).up, stateClosed, nil},
+		{"Initial Open", stateInitial, 0, false, (*FSM).open, stateStarting, nil},
+		{"Initial RCR", stateInitial, 0, false, rcr, stateInitial, nil},
+		{"Starting Up", stateStarting, 0, false, (*FSM).up, stateReqSent, []Code{ConfigureRequest}},
+		{"Starting Close", stateStarting, 0, false, (*FSM).close, stateInitial, nil},
+		{"Closed Open", stateClosed, 0, false, (*FSM).open, stateReqSent, []Code{ConfigureRequest}},
+		{"Closed Down", stateClosed, 0, false, (*FSM).down, stateInitial, nil},
+		{"Closed RCR", stateClosed, 0, false, rcr, stateClosed, []Code{TerminateAck}},
+		{"Closed RCA", stateClosed, 0, false, rca, stateClosed, []Code{TerminateAck}},
+		{"Closed RUC", stateClosed, 0, false, ruc, stateClosed, []Code{CodeReject}},
+		{"Stopped Close", stateStopped, 0, false, (*FSM).close, stateClosed, nil},
+		{"Stopped Down", stateStopped, 0, false, (*FSM).down, stateStarting, nil},
+		{"Stopped RCR+", stateStopped, 0, false, rcr, stateAckSent, []Code{ConfigureRequest, ConfigureAck}},
+		{"Stopped RCR-", stateStopped, 0, true, rcr, stateReqSent, []Code{ConfigureRequest, ConfigureNak}},
+		{"Stopped RTR", stateStopped, 0, false, rtr, stateStopped, []Code{TerminateAck}},
+		{"Closing TO+", stateClosing, 1, false, timeout, stateClosing, []Code{TerminateRequest}},
+		{"Closing TO-", stateClosing, 0, false, timeout, stateClosed, nil},
+		{"Closing RTA", stateClosing, 0, false, rta, stateClosed, nil},
+		{"Closing Open", stateClosing, 0, false, (*FSM).open, stateStopping, nil},
+		{"Closing RCR", stateClosing, 0, false, rcr, stateClosing, nil},
+		{"Closing RXJ-", stateClosing, 0, false, rxjBad, stateClosed, nil},
+		{"Stopping TO-", stateStopping, 0, false, timeout, stateStopped, nil},
+		{"Stopping RTA", stateStopping, 0, false, rta, stateStopped, nil},
+		{"Stopping Close", stateStopping, 0, false, (*FSM).close, stateClosing, nil},
+		{"Req-Sent TO+", stateReqSent, 1, false, timeout, stateReqSent, []Code{ConfigureRequest}},
+		{"Req-Sent TO-", stateReqSent, 0, false, timeout, stateStopped, nil},
+		{"Req-Sent RCR+", stateReqSent, 0, false, rcr, stateAckSent, []Code{ConfigureAck}},
+		{"Req-Sent RCR-", stateReqSent, 0, true, rcr, stateReqSent, []Code{ConfigureNak}},
+		{"Req-Sent RCA", stateReqSent, 0, false, rca, stateAckRcvd, nil},
+		{"Req-Sent RCN", stateReqSent, 0, false, rcn, stateReqSent, []Code{ConfigureRequest}},
+		{"Req-Sent RTR", stateReqSent, 0, false, rtr, stateReqSent, []Code{TerminateAck}},
+		{"Req-Sent Close", stateReqSent, 0, false, (*FSM).close, stateClosing, []Code{TerminateRequest}},
+		{"Req-Sent Down", stateReqSent, 0, false, (*FSM).down, stateStarting, nil},
+		{"Req-Sent RXJ-", stateReqSent, 0, false, rxjBad, stateStopped, nil},
+		{"Req-Sent Echo", stateReqSent, 0, false, echo, stateReqSent, nil},
+		{"Ack-Rcvd TO+", stateAckRcvd, 1, false, timeout, stateReqSent, []Code{ConfigureRequest}},
+		{"Ack-Rcvd RCR+", stateAckRcvd, 0, false, rcr, stateOpened, []Code{ConfigureAck}},
+		{"Ack-Rcvd RCR-", stateAckRcvd, 0, true, rcr, stateAckRcvd, []Code{ConfigureNak}},
+		{"Ack-Rcvd RCA", stateAckRcvd, 0, false, rca, stateReqSent, []Code{ConfigureRequest}},
+		{"Ack-Rcvd RTR", stateAckRcvd, 0, false, rtr, stateReqSent, []Code{TerminateAck}},
+		{"Ack-Rcvd RTA", stateAckRcvd, 0, false, rta, stateReqSent, nil},
+		{"Ack-Rcvd RXJ+", stateAckRcvd, 0, false, rxjGood, stateReqSent, nil},
+		{"Ack-Sent TO+", stateAckSent, 1, false, timeout, stateAckSent, []Code{ConfigureRequest}},
+		{"Ack-Sent RCR-", stateAckSent, 0, true, rcr, stateReqSent, []Code{ConfigureNak}},
+		{"Ack-Sent RCA", stateAckSent, 0, false, rca, stateOpened, nil},
+		{"Ack-Sent RCN", stateAckSent, 0, false, rcn, stateAckSent, []Code{ConfigureRequest}},
+		{"Opened RCR+", stateOpened, 0, false, rcr, stateAckSent, []Code{ConfigureRequest, ConfigureAck}},
+		{"Opened RCR-", stateOpened, 0, true, rcr, stateReqSent, []Code{ConfigureRequest, ConfigureNak}},
+		{"Opened RCA", stateOpened, 0, false, rca, stateReqSent, []Code{ConfigureRequest}},
+		{"Opened RCN", stateOpened, 0, false, rcn, stateReqSent, []Code{ConfigureRequest}},
+		{"Opened RTR", stateOpened, 0, false, rtr, stateStopping, []Code{TerminateAck}},
+		{"Opened RTA", stateOpened, 0, false, rta, stateReqSent, []Code{ConfigureRequest}},
+		{"Opened Close", stateOpened, 0, false, (*FSM).close, stateClosing, []Code{TerminateRequest}},
+		{"Opened Down", stateOpened, 0, false, (*FSM).down, stateStarting, nil},
+		{"Opened RXJ+", stateOpened, 0, false, rxjGood, stateOpened, nil},
+		{"Opened RXJ-", stateOpened, 0, false, rxjBad, stateStopping, []Code{TerminateRequest}},
+		{"Opened RUC", stateOpened, 0, false, ruc, stateOpened, []Code{CodeReject}},
+		{"Opened Echo", stateOpened, 0, false, echo, stateOpened, []Code{EchoReply}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			var sent []Code
+			f := &FSM{
+				Protocol:     LCPProtocol,
+				Neg:          &stubNegotiator{ack: !test.nak},
+				Timers:       DefaultTimers,
+				state:        test.start,
+				restartCount: test.restarts,
+				send: func(pkt *Packet) error {
+					sent = append(sent, pkt.Code)
+					return nil
+				},
+				startTimer: func() {},
+			}
+			test.event(f)
+			if f.state != test.want {
+				t.Errorf("got state %s, want %s", f.state, test.want)
+			}
+			if diff := cmp.Diff(test.wantSent, sent); diff != "" {
+				t.Errorf("wrong packets sent (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFSMLCPOnlyCodes(t *testing.T) {
+	for _, code := range []Code{ProtocolReject, EchoRequest, EchoReply, DiscardRequest} {
+		var sent []Code
+		f := &FSM{
+			Protocol: 0x8021,
+			Neg:      &stubNegotiator{ack: true},
+			Timers:   DefaultTimers,
+			state:    stateOpened,
+			send: func(pkt *Packet) error {
+				sent = append(sent, pkt.Code)
+				return nil
+			},
+			startTimer: func() {},
+		}
+		f.receive(&Packet{Code: code, ID: 9, Data: []byte{0xc0, 0x21, 0, 0}})
+		if f.state != stateOpened {
+			t.Errorf("%s: got state %s, want %s", code, f.state, stateOpened)
+		}
+		if diff := cmp.Diff([]Code{CodeReject}, sent); diff != "" {
+			t.Errorf("%s: wrong packets sent (-want +got)\n%s", code, diff)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package cp
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Logger receives events from the control protocols. It has the same
+// method set as pppoe.Logger, so that the same loggers work for every
+// layer of a link.
+type Logger interface {
+	// Log records an event. msg says what happened, and keyvals are
+	// alternating keys and values that describe it.
+	Log(msg string, keyvals ...interface{})
+}
+
+// Log sends an event to l, if it's not nil.
+func Log(l Logger, msg string, keyvals ...interface{}) {
+	if l == nil {
+		return
+	}
+	l.Log(msg, keyvals...)
+}
+
+// logPacket logs a packet that the automaton sent or received.
+func (f *FSM) logPacket(msg string, pkt *Packet) {
+	if f.Logger == nil {
+		return
+	}
+	keyvals := []interface{}{"code", pkt.Code, "id", pkt.ID}
+	if pkt.Code <= ConfigureReject {
+		keyvals = append(keyvals, "options", formatOptions(pkt.Data))
+	}
+	f.Logger.Log(fmt.Sprintf(msg, f.Name), keyvals...)
+}
+
+// formatOptions returns the options in b as type=value pairs, with
+// values in hex, e.g. "1=05d4 5=0000002a".
+func formatOptions(b []byte) string {
+	opts, err := ParseOptions(b)
+	if err != nil {
+		return fmt.Sprintf("malformed(%x)", b)
+	}
+	var ret bytes.Buffer
+	for i, opt := range opts {
+		if i > 0 {
+			ret.WriteByte(' ')
+		}
+		fmt.Fprintf(&ret, "%d=%x", opt.Type, opt.Value)
+	}
+	return ret.String()
+}
@@ -0,0 +1,138 @@
+// Package cp implements what PPP control protocols have in common:
+// the packet format and option negotiation automaton that LCP
+// defines in RFC 1661, and that the network control protocols (IPCP,
+// IPv6CP...) reuse.
+package cp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// LCPProtocol is the PPP protocol number of LCP. Some packet codes
+// are only valid in LCP.
+const LCPProtocol = 0xc021
+
+// Code is the kind of a control protocol packet.
+type Code uint8
+
+// Packet codes. Codes from TerminateAck up are only valid in LCP.
+const (
+	ConfigureRequest Code = 1
+	ConfigureAck     Code = 2
+	ConfigureNak     Code = 3
+	ConfigureReject  Code = 4
+	TerminateRequest Code = 5
+	TerminateAck     Code = 6
+	CodeReject       Code = 7
+	ProtocolReject   Code = 8
+	EchoRequest      Code = 9
+	EchoReply        Code = 10
+	DiscardRequest   Code = 11
+)
+
+var codeNames = map[Code]string{
+	ConfigureRequest: "Configure-Request",
+	ConfigureAck:     "Configure-Ack",
+	ConfigureNak:     "Configure-Nak",
+	ConfigureReject:  "Configure-Reject",
+	TerminateRequest: "Terminate-Request",
+	TerminateAck:     "Terminate-Ack",
+	CodeReject:       "Code-Reject",
+	ProtocolReject:   "Protocol-Reject",
+	EchoRequest:      "Echo-Request",
+	EchoReply:        "Echo-Reply",
+	DiscardRequest:   "Discard-Request",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Code(%d)", uint8(c))
+}
+
+// Packet is a control protocol packet.
+type Packet struct {
+	// Code is the kind of packet.
+	Code Code
+	// ID matches replies to requests.
+	ID uint8
+	// Data is the payload of the packet. For the Configure-* codes,
+	// it's a list of options, see ParseOptions.
+	Data []byte
+}
+
+// ParsePacket parses a control protocol packet, without the PPP
+// protocol field. Bytes past the packet's length field are padding,
+// and are ignored.
+func ParsePacket(b []byte) (*Packet, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("control packet too short (%d bytes)", len(b))
+	}
+	l := int(binary.BigEndian.Uint16(b[2:4]))
+	if l < 4 || l > len(b) {
+		return nil, fmt.Errorf("invalid control packet length %d for %d-byte packet", l, len(b))
+	}
+	return &Packet{
+		Code: Code(b[0]),
+		ID:   b[1],
+		Data: append([]byte(nil), b[4:l]...),
+	}, nil
+}
+
+// Marshal returns the wire encoding of the packet, without the PPP
+// protocol field.
+func (p *Packet) Marshal() []byte {
+	ret := make([]byte, 4+len(p.Data))
+	ret[0] = byte(p.Code)
+	ret[1] = p.ID
+	binary.BigEndian.PutUint16(ret[2:4], uint16(len(ret)))
+	copy(ret[4:], p.Data)
+	return ret
+}
+
+// Option is a Configuration Option, as carried in Configure-*
+// packets.
+type Option struct {
+	Type  OptionType
+	Value []byte
+}
+
+// OptionType is the type of a Configuration Option. Each control
+// protocol defines its own types.
+type OptionType uint8
+
+// ParseOptions parses the Configuration Options in the Data of a
+// Configure-* packet.
+func ParseOptions(b []byte) ([]Option, error) {
+	var ret []Option
+	for off := 0; off < len(b); {
+		if len(b)-off < 2 {
+			return nil, fmt.Errorf("truncated option header at offset %d", off)
+		}
+		l := int(b[off+1])
+		if l < 2 || off+l > len(b) {
+			return nil, fmt.Errorf("invalid length %d for option %d at offset %d", l, b[off], off)
+		}
+		ret = append(ret, Option{
+			Type:  OptionType(b[off]),
+			Value: append([]byte(nil), b[off+2:off+l]...),
+		})
+		off += l
+	}
+	return ret, nil
+}
+
+// MarshalOptions returns the wire encoding of opts, suitable for the
+// Data of a Configure-* packet.
+func MarshalOptions(opts []Option) []byte {
+	var ret bytes.Buffer
+	for _, opt := range opts {
+		ret.WriteByte(byte(opt.Type))
+		ret.WriteByte(byte(2 + len(opt.Value)))
+		ret.Write(opt.Value)
+	}
+	return ret.Bytes()
+}
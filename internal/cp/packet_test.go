@@ -0,0 +1,83 @@
+package cp
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParsePacket(t *testing.T) {
+	tests := []struct {
+		desc    string
+		raw     []byte
+		want    *Packet
+		wantErr bool
+	}{
+		{
+			desc: "Configure-Request",
+			raw:  []byte{1, 7, 0, 14, 1, 4, 0x05, 0xd4, 5, 6, 0xde, 0xad, 0xbe, 0xef},
+			want: &Packet{
+				Code: ConfigureRequest,
+				ID:   7,
+				Data: []byte{1, 4, 0x05, 0xd4, 5, 6, 0xde, 0xad, 0xbe, 0xef},
+			},
+		},
+		{
+			desc: "Terminate-Ack with padding",
+			raw:  []byte{6, 2, 0, 4, 0, 0, 0, 0},
+			want: &Packet{
+				Code: TerminateAck,
+				ID:   2,
+			},
+		},
+		{
+			desc:    "too short",
+			raw:     []byte{1, 1, 0},
+			wantErr: true,
+		},
+		{
+			desc:    "length too long",
+			raw:     []byte{1, 1, 0, 5},
+			wantErr: true,
+		},
+		{
+			desc:    "length too short",
+			raw:     []byte{1, 1, 0, 3},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := ParsePacket(test.raw)
+			if err != nil {
+				if !test.wantErr {
+					t.Fatalf("unexpected parse error: %v", err)
+				}
+				return
+			}
+			if test.wantErr {
+				t.Fatalf("parse succeeded, want error")
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Fatalf("wrong parse (-want +got)\n%s", diff)
+			}
+			if diff := cmp.Diff(test.raw[:4+len(got.Data)], got.Marshal()); diff != "" {
+				t.Fatalf("wrong marshal (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseOptionsErrors(t *testing.T) {
+	for _, raw := range [][]byte{
+		{1},
+		{1, 1},
+		{1, 4, 0},
+		{7, 2, 1, 5, 0},
+	} {
+		if opts, err := ParseOptions(raw); err == nil {
+			t.Errorf("ParseOptions(%x) = %v, want error", raw, opts)
+		}
+	}
+}
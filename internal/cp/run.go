@@ -0,0 +1,119 @@
+package cp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Run runs the automaton on conn until it reaches the Opened state, or
+// fails. check, if not nil, is called after each packet the automaton
+// receives, and aborts the run if it returns an error.
+//
+// Run reads from conn itself, so frames of other protocols that arrive
+// in the meantime are discarded. The exception is an LCP
+// Protocol-Reject of f's protocol, which means the peer doesn't speak
+// it, and makes Run fail.
+func (f *FSM) Run(ctx context.Context, conn Conn, check func() error) error {
+	err := f.run(ctx, conn, check)
+	if err != nil {
+		Log(f.Logger, f.Name+" negotiation failed", "error", err)
+	} else {
+		Log(f.Logger, f.Name+" opened")
+	}
+	return err
+}
+
+func (f *FSM) run(ctx context.Context, conn Conn, check func() error) error {
+	var deadline time.Time
+	f.send = func(pkt *Packet) error {
+		return conn.WriteProtocol(f.Protocol, pkt.Marshal())
+	}
+	f.startTimer = func() {
+		deadline = time.Now().Add(f.Timers.Restart)
+	}
+
+	stop := WatchContext(ctx, conn)
+	defer stop()
+
+	f.up()
+	f.open()
+
+	var b [1500]byte
+	for {
+		if f.err != nil && f.state != stateStopping && f.state != stateClosing {
+			return fmt.Errorf("%s negotiation failed: %v", f.Name, f.err)
+		}
+		switch f.state {
+		case stateOpened:
+			return nil
+		case stateStopped, stateClosed:
+			return fmt.Errorf("%s negotiation failed", f.Name)
+		}
+
+		if f.state.timerRunning() {
+			conn.SetReadDeadline(deadline)
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		// Check ctx after setting the deadline, so that we can't
+		// clobber the deadline that WatchContext set on
+		// cancellation.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := conn.Read(b[:])
+		if err != nil {
+			if !os.IsTimeout(err) {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !time.Now().Before(deadline) {
+				Log(f.Logger, f.Name+" restart timer expired", "state", f.state, "restarts_left", f.restartCount)
+				f.timeout()
+			}
+			continue
+		}
+
+		if n < 2 {
+			continue
+		}
+		proto := binary.BigEndian.Uint16(b[:2])
+		if proto != f.Protocol {
+			if proto == LCPProtocol {
+				f.checkProtocolReject(b[2:n])
+			}
+			continue
+		}
+		pkt, err := ParsePacket(b[2:n])
+		if err != nil {
+			Log(f.Logger, "received malformed "+f.Name+" packet", "error", err)
+			continue
+		}
+		f.logPacket("received %s packet", pkt)
+		f.receive(pkt)
+		if check != nil {
+			if err := check(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// checkProtocolReject handles an LCP packet that arrived while running
+// another protocol's automaton. If it's a Protocol-Reject of that
+// protocol, the automaton gives up.
+func (f *FSM) checkProtocolReject(b []byte) {
+	pkt, err := ParsePacket(b)
+	if err != nil || pkt.Code != ProtocolReject || len(pkt.Data) < 2 {
+		return
+	}
+	if binary.BigEndian.Uint16(pkt.Data) == f.Protocol {
+		f.rxjBad(fmt.Errorf("peer rejected %s", f.Name))
+	}
+}
@@ -0,0 +1,19 @@
+package cp
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// WiresharkBytes formats bs the way Wireshark formats byte array
+// fields, as colon-separated hex.
+func WiresharkBytes(bs []byte) string {
+	var ret bytes.Buffer
+	for i, b := range bs {
+		if i > 0 {
+			ret.WriteByte(':')
+		}
+		fmt.Fprintf(&ret, "%02x", b)
+	}
+	return ret.String()
+}
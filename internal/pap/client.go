@@ -0,0 +1,112 @@
+package pap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.universe.tf/ppp/internal/cp"
+)
+
+// Client authenticates to a peer with PAP.
+type Client struct {
+	// Name is the Peer-ID we send, typically the account's username.
+	Name string
+	// Password is the account's password.
+	Password string
+	// Logger, if not nil, receives the PAP packets that
+	// Authenticate sends and receives, without the password.
+	Logger cp.Logger
+}
+
+// Defaults for the retransmission of Authenticate-Requests. RFC 1334
+// leaves them up to the implementation, these are the same as LCP's
+// restart timer and Max-Configure.
+const (
+	defaultRestart     = 3 * time.Second
+	defaultMaxRequests = 10
+)
+
+// Authenticate sends Authenticate-Requests on conn until the peer
+// acks or naks one, or ctx is done. Frames of other protocols are
+// discarded.
+func (c *Client) Authenticate(ctx context.Context, conn cp.Conn) error {
+	return c.authenticate(ctx, conn, defaultRestart, defaultMaxRequests)
+}
+
+func (c *Client) authenticate(ctx context.Context, conn cp.Conn, restart time.Duration, maxRequests int) error {
+	stop := cp.WatchContext(ctx, conn)
+	defer stop()
+
+	var (
+		id       uint8
+		deadline time.Time
+		sent     int
+	)
+	var b [1500]byte
+	for {
+		if !time.Now().Before(deadline) {
+			if sent == maxRequests {
+				return fmt.Errorf("no answer to %d PAP Authenticate-Requests", maxRequests)
+			}
+			// RFC 1334 requires a new ID for every request.
+			id++
+			req := &Packet{
+				Code:     AuthenticateRequest,
+				ID:       id,
+				PeerID:   c.Name,
+				Password: c.Password,
+			}
+			if err := conn.WriteProtocol(Protocol, req.Marshal()); err != nil {
+				return fmt.Errorf("sending PAP Authenticate-Request: %v", err)
+			}
+			cp.Log(c.Logger, "sent PAP packet", "code", req.Code, "id", req.ID, "peer_id", req.PeerID)
+			sent++
+			deadline = time.Now().Add(restart)
+		}
+
+		conn.SetReadDeadline(deadline)
+		// Check ctx after setting the deadline, so that we can't
+		// clobber the deadline that WatchContext set on
+		// cancellation.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := conn.Read(b[:])
+		if err != nil {
+			if !os.IsTimeout(err) {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			continue
+		}
+		if n < 2 || binary.BigEndian.Uint16(b[:2]) != Protocol {
+			continue
+		}
+		pkt, err := ParsePacket(b[2:n])
+		if err != nil {
+			cp.Log(c.Logger, "received malformed PAP packet", "error", err)
+			continue
+		}
+		cp.Log(c.Logger, "received PAP packet", "code", pkt.Code, "id", pkt.ID, "message", pkt.Message)
+		if pkt.ID != id {
+			continue
+		}
+
+		switch pkt.Code {
+		case AuthenticateAck:
+			return nil
+		case AuthenticateNak:
+			if pkt.Message == "" {
+				return errors.New("PAP authentication failed")
+			}
+			return fmt.Errorf("PAP authentication failed: %q", pkt.Message)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package pap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"go.universe.tf/ppp/internal/cp"
+)
+
+// fakeConn is a PPP link whose peer is driven by the test.
+type fakeConn struct {
+	in, out chan []byte
+
+	mu              sync.Mutex
+	deadline        time.Time
+	deadlineChanged chan struct{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		in:              make(chan []byte, 10),
+		out:             make(chan []byte, 10),
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+type fakeTimeoutError struct{}
+
+func (fakeTimeoutError) Error() string { return "i/o timeout" }
+func (fakeTimeoutError) Timeout() bool { return true }
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.deadline, c.deadlineChanged
+		c.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, fakeTimeoutError{}
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case frame := <-c.in:
+			return copy(b, frame), nil
+		case <-timeout:
+			return 0, fakeTimeoutError{}
+		case <-changed:
+		}
+	}
+}
+
+func (c *fakeConn) WriteProtocol(proto uint16, payload []byte) error {
+	frame := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(frame, proto)
+	copy(frame[2:], payload)
+	c.out <- frame
+	return nil
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// send makes the peer send pkt to the client.
+func (c *fakeConn) send(pkt *Packet) {
+	frame := make([]byte, 2)
+	binary.BigEndian.PutUint16(frame, Protocol)
+	c.in <- append(frame, pkt.Marshal()...)
+}
+
+// expectRequest reads an Authenticate-Request from the client, checks
+// its credentials, and returns its ID.
+func expectRequest(t *testing.T, c *fakeConn) uint8 {
+	t.Helper()
+	select {
+	case frame := <-c.out:
+		if proto := binary.BigEndian.Uint16(frame); proto != Protocol {
+			t.Fatalf("got frame for protocol 0x%04x, want PAP", proto)
+		}
+		got, err := ParsePacket(frame[2:])
+		if err != nil {
+			t.Fatalf("parsing PAP packet: %v", err)
+		}
+		want := &Packet{
+			Code:     AuthenticateRequest,
+			ID:       got.ID,
+			PeerID:   "bob",
+			Password: "hunter2",
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("wrong Authenticate-Request (-want +got)\n%s", diff)
+		}
+		return got.ID
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Authenticate-Request")
+		return 0
+	}
+}
+
+func startAuthenticate(ctx context.Context, conn cp.Conn, restart time.Duration) <-chan error {
+	ret := make(chan error, 1)
+	go func() {
+		c := &Client{Name: "bob", Password: "hunter2"}
+		ret <- c.authenticate(ctx, conn, restart, 3)
+	}()
+	return ret
+}
+
+func waitResult(t *testing.T, res <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Authenticate")
+		return nil
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	conn := newFakeConn()
+	res := startAuthenticate(context.Background(), conn, 10*time.Millisecond)
+
+	// The first request gets lost, so the client sends another one,
+	// with a new ID.
+	first := expectRequest(t, conn)
+	second := expectRequest(t, conn)
+	if first == second {
+		t.Fatalf("retransmitted request reused ID %d", first)
+	}
+
+	// Frames of other protocols, and answers to stale requests, are
+	// ignored.
+	conn.in <- []byte{0xc0, 0x21, 9, 1, 0, 8, 0, 0, 0, 0}
+	conn.send(&Packet{Code: AuthenticateNak, ID: first})
+	conn.send(&Packet{Code: AuthenticateAck, ID: second, Message: "welcome"})
+
+	if err := waitResult(t, res); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+}
+
+func TestAuthenticateNak(t *testing.T) {
+	conn := newFakeConn()
+	res := startAuthenticate(context.Background(), conn, time.Minute)
+
+	id := expectRequest(t, conn)
+	conn.send(&Packet{Code: AuthenticateNak, ID: id, Message: "bad password"})
+
+	err := waitResult(t, res)
+	if err == nil {
+		t.Fatal("Authenticate succeeded, want error")
+	}
+	if want := `PAP authentication failed: "bad password"`; err.Error() != want {
+		t.Fatalf("got error %q, want %q", err, want)
+	}
+}
+
+func TestAuthenticateTimeout(t *testing.T) {
+	conn := newFakeConn()
+	res := startAuthenticate(context.Background(), conn, time.Millisecond)
+	for i := 0; i < 3; i++ {
+		expectRequest(t, conn)
+	}
+	if err := waitResult(t, res); err == nil {
+		t.Fatal("Authenticate succeeded, want error")
+	}
+}
+
+func TestAuthenticateCancel(t *testing.T) {
+	conn := newFakeConn()
+	ctx, cancel := context.WithCancel(context.Background())
+	res := startAuthenticate(ctx, conn, time.Minute)
+	expectRequest(t, conn)
+	cancel()
+	if err := waitResult(t, res); err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+type failingConn struct {
+	*fakeConn
+}
+
+func (failingConn) WriteProtocol(uint16, []byte) error {
+	return errors.New("link down")
+}
+
+func TestAuthenticateSendError(t *testing.T) {
+	res := startAuthenticate(context.Background(), failingConn{newFakeConn()}, time.Minute)
+	if err := waitResult(t, res); err == nil {
+		t.Fatal("Authenticate succeeded, want error")
+	}
+}
@@ -0,0 +1,129 @@
+// Package pap implements the client side of the PPP Password
+// Authentication Protocol, as described in RFC 1334.
+package pap
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Protocol is the PPP protocol number of PAP.
+const Protocol = 0xc023
+
+// Code is the kind of a PAP packet.
+type Code uint8
+
+// PAP packet codes.
+const (
+	AuthenticateRequest Code = 1
+	AuthenticateAck     Code = 2
+	AuthenticateNak     Code = 3
+)
+
+var codeNames = map[Code]string{
+	AuthenticateRequest: "Authenticate-Request",
+	AuthenticateAck:     "Authenticate-Ack",
+	AuthenticateNak:     "Authenticate-Nak",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Code(%d)", uint8(c))
+}
+
+// Packet is a PAP packet.
+type Packet struct {
+	// Code is the kind of packet.
+	Code Code
+	// ID matches Acks and Naks to Authenticate-Requests.
+	ID uint8
+	// PeerID and Password are the credentials. They're only used in
+	// Authenticate-Request packets.
+	PeerID   string
+	Password string
+	// Message is a human-readable message. It's only used in
+	// Authenticate-Ack and Authenticate-Nak packets.
+	Message string
+}
+
+// ParsePacket parses a PAP packet, without the PPP protocol
+// field. Bytes past the packet's length field are padding, and are
+// ignored.
+func ParsePacket(b []byte) (*Packet, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("PAP packet too short (%d bytes)", len(b))
+	}
+	l := int(binary.BigEndian.Uint16(b[2:4]))
+	if l < 4 || l > len(b) {
+		return nil, fmt.Errorf("invalid PAP packet length %d for %d-byte packet", l, len(b))
+	}
+	ret := &Packet{
+		Code: Code(b[0]),
+		ID:   b[1],
+	}
+	data := b[4:l]
+
+	// field reads a length-prefixed field off the front of data.
+	field := func(name string) (string, error) {
+		if len(data) < 1 || 1+int(data[0]) > len(data) {
+			return "", fmt.Errorf("truncated %s in PAP %s", name, ret.Code)
+		}
+		end := 1 + int(data[0])
+		s := string(data[1:end])
+		data = data[end:]
+		return s, nil
+	}
+
+	var err error
+	switch ret.Code {
+	case AuthenticateRequest:
+		if ret.PeerID, err = field("Peer-ID"); err != nil {
+			return nil, err
+		}
+		if ret.Password, err = field("Password"); err != nil {
+			return nil, err
+		}
+	case AuthenticateAck, AuthenticateNak:
+		// Some authenticators leave out the Message field entirely,
+		// instead of sending an empty one.
+		if len(data) == 0 {
+			break
+		}
+		if ret.Message, err = field("Message"); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown PAP code %d", uint8(ret.Code))
+	}
+
+	return ret, nil
+}
+
+// Marshal returns the wire encoding of the packet, without the PPP
+// protocol field. Fields longer than 255 bytes are truncated.
+func (p *Packet) Marshal() []byte {
+	var data []byte
+	field := func(s string) {
+		if len(s) > 255 {
+			s = s[:255]
+		}
+		data = append(data, byte(len(s)))
+		data = append(data, s...)
+	}
+	switch p.Code {
+	case AuthenticateRequest:
+		field(p.PeerID)
+		field(p.Password)
+	default:
+		field(p.Message)
+	}
+
+	ret := make([]byte, 4+len(data))
+	ret[0] = byte(p.Code)
+	ret[1] = p.ID
+	binary.BigEndian.PutUint16(ret[2:4], uint16(len(ret)))
+	copy(ret[4:], data)
+	return ret
+}
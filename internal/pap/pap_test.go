@@ -0,0 +1,191 @@
+package pap
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParsePacket(t *testing.T) {
+	tests := []struct {
+		desc    string
+		raw     []byte
+		want    *Packet
+		wantErr bool
+		// noMarshal is set for packets that Marshal encodes
+		// differently, because they're non-canonical.
+		noMarshal bool
+	}{
+		{
+			desc: "Authenticate-Request",
+			raw:  []byte{1, 3, 0, 14, 3, 'b', 'o', 'b', 5, 's', '3', 'c', 'r', 't'},
+			want: &Packet{
+				Code:     AuthenticateRequest,
+				ID:       3,
+				PeerID:   "bob",
+				Password: "s3crt",
+			},
+		},
+		{
+			desc: "Authenticate-Ack with padding",
+			raw:  []byte{2, 3, 0, 8, 3, 'y', 'a', 'y', 0, 0},
+			want: &Packet{
+				Code:    AuthenticateAck,
+				ID:      3,
+				Message: "yay",
+			},
+		},
+		{
+			desc: "Authenticate-Nak with empty message",
+			raw:  []byte{3, 3, 0, 5, 0},
+			want: &Packet{
+				Code: AuthenticateNak,
+				ID:   3,
+			},
+		},
+		{
+			desc: "Authenticate-Ack without message",
+			raw:  []byte{2, 3, 0, 4},
+			want: &Packet{
+				Code: AuthenticateAck,
+				ID:   3,
+			},
+			noMarshal: true,
+		},
+		{
+			desc:    "too short",
+			raw:     []byte{1, 1, 0},
+			wantErr: true,
+		},
+		{
+			desc:    "length too long",
+			raw:     []byte{2, 1, 0, 6, 0},
+			wantErr: true,
+		},
+		{
+			desc:    "truncated Peer-ID",
+			raw:     []byte{1, 1, 0, 6, 3, 'b'},
+			wantErr: true,
+		},
+		{
+			desc:    "missing Password",
+			raw:     []byte{1, 1, 0, 6, 1, 'b'},
+			wantErr: true,
+		},
+		{
+			desc:    "truncated Message",
+			raw:     []byte{3, 1, 0, 5, 255},
+			wantErr: true,
+		},
+		{
+			desc:    "unknown code",
+			raw:     []byte{4, 1, 0, 4},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := ParsePacket(test.raw)
+			if err != nil {
+				if !test.wantErr {
+					t.Fatalf("unexpected parse error: %v", err)
+				}
+				return
+			}
+			if test.wantErr {
+				t.Fatalf("parse succeeded, want error")
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Fatalf("wrong parse (-want +got)\n%s", diff)
+			}
+			if test.noMarshal {
+				return
+			}
+			l := int(test.raw[2])<<8 | int(test.raw[3])
+			if diff := cmp.Diff(test.raw[:l], got.Marshal()); diff != "" {
+				t.Fatalf("wrong marshal (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+// goldenHandshake is a PAP handshake, as stored in testdata/*.json.
+type goldenHandshake struct {
+	Description string
+	Packets     []struct {
+		Desc     string
+		Raw      string
+		Code     uint8
+		ID       uint8
+		PeerID   string `json:"peer_id"`
+		Password string
+		Message  string
+		// SkipUnparse is set for packets that Marshal encodes
+		// differently, such as Acks without a Message field.
+		SkipUnparse bool `json:"skip_unparse"`
+	}
+}
+
+// decodeHex decodes a hex string, ignoring whitespace.
+func decodeHex(s string) ([]byte, error) {
+	return hex.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// TestParsePacketGolden checks that the PAP handshakes in testdata/
+// parse and unparse as expected.
+func TestParsePacketGolden(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.json")
+	if err != nil {
+		t.Fatalf("listing golden files: %v", err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no golden files found in testdata/")
+	}
+
+	for _, file := range files {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading %s: %v", file, err)
+		}
+		var handshake goldenHandshake
+		if err := json.Unmarshal(bs, &handshake); err != nil {
+			t.Fatalf("decoding %s: %v", file, err)
+		}
+
+		for _, pkt := range handshake.Packets {
+			t.Run(filepath.Base(file)+"/"+pkt.Desc, func(t *testing.T) {
+				raw, err := decodeHex(pkt.Raw)
+				if err != nil {
+					t.Fatalf("decoding raw packet: %v", err)
+				}
+				want := &Packet{
+					Code:     Code(pkt.Code),
+					ID:       pkt.ID,
+					PeerID:   pkt.PeerID,
+					Password: pkt.Password,
+					Message:  pkt.Message,
+				}
+
+				got, err := ParsePacket(raw)
+				if err != nil {
+					t.Fatalf("parsing packet: %v", err)
+				}
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Errorf("wrong packet (-want +got)\n%s", diff)
+				}
+				if pkt.SkipUnparse {
+					return
+				}
+				if diff := cmp.Diff(raw, got.Marshal()); diff != "" {
+					t.Errorf("wrong marshal (-want +got)\n%s", diff)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,603 @@
+package testutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/raw"
+	"go.universe.tf/ppp/internal/cp"
+)
+
+// PPPoE packet codes and tags that FakeAC speaks.
+const (
+	pppoeSession = 0x00
+	pppoePADI    = 0x09
+	pppoePADO    = 0x07
+	pppoePADR    = 0x19
+	pppoePADS    = 0x65
+	pppoePADT    = 0xa7
+
+	tagServiceName   = 0x0101
+	tagACName        = 0x0102
+	tagHostUniq      = 0x0103
+	tagPPPMaxPayload = 0x0120
+)
+
+// LCP option types of the Magic-Number, Protocol-Field-Compression
+// and Address-and-Control-Field-Compression.
+const (
+	lcpOptMagic cp.OptionType = 5
+	lcpOptPFC   cp.OptionType = 7
+	lcpOptACFC  cp.OptionType = 8
+)
+
+// IPCP's protocol number, and the option type of IP-Address.
+const (
+	ipcpProtocol                 = 0x8021
+	ipcpOptAddress cp.OptionType = 3
+)
+
+// FakeAC is an in-memory PPPoE access concentrator, for tests that
+// bring up whole sessions without Docker, root or a real network
+// interface. Its Discovery and Session conns stand in for the raw
+// sockets that a client opens on its interface: what the client
+// writes to them goes to the FakeAC, and the FakeAC's replies come
+// back from ReadFrom, from Addr.
+//
+// FakeAC answers every PADI with a PADO, and every PADR with a PADS
+// for SessionID, echoing the client's Service-Name, Host-Uniq and
+// PPP-Max-Payload tags. On the session, it runs the concentrator's
+// side of LCP: it acks the client's Configure-Requests, sends its own
+// with a Magic-Number, and answers Echo-Requests and
+// Terminate-Requests. If PFC or ACFC are set, its Configure-Requests
+// also ask for header compression, as pppd's do by default, and it
+// asks again without the options that the client rejects. Once LCP is open, it also runs IPCP, assigning
+// ClientIPv4 to the client, and rejecting other options. It keeps the
+// other PPP frames that the client sends, for the test to check.
+//
+// Addr, Name, SessionID, IPv4, ClientIPv4, PFC and ACFC may be
+// changed before the client starts discovery.
+type FakeAC struct {
+	// Addr is the concentrator's Ethernet address.
+	Addr net.HardwareAddr
+	// Name is the concentrator's AC-Name.
+	Name string
+	// SessionID is the session ID that the concentrator assigns.
+	SessionID uint16
+	// IPv4 is the concentrator's IPv4 address, and ClientIPv4 the
+	// one it assigns to the client.
+	IPv4, ClientIPv4 net.IP
+	// PFC and ACFC are whether the concentrator requests
+	// Protocol-Field-Compression and
+	// Address-and-Control-Field-Compression.
+	PFC, ACFC bool
+
+	disc, sess *fakeACConn
+
+	mu          sync.Mutex
+	magic       uint32
+	lcpID       uint8
+	lcpSent     bool
+	lcpOpts     []cp.Option
+	lcpRejected []uint8
+	lcpOpened   bool
+	clientPFC   bool
+	ipcpID      uint8
+	ipcpSent    bool
+	ipcpOpened  bool
+	echoReplies []uint8
+	lcpTermAck  bool
+	frames      [][]byte
+	terminated  bool
+}
+
+// NewFakeAC returns a FakeAC at 02:00:00:00:ac:01, named "fake",
+// that assigns session 42.
+func NewFakeAC() *FakeAC {
+	ac := &FakeAC{
+		Addr:       net.HardwareAddr{2, 0, 0, 0, 0xac, 1},
+		Name:       "fake",
+		SessionID:  42,
+		IPv4:       net.IP{100, 64, 0, 1},
+		ClientIPv4: net.IP{100, 64, 0, 2},
+		magic:      0x0ac0ffee,
+	}
+	ac.disc = newFakeACConn(ac, ac.handleDiscovery)
+	ac.sess = newFakeACConn(ac, ac.handleSession)
+	return ac
+}
+
+// Discovery returns the conn on which the client runs PPPoE
+// Discovery.
+func (ac *FakeAC) Discovery() net.PacketConn { return ac.disc }
+
+// Session returns the conn on which the client sends and receives
+// PPPoE session frames, as a userspace client does.
+func (ac *FakeAC) Session() net.PacketConn { return ac.sess }
+
+// Interface returns a network interface for the client, with a
+// 1500-byte MTU, on the FakeAC's segment.
+func (ac *FakeAC) Interface() *net.Interface {
+	return &net.Interface{
+		Index:        1,
+		MTU:          1500,
+		Name:         "fakeac0",
+		HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0xc1, 1},
+		Flags:        net.FlagUp | net.FlagBroadcast,
+	}
+}
+
+// LCPOpened returns whether the client acked the FakeAC's LCP
+// Configure-Request.
+func (ac *FakeAC) LCPOpened() bool {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.lcpOpened
+}
+
+// IPCPOpened returns whether the client acked the FakeAC's IPCP
+// Configure-Request.
+func (ac *FakeAC) IPCPOpened() bool {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.ipcpOpened
+}
+
+// SendEchoRequest sends the client an LCP Echo-Request with the given
+// ID, as a concentrator checking that the link is alive does.
+func (ac *FakeAC) SendEchoRequest(id uint8) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, ac.magic)
+	ac.sendLCP(&cp.Packet{Code: cp.EchoRequest, ID: id, Data: data})
+}
+
+// EchoReplies returns the IDs of the LCP Echo-Replies that the client
+// sent.
+func (ac *FakeAC) EchoReplies() []uint8 {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return append([]uint8(nil), ac.echoReplies...)
+}
+
+// SendTerminateRequest sends the client an LCP Terminate-Request, as
+// a concentrator closing the link does.
+func (ac *FakeAC) SendTerminateRequest() {
+	ac.mu.Lock()
+	ac.lcpID++
+	id := ac.lcpID
+	ac.mu.Unlock()
+	ac.sendLCP(&cp.Packet{Code: cp.TerminateRequest, ID: id})
+}
+
+// LCPTerminateAcked returns whether the client acked a Terminate-Request
+// from SendTerminateRequest.
+func (ac *FakeAC) LCPTerminateAcked() bool {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.lcpTermAck
+}
+
+// LCPRejected returns the types of the LCP options that the client
+// rejected in the FakeAC's Configure-Requests.
+func (ac *FakeAC) LCPRejected() []uint8 {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return append([]uint8(nil), ac.lcpRejected...)
+}
+
+// SendFrame sends the client a PPP frame on the session. frame starts
+// with the protocol field, which is compressed to one byte if the
+// client negotiated Protocol-Field-Compression and the field allows
+// it.
+func (ac *FakeAC) SendFrame(frame []byte) {
+	ac.mu.Lock()
+	compress := ac.clientPFC
+	ac.mu.Unlock()
+	if compress && len(frame) >= 2 && frame[0] == 0 && frame[1]&1 == 1 {
+		frame = frame[1:]
+	}
+	ac.sess.send(ac.sessionPacket(frame))
+}
+
+// Frames returns the PPP frames other than LCP and IPCP that the
+// client sent on the session, starting with their protocol field.
+func (ac *FakeAC) Frames() [][]byte {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return append([][]byte(nil), ac.frames...)
+}
+
+// Terminated returns whether the client sent a PADT for the session.
+func (ac *FakeAC) Terminated() bool {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.terminated
+}
+
+// Terminate sends the client a PADT for the session, as a
+// concentrator tearing it down does.
+func (ac *FakeAC) Terminate() {
+	ac.disc.send(discoveryPacket(pppoePADT, ac.SessionID, nil))
+}
+
+// Close closes the FakeAC's conns.
+func (ac *FakeAC) Close() {
+	ac.disc.Close()
+	ac.sess.Close()
+}
+
+// handleDiscovery answers a Discovery packet from the client.
+func (ac *FakeAC) handleDiscovery(pkt []byte) {
+	if len(pkt) < 6 || pkt[0] != 0x11 {
+		return
+	}
+	code, sessionID := pkt[1], binary.BigEndian.Uint16(pkt[2:4])
+	tags := parseTags(pkt)
+
+	var reply []byte
+	switch code {
+	case pppoePADI:
+		reply = discoveryPacket(pppoePADO, 0, append(echoTags(tags), tag{tagACName, []byte(ac.Name)}))
+	case pppoePADR:
+		reply = discoveryPacket(pppoePADS, ac.SessionID, echoTags(tags))
+	case pppoePADT:
+		if sessionID == ac.SessionID {
+			ac.mu.Lock()
+			ac.terminated = true
+			ac.mu.Unlock()
+		}
+		return
+	default:
+		return
+	}
+	ac.disc.send(reply)
+}
+
+// handleSession handles a session frame from the client.
+func (ac *FakeAC) handleSession(pkt []byte) {
+	if len(pkt) < 8 || pkt[0] != 0x11 || pkt[1] != pppoeSession || binary.BigEndian.Uint16(pkt[2:4]) != ac.SessionID {
+		return
+	}
+	l := int(binary.BigEndian.Uint16(pkt[4:6]))
+	if l < 2 || l > len(pkt)-6 {
+		return
+	}
+	frame := pkt[6 : 6+l]
+	switch binary.BigEndian.Uint16(frame) {
+	case cp.LCPProtocol:
+	case ipcpProtocol:
+		ac.handleIPCP(frame[2:])
+		return
+	default:
+		ac.mu.Lock()
+		ac.frames = append(ac.frames, append([]byte(nil), frame...))
+		ac.mu.Unlock()
+		return
+	}
+
+	req, err := cp.ParsePacket(frame[2:])
+	if err != nil {
+		return
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	switch req.Code {
+	case cp.ConfigureRequest:
+		opts, err := cp.ParseOptions(req.Data)
+		if err != nil {
+			return
+		}
+		ac.clientPFC = false
+		for _, opt := range opts {
+			if opt.Type == lcpOptPFC {
+				ac.clientPFC = true
+			}
+		}
+		ac.sendLCP(&cp.Packet{Code: cp.ConfigureAck, ID: req.ID, Data: req.Data})
+		if !ac.lcpSent {
+			ac.lcpSent = true
+			magic := make([]byte, 4)
+			binary.BigEndian.PutUint32(magic, ac.magic)
+			ac.lcpOpts = []cp.Option{{Type: lcpOptMagic, Value: magic}}
+			if ac.PFC {
+				ac.lcpOpts = append(ac.lcpOpts, cp.Option{Type: lcpOptPFC})
+			}
+			if ac.ACFC {
+				ac.lcpOpts = append(ac.lcpOpts, cp.Option{Type: lcpOptACFC})
+			}
+			ac.sendLCPRequest()
+		}
+	case cp.ConfigureAck:
+		if req.ID == ac.lcpID {
+			ac.lcpOpened = true
+		}
+	case cp.ConfigureReject:
+		if req.ID != ac.lcpID {
+			return
+		}
+		rejected, err := cp.ParseOptions(req.Data)
+		if err != nil {
+			return
+		}
+		var opts []cp.Option
+		for _, opt := range ac.lcpOpts {
+			keep := true
+			for _, r := range rejected {
+				if r.Type == opt.Type {
+					keep = false
+				}
+			}
+			if keep {
+				opts = append(opts, opt)
+			}
+		}
+		for _, r := range rejected {
+			ac.lcpRejected = append(ac.lcpRejected, uint8(r.Type))
+		}
+		ac.lcpOpts = opts
+		ac.sendLCPRequest()
+	case cp.EchoRequest:
+		if len(req.Data) < 4 {
+			return
+		}
+		data := append([]byte(nil), req.Data...)
+		binary.BigEndian.PutUint32(data, ac.magic)
+		ac.sendLCP(&cp.Packet{Code: cp.EchoReply, ID: req.ID, Data: data})
+	case cp.EchoReply:
+		ac.echoReplies = append(ac.echoReplies, req.ID)
+	case cp.TerminateRequest:
+		ac.lcpOpened = false
+		ac.sendLCP(&cp.Packet{Code: cp.TerminateAck, ID: req.ID})
+	case cp.TerminateAck:
+		if req.ID == ac.lcpID {
+			ac.lcpTermAck = true
+			ac.lcpOpened = false
+		}
+	}
+}
+
+// handleIPCP handles an IPCP packet from the client.
+func (ac *FakeAC) handleIPCP(b []byte) {
+	req, err := cp.ParsePacket(b)
+	if err != nil {
+		return
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	switch req.Code {
+	case cp.ConfigureRequest:
+		opts, err := cp.ParseOptions(req.Data)
+		if err != nil {
+			return
+		}
+		// Reject everything but the IP-Address, and nak that until
+		// the client asks for ClientIPv4.
+		var naks, rejects []cp.Option
+		for _, opt := range opts {
+			switch {
+			case opt.Type != ipcpOptAddress:
+				rejects = append(rejects, opt)
+			case !net.IP(opt.Value).Equal(ac.ClientIPv4):
+				naks = append(naks, cp.Option{Type: ipcpOptAddress, Value: []byte(ac.ClientIPv4.To4())})
+			}
+		}
+		switch {
+		case len(rejects) > 0:
+			ac.sendIPCP(&cp.Packet{Code: cp.ConfigureReject, ID: req.ID, Data: cp.MarshalOptions(rejects)})
+		case len(naks) > 0:
+			ac.sendIPCP(&cp.Packet{Code: cp.ConfigureNak, ID: req.ID, Data: cp.MarshalOptions(naks)})
+		default:
+			ac.sendIPCP(&cp.Packet{Code: cp.ConfigureAck, ID: req.ID, Data: req.Data})
+		}
+		if !ac.ipcpSent {
+			ac.ipcpSent = true
+			ac.ipcpID++
+			ac.sendIPCP(&cp.Packet{
+				Code: cp.ConfigureRequest,
+				ID:   ac.ipcpID,
+				Data: cp.MarshalOptions([]cp.Option{{Type: ipcpOptAddress, Value: []byte(ac.IPv4.To4())}}),
+			})
+		}
+	case cp.ConfigureAck:
+		if req.ID == ac.ipcpID {
+			ac.ipcpOpened = true
+		}
+	}
+}
+
+// sendLCPRequest sends an LCP Configure-Request for the FakeAC's
+// current options, with a new ID. ac.mu must be held.
+func (ac *FakeAC) sendLCPRequest() {
+	ac.lcpID++
+	ac.sendLCP(&cp.Packet{
+		Code: cp.ConfigureRequest,
+		ID:   ac.lcpID,
+		Data: cp.MarshalOptions(ac.lcpOpts),
+	})
+}
+
+// sendLCP sends an LCP packet on the session.
+func (ac *FakeAC) sendLCP(pkt *cp.Packet) {
+	ac.sendProtocol(cp.LCPProtocol, pkt)
+}
+
+// sendIPCP sends an IPCP packet on the session.
+func (ac *FakeAC) sendIPCP(pkt *cp.Packet) {
+	ac.sendProtocol(ipcpProtocol, pkt)
+}
+
+// sendProtocol sends a control protocol packet for proto on the
+// session.
+func (ac *FakeAC) sendProtocol(proto uint16, pkt *cp.Packet) {
+	payload := pkt.Marshal()
+	frame := make([]byte, 2, 2+len(payload))
+	binary.BigEndian.PutUint16(frame, proto)
+	ac.sess.send(ac.sessionPacket(append(frame, payload...)))
+}
+
+// sessionPacket encapsulates the PPP frame frame in a PPPoE session
+// packet.
+func (ac *FakeAC) sessionPacket(frame []byte) []byte {
+	b := make([]byte, 6, 6+len(frame))
+	b[0], b[1] = 0x11, pppoeSession
+	binary.BigEndian.PutUint16(b[2:4], ac.SessionID)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(frame)))
+	return append(b, frame...)
+}
+
+// tag is a PPPoE Discovery tag.
+type tag struct {
+	typ   uint16
+	value []byte
+}
+
+// parseTags returns the tags of the Discovery packet pkt, stopping at
+// the first malformed one.
+func parseTags(pkt []byte) []tag {
+	l := int(binary.BigEndian.Uint16(pkt[4:6]))
+	if l > len(pkt)-6 {
+		return nil
+	}
+	var ret []tag
+	for b := pkt[6 : 6+l]; len(b) >= 4; {
+		typ, tl := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:4]))
+		if tl > len(b)-4 {
+			break
+		}
+		ret = append(ret, tag{typ, b[4 : 4+tl]})
+		b = b[4+tl:]
+	}
+	return ret
+}
+
+// echoTags returns the tags that the concentrator echoes back.
+func echoTags(tags []tag) []tag {
+	var ret []tag
+	for _, t := range tags {
+		switch t.typ {
+		case tagServiceName, tagHostUniq, tagPPPMaxPayload:
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+// discoveryPacket encodes a Discovery packet.
+func discoveryPacket(code uint8, sessionID uint16, tags []tag) []byte {
+	b := make([]byte, 6)
+	b[0], b[1] = 0x11, code
+	binary.BigEndian.PutUint16(b[2:4], sessionID)
+	for _, t := range tags {
+		var hdr [4]byte
+		binary.BigEndian.PutUint16(hdr[:2], t.typ)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(t.value)))
+		b = append(append(b, hdr[:]...), t.value...)
+	}
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)-6))
+	return b
+}
+
+// fakeACConn is one of a FakeAC's conns. Packets written to it are
+// handed to handle, and those passed to send are returned by ReadFrom.
+type fakeACConn struct {
+	ac     *FakeAC
+	handle func([]byte)
+	in     chan []byte
+
+	mu              sync.Mutex
+	deadline        time.Time
+	deadlineChanged chan struct{}
+	closed          chan struct{}
+	closeOnce       sync.Once
+}
+
+func newFakeACConn(ac *FakeAC, handle func([]byte)) *fakeACConn {
+	return &fakeACConn{
+		ac:              ac,
+		handle:          handle,
+		in:              make(chan []byte, 64),
+		deadlineChanged: make(chan struct{}),
+		closed:          make(chan struct{}),
+	}
+}
+
+var errFakeACClosed = errors.New("use of closed connection")
+
+type fakeACTimeoutError struct{}
+
+func (fakeACTimeoutError) Error() string   { return "i/o timeout" }
+func (fakeACTimeoutError) Timeout() bool   { return true }
+func (fakeACTimeoutError) Temporary() bool { return true }
+
+// send queues pkt for the client. Packets that don't fit in the queue
+// are lost, like they would be on a congested link.
+func (c *fakeACConn) send(pkt []byte) {
+	select {
+	case c.in <- pkt:
+	default:
+	}
+}
+
+func (c *fakeACConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.deadline, c.deadlineChanged
+		c.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, fakeACTimeoutError{}
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case pkt := <-c.in:
+			return copy(b, pkt), &raw.Addr{HardwareAddr: c.ac.Addr}, nil
+		case <-timeout:
+			return 0, nil, fakeACTimeoutError{}
+		case <-changed:
+		case <-c.closed:
+			return 0, nil, errFakeACClosed
+		}
+	}
+}
+
+func (c *fakeACConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errFakeACClosed
+	default:
+	}
+	c.handle(append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *fakeACConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeACConn) LocalAddr() net.Addr {
+	return &raw.Addr{HardwareAddr: c.ac.Interface().HardwareAddr}
+}
+
+func (c *fakeACConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *fakeACConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+func (c *fakeACConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,245 @@
+package testutil
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"go.universe.tf/ppp/internal/cp"
+)
+
+// FuzzPeer is a misbehaving PPP peer, for protocol-state fuzzing of
+// control protocol clients such as lcp.Negotiate. It answers each
+// packet that the client writes with a few random replies: acks,
+// naks and rejects that may or may not match the request, garbage
+// options, truncated packets, unknown codes, Protocol-Rejects and
+// frames of other protocols. The replies only depend on the seed and
+// on what the client sends, so failures can be reproduced.
+//
+// FuzzPeer implements the Conn interface of the control protocol
+// packages.
+type FuzzPeer struct {
+	// Protocol is the PPP protocol number of the client's control
+	// protocol.
+	Protocol uint16
+
+	in chan []byte
+
+	mu              sync.Mutex
+	rand            *rand.Rand
+	deadline        time.Time
+	deadlineChanged chan struct{}
+	maxWritten      int
+}
+
+// NewFuzzPeer returns a FuzzPeer for the control protocol proto,
+// whose replies are drawn from a random source seeded with seed.
+func NewFuzzPeer(proto uint16, seed int64) *FuzzPeer {
+	return &FuzzPeer{
+		Protocol:        proto,
+		in:              make(chan []byte, 64),
+		rand:            rand.New(rand.NewSource(seed)),
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+// MaxWritten returns the size of the largest frame that the client
+// wrote, as a proxy for how much state the peer made it accumulate.
+func (p *FuzzPeer) MaxWritten() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.maxWritten
+}
+
+type fuzzTimeoutError struct{}
+
+func (fuzzTimeoutError) Error() string   { return "i/o timeout" }
+func (fuzzTimeoutError) Timeout() bool   { return true }
+func (fuzzTimeoutError) Temporary() bool { return true }
+
+// Read returns the next frame that the peer sends.
+func (p *FuzzPeer) Read(b []byte) (int, error) {
+	for {
+		p.mu.Lock()
+		deadline, changed := p.deadline, p.deadlineChanged
+		p.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, fuzzTimeoutError{}
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case frame := <-p.in:
+			return copy(b, frame), nil
+		case <-timeout:
+			return 0, fuzzTimeoutError{}
+		case <-changed:
+		}
+	}
+}
+
+// SetReadDeadline sets the deadline for Read.
+func (p *FuzzPeer) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadline = t
+	close(p.deadlineChanged)
+	p.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// WriteProtocol receives a frame from the client, and queues the
+// peer's replies to it. Replies that don't fit in the peer's queue
+// are lost, like they would be on a congested link.
+func (p *FuzzPeer) WriteProtocol(proto uint16, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if l := 2 + len(payload); l > p.maxWritten {
+		p.maxWritten = l
+	}
+	if proto != p.Protocol {
+		return nil
+	}
+	pkt, err := cp.ParsePacket(payload)
+	if err != nil {
+		return nil
+	}
+
+	for n := 1 + p.rand.Intn(3); n > 0; n-- {
+		proto, frame := p.reply(pkt)
+		b := make([]byte, 2, 2+len(frame))
+		binary.BigEndian.PutUint16(b, proto)
+		select {
+		case p.in <- append(b, frame...):
+		default:
+		}
+	}
+	return nil
+}
+
+// reply returns a random reply to the client's pkt, and the protocol
+// to send it on.
+func (p *FuzzPeer) reply(pkt *cp.Packet) (uint16, []byte) {
+	id := pkt.ID
+	if p.rand.Intn(4) == 0 {
+		id = uint8(p.rand.Intn(256))
+	}
+	opts, _ := cp.ParseOptions(pkt.Data)
+
+	var ret *cp.Packet
+	switch p.rand.Intn(12) {
+	case 0, 1:
+		// An ack of the request, maybe of its options, maybe not.
+		data := pkt.Data
+		if p.rand.Intn(4) == 0 {
+			data = cp.MarshalOptions(p.mutateOptions(opts))
+		}
+		ret = &cp.Packet{Code: cp.ConfigureAck, ID: id, Data: data}
+	case 2, 3:
+		ret = &cp.Packet{Code: cp.ConfigureNak, ID: id, Data: cp.MarshalOptions(p.mutateOptions(opts))}
+	case 4:
+		ret = &cp.Packet{Code: cp.ConfigureReject, ID: id, Data: cp.MarshalOptions(p.mutateOptions(opts))}
+	case 5, 6:
+		// A request of our own, of the options the client sent or of
+		// random ones.
+		ret = &cp.Packet{Code: cp.ConfigureRequest, ID: uint8(p.rand.Intn(256)), Data: cp.MarshalOptions(p.mutateOptions(opts))}
+	case 7:
+		codes := []cp.Code{cp.TerminateRequest, cp.TerminateAck, cp.CodeReject, cp.EchoRequest, cp.EchoReply, cp.DiscardRequest}
+		ret = &cp.Packet{Code: codes[p.rand.Intn(len(codes))], ID: id, Data: p.garbage()}
+	case 8:
+		ret = &cp.Packet{Code: cp.Code(p.rand.Intn(256)), ID: id, Data: p.garbage()}
+	case 9:
+		// A truncated, or overlong, packet.
+		b := pkt.Marshal()
+		if p.rand.Intn(2) == 0 {
+			return p.Protocol, b[:p.rand.Intn(len(b))]
+		}
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(b)+1+p.rand.Intn(10)))
+		return p.Protocol, b
+	case 10:
+		// A Protocol-Reject of the client's protocol. It ends the
+		// negotiation, so it's rare.
+		if p.rand.Intn(20) != 0 {
+			return p.Protocol, pkt.Marshal()
+		}
+		data := make([]byte, 2)
+		binary.BigEndian.PutUint16(data, p.Protocol)
+		ret = &cp.Packet{Code: cp.ProtocolReject, ID: id, Data: append(data, pkt.Marshal()...)}
+		return cp.LCPProtocol, ret.Marshal()
+	default:
+		// Noise in another protocol.
+		return uint16(p.rand.Intn(0x10000)) | 1, p.garbage()
+	}
+	return p.Protocol, ret.Marshal()
+}
+
+// mutateOptions returns a random variation of opts: some dropped,
+// some with random values, and some made up.
+func (p *FuzzPeer) mutateOptions(opts []cp.Option) []cp.Option {
+	var ret []cp.Option
+	for _, opt := range opts {
+		switch p.rand.Intn(4) {
+		case 0:
+			// Dropped.
+		case 1:
+			ret = append(ret, cp.Option{Type: opt.Type, Value: p.garbage()})
+		default:
+			ret = append(ret, opt)
+		}
+	}
+	for n := p.rand.Intn(3); n > 0; n-- {
+		ret = append(ret, cp.Option{Type: cp.OptionType(p.rand.Intn(256)), Value: p.garbage()})
+	}
+	return ret
+}
+
+// garbage returns a few random bytes.
+func (p *FuzzPeer) garbage() []byte {
+	ret := make([]byte, p.rand.Intn(12))
+	p.rand.Read(ret)
+	return ret
+}
+
+// RunFuzzPeers runs negotiate against FuzzPeers for proto, with seeds
+// 0 to n-1. Each run gets a context that expires after budget. t
+// fails if a run takes much longer than its budget, if the client
+// writes frames larger than an Ethernet MTU, or if goroutines are
+// left running afterwards. negotiate may check its results, and call
+// t.Errorf with the seed if they're wrong.
+func RunFuzzPeers(t *testing.T, proto uint16, n int, budget time.Duration, negotiate func(ctx context.Context, seed int64, peer *FuzzPeer)) {
+	t.Helper()
+	goroutines := runtime.NumGoroutine()
+	for seed := int64(0); seed < int64(n); seed++ {
+		peer := NewFuzzPeer(proto, seed)
+		ctx, cancel := context.WithTimeout(context.Background(), budget)
+		start := time.Now()
+		negotiate(ctx, seed, peer)
+		cancel()
+		if elapsed := time.Since(start); elapsed > budget+time.Second {
+			t.Errorf("seed %d: negotiation took %v, with a budget of %v", seed, elapsed, budget)
+		}
+		if got := peer.MaxWritten(); got > 1500 {
+			t.Errorf("seed %d: client wrote a %d-byte frame", seed, got)
+		}
+	}
+
+	// Goroutines that were told to exit may take a moment to do so.
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > goroutines; {
+		if time.Now().After(deadline) {
+			t.Errorf("%d goroutines leaked", runtime.NumGoroutine()-goroutines)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,200 @@
+// Package ipcp implements the PPP Internet Protocol Control Protocol,
+// as described in RFC 1332, with the DNS server options of RFC 1877.
+package ipcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+
+	"go.universe.tf/ppp/internal/cp"
+)
+
+// Protocol is the PPP protocol number of IPCP.
+const Protocol = 0x8021
+
+// IPCP Configuration Option types.
+const (
+	optIPAddress    cp.OptionType = 3
+	optPrimaryDNS   cp.OptionType = 129
+	optSecondaryDNS cp.OptionType = 131
+)
+
+// Conn is a PPP link that IPCP runs over, such as a *pppoe.Conn on
+// which LCP and authentication completed. Read must return whole PPP
+// frames, starting with the protocol field.
+type Conn = cp.Conn
+
+// Logger receives events from Negotiate. It has the same method set as
+// pppoe.Logger, so a pppoe.Logger can be used as is.
+type Logger = cp.Logger
+
+// Result is the outcome of a successful IPCP negotiation, with what
+// the host needs to configure IPv4 on the link.
+type Result struct {
+	// Local is our IPv4 address.
+	Local net.IP
+	// Peer is the peer's IPv4 address, or nil if the peer didn't
+	// tell.
+	Peer net.IP
+	// DNS are the DNS servers that the peer provided, primary
+	// first. It's empty if the peer provided none.
+	DNS []net.IP
+}
+
+// Unnumbered reports whether the link is unnumbered: the peer didn't
+// tell its address, said 0.0.0.0, or claimed ours. Many ISPs run PPP
+// that way. Routes over an unnumbered link must point at the
+// interface, since Peer can't be used as a gateway.
+func (r *Result) Unnumbered() bool {
+	return r.Peer == nil || r.Peer.IsUnspecified() || r.Peer.Equal(r.Local)
+}
+
+// Negotiate runs IPCP on conn until the IPv4 link is open, and
+// returns the negotiated addresses. local is the IPv4 address to
+// request for our side of the link. If it's nil or 0.0.0.0, the peer
+// is asked to assign one, which is what ISPs expect.
+//
+// Negotiate also asks the peer for DNS servers. Peers that don't
+// provide any reject the request, which isn't an error.
+//
+// Negotiate reads from conn itself, so LCP must not be running
+// concurrently. Frames of other protocols that arrive meanwhile are
+// discarded. logger, if not nil, receives the IPCP packets that
+// Negotiate sends and receives, and how negotiation ended.
+func Negotiate(ctx context.Context, conn Conn, local net.IP, logger Logger) (*Result, error) {
+	return negotiate(ctx, conn, local, cp.DefaultTimers, logger)
+}
+
+func negotiate(ctx context.Context, conn Conn, local net.IP, timers cp.Timers, logger Logger) (*Result, error) {
+	neg := &ipcpNegotiator{
+		want: map[cp.OptionType]net.IP{
+			optIPAddress:    net.IPv4zero.To4(),
+			optPrimaryDNS:   net.IPv4zero.To4(),
+			optSecondaryDNS: net.IPv4zero.To4(),
+		},
+	}
+	if ip := local.To4(); ip != nil {
+		neg.want[optIPAddress] = ip
+	}
+
+	f := &cp.FSM{
+		Protocol: Protocol,
+		Name:     "IPCP",
+		Neg:      neg,
+		Timers:   timers,
+		Logger:   logger,
+	}
+	if err := f.Run(ctx, conn, nil); err != nil {
+		return nil, err
+	}
+	if neg.result.Local == nil || neg.result.Local.IsUnspecified() {
+		return nil, errors.New("IPCP negotiation failed: peer didn't assign an IPv4 address")
+	}
+	return &neg.result, nil
+}
+
+// requestOrder is the order of the options in our Configure-Requests.
+var requestOrder = []cp.OptionType{optIPAddress, optPrimaryDNS, optSecondaryDNS}
+
+// ipcpNegotiator is the negotiator for IPCP options.
+type ipcpNegotiator struct {
+	// want are the addresses we request, by option type. Options that
+	// the peer rejected are removed.
+	want   map[cp.OptionType]net.IP
+	result Result
+}
+
+func (n *ipcpNegotiator) Request() []cp.Option {
+	var ret []cp.Option
+	for _, typ := range requestOrder {
+		if ip, ok := n.want[typ]; ok {
+			ret = append(ret, cp.Option{Type: typ, Value: []byte(ip)})
+		}
+	}
+	return ret
+}
+
+func (n *ipcpNegotiator) CheckRequest(opts []cp.Option, nakAllowed bool) (cp.Code, []cp.Option) {
+	var rejects []cp.Option
+	for _, opt := range opts {
+		// The peer telling us its address is all we accept. We have
+		// no address to assign if it asks for one, and we don't do
+		// compression, or serve DNS.
+		ip := parseAddress(opt)
+		if opt.Type != optIPAddress || ip == nil || ip.IsUnspecified() {
+			rejects = append(rejects, opt)
+		}
+	}
+	if len(rejects) > 0 {
+		return cp.ConfigureReject, rejects
+	}
+	return cp.ConfigureAck, nil
+}
+
+func (n *ipcpNegotiator) Acked(opts []cp.Option) {
+	n.result.Local, n.result.DNS = nil, nil
+	for _, opt := range opts {
+		ip := parseAddress(opt)
+		if ip == nil {
+			continue
+		}
+		switch opt.Type {
+		case optIPAddress:
+			n.result.Local = ip
+		case optPrimaryDNS, optSecondaryDNS:
+			if !ip.IsUnspecified() {
+				n.result.DNS = append(n.result.DNS, ip)
+			}
+		}
+	}
+}
+
+func (n *ipcpNegotiator) PeerAcked(opts []cp.Option) {
+	n.result.Peer = nil
+	for _, opt := range opts {
+		if ip := parseAddress(opt); ip != nil && opt.Type == optIPAddress {
+			n.result.Peer = ip
+		}
+	}
+}
+
+func (n *ipcpNegotiator) Nakked(opts []cp.Option) {
+	for _, opt := range opts {
+		ip := parseAddress(opt)
+		if ip == nil {
+			continue
+		}
+		// Only adjust options we asked for.
+		if _, ok := n.want[opt.Type]; ok {
+			n.want[opt.Type] = ip
+		}
+	}
+}
+
+func (n *ipcpNegotiator) Rejected(opts []cp.Option) bool {
+	for _, opt := range opts {
+		if ip, ok := n.want[opt.Type]; !ok || !bytes.Equal(opt.Value, ip) {
+			return false
+		}
+	}
+	for _, opt := range opts {
+		delete(n.want, opt.Type)
+	}
+	return true
+}
+
+// parseAddress returns the IPv4 address in opt, or nil if opt isn't
+// one of the address options, or is malformed.
+func parseAddress(opt cp.Option) net.IP {
+	switch opt.Type {
+	case optIPAddress, optPrimaryDNS, optSecondaryDNS:
+	default:
+		return nil
+	}
+	if len(opt.Value) != net.IPv4len {
+		return nil
+	}
+	return net.IP(append([]byte(nil), opt.Value...))
+}
@@ -0,0 +1,406 @@
+package ipcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.universe.tf/ppp/internal/cp"
+	"go.universe.tf/ppp/internal/testutil"
+)
+
+// fakeConn is a PPP link whose peer is driven by the test.
+type fakeConn struct {
+	in, out chan []byte
+
+	mu              sync.Mutex
+	deadline        time.Time
+	deadlineChanged chan struct{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		in:              make(chan []byte, 10),
+		out:             make(chan []byte, 10),
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+type fakeTimeoutError struct{}
+
+func (fakeTimeoutError) Error() string { return "i/o timeout" }
+func (fakeTimeoutError) Timeout() bool { return true }
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.deadline, c.deadlineChanged
+		c.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, fakeTimeoutError{}
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case frame := <-c.in:
+			return copy(b, frame), nil
+		case <-timeout:
+			return 0, fakeTimeoutError{}
+		case <-changed:
+		}
+	}
+}
+
+func (c *fakeConn) WriteProtocol(proto uint16, payload []byte) error {
+	frame := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(frame, proto)
+	copy(frame[2:], payload)
+	c.out <- frame
+	return nil
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// send makes the peer send an IPCP packet.
+func (c *fakeConn) send(code cp.Code, id uint8, opts []cp.Option) {
+	c.sendProtocol(Protocol, &cp.Packet{Code: code, ID: id, Data: cp.MarshalOptions(opts)})
+}
+
+func (c *fakeConn) sendProtocol(proto uint16, pkt *cp.Packet) {
+	frame := make([]byte, 2)
+	binary.BigEndian.PutUint16(frame, proto)
+	c.in <- append(frame, pkt.Marshal()...)
+}
+
+// expect reads an IPCP packet sent by Negotiate, and checks that it
+// has the given code and options.
+func expect(t *testing.T, c *fakeConn, code cp.Code, opts []cp.Option) *cp.Packet {
+	t.Helper()
+	select {
+	case frame := <-c.out:
+		if proto := binary.BigEndian.Uint16(frame); proto != Protocol {
+			t.Fatalf("got frame for protocol 0x%04x, want IPCP", proto)
+		}
+		pkt, err := cp.ParsePacket(frame[2:])
+		if err != nil {
+			t.Fatalf("parsing IPCP packet: %v", err)
+		}
+		if pkt.Code != code {
+			t.Fatalf("got %s, want %s", pkt.Code, code)
+		}
+		got, err := cp.ParseOptions(pkt.Data)
+		if err != nil {
+			t.Fatalf("parsing options of %s: %v", pkt.Code, err)
+		}
+		if diff := cmp.Diff(opts, got); diff != "" {
+			t.Fatalf("wrong options in %s (-want +got)\n%s", pkt.Code, diff)
+		}
+		return pkt
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for IPCP packet")
+		return nil
+	}
+}
+
+type negotiateResult struct {
+	res *Result
+	err error
+}
+
+func startNegotiate(conn Conn, local net.IP) <-chan negotiateResult {
+	timers := cp.DefaultTimers
+	timers.Restart = time.Minute // No retransmits to confuse the scripts.
+	ret := make(chan negotiateResult, 1)
+	go func() {
+		res, err := negotiate(context.Background(), conn, local, timers, nil)
+		ret <- negotiateResult{res, err}
+	}()
+	return ret
+}
+
+func waitResult(t *testing.T, res <-chan negotiateResult) negotiateResult {
+	t.Helper()
+	select {
+	case got := <-res:
+		return got
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Negotiate")
+		return negotiateResult{}
+	}
+}
+
+func addr(typ cp.OptionType, a, b, c, d byte) cp.Option {
+	return cp.Option{Type: typ, Value: []byte{a, b, c, d}}
+}
+
+func TestNegotiate(t *testing.T) {
+	conn := newFakeConn()
+	res := startNegotiate(conn, nil)
+
+	// We ask for everything to be assigned.
+	req := expect(t, conn, cp.ConfigureRequest, []cp.Option{
+		addr(optIPAddress, 0, 0, 0, 0),
+		addr(optPrimaryDNS, 0, 0, 0, 0),
+		addr(optSecondaryDNS, 0, 0, 0, 0),
+	})
+	conn.send(cp.ConfigureNak, req.ID, []cp.Option{
+		addr(optIPAddress, 100, 64, 0, 2),
+		addr(optPrimaryDNS, 192, 0, 2, 53),
+		addr(optSecondaryDNS, 192, 0, 2, 54),
+	})
+	want := []cp.Option{
+		addr(optIPAddress, 100, 64, 0, 2),
+		addr(optPrimaryDNS, 192, 0, 2, 53),
+		addr(optSecondaryDNS, 192, 0, 2, 54),
+	}
+	req = expect(t, conn, cp.ConfigureRequest, want)
+	conn.send(cp.ConfigureAck, req.ID, want)
+
+	// The peer's options, other than its address, get rejected.
+	conn.send(cp.ConfigureRequest, 1, []cp.Option{
+		addr(optIPAddress, 100, 64, 0, 1),
+		{Type: 2, Value: []byte{0, 0x2d, 15, 1}},
+	})
+	expect(t, conn, cp.ConfigureReject, []cp.Option{{Type: 2, Value: []byte{0, 0x2d, 15, 1}}})
+	conn.send(cp.ConfigureRequest, 2, []cp.Option{addr(optIPAddress, 100, 64, 0, 1)})
+	expect(t, conn, cp.ConfigureAck, []cp.Option{addr(optIPAddress, 100, 64, 0, 1)})
+
+	got := waitResult(t, res)
+	if got.err != nil {
+		t.Fatalf("negotiation failed: %v", got.err)
+	}
+	wantRes := &Result{
+		Local: net.IP{100, 64, 0, 2},
+		Peer:  net.IP{100, 64, 0, 1},
+		DNS:   []net.IP{{192, 0, 2, 53}, {192, 0, 2, 54}},
+	}
+	if diff := cmp.Diff(wantRes, got.res); diff != "" {
+		t.Fatalf("wrong result (-want +got)\n%s", diff)
+	}
+}
+
+func TestNegotiateNoDNS(t *testing.T) {
+	conn := newFakeConn()
+	res := startNegotiate(conn, net.ParseIP("100.64.0.2"))
+
+	req := expect(t, conn, cp.ConfigureRequest, []cp.Option{
+		addr(optIPAddress, 100, 64, 0, 2),
+		addr(optPrimaryDNS, 0, 0, 0, 0),
+		addr(optSecondaryDNS, 0, 0, 0, 0),
+	})
+	conn.send(cp.ConfigureReject, req.ID, []cp.Option{
+		addr(optPrimaryDNS, 0, 0, 0, 0),
+		addr(optSecondaryDNS, 0, 0, 0, 0),
+	})
+	req = expect(t, conn, cp.ConfigureRequest, []cp.Option{addr(optIPAddress, 100, 64, 0, 2)})
+	conn.send(cp.ConfigureAck, req.ID, []cp.Option{addr(optIPAddress, 100, 64, 0, 2)})
+
+	// A peer that wants us to assign its address gets rejected, and
+	// can do without.
+	conn.send(cp.ConfigureRequest, 1, []cp.Option{addr(optIPAddress, 0, 0, 0, 0)})
+	expect(t, conn, cp.ConfigureReject, []cp.Option{addr(optIPAddress, 0, 0, 0, 0)})
+	conn.send(cp.ConfigureRequest, 2, nil)
+	expect(t, conn, cp.ConfigureAck, nil)
+
+	got := waitResult(t, res)
+	if got.err != nil {
+		t.Fatalf("negotiation failed: %v", got.err)
+	}
+	wantRes := &Result{
+		Local: net.IP{100, 64, 0, 2},
+	}
+	if diff := cmp.Diff(wantRes, got.res); diff != "" {
+		t.Fatalf("wrong result (-want +got)\n%s", diff)
+	}
+}
+
+func TestUnnumbered(t *testing.T) {
+	local := net.IP{100, 64, 0, 2}
+	tests := []struct {
+		peer net.IP
+		want bool
+	}{
+		{net.IP{100, 64, 0, 1}, false},
+		{net.ParseIP("100.64.0.1"), false},
+		{nil, true},
+		{net.IP{0, 0, 0, 0}, true},
+		{net.IP{100, 64, 0, 2}, true},
+		{net.ParseIP("100.64.0.2"), true},
+	}
+	for _, test := range tests {
+		res := &Result{Local: local, Peer: test.peer}
+		if got := res.Unnumbered(); got != test.want {
+			t.Errorf("Unnumbered() with peer %v = %v, want %v", test.peer, got, test.want)
+		}
+	}
+}
+
+func TestNegotiateNoAddress(t *testing.T) {
+	conn := newFakeConn()
+	res := startNegotiate(conn, nil)
+
+	// A broken peer acks our request for an assignment.
+	req := expect(t, conn, cp.ConfigureRequest, []cp.Option{
+		addr(optIPAddress, 0, 0, 0, 0),
+		addr(optPrimaryDNS, 0, 0, 0, 0),
+		addr(optSecondaryDNS, 0, 0, 0, 0),
+	})
+	conn.send(cp.ConfigureAck, req.ID, []cp.Option{
+		addr(optIPAddress, 0, 0, 0, 0),
+		addr(optPrimaryDNS, 0, 0, 0, 0),
+		addr(optSecondaryDNS, 0, 0, 0, 0),
+	})
+	conn.send(cp.ConfigureRequest, 1, nil)
+	expect(t, conn, cp.ConfigureAck, nil)
+
+	if got := waitResult(t, res); got.err == nil {
+		t.Fatalf("negotiation without an address succeeded with %v", got.res)
+	}
+}
+
+func TestNegotiateProtocolReject(t *testing.T) {
+	conn := newFakeConn()
+	res := startNegotiate(conn, nil)
+
+	req := expect(t, conn, cp.ConfigureRequest, []cp.Option{
+		addr(optIPAddress, 0, 0, 0, 0),
+		addr(optPrimaryDNS, 0, 0, 0, 0),
+		addr(optSecondaryDNS, 0, 0, 0, 0),
+	})
+	data := append([]byte{0x80, 0x21}, req.Marshal()...)
+	conn.sendProtocol(cp.LCPProtocol, &cp.Packet{Code: cp.ProtocolReject, ID: 1, Data: data})
+
+	if got := waitResult(t, res); got.err == nil {
+		t.Fatal("negotiation succeeded after peer rejected IPCP")
+	}
+}
+
+func TestNegotiateFuzz(t *testing.T) {
+	timers := cp.DefaultTimers
+	timers.Restart = 10 * time.Millisecond
+	testutil.RunFuzzPeers(t, Protocol, 100, 50*time.Millisecond, func(ctx context.Context, seed int64, peer *testutil.FuzzPeer) {
+		res, err := negotiate(ctx, peer, nil, timers, nil)
+		if err != nil {
+			return
+		}
+		if res.Local.To4() == nil || res.Local.IsUnspecified() {
+			t.Errorf("seed %d: negotiated local address %v", seed, res.Local)
+		}
+	})
+}
+
+// goldenHandshake is an IPCP handshake, as stored in testdata/*.json.
+type goldenHandshake struct {
+	Description string
+	Packets     []struct {
+		Desc    string
+		Raw     string
+		Code    uint8
+		ID      uint8
+		Options []struct {
+			Type uint8
+			// IP is the address in address options, and Value the
+			// value of other options, in hex.
+			IP    string
+			Value string
+		}
+	}
+}
+
+// decodeHex decodes a hex string, ignoring whitespace.
+func decodeHex(s string) ([]byte, error) {
+	return hex.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// TestParsePacketGolden checks that the IPCP handshakes in testdata/
+// parse and unparse as expected.
+func TestParsePacketGolden(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.json")
+	if err != nil {
+		t.Fatalf("listing golden files: %v", err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no golden files found in testdata/")
+	}
+
+	for _, file := range files {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading %s: %v", file, err)
+		}
+		var handshake goldenHandshake
+		if err := json.Unmarshal(bs, &handshake); err != nil {
+			t.Fatalf("decoding %s: %v", file, err)
+		}
+
+		for _, pkt := range handshake.Packets {
+			t.Run(filepath.Base(file)+"/"+pkt.Desc, func(t *testing.T) {
+				raw, err := decodeHex(pkt.Raw)
+				if err != nil {
+					t.Fatalf("decoding raw packet: %v", err)
+				}
+				got, err := cp.ParsePacket(raw)
+				if err != nil {
+					t.Fatalf("parsing packet: %v", err)
+				}
+				if got.Code != cp.Code(pkt.Code) || got.ID != pkt.ID {
+					t.Errorf("got %s ID %d, want %s ID %d", got.Code, got.ID, cp.Code(pkt.Code), pkt.ID)
+				}
+				opts, err := cp.ParseOptions(got.Data)
+				if err != nil {
+					t.Fatalf("parsing options: %v", err)
+				}
+				if len(opts) != len(pkt.Options) {
+					t.Fatalf("got %d options, want %d", len(opts), len(pkt.Options))
+				}
+				for i, want := range pkt.Options {
+					opt := opts[i]
+					if opt.Type != cp.OptionType(want.Type) {
+						t.Errorf("option %d has type %d, want %d", i, opt.Type, want.Type)
+						continue
+					}
+					if want.IP != "" {
+						if ip := parseAddress(opt); !ip.Equal(net.ParseIP(want.IP)) {
+							t.Errorf("option %d has address %v, want %s", i, ip, want.IP)
+						}
+						continue
+					}
+					value, err := decodeHex(want.Value)
+					if err != nil {
+						t.Fatalf("decoding option %d: %v", i, err)
+					}
+					if !bytes.Equal(value, opt.Value) {
+						t.Errorf("option %d has value %x, want %x", i, opt.Value, value)
+					}
+				}
+				if diff := cmp.Diff(raw, got.Marshal()); diff != "" {
+					t.Errorf("wrong marshal (-want +got)\n%s", diff)
+				}
+			})
+		}
+	}
+}
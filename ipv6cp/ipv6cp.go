@@ -0,0 +1,203 @@
+// Package ipv6cp implements the PPP IPv6 Control Protocol, as
+// described in RFC 5072.
+package ipv6cp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+
+	"go.universe.tf/ppp/internal/cp"
+)
+
+// Protocol is the PPP protocol number of IPv6CP.
+const Protocol = 0x8057
+
+// optInterfaceID is the type of the Interface-Identifier option, the
+// only IPv6CP option we negotiate.
+const optInterfaceID cp.OptionType = 1
+
+// Conn is a PPP link that IPv6CP runs over, such as a *pppoe.Conn on
+// which LCP and authentication completed. Read must return whole PPP
+// frames, starting with the protocol field.
+type Conn = cp.Conn
+
+// InterfaceID is a 64-bit IPv6 interface identifier.
+type InterfaceID [8]byte
+
+// LinkLocal returns the link-local IPv6 address for the interface
+// identifier.
+func (id InterfaceID) LinkLocal() net.IP {
+	ret := make(net.IP, net.IPv6len)
+	ret[0], ret[1] = 0xfe, 0x80
+	copy(ret[8:], id[:])
+	return ret
+}
+
+func (id InterfaceID) String() string {
+	return fmt.Sprintf("%x:%x:%x:%x", id[0:2], id[2:4], id[4:6], id[6:8])
+}
+
+// Logger receives events from Negotiate. It has the same method set as
+// pppoe.Logger, so a pppoe.Logger can be used as is.
+type Logger = cp.Logger
+
+// Result is the outcome of a successful IPv6CP negotiation.
+type Result struct {
+	// Local is our interface identifier.
+	Local InterfaceID
+	// Peer is the peer's interface identifier, or zero if the peer
+	// didn't tell.
+	Peer InterfaceID
+}
+
+// Negotiate runs IPv6CP on conn until the IPv6 link is open, and
+// returns the negotiated interface identifiers. local is the
+// interface identifier to request for our side of the link. If it's
+// zero, a random one is used.
+//
+// If the peer asks for an identifier that is zero or equal to ours, it
+// gets a random one suggested instead, as RFC 5072 requires.
+//
+// Negotiate reads from conn itself, so LCP must not be running
+// concurrently. Frames of other protocols that arrive meanwhile are
+// discarded. logger, if not nil, receives the IPv6CP packets that
+// Negotiate sends and receives, and how negotiation ended.
+func Negotiate(ctx context.Context, conn Conn, local InterfaceID, logger Logger) (*Result, error) {
+	return negotiate(ctx, conn, local, cp.DefaultTimers, logger)
+}
+
+func negotiate(ctx context.Context, conn Conn, local InterfaceID, timers cp.Timers, logger Logger) (*Result, error) {
+	if local == (InterfaceID{}) {
+		local = randomID()
+	}
+	neg := &ipv6cpNegotiator{
+		want:      local,
+		requestID: true,
+	}
+
+	f := &cp.FSM{
+		Protocol: Protocol,
+		Name:     "IPv6CP",
+		Neg:      neg,
+		Timers:   timers,
+		Logger:   logger,
+	}
+	if err := f.Run(ctx, conn, nil); err != nil {
+		return nil, err
+	}
+	return &Result{
+		Local: neg.want,
+		Peer:  neg.peer,
+	}, nil
+}
+
+// randomID returns a random, non-zero interface identifier.
+var randomID = func() InterfaceID {
+	var ret InterfaceID
+	for ret == (InterfaceID{}) {
+		if _, err := rand.Read(ret[:]); err != nil {
+			panic(fmt.Sprintf("reading random bytes: %v", err))
+		}
+		// Clear the universal/local bit (RFC 4291 appendix A): the
+		// identifier isn't derived from a globally unique MAC.
+		ret[0] &^= 0x02
+	}
+	return ret
+}
+
+// ipv6cpNegotiator is the negotiator for IPv6CP options.
+type ipv6cpNegotiator struct {
+	// want is our interface identifier. We request it as long as
+	// requestID is true, which it stops being if the peer rejects
+	// the option. We keep using it regardless.
+	want      InterfaceID
+	requestID bool
+	// peer is the peer's interface identifier, once acked.
+	peer InterfaceID
+}
+
+func (n *ipv6cpNegotiator) Request() []cp.Option {
+	if !n.requestID {
+		return nil
+	}
+	return []cp.Option{{Type: optInterfaceID, Value: append([]byte(nil), n.want[:]...)}}
+}
+
+func (n *ipv6cpNegotiator) CheckRequest(opts []cp.Option, nakAllowed bool) (cp.Code, []cp.Option) {
+	var naks, rejects []cp.Option
+	for _, opt := range opts {
+		id, ok := parseInterfaceID(opt)
+		if !ok {
+			// We don't do header compression.
+			rejects = append(rejects, opt)
+			continue
+		}
+		if id != (InterfaceID{}) && id != n.want {
+			continue
+		}
+		if !nakAllowed {
+			rejects = append(rejects, opt)
+			continue
+		}
+		suggest := randomID()
+		for suggest == n.want {
+			suggest = randomID()
+		}
+		naks = append(naks, cp.Option{Type: optInterfaceID, Value: suggest[:]})
+	}
+
+	switch {
+	case len(rejects) > 0:
+		return cp.ConfigureReject, rejects
+	case len(naks) > 0:
+		return cp.ConfigureNak, naks
+	default:
+		return cp.ConfigureAck, nil
+	}
+}
+
+func (n *ipv6cpNegotiator) Acked(opts []cp.Option) {}
+
+func (n *ipv6cpNegotiator) PeerAcked(opts []cp.Option) {
+	n.peer = InterfaceID{}
+	for _, opt := range opts {
+		if id, ok := parseInterfaceID(opt); ok {
+			n.peer = id
+		}
+	}
+}
+
+func (n *ipv6cpNegotiator) Nakked(opts []cp.Option) {
+	for _, opt := range opts {
+		// A zero suggestion is bogus, keep ours.
+		if id, ok := parseInterfaceID(opt); ok && n.requestID && id != (InterfaceID{}) {
+			n.want = id
+		}
+	}
+}
+
+func (n *ipv6cpNegotiator) Rejected(opts []cp.Option) bool {
+	for _, opt := range opts {
+		if !n.requestID || opt.Type != optInterfaceID || !bytes.Equal(opt.Value, n.want[:]) {
+			return false
+		}
+	}
+	if len(opts) > 0 {
+		n.requestID = false
+	}
+	return true
+}
+
+// parseInterfaceID returns the identifier in opt, or false if opt
+// isn't a well-formed Interface-Identifier option.
+func parseInterfaceID(opt cp.Option) (InterfaceID, bool) {
+	var ret InterfaceID
+	if opt.Type != optInterfaceID || len(opt.Value) != len(ret) {
+		return ret, false
+	}
+	copy(ret[:], opt.Value)
+	return ret, true
+}
@@ -0,0 +1,260 @@
+package ipv6cp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.universe.tf/ppp/internal/cp"
+	"go.universe.tf/ppp/internal/testutil"
+)
+
+// fakeConn is a PPP link whose peer is driven by the test.
+type fakeConn struct {
+	in, out chan []byte
+
+	mu              sync.Mutex
+	deadline        time.Time
+	deadlineChanged chan struct{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		in:              make(chan []byte, 10),
+		out:             make(chan []byte, 10),
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+type fakeTimeoutError struct{}
+
+func (fakeTimeoutError) Error() string { return "i/o timeout" }
+func (fakeTimeoutError) Timeout() bool { return true }
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.deadline, c.deadlineChanged
+		c.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, fakeTimeoutError{}
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case frame := <-c.in:
+			return copy(b, frame), nil
+		case <-timeout:
+			return 0, fakeTimeoutError{}
+		case <-changed:
+		}
+	}
+}
+
+func (c *fakeConn) WriteProtocol(proto uint16, payload []byte) error {
+	frame := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(frame, proto)
+	copy(frame[2:], payload)
+	c.out <- frame
+	return nil
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// send makes the peer send an IPv6CP packet.
+func (c *fakeConn) send(code cp.Code, id uint8, opts []cp.Option) {
+	pkt := &cp.Packet{Code: code, ID: id, Data: cp.MarshalOptions(opts)}
+	frame := make([]byte, 2)
+	binary.BigEndian.PutUint16(frame, Protocol)
+	c.in <- append(frame, pkt.Marshal()...)
+}
+
+// expect reads an IPv6CP packet sent by Negotiate, and checks that it
+// has the given code and options.
+func expect(t *testing.T, c *fakeConn, code cp.Code, opts []cp.Option) *cp.Packet {
+	t.Helper()
+	select {
+	case frame := <-c.out:
+		if proto := binary.BigEndian.Uint16(frame); proto != Protocol {
+			t.Fatalf("got frame for protocol 0x%04x, want IPv6CP", proto)
+		}
+		pkt, err := cp.ParsePacket(frame[2:])
+		if err != nil {
+			t.Fatalf("parsing IPv6CP packet: %v", err)
+		}
+		if pkt.Code != code {
+			t.Fatalf("got %s, want %s", pkt.Code, code)
+		}
+		got, err := cp.ParseOptions(pkt.Data)
+		if err != nil {
+			t.Fatalf("parsing options of %s: %v", pkt.Code, err)
+		}
+		if diff := cmp.Diff(opts, got); diff != "" {
+			t.Fatalf("wrong options in %s (-want +got)\n%s", pkt.Code, diff)
+		}
+		return pkt
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for IPv6CP packet")
+		return nil
+	}
+}
+
+type negotiateResult struct {
+	res *Result
+	err error
+}
+
+func startNegotiate(conn Conn, local InterfaceID) <-chan negotiateResult {
+	timers := cp.DefaultTimers
+	timers.Restart = time.Minute // No retransmits to confuse the scripts.
+	ret := make(chan negotiateResult, 1)
+	go func() {
+		res, err := negotiate(context.Background(), conn, local, timers, nil)
+		ret <- negotiateResult{res, err}
+	}()
+	return ret
+}
+
+func waitResult(t *testing.T, res <-chan negotiateResult) negotiateResult {
+	t.Helper()
+	select {
+	case got := <-res:
+		return got
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Negotiate")
+		return negotiateResult{}
+	}
+}
+
+// fakeRandomIDs makes randomID return ids, in order. The returned
+// function restores the real randomID.
+func fakeRandomIDs(ids ...InterfaceID) func() {
+	orig := randomID
+	randomID = func() InterfaceID {
+		ret := ids[0]
+		ids = ids[1:]
+		return ret
+	}
+	return func() { randomID = orig }
+}
+
+func idOpt(id InterfaceID) cp.Option {
+	return cp.Option{Type: optInterfaceID, Value: id[:]}
+}
+
+var (
+	idA = InterfaceID{0, 0, 0, 0, 0, 0, 0, 0xa}
+	idB = InterfaceID{0, 0, 0, 0, 0, 0, 0, 0xb}
+	idC = InterfaceID{0, 0, 0, 0, 0, 0, 0, 0xc}
+)
+
+func TestNegotiate(t *testing.T) {
+	// Our random ID, then suggestions for the peer. The first
+	// suggestion collides with our ID, and must be drawn again.
+	defer fakeRandomIDs(idA, idA, idB)()
+
+	conn := newFakeConn()
+	res := startNegotiate(conn, InterfaceID{})
+
+	req := expect(t, conn, cp.ConfigureRequest, []cp.Option{idOpt(idA)})
+
+	// The peer picked the same ID as us, we suggest another one.
+	conn.send(cp.ConfigureRequest, 1, []cp.Option{idOpt(idA)})
+	expect(t, conn, cp.ConfigureNak, []cp.Option{idOpt(idB)})
+
+	// The peer wants us to use another ID.
+	conn.send(cp.ConfigureNak, req.ID, []cp.Option{idOpt(idC)})
+	req = expect(t, conn, cp.ConfigureRequest, []cp.Option{idOpt(idC)})
+	conn.send(cp.ConfigureAck, req.ID, []cp.Option{idOpt(idC)})
+
+	// Header compression gets rejected.
+	conn.send(cp.ConfigureRequest, 2, []cp.Option{idOpt(idB), {Type: 2, Value: []byte{0, 0x61}}})
+	expect(t, conn, cp.ConfigureReject, []cp.Option{{Type: 2, Value: []byte{0, 0x61}}})
+	conn.send(cp.ConfigureRequest, 3, []cp.Option{idOpt(idB)})
+	expect(t, conn, cp.ConfigureAck, []cp.Option{idOpt(idB)})
+
+	got := waitResult(t, res)
+	if got.err != nil {
+		t.Fatalf("negotiation failed: %v", got.err)
+	}
+	if diff := cmp.Diff(&Result{Local: idC, Peer: idB}, got.res); diff != "" {
+		t.Fatalf("wrong result (-want +got)\n%s", diff)
+	}
+}
+
+func TestNegotiatePeerRejectsID(t *testing.T) {
+	defer fakeRandomIDs(idB)()
+
+	conn := newFakeConn()
+	res := startNegotiate(conn, idA)
+
+	// The peer doesn't want to hear about our ID. We keep it, without
+	// negotiating it.
+	req := expect(t, conn, cp.ConfigureRequest, []cp.Option{idOpt(idA)})
+	conn.send(cp.ConfigureReject, req.ID, []cp.Option{idOpt(idA)})
+	req = expect(t, conn, cp.ConfigureRequest, nil)
+	conn.send(cp.ConfigureAck, req.ID, nil)
+
+	// The peer asks us for an ID.
+	conn.send(cp.ConfigureRequest, 1, []cp.Option{idOpt(InterfaceID{})})
+	expect(t, conn, cp.ConfigureNak, []cp.Option{idOpt(idB)})
+	conn.send(cp.ConfigureRequest, 2, []cp.Option{idOpt(idB)})
+	expect(t, conn, cp.ConfigureAck, []cp.Option{idOpt(idB)})
+
+	got := waitResult(t, res)
+	if got.err != nil {
+		t.Fatalf("negotiation failed: %v", got.err)
+	}
+	if diff := cmp.Diff(&Result{Local: idA, Peer: idB}, got.res); diff != "" {
+		t.Fatalf("wrong result (-want +got)\n%s", diff)
+	}
+}
+
+func TestInterfaceID(t *testing.T) {
+	id := InterfaceID{0x02, 0x11, 0x22, 0xff, 0xfe, 0x33, 0x44, 0x55}
+	if got, want := id.String(), "0211:22ff:fe33:4455"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got, want := id.LinkLocal(), net.ParseIP("fe80::211:22ff:fe33:4455"); !got.Equal(want) {
+		t.Errorf("LinkLocal() = %s, want %s", got, want)
+	}
+
+	for i := 0; i < 100; i++ {
+		id := randomID()
+		if id == (InterfaceID{}) || id[0]&0x02 != 0 {
+			t.Fatalf("bad random interface ID %s", id)
+		}
+	}
+}
+
+func TestNegotiateFuzz(t *testing.T) {
+	timers := cp.DefaultTimers
+	timers.Restart = 10 * time.Millisecond
+	testutil.RunFuzzPeers(t, Protocol, 100, 50*time.Millisecond, func(ctx context.Context, seed int64, peer *testutil.FuzzPeer) {
+		res, err := negotiate(ctx, peer, InterfaceID{}, timers, nil)
+		if err != nil {
+			return
+		}
+		if res.Local == (InterfaceID{}) {
+			t.Errorf("seed %d: negotiated a zero interface identifier", seed)
+		}
+	})
+}
@@ -0,0 +1,288 @@
+package lcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"go.universe.tf/ppp/internal/cp"
+)
+
+// Conn is a PPP link that LCP runs over, such as a *pppoe.Conn. Read
+// must return whole PPP frames, starting with the protocol field.
+type Conn = cp.Conn
+
+// Negotiated is the result of a successful LCP negotiation.
+type Negotiated struct {
+	// Local are the options that the peer acked for our side of the
+	// link, e.g. the MRU that the peer must respect when sending to
+	// us.
+	Local Options
+	// Peer are the options that we acked for the peer's side of the
+	// link, e.g. the authentication protocol that the peer wants us
+	// to use.
+	Peer Options
+}
+
+// Timers are the restart timer and counters of LCP negotiation, as
+// described in RFC 1661 section 4.6. Zero fields take the defaults
+// that RFC 1661 suggests: a 3s Restart, 10 Configure-Requests, 2
+// Terminate-Requests and 5 Configure-Naks.
+type Timers = cp.Timers
+
+// Logger receives events from Negotiate. It has the same method set as
+// pppoe.Logger, so a pppoe.Logger can be used as is.
+type Logger = cp.Logger
+
+// minMRU is the smallest peer MRU we accept. RFC 1661 doesn't set a
+// minimum, but going below the size of an IPv4 header plus a bit
+// makes no sense.
+const minMRU = 64
+
+// Negotiate runs LCP on conn until the link is open, and returns the
+// negotiated options. desired are the options to request for our side
+// of the link; it may be nil. A Magic of 0 in desired is replaced by a
+// random number, since magic numbers can't be zero. desired.Timers
+// sets the negotiation's timers, if it's not nil.
+//
+// Header compression isn't supported, so desired can't have PFC or
+// ACFC set: RFC 2516 forbids ACFC on PPPoE, and the readers of this
+// module's links expect uncompressed 2-byte protocol fields.
+//
+// Negotiation follows the automaton of RFC 1661. The peer's requests
+// are acked if they only contain an MRU of at least 64 bytes, PAP or
+// CHAP with MD5 as the authentication protocol, or a magic number that
+// differs from ours. Other options are nakked or rejected.
+//
+// Frames of other protocols that arrive before the link is open are
+// discarded, as required by RFC 1661.
+func Negotiate(ctx context.Context, conn Conn, desired *Options) (*Negotiated, error) {
+	timers := cp.DefaultTimers
+	if desired != nil && desired.Timers != nil {
+		timers = desired.Timers.WithDefaults()
+	}
+	return negotiate(ctx, conn, desired, timers)
+}
+
+func negotiate(ctx context.Context, conn Conn, desired *Options, timers cp.Timers) (*Negotiated, error) {
+	if desired == nil {
+		desired = &Options{}
+	}
+	if desired.PFC || desired.ACFC {
+		return nil, errHeaderCompression
+	}
+	neg := &lcpNegotiator{want: desired.copy()}
+	if neg.want.Magic != nil && *neg.want.Magic == 0 {
+		magic := randomMagic()
+		neg.want.Magic = &magic
+	}
+
+	f := &cp.FSM{
+		Protocol: Protocol,
+		Name:     "LCP",
+		Neg:      neg,
+		Timers:   timers,
+		Logger:   desired.Logger,
+	}
+	check := func() error {
+		if neg.loops >= timers.MaxFailure {
+			return errLoopback
+		}
+		if neg.local != nil && neg.local.Magic != nil {
+			f.Magic = *neg.local.Magic
+		}
+		return nil
+	}
+	if err := f.Run(ctx, conn, check); err != nil {
+		return nil, err
+	}
+	return &Negotiated{
+		Local: *neg.local,
+		Peer:  *neg.peer,
+	}, nil
+}
+
+// errLoopback is returned by Negotiate when the link appears to be
+// looped back: the peer keeps requesting our own magic number, even
+// after we changed it.
+var errLoopback = errors.New("LCP negotiation failed: link is looped back")
+
+// errHeaderCompression is returned by Negotiate when asked to request
+// PFC or ACFC.
+var errHeaderCompression = errors.New("LCP header compression isn't supported: PFC and ACFC can't be requested")
+
+// randomMagic returns a random, non-zero magic number.
+var randomMagic = func() uint32 {
+	var b [4]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(fmt.Sprintf("reading random bytes: %v", err))
+		}
+		if magic := binary.BigEndian.Uint32(b[:]); magic != 0 {
+			return magic
+		}
+	}
+}
+
+// lcpNegotiator is the negotiator for LCP options.
+type lcpNegotiator struct {
+	// want are the options we request.
+	want *Options
+	// local and peer are the options that were acked on each side,
+	// or nil if none were yet.
+	local, peer *Options
+	// loops counts the peer's requests that had our magic number.
+	loops int
+}
+
+func (n *lcpNegotiator) Request() []Option {
+	return n.want.Options()
+}
+
+func (n *lcpNegotiator) CheckRequest(opts []Option, nakAllowed bool) (Code, []Option) {
+	var naks, rejects []Option
+	for _, opt := range opts {
+		var o Options
+		if !o.parseOption(opt) {
+			rejects = append(rejects, opt)
+			continue
+		}
+
+		var suggest *Options
+		switch opt.Type {
+		case OptMRU:
+			if *o.MRU < minMRU {
+				mru := uint16(minMRU)
+				suggest = &Options{MRU: &mru}
+			}
+		case OptAuthProto:
+			if !supportedAuth(o.AuthProto) {
+				suggest = &Options{AuthProto: &AuthProto{
+					Protocol: ProtoCHAP,
+					Data:     []byte{CHAPMD5},
+				}}
+			}
+		case OptMagicNumber:
+			// A zero magic number is invalid, and our own magic
+			// number means that the link is looped back.
+			looped := n.want.Magic != nil && *o.Magic == *n.want.Magic
+			if looped {
+				n.loops++
+			}
+			if *o.Magic == 0 || looped {
+				magic := randomMagic()
+				suggest = &Options{Magic: &magic}
+			}
+		default:
+			// We don't do compression on PPPoE, RFC 2516 forbids
+			// ACFC and there's no point in PFC.
+			rejects = append(rejects, opt)
+			continue
+		}
+
+		if suggest != nil {
+			if nakAllowed {
+				naks = append(naks, suggest.Options()...)
+			} else {
+				rejects = append(rejects, opt)
+			}
+		}
+	}
+
+	switch {
+	case len(rejects) > 0:
+		return ConfigureReject, rejects
+	case len(naks) > 0:
+		return ConfigureNak, naks
+	default:
+		return ConfigureAck, nil
+	}
+}
+
+// supportedAuth returns whether we can authenticate with auth.
+func supportedAuth(auth *AuthProto) bool {
+	switch auth.Protocol {
+	case ProtoPAP:
+		return len(auth.Data) == 0
+	case ProtoCHAP:
+		return bytes.Equal(auth.Data, []byte{CHAPMD5})
+	default:
+		return false
+	}
+}
+
+func (n *lcpNegotiator) Acked(opts []Option) {
+	n.local = parseOptions(opts)
+}
+
+func (n *lcpNegotiator) PeerAcked(opts []Option) {
+	n.peer = parseOptions(opts)
+}
+
+func (n *lcpNegotiator) Nakked(opts []Option) {
+	for _, opt := range opts {
+		var o Options
+		if !o.parseOption(opt) {
+			continue
+		}
+		// Only adjust options we asked for. The peer can also hint
+		// at options it would like us to request, but we're happy
+		// with what we asked for.
+		switch opt.Type {
+		case OptMRU:
+			if n.want.MRU != nil {
+				n.want.MRU = o.MRU
+			}
+		case OptAuthProto:
+			if n.want.AuthProto != nil {
+				n.want.AuthProto = o.AuthProto
+			}
+		case OptMagicNumber:
+			if n.want.Magic != nil {
+				magic := randomMagic()
+				n.want.Magic = &magic
+			}
+		}
+	}
+}
+
+func (n *lcpNegotiator) Rejected(opts []Option) bool {
+	requested := n.want.Options()
+	for _, opt := range opts {
+		found := false
+		for _, req := range requested {
+			if opt.Type == req.Type && bytes.Equal(opt.Value, req.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, opt := range opts {
+		switch opt.Type {
+		case OptMRU:
+			n.want.MRU = nil
+		case OptAuthProto:
+			n.want.AuthProto = nil
+		case OptMagicNumber:
+			n.want.Magic = nil
+		}
+	}
+	return true
+}
+
+// parseOptions returns the Options that opts describe, ignoring
+// unknown or malformed options.
+func parseOptions(opts []Option) *Options {
+	ret := &Options{}
+	for _, opt := range opts {
+		ret.parseOption(opt)
+	}
+	return ret
+}
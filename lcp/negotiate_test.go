@@ -0,0 +1,475 @@
+package lcp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.universe.tf/ppp/internal/cp"
+	"go.universe.tf/ppp/internal/testutil"
+)
+
+// fakeConn is one end of an in-memory PPP link.
+type fakeConn struct {
+	in   chan []byte
+	peer *fakeConn
+
+	mu              sync.Mutex
+	deadline        time.Time
+	deadlineChanged chan struct{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		in:              make(chan []byte, 100),
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+// newFakeLink returns the two ends of an in-memory PPP link.
+func newFakeLink() (*fakeConn, *fakeConn) {
+	a, b := newFakeConn(), newFakeConn()
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+type fakeTimeoutError struct{}
+
+func (fakeTimeoutError) Error() string { return "i/o timeout" }
+func (fakeTimeoutError) Timeout() bool { return true }
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.deadline, c.deadlineChanged
+		c.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, fakeTimeoutError{}
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case frame := <-c.in:
+			return copy(b, frame), nil
+		case <-timeout:
+			return 0, fakeTimeoutError{}
+		case <-changed:
+		}
+	}
+}
+
+func (c *fakeConn) WriteProtocol(proto uint16, payload []byte) error {
+	frame := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(frame, proto)
+	copy(frame[2:], payload)
+	c.peer.in <- frame
+	return nil
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// readPacket reads an LCP packet that the other end of conn sent.
+func readPacket(t *testing.T, conn *fakeConn) *Packet {
+	t.Helper()
+	select {
+	case frame := <-conn.in:
+		if proto := binary.BigEndian.Uint16(frame); proto != Protocol {
+			t.Fatalf("got frame for protocol 0x%04x, want LCP", proto)
+		}
+		pkt, err := ParsePacket(frame[2:])
+		if err != nil {
+			t.Fatalf("parsing LCP packet: %v", err)
+		}
+		return pkt
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for LCP packet")
+		return nil
+	}
+}
+
+// expectPacket reads an LCP packet sent to conn, and checks that it
+// has the given code and options.
+func expectPacket(t *testing.T, conn *fakeConn, code Code, opts []Option) *Packet {
+	t.Helper()
+	pkt := readPacket(t, conn)
+	if pkt.Code != code {
+		t.Fatalf("got %s, want %s", pkt.Code, code)
+	}
+	got, err := ParseOptions(pkt.Data)
+	if err != nil {
+		t.Fatalf("parsing options of %s: %v", pkt.Code, err)
+	}
+	if diff := cmp.Diff(opts, got); diff != "" {
+		t.Fatalf("wrong options in %s (-want +got)\n%s", pkt.Code, diff)
+	}
+	return pkt
+}
+
+func sendPacket(t *testing.T, conn *fakeConn, code Code, id uint8, opts []Option) {
+	t.Helper()
+	pkt := &Packet{Code: code, ID: id, Data: MarshalOptions(opts)}
+	if err := conn.WriteProtocol(Protocol, pkt.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type negotiateResult struct {
+	neg *Negotiated
+	err error
+}
+
+// startNegotiate runs negotiate in the background.
+func startNegotiate(ctx context.Context, conn Conn, desired *Options, timers cp.Timers) <-chan negotiateResult {
+	ret := make(chan negotiateResult, 1)
+	go func() {
+		neg, err := negotiate(ctx, conn, desired, timers)
+		ret <- negotiateResult{neg, err}
+	}()
+	return ret
+}
+
+// fastTimers are timers that keep tests quick.
+var fastTimers = cp.Timers{
+	Restart:      10 * time.Millisecond,
+	MaxConfigure: 3,
+	MaxTerminate: 2,
+	MaxFailure:   5,
+}
+
+func uint16p(v uint16) *uint16 { return &v }
+func uint32p(v uint32) *uint32 { return &v }
+
+func TestNegotiate(t *testing.T) {
+	a, b := newFakeLink()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chap := &AuthProto{Protocol: ProtoCHAP, Data: []byte{CHAPMD5}}
+	resA := startNegotiate(ctx, a, &Options{MRU: uint16p(1492), Magic: uint32p(0)}, cp.DefaultTimers)
+	resB := startNegotiate(ctx, b, &Options{AuthProto: chap, Magic: uint32p(0x42)}, cp.DefaultTimers)
+
+	gotA, gotB := <-resA, <-resB
+	if gotA.err != nil || gotB.err != nil {
+		t.Fatalf("negotiation failed: %v, %v", gotA.err, gotB.err)
+	}
+
+	if gotA.neg.Local.Magic == nil || *gotA.neg.Local.Magic == 0 {
+		t.Fatalf("A didn't negotiate a random magic number")
+	}
+	wantA := &Negotiated{
+		Local: Options{MRU: uint16p(1492), Magic: gotA.neg.Local.Magic},
+		Peer:  Options{AuthProto: chap, Magic: uint32p(0x42)},
+	}
+	if diff := cmp.Diff(wantA, gotA.neg); diff != "" {
+		t.Errorf("wrong negotiation result for A (-want +got)\n%s", diff)
+	}
+	wantB := &Negotiated{
+		Local: wantA.Peer,
+		Peer:  wantA.Local,
+	}
+	if diff := cmp.Diff(wantB, gotB.neg); diff != "" {
+		t.Errorf("wrong negotiation result for B (-want +got)\n%s", diff)
+	}
+}
+
+func TestNegotiateScripted(t *testing.T) {
+	conn, peer := newFakeLink()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	timers := cp.DefaultTimers
+	timers.Restart = time.Minute // No retransmits to confuse the script.
+
+	res := startNegotiate(ctx, conn, &Options{MRU: uint16p(1492)}, timers)
+
+	req := expectPacket(t, peer, ConfigureRequest, []Option{{Type: OptMRU, Value: []byte{0x05, 0xd4}}})
+
+	// Options we don't support get rejected.
+	sendPacket(t, peer, ConfigureRequest, 1, []Option{
+		{Type: OptACCM, Value: []byte{0, 0, 0, 0}},
+		{Type: OptMRU, Value: []byte{0x05, 0xdc}},
+		{Type: OptPFC, Value: nil},
+	})
+	expectPacket(t, peer, ConfigureReject, []Option{
+		{Type: OptACCM, Value: []byte{0, 0, 0, 0}},
+		{Type: OptPFC, Value: nil},
+	})
+
+	// Silly values get nakked.
+	sendPacket(t, peer, ConfigureRequest, 2, []Option{
+		{Type: OptMRU, Value: []byte{0, 32}},
+		{Type: OptAuthProto, Value: []byte{0xc2, 0x27}},
+		{Type: OptMagicNumber, Value: []byte{0, 0, 0, 0}},
+	})
+	nak := readPacket(t, peer)
+	if nak.Code != ConfigureNak {
+		t.Fatalf("got %s, want %s", nak.Code, ConfigureNak)
+	}
+	nakOpts, _ := ParseOptions(nak.Data)
+	if len(nakOpts) != 3 || nakOpts[2].Type != OptMagicNumber {
+		t.Fatalf("wrong Configure-Nak options %v", nakOpts)
+	}
+	if diff := cmp.Diff([]Option{{Type: OptMRU, Value: []byte{0, 64}}, {Type: OptAuthProto, Value: []byte{0xc2, 0x23, 5}}}, nakOpts[:2]); diff != "" {
+		t.Fatalf("wrong Configure-Nak options (-want +got)\n%s", diff)
+	}
+
+	// A nak of our MRU makes us ask for the suggested one.
+	sendPacket(t, peer, ConfigureNak, req.ID, []Option{{Type: OptMRU, Value: []byte{0x05, 0xc8}}})
+	req = expectPacket(t, peer, ConfigureRequest, []Option{{Type: OptMRU, Value: []byte{0x05, 0xc8}}})
+
+	// An ack with the wrong ID is ignored, the right one goes
+	// through.
+	sendPacket(t, peer, ConfigureAck, req.ID+1, []Option{{Type: OptMRU, Value: []byte{0x05, 0xc8}}})
+	sendPacket(t, peer, ConfigureAck, req.ID, []Option{{Type: OptMRU, Value: []byte{0x05, 0xc8}}})
+
+	// Frames of other protocols are dropped.
+	if err := peer.WriteProtocol(0x0021, []byte{0x45}); err != nil {
+		t.Fatal(err)
+	}
+
+	sendPacket(t, peer, ConfigureRequest, 3, []Option{
+		{Type: OptMRU, Value: []byte{0x05, 0xdc}},
+		{Type: OptAuthProto, Value: []byte{0xc0, 0x23}},
+	})
+	expectPacket(t, peer, ConfigureAck, []Option{
+		{Type: OptMRU, Value: []byte{0x05, 0xdc}},
+		{Type: OptAuthProto, Value: []byte{0xc0, 0x23}},
+	})
+
+	got := <-res
+	if got.err != nil {
+		t.Fatalf("negotiation failed: %v", got.err)
+	}
+	want := &Negotiated{
+		Local: Options{MRU: uint16p(1480)},
+		Peer: Options{
+			MRU:       uint16p(1500),
+			AuthProto: &AuthProto{Protocol: ProtoPAP},
+		},
+	}
+	if diff := cmp.Diff(want, got.neg); diff != "" {
+		t.Fatalf("wrong negotiation result (-want +got)\n%s", diff)
+	}
+}
+
+func TestNegotiateRejectedOptions(t *testing.T) {
+	conn, peer := newFakeLink()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	timers := cp.DefaultTimers
+	timers.Restart = time.Minute
+
+	res := startNegotiate(ctx, conn, &Options{MRU: uint16p(1492), Magic: uint32p(7)}, timers)
+	req := expectPacket(t, peer, ConfigureRequest, []Option{
+		{Type: OptMRU, Value: []byte{0x05, 0xd4}},
+		{Type: OptMagicNumber, Value: []byte{0, 0, 0, 7}},
+	})
+
+	// Rejecting options we didn't ask for is bogus.
+	sendPacket(t, peer, ConfigureReject, req.ID, []Option{{Type: OptPFC, Value: nil}})
+	// Rejecting the magic number makes us negotiate without it.
+	sendPacket(t, peer, ConfigureReject, req.ID, []Option{{Type: OptMagicNumber, Value: []byte{0, 0, 0, 7}}})
+	req = expectPacket(t, peer, ConfigureRequest, []Option{{Type: OptMRU, Value: []byte{0x05, 0xd4}}})
+	sendPacket(t, peer, ConfigureAck, req.ID, []Option{{Type: OptMRU, Value: []byte{0x05, 0xd4}}})
+	sendPacket(t, peer, ConfigureRequest, 1, nil)
+	expectPacket(t, peer, ConfigureAck, nil)
+
+	got := <-res
+	if got.err != nil {
+		t.Fatalf("negotiation failed: %v", got.err)
+	}
+	if got.neg.Local.Magic != nil {
+		t.Fatalf("negotiated magic number %d after peer rejected it", *got.neg.Local.Magic)
+	}
+}
+
+// TestNegotiateHeaderCompression runs every combination of PFC and
+// ACFC on each end of the link. RFC 2516 forbids ACFC on PPPoE, and
+// our readers expect 2-byte protocol fields, so we refuse to request
+// either option, and reject the peer's requests for them. Mismatches
+// here are a classic cause of links that come up but carry no
+// traffic.
+func TestNegotiateHeaderCompression(t *testing.T) {
+	type compression struct{ pfc, acfc bool }
+	var combos []compression
+	for _, pfc := range []bool{false, true} {
+		for _, acfc := range []bool{false, true} {
+			combos = append(combos, compression{pfc, acfc})
+		}
+	}
+
+	// Asking for compression is an error.
+	for _, ours := range combos {
+		if !ours.pfc && !ours.acfc {
+			continue
+		}
+		conn, _ := newFakeLink()
+		_, err := Negotiate(context.Background(), conn, &Options{PFC: ours.pfc, ACFC: ours.acfc})
+		if err != errHeaderCompression {
+			t.Errorf("Negotiate with %+v returned %v, want %v", ours, err, errHeaderCompression)
+		}
+	}
+
+	// A peer that would accept compression, as pppd does by default,
+	// never gets asked for it, and has its own requests for it
+	// rejected.
+	for _, peers := range combos {
+		t.Run(fmt.Sprintf("%+v", peers), func(t *testing.T) {
+			conn, peer := newFakeLink()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			timers := cp.DefaultTimers
+			timers.Restart = time.Minute // No retransmits to confuse the script.
+
+			res := startNegotiate(ctx, conn, nil, timers)
+
+			req := expectPacket(t, peer, ConfigureRequest, nil)
+			sendPacket(t, peer, ConfigureAck, req.ID, nil)
+
+			peerOpts := (&Options{PFC: peers.pfc, ACFC: peers.acfc}).Options()
+			if len(peerOpts) > 0 {
+				sendPacket(t, peer, ConfigureRequest, 1, peerOpts)
+				expectPacket(t, peer, ConfigureReject, peerOpts)
+			}
+			sendPacket(t, peer, ConfigureRequest, 2, nil)
+			expectPacket(t, peer, ConfigureAck, nil)
+
+			got := <-res
+			if got.err != nil {
+				t.Fatalf("negotiation failed: %v", got.err)
+			}
+			want := &Negotiated{}
+			if diff := cmp.Diff(want, got.neg); diff != "" {
+				t.Errorf("wrong negotiation result (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestNegotiateTimers checks that Negotiate uses the Timers in the
+// desired options, with defaults for the fields left at zero.
+func TestNegotiateTimers(t *testing.T) {
+	conn, peer := newFakeLink()
+	desired := &Options{Timers: &Timers{Restart: 10 * time.Millisecond, MaxConfigure: 2}}
+	start := time.Now()
+	_, err := Negotiate(context.Background(), conn, desired)
+	if err == nil {
+		t.Fatal("negotiation with silent peer succeeded")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("negotiation took %v, want about 20ms", d)
+	}
+	for i := 0; i < 2; i++ {
+		expectPacket(t, peer, ConfigureRequest, nil)
+	}
+	select {
+	case <-peer.in:
+		t.Fatal("more than 2 Configure-Requests sent")
+	default:
+	}
+}
+
+func TestNegotiateTimeout(t *testing.T) {
+	conn, peer := newFakeLink()
+	_, err := negotiate(context.Background(), conn, nil, fastTimers)
+	if err == nil {
+		t.Fatal("negotiation with silent peer succeeded")
+	}
+	for i := 0; i < fastTimers.MaxConfigure; i++ {
+		expectPacket(t, peer, ConfigureRequest, nil)
+	}
+	select {
+	case <-peer.in:
+		t.Fatalf("sent more than %d Configure-Requests", fastTimers.MaxConfigure)
+	default:
+	}
+}
+
+func TestNegotiateCancel(t *testing.T) {
+	conn, _ := newFakeLink()
+	ctx, cancel := context.WithCancel(context.Background())
+	res := startNegotiate(ctx, conn, nil, cp.DefaultTimers)
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case got := <-res:
+		if got.err != context.Canceled {
+			t.Fatalf("negotiation returned %v, want %v", got.err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("negotiation didn't stop on cancellation")
+	}
+}
+
+func TestNegotiatePeerRejectsLCP(t *testing.T) {
+	conn, peer := newFakeLink()
+	res := startNegotiate(context.Background(), conn, nil, cp.DefaultTimers)
+	expectPacket(t, peer, ConfigureRequest, nil)
+	pkt := &Packet{Code: ProtocolReject, ID: 1, Data: []byte{0xc0, 0x21}}
+	if err := peer.WriteProtocol(Protocol, pkt.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-res:
+		if got.err == nil {
+			t.Fatal("negotiation succeeded after peer rejected LCP")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("negotiation didn't stop after peer rejected LCP")
+	}
+}
+
+func TestNegotiateLoopback(t *testing.T) {
+	conn := newFakeConn()
+	conn.peer = conn
+	_, err := negotiate(context.Background(), conn, &Options{Magic: uint32p(0)}, fastTimers)
+	if err != errLoopback {
+		t.Fatalf("negotiation on looped back link returned %v, want %v", err, errLoopback)
+	}
+}
+
+func TestNegotiateSendError(t *testing.T) {
+	_, err := negotiate(context.Background(), failingConn{}, nil, fastTimers)
+	if err == nil {
+		t.Fatal("negotiation succeeded without sending anything")
+	}
+}
+
+// failingConn is a Conn whose writes always fail.
+type failingConn struct{ Conn }
+
+func (failingConn) WriteProtocol(uint16, []byte) error { return errors.New("nope") }
+func (failingConn) SetReadDeadline(time.Time) error    { return nil }
+
+func TestNegotiateFuzz(t *testing.T) {
+	testutil.RunFuzzPeers(t, Protocol, 100, 50*time.Millisecond, func(ctx context.Context, seed int64, peer *testutil.FuzzPeer) {
+		neg, err := negotiate(ctx, peer, &Options{MRU: uint16p(1492), Magic: uint32p(0)}, fastTimers)
+		if err != nil {
+			return
+		}
+		if neg.Peer.MRU != nil && *neg.Peer.MRU < minMRU {
+			t.Errorf("seed %d: acked peer MRU %d", seed, *neg.Peer.MRU)
+		}
+		if neg.Local.Magic != nil && neg.Peer.Magic != nil && *neg.Local.Magic == *neg.Peer.Magic {
+			t.Errorf("seed %d: acked peer's copy of our magic number", seed)
+		}
+	})
+}
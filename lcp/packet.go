@@ -0,0 +1,279 @@
+// Package lcp implements the PPP Link Control Protocol, as described
+// in RFC 1661.
+package lcp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"go.universe.tf/ppp/internal/cp"
+)
+
+// Protocol is the PPP protocol number of LCP.
+const Protocol = cp.LCPProtocol
+
+// Code is the kind of an LCP packet.
+type Code = cp.Code
+
+// LCP packet codes.
+const (
+	ConfigureRequest = cp.ConfigureRequest
+	ConfigureAck     = cp.ConfigureAck
+	ConfigureNak     = cp.ConfigureNak
+	ConfigureReject  = cp.ConfigureReject
+	TerminateRequest = cp.TerminateRequest
+	TerminateAck     = cp.TerminateAck
+	CodeReject       = cp.CodeReject
+	ProtocolReject   = cp.ProtocolReject
+	EchoRequest      = cp.EchoRequest
+	EchoReply        = cp.EchoReply
+	DiscardRequest   = cp.DiscardRequest
+)
+
+// Packet is an LCP packet. Its Data is a list of options for the
+// Configure-* codes, see ParseOptions.
+type Packet = cp.Packet
+
+// ParsePacket parses an LCP packet, without the PPP protocol
+// field. Bytes past the packet's length field are padding, and are
+// ignored.
+func ParsePacket(b []byte) (*Packet, error) {
+	return cp.ParsePacket(b)
+}
+
+// Option is a Configuration Option, as carried in Configure-*
+// packets.
+type Option = cp.Option
+
+// OptionType is the type of a Configuration Option.
+type OptionType = cp.OptionType
+
+// LCP Configuration Option types.
+const (
+	OptMRU         OptionType = 1
+	OptACCM        OptionType = 2
+	OptAuthProto   OptionType = 3
+	OptQualityProt OptionType = 4
+	OptMagicNumber OptionType = 5
+	OptPFC         OptionType = 7
+	OptACFC        OptionType = 8
+)
+
+// ParseOptions parses the Configuration Options in the Data of a
+// Configure-* packet.
+func ParseOptions(b []byte) ([]Option, error) {
+	return cp.ParseOptions(b)
+}
+
+// MarshalOptions returns the wire encoding of opts, suitable for the
+// Data of a Configure-* packet.
+func MarshalOptions(opts []Option) []byte {
+	return cp.MarshalOptions(opts)
+}
+
+// Auth protocols that may appear in the AuthProto option.
+const (
+	ProtoPAP  = 0xc023
+	ProtoCHAP = 0xc223
+)
+
+// CHAPMD5 is the CHAP algorithm number for MD5, as used in the
+// AuthProto option.
+const CHAPMD5 = 5
+
+// AuthProto is the value of an Authentication-Protocol option.
+type AuthProto struct {
+	// Protocol is the PPP protocol number of the authentication
+	// protocol, e.g. ProtoCHAP.
+	Protocol uint16
+	// Data is protocol-specific, e.g. the CHAP algorithm.
+	Data []byte
+}
+
+// Options are the LCP Configuration Options that this package
+// understands. nil fields are options that are absent, which is
+// distinct from options present with a zero value.
+type Options struct {
+	// MRU is the Maximum-Receive-Unit.
+	MRU *uint16
+	// AuthProto is the Authentication-Protocol.
+	AuthProto *AuthProto
+	// Magic is the Magic-Number.
+	Magic *uint32
+	// PFC is Protocol-Field-Compression. Negotiate never requests
+	// it, and fails if it's set in the desired options.
+	PFC bool
+	// ACFC is Address-and-Control-Field-Compression. Negotiate never
+	// requests it, and fails if it's set in the desired options.
+	ACFC bool
+
+	// Timers, if not nil, are the restart timer and counters that
+	// Negotiate uses. They aren't a Configuration Option, and only
+	// matter in the desired options passed to Negotiate.
+	Timers *Timers
+	// Logger, if not nil, receives Negotiate's events: the LCP
+	// packets it sends and receives, and how negotiation ended. Like
+	// Timers, it only matters in the desired options.
+	Logger Logger
+}
+
+// Options returns opts as a list of Configuration Options.
+func (o *Options) Options() []Option {
+	var ret []Option
+	if o.MRU != nil {
+		v := make([]byte, 2)
+		binary.BigEndian.PutUint16(v, *o.MRU)
+		ret = append(ret, Option{Type: OptMRU, Value: v})
+	}
+	if o.AuthProto != nil {
+		v := make([]byte, 2, 2+len(o.AuthProto.Data))
+		binary.BigEndian.PutUint16(v, o.AuthProto.Protocol)
+		ret = append(ret, Option{Type: OptAuthProto, Value: append(v, o.AuthProto.Data...)})
+	}
+	if o.Magic != nil {
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint32(v, *o.Magic)
+		ret = append(ret, Option{Type: OptMagicNumber, Value: v})
+	}
+	if o.PFC {
+		ret = append(ret, Option{Type: OptPFC, Value: nil})
+	}
+	if o.ACFC {
+		ret = append(ret, Option{Type: OptACFC, Value: nil})
+	}
+	return ret
+}
+
+// parseOption sets the field of o that corresponds to opt. It returns
+// false if opt is of an unknown type, or malformed.
+func (o *Options) parseOption(opt Option) bool {
+	switch opt.Type {
+	case OptMRU:
+		if len(opt.Value) != 2 {
+			return false
+		}
+		mru := binary.BigEndian.Uint16(opt.Value)
+		o.MRU = &mru
+	case OptAuthProto:
+		if len(opt.Value) < 2 {
+			return false
+		}
+		o.AuthProto = &AuthProto{
+			Protocol: binary.BigEndian.Uint16(opt.Value),
+			Data:     append([]byte(nil), opt.Value[2:]...),
+		}
+	case OptMagicNumber:
+		if len(opt.Value) != 4 {
+			return false
+		}
+		magic := binary.BigEndian.Uint32(opt.Value)
+		o.Magic = &magic
+	case OptPFC:
+		if len(opt.Value) != 0 {
+			return false
+		}
+		o.PFC = true
+	case OptACFC:
+		if len(opt.Value) != 0 {
+			return false
+		}
+		o.ACFC = true
+	default:
+		return false
+	}
+	return true
+}
+
+// copy returns a deep copy of o.
+func (o *Options) copy() *Options {
+	ret := *o
+	if o.MRU != nil {
+		mru := *o.MRU
+		ret.MRU = &mru
+	}
+	if o.AuthProto != nil {
+		ret.AuthProto = &AuthProto{
+			Protocol: o.AuthProto.Protocol,
+			Data:     append([]byte(nil), o.AuthProto.Data...),
+		}
+	}
+	if o.Magic != nil {
+		magic := *o.Magic
+		ret.Magic = &magic
+	}
+	if o.Timers != nil {
+		timers := *o.Timers
+		ret.Timers = &timers
+	}
+	return &ret
+}
+
+// WiresharkJSON encodes pkt using the field names and value formatting
+// of the LCP layer of Wireshark's JSON export (tshark -T json), so
+// that our parse can be diffed against Wireshark's, like
+// pppoe.DiscoveryEvent's MarshalJSON does for Discovery packets.
+// Options are listed in the order they appear in, under lcp.options.
+// Options that can't be parsed are encoded as a _ws.malformed field.
+func WiresharkJSON(pkt *Packet) ([]byte, error) {
+	type option map[string]string
+	ret := struct {
+		Code      string   `json:"ppp.code"`
+		ID        string   `json:"ppp.identifier"`
+		Length    string   `json:"ppp.length"`
+		Options   []option `json:"lcp.options,omitempty"`
+		Magic     string   `json:"ppp.magic_number,omitempty"`
+		Data      string   `json:"ppp.data,omitempty"`
+		Malformed string   `json:"_ws.malformed,omitempty"`
+	}{
+		Code:   strconv.Itoa(int(pkt.Code)),
+		ID:     strconv.Itoa(int(pkt.ID)),
+		Length: strconv.Itoa(4 + len(pkt.Data)),
+	}
+
+	switch pkt.Code {
+	case ConfigureRequest, ConfigureAck, ConfigureNak, ConfigureReject:
+		opts, err := ParseOptions(pkt.Data)
+		if err != nil {
+			ret.Malformed = err.Error()
+			break
+		}
+		ret.Options = []option{}
+		for _, opt := range opts {
+			o := option{
+				"lcp.opt.type":   strconv.Itoa(int(opt.Type)),
+				"lcp.opt.length": strconv.Itoa(2 + len(opt.Value)),
+			}
+			switch {
+			case opt.Type == OptMRU && len(opt.Value) == 2:
+				o["lcp.opt.mru"] = strconv.Itoa(int(binary.BigEndian.Uint16(opt.Value)))
+			case opt.Type == OptACCM && len(opt.Value) == 4:
+				o["lcp.opt.asyncmap"] = fmt.Sprintf("0x%08x", binary.BigEndian.Uint32(opt.Value))
+			case opt.Type == OptAuthProto && len(opt.Value) >= 2:
+				o["lcp.opt.auth_protocol"] = fmt.Sprintf("0x%04x", binary.BigEndian.Uint16(opt.Value))
+				if len(opt.Value) == 3 && binary.BigEndian.Uint16(opt.Value) == ProtoCHAP {
+					o["lcp.opt.algorithm"] = strconv.Itoa(int(opt.Value[2]))
+				} else if len(opt.Value) > 2 {
+					o["lcp.opt.data"] = cp.WiresharkBytes(opt.Value[2:])
+				}
+			case opt.Type == OptMagicNumber && len(opt.Value) == 4:
+				o["lcp.opt.magic_number"] = fmt.Sprintf("0x%08x", binary.BigEndian.Uint32(opt.Value))
+			case len(opt.Value) > 0:
+				o["lcp.opt.data"] = cp.WiresharkBytes(opt.Value)
+			}
+			ret.Options = append(ret.Options, o)
+		}
+	case EchoRequest, EchoReply, DiscardRequest:
+		if len(pkt.Data) < 4 {
+			ret.Malformed = "LCP packet too short for magic number"
+			break
+		}
+		ret.Magic = fmt.Sprintf("0x%08x", binary.BigEndian.Uint32(pkt.Data))
+		ret.Data = cp.WiresharkBytes(pkt.Data[4:])
+	default:
+		ret.Data = cp.WiresharkBytes(pkt.Data)
+	}
+
+	return json.Marshal(ret)
+}
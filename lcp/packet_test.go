@@ -0,0 +1,281 @@
+package lcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestOptions(t *testing.T) {
+	mru, magic := uint16(1492), uint32(0)
+	tests := []struct {
+		desc string
+		raw  []byte
+		want *Options
+	}{
+		{
+			desc: "empty",
+			raw:  nil,
+			want: &Options{},
+		},
+		{
+			desc: "everything",
+			raw: []byte{
+				1, 4, 0x05, 0xd4,
+				3, 5, 0xc2, 0x23, 5,
+				5, 6, 0, 0, 0, 0,
+				7, 2,
+				8, 2,
+			},
+			want: &Options{
+				MRU: &mru,
+				AuthProto: &AuthProto{
+					Protocol: ProtoCHAP,
+					Data:     []byte{CHAPMD5},
+				},
+				Magic: &magic,
+				PFC:   true,
+				ACFC:  true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			opts, err := ParseOptions(test.raw)
+			if err != nil {
+				t.Fatalf("parsing options: %v", err)
+			}
+			got := parseOptions(opts)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Fatalf("wrong options (-want +got)\n%s", diff)
+			}
+			if diff := cmp.Diff(test.raw, MarshalOptions(got.Options())); diff != "" {
+				t.Fatalf("wrong marshal (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWiresharkJSON(t *testing.T) {
+	tests := []struct {
+		desc string
+		pkt  *Packet
+		want string
+	}{
+		{
+			desc: "configure request",
+			pkt: &Packet{
+				Code: ConfigureRequest,
+				ID:   1,
+				Data: []byte{
+					1, 4, 0x05, 0xd4,
+					3, 5, 0xc2, 0x23, 5,
+					5, 6, 0x0a, 0xc0, 0xff, 0xee,
+					7, 2,
+					0x42, 3, 9,
+				},
+			},
+			want: `{
+  "ppp.code": "1",
+  "ppp.identifier": "1",
+  "ppp.length": "24",
+  "lcp.options": [
+    {
+      "lcp.opt.length": "4",
+      "lcp.opt.mru": "1492",
+      "lcp.opt.type": "1"
+    },
+    {
+      "lcp.opt.algorithm": "5",
+      "lcp.opt.auth_protocol": "0xc223",
+      "lcp.opt.length": "5",
+      "lcp.opt.type": "3"
+    },
+    {
+      "lcp.opt.length": "6",
+      "lcp.opt.magic_number": "0x0ac0ffee",
+      "lcp.opt.type": "5"
+    },
+    {
+      "lcp.opt.length": "2",
+      "lcp.opt.type": "7"
+    },
+    {
+      "lcp.opt.data": "09",
+      "lcp.opt.length": "3",
+      "lcp.opt.type": "66"
+    }
+  ]
+}`,
+		},
+		{
+			desc: "echo request",
+			pkt:  &Packet{Code: EchoRequest, ID: 7, Data: []byte{0, 0, 0, 0x2a, 1, 2}},
+			want: `{
+  "ppp.code": "9",
+  "ppp.identifier": "7",
+  "ppp.length": "10",
+  "ppp.magic_number": "0x0000002a",
+  "ppp.data": "01:02"
+}`,
+		},
+		{
+			desc: "terminate ack",
+			pkt:  &Packet{Code: TerminateAck, ID: 3},
+			want: `{
+  "ppp.code": "6",
+  "ppp.identifier": "3",
+  "ppp.length": "4"
+}`,
+		},
+		{
+			desc: "malformed options",
+			pkt:  &Packet{Code: ConfigureAck, ID: 2, Data: []byte{1, 4, 0x05}},
+			want: `{
+  "ppp.code": "2",
+  "ppp.identifier": "2",
+  "ppp.length": "7",
+  "_ws.malformed": "invalid length 4 for option 1 at offset 0"
+}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			b, err := WiresharkJSON(test.pkt)
+			if err != nil {
+				t.Fatalf("marshaling packet: %v", err)
+			}
+			var got bytes.Buffer
+			if err := json.Indent(&got, b, "", "  "); err != nil {
+				t.Fatalf("indenting JSON: %v", err)
+			}
+			if diff := cmp.Diff(test.want, got.String()); diff != "" {
+				t.Errorf("wrong JSON (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+// goldenHandshake is an LCP handshake, as stored in testdata/*.json.
+type goldenHandshake struct {
+	Description string
+	Packets     []struct {
+		Desc string
+		Raw  string
+		Code uint8
+		ID   uint8
+		// Options are the parsed options of Configure-* packets.
+		Options *goldenOptions
+		// Data is the data of other packets, in hex.
+		Data string
+	}
+}
+
+// goldenOptions are Options, with their values as they're written in
+// golden files.
+type goldenOptions struct {
+	MRU       *uint16 `json:"mru"`
+	AuthProto string  `json:"auth_proto"`
+	Magic     string  `json:"magic"`
+	PFC       bool    `json:"pfc"`
+	ACFC      bool    `json:"acfc"`
+}
+
+func (g *goldenOptions) options() (*Options, error) {
+	ret := &Options{MRU: g.MRU, PFC: g.PFC, ACFC: g.ACFC}
+	if g.AuthProto != "" {
+		b, err := decodeHex(g.AuthProto)
+		if err != nil {
+			return nil, err
+		}
+		ret.AuthProto = &AuthProto{Protocol: binary.BigEndian.Uint16(b), Data: b[2:]}
+	}
+	if g.Magic != "" {
+		b, err := decodeHex(g.Magic)
+		if err != nil {
+			return nil, err
+		}
+		magic := binary.BigEndian.Uint32(b)
+		ret.Magic = &magic
+	}
+	return ret, nil
+}
+
+// decodeHex decodes a hex string, ignoring whitespace.
+func decodeHex(s string) ([]byte, error) {
+	return hex.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// TestParsePacketGolden checks that the LCP handshakes in testdata/
+// parse and unparse as expected.
+func TestParsePacketGolden(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.json")
+	if err != nil {
+		t.Fatalf("listing golden files: %v", err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no golden files found in testdata/")
+	}
+
+	for _, file := range files {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading %s: %v", file, err)
+		}
+		var handshake goldenHandshake
+		if err := json.Unmarshal(bs, &handshake); err != nil {
+			t.Fatalf("decoding %s: %v", file, err)
+		}
+
+		for _, pkt := range handshake.Packets {
+			t.Run(filepath.Base(file)+"/"+pkt.Desc, func(t *testing.T) {
+				raw, err := decodeHex(pkt.Raw)
+				if err != nil {
+					t.Fatalf("decoding raw packet: %v", err)
+				}
+				got, err := ParsePacket(raw)
+				if err != nil {
+					t.Fatalf("parsing packet: %v", err)
+				}
+				if got.Code != Code(pkt.Code) || got.ID != pkt.ID {
+					t.Errorf("got %s ID %d, want %s ID %d", got.Code, got.ID, Code(pkt.Code), pkt.ID)
+				}
+
+				if pkt.Options != nil {
+					want, err := pkt.Options.options()
+					if err != nil {
+						t.Fatalf("decoding options: %v", err)
+					}
+					opts, err := ParseOptions(got.Data)
+					if err != nil {
+						t.Fatalf("parsing options: %v", err)
+					}
+					if diff := cmp.Diff(want, parseOptions(opts)); diff != "" {
+						t.Errorf("wrong options (-want +got)\n%s", diff)
+					}
+				} else {
+					want, err := decodeHex(pkt.Data)
+					if err != nil {
+						t.Fatalf("decoding data: %v", err)
+					}
+					if !bytes.Equal(want, got.Data) {
+						t.Errorf("wrong data, got %x, want %x", got.Data, want)
+					}
+				}
+
+				if diff := cmp.Diff(raw, got.Marshal()); diff != "" {
+					t.Errorf("wrong marshal (-want +got)\n%s", diff)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package ppp
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"go.universe.tf/ppp/internal/cp"
+	"go.universe.tf/ppp/ipcp"
+	"go.universe.tf/ppp/lcp"
+	"go.universe.tf/ppp/pppoe"
+)
+
+// ErrTerminated is the error of a Link that the ISP closed with an
+// LCP Terminate-Request.
+var ErrTerminated = errors.New("PPP link terminated by peer")
+
+// errLinkClosed is the error of a Link that was closed locally.
+var errLinkClosed = errors.New("PPP link closed")
+
+// linkQueueLen is how many frames a Link queues for Read. Frames that
+// arrive while the queue is full are dropped.
+const linkQueueLen = 64
+
+// Link is a PPP link on which LCP, authentication and IPCP
+// completed.
+//
+// Once the link is up, Link reads the frames that arrive on Conn, to
+// keep LCP running: it answers the ISP's Echo-Requests, so that the
+// ISP doesn't drop the link as dead, and acks its Terminate-Requests,
+// after which it closes Conn. Other frames, such as the IP packets of
+// a link without a kernel PPP unit, are returned by Read. Callers
+// must not read from Conn themselves, but may write to it.
+type Link struct {
+	// Conn is the PPPoE session that the link runs over.
+	Conn *pppoe.Conn
+	// LCP are the negotiated LCP options.
+	LCP *lcp.Negotiated
+	// IPv4 are the negotiated IPv4 addresses and DNS servers.
+	IPv4 *ipcp.Result
+	// Unit is the name of the network interface of the link's
+	// kernel PPP unit (e.g. "ppp0"), if Config.Unit was set.
+	Unit string
+
+	conn   session
+	timers lcp.Timers
+	logger cp.Logger
+
+	frames    chan []byte
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// newLink returns a Link over conn, whose LCP handling isn't started
+// yet. timers may be nil, for the defaults.
+func newLink(conn session, neg *lcp.Negotiated, v4 *ipcp.Result, timers *lcp.Timers, logger cp.Logger) *Link {
+	ret := &Link{
+		LCP:     neg,
+		IPv4:    v4,
+		conn:    conn,
+		timers:  cp.DefaultTimers,
+		logger:  logger,
+		frames:  make(chan []byte, linkQueueLen),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if timers != nil {
+		ret.timers = timers.WithDefaults()
+	}
+	return ret
+}
+
+// Read reads the next frame that Link doesn't handle itself,
+// starting with its PPP protocol field. Once the link is down, Read
+// returns why: ErrTerminated if the ISP closed the link, or the
+// error of the PPPoE session, e.g. pppoe.ErrTerminated if the
+// concentrator tore it down.
+func (l *Link) Read(b []byte) (int, error) {
+	select {
+	case frame := <-l.frames:
+		return copy(b, frame), nil
+	default:
+	}
+	select {
+	case frame := <-l.frames:
+		return copy(b, frame), nil
+	case <-l.done:
+		return 0, l.Err()
+	}
+}
+
+// Done returns a channel that's closed once the link is down, and
+// Conn closed.
+func (l *Link) Done() <-chan struct{} {
+	return l.done
+}
+
+// Err returns why the link went down, or nil if it's still up.
+func (l *Link) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *Link) setErr(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err == nil {
+		l.err = err
+	}
+}
+
+// Close closes the link. It sends the ISP LCP Terminate-Requests,
+// waits for a Terminate-Ack as long as LCP's restart timer and
+// counter allow, then closes Conn.
+func (l *Link) Close() error {
+	first := false
+	l.closeOnce.Do(func() {
+		first = true
+		close(l.closing)
+	})
+	if !first {
+		<-l.done
+		return nil
+	}
+
+	for i := 0; i < l.timers.MaxTerminate; i++ {
+		select {
+		case <-l.done:
+			return nil
+		default:
+		}
+		pkt := &lcp.Packet{Code: lcp.TerminateRequest, ID: uint8(i + 1)}
+		if err := l.conn.WriteProtocol(lcp.Protocol, pkt.Marshal()); err != nil {
+			break
+		}
+		t := time.NewTimer(l.timers.Restart)
+		select {
+		case <-l.done:
+			t.Stop()
+			return nil
+		case <-t.C:
+		}
+	}
+	cp.Log(l.logger, "no Terminate-Ack from peer, closing PPP link")
+	l.setErr(errLinkClosed)
+	l.conn.Close()
+	<-l.done
+	return nil
+}
+
+// run reads the frames that arrive on the link until it goes down,
+// handling LCP and queuing the other frames for Read.
+func (l *Link) run() {
+	defer close(l.done)
+	defer l.conn.Close()
+
+	b := make([]byte, 1<<16)
+	for {
+		n, err := l.conn.Read(b)
+		if err != nil {
+			select {
+			case <-l.closing:
+				l.setErr(errLinkClosed)
+			default:
+				cp.Log(l.logger, "PPP session failed, closing PPP link", "error", err)
+				l.setErr(err)
+			}
+			return
+		}
+		if n < 2 {
+			continue
+		}
+		if binary.BigEndian.Uint16(b) != lcp.Protocol {
+			select {
+			case l.frames <- append([]byte(nil), b[:n]...):
+			default:
+			}
+			continue
+		}
+		pkt, err := lcp.ParsePacket(b[2:n])
+		if err != nil {
+			continue
+		}
+		if l.handleLCP(pkt) {
+			return
+		}
+	}
+}
+
+// handleLCP handles an LCP packet from the ISP, and returns whether
+// the link is now down.
+func (l *Link) handleLCP(pkt *lcp.Packet) bool {
+	switch pkt.Code {
+	case lcp.EchoRequest:
+		if len(pkt.Data) < 4 {
+			return false
+		}
+		data := append([]byte(nil), pkt.Data...)
+		var magic uint32
+		if l.LCP.Local.Magic != nil {
+			magic = *l.LCP.Local.Magic
+		}
+		binary.BigEndian.PutUint32(data, magic)
+		reply := &lcp.Packet{Code: lcp.EchoReply, ID: pkt.ID, Data: data}
+		if err := l.conn.WriteProtocol(lcp.Protocol, reply.Marshal()); err != nil {
+			cp.Log(l.logger, "sending LCP Echo-Reply failed", "error", err)
+		}
+		return false
+	case lcp.TerminateRequest:
+		ack := &lcp.Packet{Code: lcp.TerminateAck, ID: pkt.ID}
+		l.conn.WriteProtocol(lcp.Protocol, ack.Marshal())
+		cp.Log(l.logger, "peer terminated PPP link")
+		l.setErr(ErrTerminated)
+		return true
+	case lcp.TerminateAck:
+		select {
+		case <-l.closing:
+			cp.Log(l.logger, "peer acked Terminate-Request, closing PPP link")
+			l.setErr(errLinkClosed)
+			return true
+		default:
+			return false
+		}
+	case lcp.ConfigureRequest:
+		// The peer restarted LCP. Renegotiating would also mean
+		// redoing authentication and IPCP, which Dial's callers
+		// aren't prepared for, so the link is over.
+		cp.Log(l.logger, "peer restarted LCP negotiation, closing PPP link")
+		l.setErr(errors.New("peer restarted LCP negotiation"))
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,186 @@
+// Package ppp brings up PPP links to ISPs over PPPoE, from discovery
+// to IPv4 addresses. The packages it builds on, pppoe, lcp and ipcp,
+// can also be used on their own, for finer control.
+package ppp // import "go.universe.tf/ppp"
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"go.universe.tf/ppp/internal/auth"
+	"go.universe.tf/ppp/ipcp"
+	"go.universe.tf/ppp/lcp"
+	"go.universe.tf/ppp/pppoe"
+)
+
+// Config is the configuration of a PPP link.
+type Config struct {
+	// PPPoE configures the PPPoE session that the link runs over. It
+	// may be nil.
+	PPPoE *pppoe.Config
+	// LCP are the LCP options to request for our side of the link.
+	// If it's nil, or leaves MRU unset, the MRU requested is the
+	// session's MaxPayload, if that's less than the default of 1500.
+	LCP *lcp.Options
+	// Name and Secret are the credentials to authenticate with, if
+	// the ISP asks for authentication.
+	Name, Secret string
+	// IPv4 is the IPv4 address to request. If it's nil, the ISP is
+	// asked to assign one.
+	IPv4 net.IP
+	// Unit, if true, hands the link to a kernel PPP unit once it's
+	// up, and configures the unit's network interface with the MRU,
+	// MTU and addresses that were negotiated, and an IPv4 default
+	// route. The host's IP traffic then flows over the link. This
+	// requires a kernel PPPoE session and CAP_NET_ADMIN. Otherwise,
+	// IP packets are read and written as PPP frames on the Link's
+	// Conn.
+	Unit bool
+	// Logger, if not nil, receives events from every layer of the
+	// link as it comes up: PPPoE, LCP, authentication and IPCP.
+	// PPPoE.Logger and LCP.Logger, if set, take precedence for their
+	// layers.
+	Logger pppoe.Logger
+}
+
+// Dial brings up a PPP link over PPPoE on the network interface
+// ifName: it runs PPPoE discovery, LCP, authentication and IPCP, in
+// that order. cfg may be nil. If any step fails, the PPPoE session is
+// closed and Dial returns the step's error.
+//
+// Once Dial returns, the Link keeps LCP running in the background: it
+// answers the peer's Echo-Requests, and goes down when either side
+// terminates LCP. Link.Close terminates LCP and closes the session.
+func Dial(ctx context.Context, ifName string, cfg *Config) (*Link, error) {
+	return dialPPPoE(ctx, cfg, func(pppoeCfg *pppoe.Config) (*pppoe.Conn, error) {
+		return pppoe.New(ctx, ifName, pppoeCfg)
+	})
+}
+
+// DialAuto is like Dial, but sets up the PPPoE session with
+// pppoe.NewAuto, on the first interface matching pattern that a
+// concentrator answers on.
+func DialAuto(ctx context.Context, pattern string, cfg *Config) (*Link, error) {
+	return dialPPPoE(ctx, cfg, func(pppoeCfg *pppoe.Config) (*pppoe.Conn, error) {
+		return pppoe.NewAuto(ctx, pattern, pppoeCfg)
+	})
+}
+
+// DialAny is like Dial, but sets up the PPPoE session with
+// pppoe.NewAny, on whichever of ifNames gets a session first.
+func DialAny(ctx context.Context, ifNames []string, cfg *Config) (*Link, error) {
+	return dialPPPoE(ctx, cfg, func(pppoeCfg *pppoe.Config) (*pppoe.Conn, error) {
+		return pppoe.NewAny(ctx, ifNames, pppoeCfg)
+	})
+}
+
+// dialPPPoE sets up a PPPoE session with newSession, and brings up a
+// PPP link over it.
+func dialPPPoE(ctx context.Context, cfg *Config, newSession func(*pppoe.Config) (*pppoe.Conn, error)) (*Link, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	pppoeCfg := cfg.PPPoE
+	if cfg.Logger != nil && (pppoeCfg == nil || pppoeCfg.Logger == nil) {
+		pppoeCfg = &pppoe.Config{}
+		if cfg.PPPoE != nil {
+			*pppoeCfg = *cfg.PPPoE
+		}
+		pppoeCfg.Logger = cfg.Logger
+	}
+	conn, err := newSession(pppoeCfg)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := dial(ctx, conn, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ret.Conn = conn
+	return ret, nil
+}
+
+// session is the part of *pppoe.Conn that dial and Link use.
+type session interface {
+	lcp.Conn
+	MaxPayload() int
+	NewUnit() (string, error)
+	SetUnitMRU(mru int) error
+	SetUnitMTU(mtu int) error
+	SetUnitIPv4(local, peer net.IP) error
+	AddUnitRoute(dst *net.IPNet) error
+	Close() error
+}
+
+// defaultMRU is the MRU of PPP links that didn't negotiate one.
+const defaultMRU = 1500
+
+// dial runs the PPP negotiations of Dial on conn, and starts the
+// returned Link's LCP handling once they succeed.
+func dial(ctx context.Context, conn session, cfg *Config) (*Link, error) {
+	var desired lcp.Options
+	if cfg.LCP != nil {
+		desired = *cfg.LCP
+	}
+	if desired.Logger == nil && cfg.Logger != nil {
+		desired.Logger = cfg.Logger
+	}
+	if desired.MRU == nil && conn.MaxPayload() < defaultMRU {
+		mru := uint16(conn.MaxPayload())
+		desired.MRU = &mru
+	}
+	neg, err := lcp.Negotiate(ctx, conn, &desired)
+	if err != nil {
+		return nil, fmt.Errorf("negotiating LCP: %v", err)
+	}
+	if err := auth.Authenticate(ctx, conn, neg.Peer.AuthProto, cfg.Name, cfg.Secret, cfg.Logger); err != nil {
+		return nil, fmt.Errorf("authenticating: %v", err)
+	}
+	v4, err := ipcp.Negotiate(ctx, conn, cfg.IPv4, cfg.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("negotiating IPCP: %v", err)
+	}
+	ret := newLink(conn, neg, v4, desired.Timers, desired.Logger)
+	if cfg.Unit {
+		if err := setupUnit(ret, conn); err != nil {
+			return nil, err
+		}
+	}
+	go ret.run()
+	return ret, nil
+}
+
+// setupUnit hands the link to a kernel PPP unit, and configures the
+// unit's network interface.
+func setupUnit(ret *Link, conn session) error {
+	neg, v4 := ret.LCP, ret.IPv4
+	var err error
+	if ret.Unit, err = conn.NewUnit(); err != nil {
+		return fmt.Errorf("creating PPP unit: %v", err)
+	}
+	mru, mtu := defaultMRU, defaultMRU
+	if neg.Local.MRU != nil {
+		mru = int(*neg.Local.MRU)
+	}
+	if neg.Peer.MRU != nil {
+		mtu = int(*neg.Peer.MRU)
+	}
+	if mtu > conn.MaxPayload() {
+		mtu = conn.MaxPayload()
+	}
+	if err := conn.SetUnitMRU(mru); err != nil {
+		return fmt.Errorf("setting MRU of %s: %v", ret.Unit, err)
+	}
+	if err := conn.SetUnitMTU(mtu); err != nil {
+		return fmt.Errorf("setting MTU of %s: %v", ret.Unit, err)
+	}
+	if err := conn.SetUnitIPv4(v4.Local, v4.Peer); err != nil {
+		return fmt.Errorf("setting IPv4 address of %s: %v", ret.Unit, err)
+	}
+	if err := conn.AddUnitRoute(nil); err != nil {
+		return fmt.Errorf("adding default route via %s: %v", ret.Unit, err)
+	}
+	return nil
+}
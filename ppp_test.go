@@ -0,0 +1,456 @@
+package ppp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"go.universe.tf/ppp/internal/cp"
+	"go.universe.tf/ppp/internal/testutil"
+	"go.universe.tf/ppp/ipcp"
+	"go.universe.tf/ppp/lcp"
+)
+
+// fakeConn is one end of an in-memory PPP link.
+type fakeConn struct {
+	in   chan []byte
+	peer *fakeConn
+
+	mu              sync.Mutex
+	deadline        time.Time
+	deadlineChanged chan struct{}
+	closed          chan struct{}
+	closeOnce       sync.Once
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		in:              make(chan []byte, 100),
+		deadlineChanged: make(chan struct{}),
+		closed:          make(chan struct{}),
+	}
+}
+
+// newFakeLink returns the two ends of an in-memory PPP link.
+func newFakeLink() (*fakeConn, *fakeConn) {
+	a, b := newFakeConn(), newFakeConn()
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+type fakeTimeoutError struct{}
+
+func (fakeTimeoutError) Error() string { return "i/o timeout" }
+func (fakeTimeoutError) Timeout() bool { return true }
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.deadline, c.deadlineChanged
+		c.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, fakeTimeoutError{}
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case frame := <-c.in:
+			return copy(b, frame), nil
+		case <-timeout:
+			return 0, fakeTimeoutError{}
+		case <-changed:
+		case <-c.closed:
+			return 0, errors.New("use of closed connection")
+		}
+	}
+}
+
+func (c *fakeConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeConn) WriteProtocol(proto uint16, payload []byte) error {
+	frame := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(frame, proto)
+	copy(frame[2:], payload)
+	c.peer.in <- frame
+	return nil
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// fakeSession is a session over a fakeConn, which records the PPP
+// unit calls that it gets.
+type fakeSession struct {
+	*fakeConn
+	failUnit bool
+	calls    []string
+}
+
+func (s *fakeSession) MaxPayload() int { return 1492 }
+
+func (s *fakeSession) NewUnit() (string, error) {
+	s.calls = append(s.calls, "NewUnit")
+	if s.failUnit {
+		return "", errors.New("no /dev/ppp")
+	}
+	return "ppp0", nil
+}
+
+func (s *fakeSession) SetUnitMRU(mru int) error {
+	s.calls = append(s.calls, fmt.Sprintf("SetUnitMRU %d", mru))
+	return nil
+}
+
+func (s *fakeSession) SetUnitMTU(mtu int) error {
+	s.calls = append(s.calls, fmt.Sprintf("SetUnitMTU %d", mtu))
+	return nil
+}
+
+func (s *fakeSession) SetUnitIPv4(local, peer net.IP) error {
+	s.calls = append(s.calls, fmt.Sprintf("SetUnitIPv4 %v %v", local, peer))
+	return nil
+}
+
+func (s *fakeSession) AddUnitRoute(dst *net.IPNet) error {
+	s.calls = append(s.calls, fmt.Sprintf("AddUnitRoute %v", dst))
+	return nil
+}
+
+// runISP runs LCP and IPCP on conn as an ISP would, with peerMRU as
+// its MRU, and address as its IPv4 address.
+func runISP(ctx context.Context, conn *fakeConn, peerMRU uint16, address net.IP) <-chan error {
+	ret := make(chan error, 1)
+	go func() {
+		if _, err := lcp.Negotiate(ctx, conn, &lcp.Options{MRU: &peerMRU}); err != nil {
+			ret <- fmt.Errorf("ISP LCP: %v", err)
+			return
+		}
+		if _, err := ipcp.Negotiate(ctx, conn, address, nil); err != nil {
+			ret <- fmt.Errorf("ISP IPCP: %v", err)
+			return
+		}
+		ret <- nil
+	}()
+	return ret
+}
+
+func TestDial(t *testing.T) {
+	tests := []struct {
+		desc      string
+		cfg       *Config
+		failUnit  bool
+		wantCalls []string
+		wantErr   bool
+	}{
+		{
+			desc: "userspace",
+			cfg:  &Config{IPv4: net.IP{100, 64, 0, 2}},
+		},
+		{
+			desc: "unit",
+			cfg:  &Config{IPv4: net.IP{100, 64, 0, 2}, Unit: true},
+			wantCalls: []string{
+				"NewUnit",
+				"SetUnitMRU 1492",
+				"SetUnitMTU 1480",
+				"SetUnitIPv4 100.64.0.2 100.64.0.1",
+				"AddUnitRoute <nil>",
+			},
+		},
+		{
+			desc:      "unit failure",
+			cfg:       &Config{IPv4: net.IP{100, 64, 0, 2}, Unit: true},
+			failUnit:  true,
+			wantCalls: []string{"NewUnit"},
+			wantErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+
+			ours, theirs := newFakeLink()
+			isp := runISP(ctx, theirs, 1480, net.IP{100, 64, 0, 1})
+			sess := &fakeSession{fakeConn: ours, failUnit: test.failUnit}
+			defer sess.Close()
+			link, err := dial(ctx, sess, test.cfg)
+			if ispErr := <-isp; ispErr != nil {
+				t.Fatal(ispErr)
+			}
+			if diff := cmp.Diff(test.wantCalls, sess.calls); diff != "" {
+				t.Errorf("wrong PPP unit calls (-want +got)\n%s", diff)
+			}
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("dial succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dial failed: %v", err)
+			}
+
+			if got, want := *link.LCP.Local.MRU, uint16(1492); got != want {
+				t.Errorf("negotiated MRU %d, want %d", got, want)
+			}
+			if got, want := link.IPv4.Local, (net.IP{100, 64, 0, 2}); !got.Equal(want) {
+				t.Errorf("local address %v, want %v", got, want)
+			}
+			if got, want := link.IPv4.Peer, (net.IP{100, 64, 0, 1}); !got.Equal(want) {
+				t.Errorf("peer address %v, want %v", got, want)
+			}
+			wantUnit := ""
+			if test.cfg.Unit {
+				wantUnit = "ppp0"
+			}
+			if link.Unit != wantUnit {
+				t.Errorf("unit %q, want %q", link.Unit, wantUnit)
+			}
+		})
+	}
+}
+
+// logRecorder is a logger that records the messages it gets.
+type logRecorder struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (r *logRecorder) Log(msg string, keyvals ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, msg)
+}
+
+func TestDialLogger(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	ours, theirs := newFakeLink()
+	isp := runISP(ctx, theirs, 1480, net.IP{100, 64, 0, 1})
+	var logs logRecorder
+	cfg := &Config{IPv4: net.IP{100, 64, 0, 2}, Logger: &logs}
+	defer ours.Close()
+	if _, err := dial(ctx, &fakeSession{fakeConn: ours}, cfg); err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	if err := <-isp; err != nil {
+		t.Fatal(err)
+	}
+
+	// Every layer logs its packets and outcome.
+	var got []string
+	seen := map[string]bool{}
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	for _, msg := range logs.msgs {
+		if !seen[msg] {
+			seen[msg] = true
+			got = append(got, msg)
+		}
+	}
+	want := []string{
+		"sent LCP packet",
+		"received LCP packet",
+		"LCP opened",
+		"peer didn't ask for authentication",
+		"sent IPCP packet",
+		"received IPCP packet",
+		"IPCP opened",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong log messages (-want +got)\n%s", diff)
+	}
+}
+
+// acSession is a session with a testutil.FakeAC, which carries PPP
+// frames in PPPoE session packets, as a userspace pppoe.Conn does.
+type acSession struct {
+	ac   *testutil.FakeAC
+	conn net.PacketConn
+}
+
+func newACSession(ac *testutil.FakeAC) *acSession {
+	return &acSession{ac: ac, conn: ac.Session()}
+}
+
+func (s *acSession) Read(b []byte) (int, error) {
+	var pkt [1500]byte
+	for {
+		n, _, err := s.conn.ReadFrom(pkt[:])
+		if err != nil {
+			return 0, err
+		}
+		if n < 6 || binary.BigEndian.Uint16(pkt[2:4]) != s.ac.SessionID {
+			continue
+		}
+		l := int(binary.BigEndian.Uint16(pkt[4:6]))
+		if l > n-6 {
+			continue
+		}
+		return copy(b, pkt[6:6+l]), nil
+	}
+}
+
+func (s *acSession) WriteProtocol(proto uint16, payload []byte) error {
+	pkt := make([]byte, 8, 8+len(payload))
+	pkt[0] = 0x11
+	binary.BigEndian.PutUint16(pkt[2:4], s.ac.SessionID)
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(2+len(payload)))
+	binary.BigEndian.PutUint16(pkt[6:8], proto)
+	_, err := s.conn.WriteTo(append(pkt, payload...), nil)
+	return err
+}
+
+func (s *acSession) SetReadDeadline(t time.Time) error { return s.conn.SetReadDeadline(t) }
+func (s *acSession) MaxPayload() int                   { return 1492 }
+func (s *acSession) Close() error                      { return s.conn.Close() }
+
+func (s *acSession) NewUnit() (string, error)             { return "", errors.New("no PPP units") }
+func (s *acSession) SetUnitMRU(int) error                 { return errors.New("no PPP units") }
+func (s *acSession) SetUnitMTU(int) error                 { return errors.New("no PPP units") }
+func (s *acSession) SetUnitIPv4(local, peer net.IP) error { return errors.New("no PPP units") }
+func (s *acSession) AddUnitRoute(*net.IPNet) error        { return errors.New("no PPP units") }
+
+// waitFor polls cond until it's true, or fails the test after 5s.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// dialFakeAC brings up a Link with ac.
+func dialFakeAC(t *testing.T, ac *testutil.FakeAC) *Link {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	link, err := dial(ctx, newACSession(ac), &Config{})
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	if !link.IPv4.Local.Equal(ac.ClientIPv4) {
+		t.Errorf("local address %v, want %v", link.IPv4.Local, ac.ClientIPv4)
+	}
+	if !ac.LCPOpened() || !ac.IPCPOpened() {
+		t.Errorf("concentrator didn't see the link open: LCP %v, IPCP %v", ac.LCPOpened(), ac.IPCPOpened())
+	}
+	return link
+}
+
+// TestLinkKeepalive checks that a Link keeps LCP running once Dial
+// returns: that it answers the concentrator's Echo-Requests, passes
+// other frames to Read, and goes down on the concentrator's
+// Terminate-Request.
+func TestLinkKeepalive(t *testing.T) {
+	ac := testutil.NewFakeAC()
+	defer ac.Close()
+	link := dialFakeAC(t, ac)
+
+	for id := uint8(1); id <= 3; id++ {
+		ac.SendEchoRequest(id)
+	}
+	waitFor(t, "Echo-Replies", func() bool { return len(ac.EchoReplies()) == 3 })
+	if diff := cmp.Diff([]uint8{1, 2, 3}, ac.EchoReplies()); diff != "" {
+		t.Errorf("wrong Echo-Replies (-want +got)\n%s", diff)
+	}
+
+	frame := []byte{0x00, 0x21, 0x45, 0, 0, 20}
+	ac.SendFrame(frame)
+	b := make([]byte, 1500)
+	n, err := link.Read(b)
+	if err != nil {
+		t.Fatalf("reading from link: %v", err)
+	}
+	if diff := cmp.Diff(frame, b[:n]); diff != "" {
+		t.Errorf("wrong frame read (-want +got)\n%s", diff)
+	}
+
+	ac.SendTerminateRequest()
+	select {
+	case <-link.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("link still up after Terminate-Request")
+	}
+	if err := link.Err(); err != ErrTerminated {
+		t.Errorf("link went down with %v, want %v", err, ErrTerminated)
+	}
+	if !ac.LCPTerminateAcked() {
+		t.Error("concentrator's Terminate-Request wasn't acked")
+	}
+	if _, err := link.Read(b); err != ErrTerminated {
+		t.Errorf("Read after termination returned %v, want %v", err, ErrTerminated)
+	}
+	if err := link.Close(); err != nil {
+		t.Errorf("closing terminated link: %v", err)
+	}
+}
+
+// TestLinkClose checks that closing a Link terminates LCP before
+// closing the session.
+func TestLinkClose(t *testing.T) {
+	ac := testutil.NewFakeAC()
+	defer ac.Close()
+	link := dialFakeAC(t, ac)
+
+	// The concentrator acks our Terminate-Request straight away, so
+	// Close doesn't have to wait for LCP's restart timer.
+	start := time.Now()
+	if err := link.Close(); err != nil {
+		t.Fatalf("closing link: %v", err)
+	}
+	if d := time.Since(start); d >= cp.DefaultTimers.Restart {
+		t.Errorf("Close took %v, want less than the restart timer", d)
+	}
+	if ac.LCPOpened() {
+		t.Error("concentrator's LCP still open after Close")
+	}
+	select {
+	case <-link.Done():
+	default:
+		t.Error("link not done after Close")
+	}
+	if _, err := ac.Session().WriteTo([]byte{0x11}, nil); err == nil {
+		t.Error("session still open after Close")
+	}
+}
+
+// TestDialInterfaceChoiceErrors checks that DialAuto and DialAny
+// return the errors of choosing an interface.
+func TestDialInterfaceChoiceErrors(t *testing.T) {
+	ctx := context.Background()
+	if _, err := DialAuto(ctx, "[", nil); err == nil {
+		t.Error("DialAuto with a malformed pattern succeeded")
+	}
+	if _, err := DialAny(ctx, nil, nil); err == nil {
+		t.Error("DialAny with no interfaces succeeded")
+	}
+}
@@ -0,0 +1,250 @@
+package pppoe
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// NewAuto is like New, but picks the network interface itself, for
+// devices that don't know in advance which port faces the ISP.
+//
+// Candidate interfaces are those that are up, have an Ethernet
+// address, aren't loopbacks, don't carry a default route, and match
+// pattern (in path.Match syntax; an empty pattern matches every
+// name). NewAuto sends a PADI on every candidate, on the VLAN and from
+// the Ethernet address that cfg asks for, like New would, and runs
+// New on the first one to get a PADO back. The probes are retried
+// following cfg.Discovery.PADI, except that its Jitter applies to
+// every interface at once. cfg may be nil.
+func NewAuto(ctx context.Context, pattern string, cfg *Config) (*Conn, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	candidates := autoCandidates(intfs, defaultRouteInterfaces(), pattern)
+	if len(candidates) == 0 {
+		return nil, errors.New("no candidate interfaces for PPPoE")
+	}
+
+	ifName, err := autoProbe(ctx, candidates, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return New(ctx, ifName, cfg)
+}
+
+// autoProbe probes candidates until one gets a PADO, retrying as
+// cfg.Discovery.PADI says, and returns its name.
+func autoProbe(ctx context.Context, candidates []string, cfg *Config) (string, error) {
+	retry := cfg.discovery().PADI
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if retry.Attempts > 0 && attempt == retry.Attempts {
+			return "", fmt.Errorf("no PADO on any interface after %d PADIs", attempt)
+		}
+
+		ifName, err := probeInterfaces(ctx, candidates, cfg, retry.timeout(attempt))
+		if err != nil {
+			return "", err
+		}
+		if ifName != "" {
+			return ifName, nil
+		}
+	}
+}
+
+// NewAny is like New, but runs PPPoE discovery on all of ifNames
+// concurrently, and returns a Conn for the first one to get a session
+// (a PADS). Discovery on the other interfaces is canceled, and
+// sessions that they set up meanwhile are torn down. If discovery
+// fails on every interface, NewAny returns one of the errors. cfg may
+// be nil.
+//
+// Unlike NewAuto, NewAny goes through full discovery on each
+// interface, so it also picks between ports that all face a
+// concentrator, but not all of which offer cfg's Service-Name.
+func NewAny(ctx context.Context, ifNames []string, cfg *Config) (*Conn, error) {
+	if len(ifNames) == 0 {
+		return nil, errors.New("no interfaces to run PPPoE discovery on")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	results := make(chan result, len(ifNames))
+	for _, ifName := range ifNames {
+		go func(ifName string) {
+			conn, err := anyNew(ctx, ifName, cfg)
+			results <- result{conn, err}
+		}(ifName)
+	}
+
+	// Wait for every interface, so that no discovery outlives
+	// NewAny, and no losing session is left up.
+	var (
+		ret     *Conn
+		lastErr error
+	)
+	for range ifNames {
+		res := <-results
+		switch {
+		case res.err != nil:
+			lastErr = res.err
+		case ret == nil:
+			ret = res.conn
+			cancel()
+		default:
+			res.conn.Close()
+		}
+	}
+	if ret == nil {
+		return nil, lastErr
+	}
+	return ret, nil
+}
+
+// anyNew is New, as a variable so that tests can fake discovery for
+// NewAny.
+var anyNew = New
+
+// probeInterfaces sends a PADI for cfg's Service-Name on each of
+// ifNames concurrently, and returns the first one that gets a PADO
+// back within timeout, or "" if none do. If probing failed
+// outright on every interface, it returns one of the errors.
+func probeInterfaces(ctx context.Context, ifNames []string, cfg *Config, timeout time.Duration) (ifName string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		ifName string
+		err    error
+	}
+	results := make(chan result, len(ifNames))
+	for _, ifName := range ifNames {
+		go func(ifName string) {
+			results <- result{ifName, probeInterface(ctx, ifName, cfg)}
+		}(ifName)
+	}
+
+	var (
+		timedOut bool
+		lastErr  error
+	)
+	for range ifNames {
+		res := <-results
+		switch {
+		case res.err == nil:
+			return res.ifName, nil
+		case isTimeout(res.err):
+			timedOut = true
+		default:
+			lastErr = res.err
+		}
+	}
+	if timedOut {
+		return "", nil
+	}
+	return "", lastErr
+}
+
+// probeInterface sends a PADI for cfg's Service-Name on ifName, and
+// waits for a PADO in response. It returns nil if a PADO arrived. The
+// PADI goes out the way New would send it, on the VLAN and from the
+// Ethernet address that cfg asks for, since concentrators may only
+// answer those.
+func probeInterface(ctx context.Context, ifName string, cfg *Config) error {
+	ifName, links, err := setupLinks(ifName, cfg)
+	if err != nil {
+		return err
+	}
+	defer teardownLinks(links)
+	conn, err := setupDiscoveryConn(ifName)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	hostUniq := newHostUniq(cfg)
+	if err := sendPADI(conn, cfg.serviceName(), hostUniq, cfg.maxPayload()); err != nil {
+		return err
+	}
+	_, err = readPADO(ctx, conn, cfg.serviceName(), hostUniq)
+	return err
+}
+
+// autoCandidates returns the names of the interfaces in intfs that
+// NewAuto should probe. routed is the set of interfaces that carry a
+// default route.
+func autoCandidates(intfs []net.Interface, routed map[string]bool, pattern string) []string {
+	var ret []string
+	for _, intf := range intfs {
+		if intf.Flags&net.FlagUp == 0 || intf.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if len(intf.HardwareAddr) != 6 {
+			continue
+		}
+		if routed[intf.Name] {
+			// Already has working upstream connectivity, so it's
+			// unlikely to be the PPPoE uplink.
+			continue
+		}
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, intf.Name); !ok {
+				continue
+			}
+		}
+		ret = append(ret, intf.Name)
+	}
+	return ret
+}
+
+// defaultRouteInterfaces returns the set of interfaces that carry an
+// IPv4 default route, according to the kernel. On systems without
+// /proc/net/route, it returns an empty set.
+func defaultRouteInterfaces() map[string]bool {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return map[string]bool{}
+	}
+	defer f.Close()
+	return parseDefaultRoutes(f)
+}
+
+// parseDefaultRoutes parses a /proc/net/route table, and returns the
+// set of interfaces that carry a default route.
+func parseDefaultRoutes(r io.Reader) map[string]bool {
+	ret := map[string]bool{}
+	s := bufio.NewScanner(r)
+	// Skip the header line.
+	s.Scan()
+	for s.Scan() {
+		// Fields are: Iface Destination Gateway Flags RefCnt Use
+		// Metric Mask MTU Window IRTT
+		fs := strings.Fields(s.Text())
+		if len(fs) < 8 {
+			continue
+		}
+		if fs[1] == "00000000" && fs[7] == "00000000" {
+			ret[fs[0]] = true
+		}
+	}
+	return ret
+}
@@ -0,0 +1,176 @@
+package pppoe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/raw"
+)
+
+func TestParseDefaultRoutes(t *testing.T) {
+	table := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0101A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0001A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+eth1	0000000A	00000000	0001	0	0	0	000000FF	0	0	0
+wlan0	00000000	0100000A	0003	0	0	600	00000000	0	0	0
+`
+	want := map[string]bool{
+		"eth0":  true,
+		"wlan0": true,
+	}
+	got := parseDefaultRoutes(strings.NewReader(table))
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("wrong default route interfaces: (-want +got)\n%s", diff)
+	}
+}
+
+func TestAutoCandidates(t *testing.T) {
+	mac := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	intfs := []net.Interface{
+		{Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+		{Name: "eth0", Flags: net.FlagUp, HardwareAddr: mac},
+		{Name: "eth1", Flags: net.FlagUp, HardwareAddr: mac},
+		{Name: "eth2", HardwareAddr: mac},
+		{Name: "wan0", Flags: net.FlagUp, HardwareAddr: mac},
+		{Name: "tun0", Flags: net.FlagUp},
+	}
+	routed := map[string]bool{"eth0": true}
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"", []string{"eth1", "wan0"}},
+		{"eth*", []string{"eth1"}},
+		{"wan[0-9]", []string{"wan0"}},
+		{"nope*", nil},
+	}
+	for _, test := range tests {
+		got := autoCandidates(intfs, routed, test.pattern)
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("wrong candidates for pattern %q: (-want +got)\n%s", test.pattern, diff)
+		}
+	}
+}
+
+func TestProbeInterfaceLinks(t *testing.T) {
+	origVLAN, origMACVLAN, origTeardown, origDiscoveryConn := setupVLAN, setupMACVLAN, teardownLink, setupDiscoveryConn
+	defer func() {
+		setupVLAN, setupMACVLAN, teardownLink, setupDiscoveryConn = origVLAN, origMACVLAN, origTeardown, origDiscoveryConn
+	}()
+
+	var calls []string
+	setupVLAN = func(parent string, id, priority int) (string, bool, error) {
+		name := fmt.Sprintf("%s.%d", parent, id)
+		calls = append(calls, "create "+name)
+		return name, true, nil
+	}
+	setupMACVLAN = func(parent string, addr net.HardwareAddr) (string, bool, error) {
+		name := fmt.Sprintf("%s/%s", parent, addr)
+		calls = append(calls, "create "+name)
+		return name, true, nil
+	}
+	teardownLink = func(name string) error {
+		calls = append(calls, "delete "+name)
+		return nil
+	}
+	hostUniq := []byte{1, 2, 3}
+	conn := newFakeConn()
+	ac := &raw.Addr{HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 2}}
+	conn.In <- fakePacket{NewPADO().WithServiceName("").WithACName("ac").WithHostUniq(hostUniq).Bytes(), ac, nil}
+	setupDiscoveryConn = func(ifName string) (net.PacketConn, error) {
+		calls = append(calls, "probe "+ifName)
+		return conn, nil
+	}
+
+	cfg := &Config{
+		VLANID:       7,
+		HardwareAddr: net.HardwareAddr{2, 0, 0, 0x0a, 0x0b, 0x0c},
+		HostUniq:     hostUniq,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := probeInterface(ctx, "eth0", cfg); err != nil {
+		t.Fatalf("probing eth0: %v", err)
+	}
+	want := []string{
+		"create eth0.7",
+		"create eth0.7/02:00:00:0a:0b:0c",
+		"probe eth0.7/02:00:00:0a:0b:0c",
+		"delete eth0.7/02:00:00:0a:0b:0c",
+		"delete eth0.7",
+	}
+	if diff := cmp.Diff(want, calls); diff != "" {
+		t.Errorf("wrong probe setup (-want +got)\n%s", diff)
+	}
+
+	calls = nil
+	cfg.VLANID = 5000
+	if err := probeInterface(ctx, "eth0", cfg); err == nil {
+		t.Error("probing with an invalid VLAN ID succeeded")
+	}
+	if len(calls) != 0 {
+		t.Errorf("probing with an invalid VLAN ID touched interfaces: %v", calls)
+	}
+}
+
+func TestAutoProbeRetry(t *testing.T) {
+	origDiscoveryConn := setupDiscoveryConn
+	defer func() { setupDiscoveryConn = origDiscoveryConn }()
+
+	hostUniq := []byte{1, 2, 3}
+	ac := &raw.Addr{HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 2}}
+	var (
+		mu     sync.Mutex
+		probes map[string]int
+		// answer is the interface that gets a PADO on its second
+		// probe, or "" if none do.
+		answer string
+	)
+	setupDiscoveryConn = func(ifName string) (net.PacketConn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		probes[ifName]++
+		conn := newFakeConn()
+		if ifName == answer && probes[ifName] == 2 {
+			conn.In <- fakePacket{NewPADO().WithServiceName("").WithACName("ac").WithHostUniq(hostUniq).Bytes(), ac, nil}
+		}
+		return conn, nil
+	}
+
+	cfg := &Config{
+		HostUniq: hostUniq,
+		Discovery: DiscoveryConfig{
+			PADI: DiscoveryRetry{Timeout: 10 * time.Millisecond, Attempts: 3},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	probes = map[string]int{}
+	start := time.Now()
+	if _, err := autoProbe(ctx, []string{"eth0", "eth1"}, cfg); err == nil {
+		t.Fatal("probing silent interfaces succeeded")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("probing took %v, want about 30ms", d)
+	}
+	if diff := cmp.Diff(map[string]int{"eth0": 3, "eth1": 3}, probes); diff != "" {
+		t.Errorf("wrong probe counts (-want +got)\n%s", diff)
+	}
+
+	probes, answer = map[string]int{}, "eth1"
+	ifName, err := autoProbe(ctx, []string{"eth0", "eth1"}, cfg)
+	if err != nil {
+		t.Fatalf("probing: %v", err)
+	}
+	if ifName != "eth1" {
+		t.Errorf("probing picked %q, want eth1", ifName)
+	}
+}
@@ -0,0 +1,101 @@
+package pppoe
+
+// PacketBuilder builds PPPoE Discovery packets, for tests and tools
+// that need to craft them by hand.
+//
+// Tags are encoded in the order they're added, and no tags are added
+// implicitly: RFC 2516 requires a Service-Name tag in PADI, PADO, PADR
+// and PADS packets, but it's up to the caller to add one. This makes
+// it possible to build invalid packets on purpose.
+type PacketBuilder struct {
+	code      int
+	sessionID uint16
+	tags      []discoveryTag
+}
+
+// NewPADI returns a builder for a PPPoE Active Discovery Initiation
+// packet.
+func NewPADI() *PacketBuilder { return &PacketBuilder{code: pppoePADI} }
+
+// NewPADO returns a builder for a PPPoE Active Discovery Offer packet.
+func NewPADO() *PacketBuilder { return &PacketBuilder{code: pppoePADO} }
+
+// NewPADR returns a builder for a PPPoE Active Discovery Request
+// packet.
+func NewPADR() *PacketBuilder { return &PacketBuilder{code: pppoePADR} }
+
+// NewPADS returns a builder for a PPPoE Active Discovery
+// Session-confirmation packet for sessionID.
+func NewPADS(sessionID uint16) *PacketBuilder {
+	return &PacketBuilder{code: pppoePADS, sessionID: sessionID}
+}
+
+// NewPADT returns a builder for a PPPoE Active Discovery Terminate
+// packet for sessionID.
+func NewPADT(sessionID uint16) *PacketBuilder {
+	return &PacketBuilder{code: pppoePADT, sessionID: sessionID}
+}
+
+// WithSessionID sets the packet's session ID.
+func (b *PacketBuilder) WithSessionID(sessionID uint16) *PacketBuilder {
+	b.sessionID = sessionID
+	return b
+}
+
+// WithTag adds a tag of type typ with the given value.
+func (b *PacketBuilder) WithTag(typ uint16, value []byte) *PacketBuilder {
+	b.tags = append(b.tags, discoveryTag{
+		Type:  int(typ),
+		Value: append([]byte(nil), value...),
+	})
+	return b
+}
+
+// WithServiceName adds a Service-Name tag. An empty name means "any
+// service".
+func (b *PacketBuilder) WithServiceName(name string) *PacketBuilder {
+	return b.WithTag(pppoeTagServiceName, []byte(name))
+}
+
+// WithACName adds an AC-Name tag.
+func (b *PacketBuilder) WithACName(name string) *PacketBuilder {
+	return b.WithTag(pppoeTagACName, []byte(name))
+}
+
+// WithHostUniq adds a Host-Uniq tag.
+func (b *PacketBuilder) WithHostUniq(hostUniq []byte) *PacketBuilder {
+	return b.WithTag(pppoeTagHostUniq, hostUniq)
+}
+
+// WithCookie adds an AC-Cookie tag.
+func (b *PacketBuilder) WithCookie(cookie []byte) *PacketBuilder {
+	return b.WithTag(pppoeTagCookie, cookie)
+}
+
+// WithRelaySessionID adds a Relay-Session-Id tag.
+func (b *PacketBuilder) WithRelaySessionID(id []byte) *PacketBuilder {
+	return b.WithTag(pppoeTagRelaySessionID, id)
+}
+
+// WithServiceNameError adds a Service-Name-Error tag with the given
+// message.
+func (b *PacketBuilder) WithServiceNameError(msg string) *PacketBuilder {
+	return b.WithTag(pppoeTagServiceNameError, []byte(msg))
+}
+
+// WithACSystemError adds an AC-System-Error tag with the given
+// message.
+func (b *PacketBuilder) WithACSystemError(msg string) *PacketBuilder {
+	return b.WithTag(pppoeTagACSystemError, []byte(msg))
+}
+
+// WithGenericError adds a Generic-Error tag with the given message.
+func (b *PacketBuilder) WithGenericError(msg string) *PacketBuilder {
+	return b.WithTag(pppoeTagGenericError, []byte(msg))
+}
+
+// Bytes returns the wire encoding of the packet, as it appears after
+// the Ethernet header.
+func (b *PacketBuilder) Bytes() []byte {
+	return encodeDiscoveryTags(b.code, b.sessionID, b.tags)
+}
@@ -0,0 +1,77 @@
+package pppoe
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPacketBuilder(t *testing.T) {
+	tests := []struct {
+		desc string
+		pkt  *PacketBuilder
+		want []byte
+	}{
+		{
+			desc: "empty PADI",
+			pkt:  NewPADI(),
+			want: []byte{0x11, 0x09, 0, 0, 0, 0},
+		},
+		{
+			desc: "PADO",
+			pkt:  NewPADO().WithServiceName("").WithACName("ac").WithCookie([]byte("NOM")),
+			want: []byte{
+				0x11, 0x07, 0, 0, 0, 17,
+				1, 1, 0, 0,
+				1, 2, 0, 2, 'a', 'c',
+				1, 4, 0, 3, 'N', 'O', 'M',
+			},
+		},
+		{
+			desc: "PADR keeps tag order",
+			pkt:  NewPADR().WithCookie([]byte{1}).WithHostUniq([]byte{2}).WithServiceName("isp"),
+			want: []byte{
+				0x11, 0x19, 0, 0, 0, 17,
+				1, 4, 0, 1, 1,
+				1, 3, 0, 1, 2,
+				1, 1, 0, 3, 'i', 's', 'p',
+			},
+		},
+		{
+			desc: "PADS",
+			pkt:  NewPADS(0x4243).WithServiceName("").WithRelaySessionID([]byte{9}),
+			want: []byte{
+				0x11, 0x65, 0x42, 0x43, 0, 9,
+				1, 1, 0, 0,
+				1, 0x10, 0, 1, 9,
+			},
+		},
+		{
+			desc: "PADT with errors",
+			pkt:  NewPADT(1).WithServiceNameError("a").WithACSystemError("b").WithGenericError("c"),
+			want: []byte{
+				0x11, 0xa7, 0, 1, 0, 15,
+				2, 1, 0, 1, 'a',
+				2, 2, 0, 1, 'b',
+				2, 3, 0, 1, 'c',
+			},
+		},
+		{
+			desc: "PADO with session ID and duplicate tags",
+			pkt:  NewPADO().WithSessionID(7).WithTag(0x0101, nil).WithTag(0x0101, nil),
+			want: []byte{
+				0x11, 0x07, 0, 7, 0, 8,
+				1, 1, 0, 0,
+				1, 1, 0, 0,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if diff := cmp.Diff(test.want, test.pkt.Bytes()); diff != "" {
+				t.Fatalf("wrong packet bytes (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
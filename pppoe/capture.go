@@ -0,0 +1,196 @@
+package pppoe
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/raw"
+)
+
+// pcapng block types, option codes and link type, from
+// draft-tuexen-opsawg-pcapng.
+const (
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1a2b3c4d
+
+	pcapngOptEnd      = 0
+	pcapngOptIfName   = 2
+	pcapngOptTSResol  = 9
+	pcapngOptEPBFlags = 2
+
+	pcapngInbound  = 1
+	pcapngOutbound = 2
+
+	linkTypeEthernet = 1
+)
+
+// capture writes the packets of a session to a pcapng file, as
+// Ethernet frames, so that they can be opened in Wireshark. Session
+// frames are captured with the PPPoE header they have on the wire,
+// even when the kernel adds it. Captures stop at the first write
+// error. A nil *capture captures nothing.
+type capture struct {
+	mu    sync.Mutex
+	w     io.Writer
+	local net.HardwareAddr
+	err   error
+}
+
+// newCapture starts a pcapng capture to w, for the interface intf.
+// It returns nil if w is nil.
+func newCapture(w io.Writer, intf *net.Interface) *capture {
+	if w == nil {
+		return nil
+	}
+	c := &capture{
+		w:     w,
+		local: intf.HardwareAddr,
+	}
+
+	var shb [16]byte
+	binary.LittleEndian.PutUint32(shb[:4], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:6], 1) // Major version
+	binary.LittleEndian.PutUint16(shb[6:8], 0) // Minor version
+	binary.LittleEndian.PutUint64(shb[8:], 0xffffffffffffffff)
+
+	// The link type, then a reserved field and a snap length of 0
+	// (unlimited).
+	var idb [8]byte
+	binary.LittleEndian.PutUint16(idb[:2], linkTypeEthernet)
+	opts := pcapngOption(pcapngOptIfName, []byte(intf.Name))
+	// Timestamps are in nanoseconds.
+	opts = append(opts, pcapngOption(pcapngOptTSResol, []byte{9})...)
+	opts = append(opts, pcapngOption(pcapngOptEnd, nil)...)
+
+	c.write(append(pcapngBlock(pcapngSectionHeader, shb[:]), pcapngBlock(pcapngInterface, append(idb[:], opts...))...))
+	return c
+}
+
+// discovery captures the PPPoE Discovery packet pkt, sent to or
+// received from peer.
+func (c *capture) discovery(sent bool, peer net.HardwareAddr, pkt []byte) {
+	if c == nil {
+		return
+	}
+	c.packet(sent, peer, protoPPPoEDiscovery, pkt)
+}
+
+// session captures the PPP frame, sent to or received from the
+// concentrator at peer.
+func (c *capture) session(sent bool, peer *Addr, frame []byte) {
+	if c == nil {
+		return
+	}
+	pkt := make([]byte, 6+len(frame))
+	pkt[0] = 0x11
+	binary.BigEndian.PutUint16(pkt[2:4], peer.SessionID)
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(frame)))
+	copy(pkt[6:], frame)
+	c.packet(sent, peer.HardwareAddr, protoPPPoESession, pkt)
+}
+
+// packet captures pkt, of Ethernet type proto, in an Ethernet frame
+// between the capture's interface and peer.
+func (c *capture) packet(sent bool, peer net.HardwareAddr, proto uint16, pkt []byte) {
+	now := time.Now().UnixNano()
+	src, dst, flags := peer, c.local, uint32(pcapngInbound)
+	if sent {
+		src, dst, flags = c.local, peer, pcapngOutbound
+	}
+	frame := make([]byte, 14+len(pkt))
+	copy(frame[:6], dst)
+	copy(frame[6:12], src)
+	binary.BigEndian.PutUint16(frame[12:14], proto)
+	copy(frame[14:], pkt)
+
+	body := make([]byte, 20, 20+len(frame)+16)
+	binary.LittleEndian.PutUint32(body[0:4], 0) // Interface ID
+	binary.LittleEndian.PutUint32(body[4:8], uint32(now>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(now))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(len(frame)))
+	body = append(body, pcapngPad(frame)...)
+	var f [4]byte
+	binary.LittleEndian.PutUint32(f[:], flags)
+	body = append(body, pcapngOption(pcapngOptEPBFlags, f[:])...)
+	body = append(body, pcapngOption(pcapngOptEnd, nil)...)
+
+	c.write(pcapngBlock(pcapngEnhancedPacket, body))
+}
+
+// write writes b to the capture, unless an earlier write failed.
+func (c *capture) write(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	_, c.err = c.w.Write(b)
+}
+
+// pcapngBlock returns a pcapng block of type typ, whose body is
+// padded to 32 bits.
+func pcapngBlock(typ uint32, body []byte) []byte {
+	body = pcapngPad(body)
+	ret := make([]byte, 8, 12+len(body))
+	binary.LittleEndian.PutUint32(ret[0:4], typ)
+	binary.LittleEndian.PutUint32(ret[4:8], uint32(12+len(body)))
+	ret = append(ret, body...)
+	var l [4]byte
+	binary.LittleEndian.PutUint32(l[:], uint32(12+len(body)))
+	return append(ret, l[:]...)
+}
+
+// pcapngOption returns a pcapng option, padded to 32 bits.
+func pcapngOption(code uint16, value []byte) []byte {
+	ret := make([]byte, 4, 4+len(value)+3)
+	binary.LittleEndian.PutUint16(ret[0:2], code)
+	binary.LittleEndian.PutUint16(ret[2:4], uint16(len(value)))
+	return pcapngPad(append(ret, value...))
+}
+
+// pcapngPad pads b with zeros to a multiple of 32 bits.
+func pcapngPad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// captureConn is a discovery conn that captures the packets it sends
+// and receives.
+type captureConn struct {
+	net.PacketConn
+	c *capture
+}
+
+func (c *captureConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, from, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, from, err
+	}
+	c.c.discovery(false, hardwareAddr(from), b[:n])
+	return n, from, err
+}
+
+func (c *captureConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if err == nil {
+		c.c.discovery(true, hardwareAddr(addr), b)
+	}
+	return n, err
+}
+
+// hardwareAddr returns the Ethernet address of a raw socket address,
+// or nil for other addresses.
+func hardwareAddr(addr net.Addr) net.HardwareAddr {
+	if a, ok := addr.(*raw.Addr); ok {
+		return a.HardwareAddr
+	}
+	return nil
+}
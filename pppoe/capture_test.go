@@ -0,0 +1,143 @@
+package pppoe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"go.universe.tf/ppp/internal/testutil"
+)
+
+// capturedPacket is an Enhanced Packet Block of a pcapng capture.
+type capturedPacket struct {
+	Time     time.Time
+	Outbound bool
+	Frame    []byte
+}
+
+// parseCapture parses a pcapng capture written by capture, checking
+// its section header and interface description along the way.
+func parseCapture(t *testing.T, b []byte, ifName string) []capturedPacket {
+	t.Helper()
+	var ret []capturedPacket
+	for i := 0; len(b) > 0; i++ {
+		if len(b) < 12 {
+			t.Fatalf("truncated block header: % x", b)
+		}
+		typ, l := binary.LittleEndian.Uint32(b), int(binary.LittleEndian.Uint32(b[4:]))
+		if l < 12 || l%4 != 0 || l > len(b) || int(binary.LittleEndian.Uint32(b[l-4:])) != l {
+			t.Fatalf("block %d has invalid length %d", i, l)
+		}
+		body := b[8 : l-4]
+		b = b[l:]
+
+		switch {
+		case i == 0:
+			if typ != pcapngSectionHeader || binary.LittleEndian.Uint32(body) != pcapngByteOrderMagic {
+				t.Fatalf("capture doesn't start with a section header: % x", body)
+			}
+		case i == 1:
+			if typ != pcapngInterface || binary.LittleEndian.Uint16(body) != linkTypeEthernet {
+				t.Fatalf("second block isn't an Ethernet interface description: % x", body)
+			}
+			want := append(pcapngOption(pcapngOptIfName, []byte(ifName)), pcapngOption(pcapngOptTSResol, []byte{9})...)
+			want = append(want, pcapngOption(pcapngOptEnd, nil)...)
+			if diff := cmp.Diff(want, body[8:]); diff != "" {
+				t.Fatalf("wrong interface options (-want +got)\n%s", diff)
+			}
+		case typ == pcapngEnhancedPacket:
+			ts := int64(binary.LittleEndian.Uint32(body[4:]))<<32 | int64(binary.LittleEndian.Uint32(body[8:]))
+			n := int(binary.LittleEndian.Uint32(body[12:]))
+			opts := body[20+(n+3)/4*4:]
+			if len(opts) != 12 || binary.LittleEndian.Uint16(opts) != pcapngOptEPBFlags {
+				t.Fatalf("wrong packet options: % x", opts)
+			}
+			ret = append(ret, capturedPacket{
+				Time:     time.Unix(0, ts),
+				Outbound: binary.LittleEndian.Uint32(opts[4:]) == pcapngOutbound,
+				Frame:    body[20 : 20+n],
+			})
+		default:
+			t.Fatalf("unexpected block type %#x", typ)
+		}
+	}
+	return ret
+}
+
+func TestCapture(t *testing.T) {
+	ac := testutil.NewFakeAC()
+	defer ac.Close()
+
+	origInterface, origDiscoveryConn, origSessionConn := setupInterface, setupDiscoveryConn, setupSessionConn
+	defer func() {
+		setupInterface, setupDiscoveryConn, setupSessionConn = origInterface, origDiscoveryConn, origSessionConn
+	}()
+	setupInterface = func(string) (*net.Interface, error) { return ac.Interface(), nil }
+	setupDiscoveryConn = func(string) (net.PacketConn, error) { return ac.Discovery(), nil }
+	setupSessionConn = func(string) (net.PacketConn, error) { return ac.Session(), nil }
+
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+
+	var buf bytes.Buffer
+	start := time.Now()
+	conn, err := New(ctx, "fakeac0", &Config{
+		Userspace: true,
+		PADTCount: 1,
+		Capture:   &buf,
+	})
+	if err != nil {
+		t.Fatalf("PPPoE session setup failed: %v", err)
+	}
+	frame := []byte{0x00, 0x21, 0x45, 0, 0, 20}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatalf("writing to PPPoE session: %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("closing PPPoE session: %v", err)
+	}
+	end := time.Now()
+
+	client, broadcast := ac.Interface().HardwareAddr, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	type packet struct {
+		Outbound bool
+		Dst, Src net.HardwareAddr
+		Proto    uint16
+		Code     uint8
+	}
+	want := []packet{
+		{true, broadcast, client, protoPPPoEDiscovery, pppoePADI},
+		{false, client, ac.Addr, protoPPPoEDiscovery, pppoePADO},
+		{true, ac.Addr, client, protoPPPoEDiscovery, pppoePADR},
+		{false, client, ac.Addr, protoPPPoEDiscovery, pppoePADS},
+		{true, ac.Addr, client, protoPPPoESession, 0},
+		{true, ac.Addr, client, protoPPPoEDiscovery, pppoePADT},
+	}
+	pkts := parseCapture(t, buf.Bytes(), "fakeac0")
+	var got []packet
+	for _, p := range pkts {
+		if p.Time.Before(start) || p.Time.After(end) {
+			t.Errorf("packet timestamp %v outside of the test's %v-%v", p.Time, start, end)
+		}
+		got = append(got, packet{
+			Outbound: p.Outbound,
+			Dst:      p.Frame[:6],
+			Src:      p.Frame[6:12],
+			Proto:    binary.BigEndian.Uint16(p.Frame[12:14]),
+			Code:     p.Frame[15],
+		})
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("wrong captured packets (-want +got)\n%s", diff)
+	}
+
+	wantSession := append([]byte{0x11, 0, 0, byte(ac.SessionID), 0, byte(len(frame))}, frame...)
+	if diff := cmp.Diff(wantSession, pkts[4].Frame[14:]); diff != "" {
+		t.Errorf("wrong captured session frame (-want +got)\n%s", diff)
+	}
+}
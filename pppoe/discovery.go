@@ -3,14 +3,20 @@ package pppoe
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sort"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/mdlayher/raw"
+
+	"go.universe.tf/ppp/internal/cp"
 )
 
 // Constants for PPPoE protocol EtherTypes.
@@ -30,86 +36,225 @@ const (
 
 // Constants for PPPoE Discovery tag types
 const (
-	pppoeTagServiceName = 0x0101 // Roughly speaking, the name of the ISP.
-	pppoeTagACName      = 0x0102 // Roughly speaking, the hostname of the PPPoE concentrator.
-	pppoeTagCookie      = 0x0104 // The PPPoE equivalent of a syncookie.
+	pppoeTagServiceName      = 0x0101 // Roughly speaking, the name of the ISP.
+	pppoeTagACName           = 0x0102 // Roughly speaking, the hostname of the PPPoE concentrator.
+	pppoeTagHostUniq         = 0x0103 // Opaque value the concentrator must echo back to us.
+	pppoeTagCookie           = 0x0104 // The PPPoE equivalent of a syncookie.
+	pppoeTagVendorSpecific   = 0x0105 // Vendor extensions, starting with an IANA enterprise number.
+	pppoeTagRelaySessionID   = 0x0110 // Added by relay agents to track their sessions.
+	pppoeTagPPPMaxPayload    = 0x0120 // Largest PPP payload we can both handle, from RFC 4638.
+	pppoeTagServiceNameError = 0x0201 // "I can't serve the requested Service-Name"
+	pppoeTagACSystemError    = 0x0202 // "I'm broken somehow"
+	pppoeTagGenericError     = 0x0203 // "Something else went wrong"
 )
 
 // pppoeBufferLen is the maximum size of a PPPoE packet. The spec says
 // that PPPoE packets may not exceed the ethernet MTU, which is 1500.
 const pppoeBufferLen = 1500
 
-var (
-	// padiPacket is a PPPoE Active Discovery Initiation (PADI) packet
-	// that sollicits session offers from any available PPPoE
-	// concentrator.
-	padiPacket = encodeDiscoveryPacket(&discoveryPacket{
+// defaultMaxPayload is the largest PPP payload that a PPPoE session
+// carries in a standard 1500-byte Ethernet frame, after the 8 bytes of
+// PPPoE and PPP headers.
+const defaultMaxPayload = 1492
+
+// ethernetBroadcast is the Ethernet broadcast address.
+var ethernetBroadcast = &raw.Addr{
+	HardwareAddr: net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+}
+
+// padiPacket returns a PPPoE Active Discovery Initiation (PADI)
+// packet that sollicits session offers for serviceName from any
+// available PPPoE concentrator. The packet carries hostUniq as its
+// Host-Uniq tag, unless it's nil, and maxPayload as its
+// PPP-Max-Payload tag, unless it's zero.
+//
+// By convention on single-ISP customer access networks, serviceName
+// is empty, meaning "don't care," because there's only one ISP around
+// anyway.
+func padiPacket(serviceName string, hostUniq []byte, maxPayload int) []byte {
+	pkt := &discoveryPacket{
 		Code: pppoePADI,
 		Tags: map[int][]byte{
-			// By convention on single-ISP customer access networks,
-			// the tag is always nil, meaning "don't care," because
-			// there's only one ISP around anyway.
-			pppoeTagServiceName: nil,
+			pppoeTagServiceName: []byte(serviceName),
 		},
-	})
-	// ethernetBroadcast is the Ethernet broadcast address.
-	ethernetBroadcast = &raw.Addr{
-		HardwareAddr: net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
 	}
-)
+	if hostUniq != nil {
+		pkt.Tags[pppoeTagHostUniq] = hostUniq
+	}
+	addMaxPayload(pkt, maxPayload)
+	return encodeDiscoveryPacket(pkt)
+}
 
-// pppoeDiscovery executes PPPoE discovery and returns a PPPoE session ID.
-func pppoeDiscovery(ctx context.Context, conn net.PacketConn) (concentrator net.HardwareAddr, sessionID uint16, err error) {
-	deadline, hasDeadline := ctx.Deadline()
+// addMaxPayload adds a PPP-Max-Payload tag for maxPayload to pkt,
+// unless maxPayload is zero.
+func addMaxPayload(pkt *discoveryPacket, maxPayload int) {
+	if maxPayload == 0 {
+		return
+	}
+	v := make([]byte, 2)
+	binary.BigEndian.PutUint16(v, uint16(maxPayload))
+	pkt.Tags[pppoeTagPPPMaxPayload] = v
+}
 
-	var (
-		from   net.Addr
-		cookie []byte
-	)
+// sessionMaxPayload returns the largest PPP payload of the session
+// that pads sets up, when we asked for want in the PADR: the smaller
+// of want and what the concentrator agreed to, and never less than
+// defaultMaxPayload. Concentrators that don't support RFC 4638 don't
+// echo the tag, which leaves the session at defaultMaxPayload.
+func sessionMaxPayload(pads *discoveryPacket, want int) int {
+	v, ok := pads.Tags[pppoeTagPPPMaxPayload]
+	if want == 0 || !ok || len(v) != 2 {
+		return defaultMaxPayload
+	}
+	got := int(binary.BigEndian.Uint16(v))
+	switch {
+	case got < defaultMaxPayload:
+		return defaultMaxPayload
+	case got > want:
+		return want
+	default:
+		return got
+	}
+}
+
+// newHostUniq returns the Host-Uniq value for a discovery run: the
+// one in cfg, or a random one.
+func newHostUniq(cfg *Config) []byte {
+	if cfg != nil && len(cfg.HostUniq) != 0 {
+		return cfg.HostUniq
+	}
+	ret := make([]byte, 8)
+	if _, err := rand.Read(ret); err != nil {
+		panic(fmt.Sprintf("reading random bytes: %v", err))
+	}
+	return ret
+}
+
+// checkHostUniq returns an error if hostUniq isn't nil, and pkt
+// doesn't echo it back.
+func checkHostUniq(pkt *discoveryPacket, hostUniq []byte) error {
+	if hostUniq == nil {
+		return nil
+	}
+	if got, ok := pkt.Tags[pppoeTagHostUniq]; !ok || !bytes.Equal(got, hostUniq) {
+		return errors.New("wrong Host-Uniq")
+	}
+	return nil
+}
+
+// discoveryTimeout is how long we wait for a reply to a PADI or PADR
+// before sending it again, unless cfg.Discovery says otherwise.
+const discoveryTimeout = time.Second
+
+// pppoeDiscovery executes PPPoE discovery and returns a PPPoE session
+// ID, along with the largest PPP payload that the session carries.
+// cfg may be nil.
+//
+// All timeouts are driven by context timers rather than by comparing
+// time.Now() to ctx.Deadline(), so that wall clock steps (e.g. NTP
+// syncing just after the WAN link comes up) don't cut discovery short
+// or drag it out.
+func pppoeDiscovery(ctx context.Context, conn net.PacketConn, cfg *Config) (concentrator net.HardwareAddr, sessionID uint16, maxPayload int, err error) {
+	var offer *Offer
+	hostUniq, wantPayload := newHostUniq(cfg), cfg.maxPayload()
+	retry := cfg.discovery()
 
 	// Broadcast PADIs, looking for a PPPoE concentrator.
-	for concentrator == nil && (!hasDeadline || time.Now().Before(deadline)) {
+	for attempt := 0; offer == nil; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, 0, err
+		}
+		if retry.PADI.Attempts > 0 && attempt == retry.PADI.Attempts {
+			return nil, 0, 0, fmt.Errorf("no PADO after %d PADIs", attempt)
+		}
+
 		// Send a PADI, asking concentrators for a session offer.
-		if err := sendPADI(conn); err != nil {
-			return nil, 0, fmt.Errorf("sending PADI packet: %v", err)
+		// Transient errors are as good as a lost PADI: we'll time
+		// out waiting for a PADO, and try again.
+		if err := sendPADI(conn, cfg.serviceName(), hostUniq, wantPayload); err != nil && !isTransient(err) {
+			return nil, 0, 0, fmt.Errorf("sending PADI packet: %v", err)
 		}
 
-		padoCtx, cancelPADO := context.WithTimeout(ctx, time.Second)
-		defer cancelPADO()
-		from, cookie, err = readPADO(padoCtx, conn)
-		if err == nil {
-			// We know about a concentrator, move on.
-			break
-		} else if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
-			return nil, 0, fmt.Errorf("waiting for PADO: %v", err)
+		offer, err = readOffer(ctx, conn, cfg, hostUniq, retry.PADI.timeout(attempt))
+		if cerr, ok := err.(*ConcentratorError); ok {
+			cfg.log("concentrator refused session", "error", cerr)
+			return nil, 0, 0, cerr
+		} else if err != nil && !isTimeout(err) {
+			return nil, 0, 0, fmt.Errorf("waiting for PADO: %v", err)
+		} else if err != nil {
+			cfg.log("no PADO", "attempt", attempt+1)
 		}
-		// Timed out waiting for PADO. Loop back around to (maybe) try
-		// again.
+		// On timeout, loop back around to (maybe) try again.
 	}
 
-	concentrator = from.(*raw.Addr).HardwareAddr
+	concentrator, from := offer.Concentrator, offer.addr
+	cfg.log("accepted PADO", "peer", concentrator, "ac_name", offer.ACName)
 
 	// Got a concentrator, request a session.
-	for !hasDeadline || time.Now().Before(deadline) {
-		if err := sendPADR(conn, from, cookie); err != nil {
-			return nil, 0, fmt.Errorf("sending PADR packet: %v", err)
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, 0, err
+		}
+		if retry.PADR.Attempts > 0 && attempt == retry.PADR.Attempts {
+			return nil, 0, 0, fmt.Errorf("no PADS after %d PADRs", attempt)
 		}
 
-		padsCtx, cancelPADS := context.WithTimeout(ctx, time.Second)
-		defer cancelPADS()
-		sessionID, err = readPADS(padsCtx, conn, from)
+		if err := sendPADR(conn, from, offer.Cookie, offer.service, hostUniq, wantPayload); err != nil && !isTransient(err) {
+			return nil, 0, 0, fmt.Errorf("sending PADR packet: %v", err)
+		}
+
+		padsCtx, cancelPADS := context.WithTimeout(ctx, retry.PADR.timeout(attempt))
+		pads, err := readPADS(padsCtx, conn, from, hostUniq)
+		cancelPADS()
 		if err == nil {
 			// We're done!
-			return concentrator, sessionID, nil
-		} else if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
-			return nil, 0, fmt.Errorf("waiting for PADS: %v", err)
+			cfg.log("accepted PADS", "peer", concentrator, "session", pads.SessionID)
+			return concentrator, pads.SessionID, sessionMaxPayload(pads, wantPayload), nil
+		} else if cerr, ok := err.(*ConcentratorError); ok {
+			cfg.log("concentrator refused session", "peer", concentrator, "error", cerr)
+			return nil, 0, 0, cerr
+		} else if !isTimeout(err) {
+			return nil, 0, 0, fmt.Errorf("waiting for PADS: %v", err)
 		}
+		cfg.log("no PADS", "peer", concentrator, "attempt", attempt+1)
 		// Timed out waiting for PADS. Loop back around to (maybe) try
 		// again.
 	}
+}
+
+// isTimeout returns whether err is a net.Error timeout.
+func isTimeout(err error) bool {
+	neterr, ok := err.(net.Error)
+	return ok && neterr.Timeout()
+}
+
+// maxTransientErrors is how many transient socket errors in a row we
+// tolerate on a discovery conn before giving up.
+const maxTransientErrors = 10
 
-	// Oops, deadline exceeded :(
-	return nil, 0, ctx.Err()
+// isTransient returns whether err is a socket error that is likely to
+// go away on its own, like running out of buffer space under load.
+func isTransient(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	return ok && (errno == syscall.EINTR || errno == syscall.ENOBUFS)
+}
+
+// readFrom reads a packet from conn, retrying up to
+// maxTransientErrors times in a row if the read fails with a
+// transient error.
+func readFrom(conn net.PacketConn, b []byte) (n int, from net.Addr, err error) {
+	for retries := 0; ; retries++ {
+		n, from, err = conn.ReadFrom(b)
+		if err == nil || !isTransient(err) || retries == maxTransientErrors {
+			return n, from, err
+		}
+	}
 }
 
 // newDiscoveryConn creates a net.PacketConn that can receive PPPoE
@@ -119,7 +264,7 @@ func newDiscoveryConn(ifName string) (net.PacketConn, error) {
 	if err != nil {
 		return nil, fmt.Errorf("getting interface %v: %v", ifName, err)
 	}
-	conn, err := raw.ListenPacket(intf, protoPPPoEDiscovery, &raw.Config{LinuxSockDGRAM: true})
+	conn, err := listenRaw(intf, protoPPPoEDiscovery)
 	if err != nil {
 		return nil, fmt.Errorf("creating PPPoE Discovery listener: %v", err)
 	}
@@ -128,37 +273,134 @@ func newDiscoveryConn(ifName string) (net.PacketConn, error) {
 
 // sendPADI broadcasts a PADI packet. While trivial, it's separated
 // out so tests can invoke it.
-func sendPADI(conn net.PacketConn) error {
-	_, err := conn.WriteTo(padiPacket, ethernetBroadcast)
+func sendPADI(conn net.PacketConn, serviceName string, hostUniq []byte, maxPayload int) error {
+	_, err := conn.WriteTo(padiPacket(serviceName, hostUniq, maxPayload), ethernetBroadcast)
 	return err
 }
 
-// readPADO waits to receive a valid PPPoE Active Discovery Offer
-// (PADO) packet, and returns relevant information from it.
-func readPADO(ctx context.Context, conn net.PacketConn) (concentratorAddr net.Addr, cookie []byte, err error) {
-	var b [pppoeBufferLen]byte
+// Offer is a session offer from a PPPoE concentrator, as received in
+// a PADO packet.
+type Offer struct {
+	// Concentrator is the Ethernet address of the concentrator.
+	Concentrator net.HardwareAddr
+	// ACName is the concentrator's name, from the AC-Name tag. It's
+	// empty if the PADO had none.
+	ACName string
+	// Cookie is the value of the AC-Cookie tag, or nil if the PADO
+	// had none.
+	Cookie []byte
+	// Tags are all the tags of the PADO, in the order they appeared.
+	Tags []Tag
+
+	// addr is where the PADO came from, and service the Service-Name
+	// to request in the PADR.
+	addr    net.Addr
+	service []byte
+}
+
+// Tag is a PPPoE Discovery tag.
+type Tag struct {
+	Type  uint16
+	Value []byte
+}
 
-	if deadline, ok := ctx.Deadline(); ok {
-		conn.SetReadDeadline(deadline)
-		defer conn.SetReadDeadline(time.Time{})
+// readOffer waits for PADOs for cfg's Service-Name and hostUniq, and
+// returns the offer to accept. That's the first one to arrive within
+// timeout, unless cfg.SelectOffer is set, in which case it's the one
+// SelectOffer picks among those that arrive within cfg's offer
+// window. If no PADO arrives in time, readOffer returns a timeout
+// error, or the *ConcentratorError of a PADO that refused us.
+func readOffer(ctx context.Context, conn net.PacketConn, cfg *Config, hostUniq []byte, timeout time.Duration) (*Offer, error) {
+	if cfg == nil || cfg.SelectOffer == nil {
+		padoCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return readPADO(padoCtx, conn, cfg.serviceName(), hostUniq)
+	}
+
+	windowCtx, cancel := context.WithTimeout(ctx, cfg.offerWindow())
+	defer cancel()
+	var (
+		offers []Offer
+		err    error
+	)
+	for {
+		var offer *Offer
+		offer, err = readPADO(windowCtx, conn, cfg.serviceName(), hostUniq)
+		if err != nil {
+			break
+		}
+		// Concentrators answer every PADI they see, including those
+		// of other hosts, so keep only the first offer of each.
+		dup := false
+		for _, o := range offers {
+			if bytes.Equal(o.Concentrator, offer.Concentrator) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			offers = append(offers, *offer)
+		}
+	}
+	_, refused := err.(*ConcentratorError)
+	if len(offers) == 0 || !(isTimeout(err) || refused) || ctx.Err() != nil {
+		return nil, err
+	}
+
+	chosen := cfg.SelectOffer(offers)
+	for i := range offers {
+		if bytes.Equal(offers[i].Concentrator, chosen.Concentrator) {
+			return &offers[i], nil
+		}
 	}
+	return nil, fmt.Errorf("SelectOffer chose concentrator %s, which made no offer", chosen.Concentrator)
+}
+
+// readPADO waits to receive a valid PPPoE Active Discovery Offer
+// (PADO) packet for serviceName and hostUniq, and returns the offer
+// it makes. PADOs with error tags don't count, but if one arrived and
+// no valid PADO did by the time ctx expires, readPADO returns its
+// *ConcentratorError instead of a timeout.
+func readPADO(ctx context.Context, conn net.PacketConn, serviceName string, hostUniq []byte) (*Offer, error) {
+	var (
+		b       [pppoeBufferLen]byte
+		refusal *ConcentratorError
+	)
+
+	defer cp.WatchContext(ctx, conn)()
 	for {
-		n, from, err := conn.ReadFrom(b[:])
+		n, from, err := readFrom(conn, b[:])
 		if err != nil {
-			return nil, nil, err
+			if refusal != nil && isTimeout(err) {
+				return nil, refusal
+			}
+			return nil, err
+		}
+		addr, ok := from.(*raw.Addr)
+		if !ok {
+			continue
 		}
 
-		cookie, err := parsePADO(b[:n])
+		offer, err := parsePADO(b[:n], serviceName, hostUniq)
 		if err == nil {
-			return from, cookie, nil
+			offer.Concentrator = addr.HardwareAddr
+			offer.addr = from
+			return offer, nil
+		}
+		if cerr, ok := err.(*ConcentratorError); ok {
+			refusal = cerr
 		}
 
 		// Not a valid PADO, keep waiting
 	}
 }
 
-// parsePADO parses a raw PADO packet and extracts the PPPoE cookie.
-func parsePADO(buf []byte) (cookie []byte, err error) {
+// parsePADO parses a raw PADO packet that offers serviceName, and
+// echoes hostUniq if it's not nil. It returns the offer, with the
+// Service-Name to request in the PADR. The offer's Concentrator and
+// addr are left for the caller to fill. If the PADO carries an error
+// tag, parsePADO returns it as a *ConcentratorError.
+func parsePADO(buf []byte, serviceName string, hostUniq []byte) (*Offer, error) {
 	pkt, err := parseDiscoveryPacket(buf)
 	if err != nil {
 		return nil, err
@@ -169,38 +411,85 @@ func parsePADO(buf []byte) (cookie []byte, err error) {
 	if pkt.SessionID != 0 {
 		return nil, errors.New("non-zero session ID")
 	}
+	if err := checkHostUniq(pkt, hostUniq); err != nil {
+		return nil, err
+	}
+	if err := concentratorError(pkt); err != nil {
+		return nil, err
+	}
+
+	// A PADO has one Service-Name tag for each service that the
+	// concentrator offers, which should include the one we asked
+	// for. When we don't care, some concentrators only list their
+	// real services, and expect us to request one of them, so we take
+	// the first.
+	tags, err := parseDiscoveryTags(buf)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		service []byte
+		found   bool
+	)
+	for _, tag := range tags {
+		if tag.Type != pppoeTagServiceName {
+			continue
+		}
+		if string(tag.Value) == serviceName {
+			service, found = tag.Value, true
+			break
+		}
+		if serviceName == "" && !found {
+			service, found = tag.Value, true
+		}
+	}
+	if !found && serviceName != "" {
+		return nil, fmt.Errorf("PADO doesn't offer service %q", serviceName)
+	}
 
-	// Note, not having a cookie is fine. Its function is similar to
-	// syncookies, an anti-DoS measure at the concentrator. If the
-	// concentrator doesn't care, then neither do we.
-	return pkt.Tags[pppoeTagCookie], nil
+	ret := &Offer{
+		ACName: string(pkt.Tags[pppoeTagACName]),
+		// Note, not having a cookie is fine. Its function is similar
+		// to syncookies, an anti-DoS measure at the concentrator. If
+		// the concentrator doesn't care, then neither do we.
+		Cookie:  pkt.Tags[pppoeTagCookie],
+		service: service,
+	}
+	for _, tag := range tags {
+		ret.Tags = append(ret.Tags, Tag{
+			Type:  uint16(tag.Type),
+			Value: append([]byte{}, tag.Value...),
+		})
+	}
+	return ret, nil
 }
 
-func sendPADR(conn net.PacketConn, concentrator net.Addr, cookie []byte) error {
+func sendPADR(conn net.PacketConn, concentrator net.Addr, cookie, service, hostUniq []byte, maxPayload int) error {
 	pkt := &discoveryPacket{
 		Code: pppoePADR,
 		Tags: map[int][]byte{
-			pppoeTagServiceName: nil,
+			pppoeTagServiceName: service,
 		},
 	}
 	if len(cookie) != 0 {
 		pkt.Tags[pppoeTagCookie] = cookie
 	}
+	if hostUniq != nil {
+		pkt.Tags[pppoeTagHostUniq] = hostUniq
+	}
+	addMaxPayload(pkt, maxPayload)
 	_, err := conn.WriteTo(encodeDiscoveryPacket(pkt), concentrator)
 	return err
 }
 
-func readPADS(ctx context.Context, conn net.PacketConn, concentrator net.Addr) (sessionID uint16, err error) {
+func readPADS(ctx context.Context, conn net.PacketConn, concentrator net.Addr, hostUniq []byte) (*discoveryPacket, error) {
 	var b [pppoeBufferLen]byte
 
-	if deadline, ok := ctx.Deadline(); ok {
-		conn.SetReadDeadline(deadline)
-		defer conn.SetReadDeadline(time.Time{})
-	}
+	defer cp.WatchContext(ctx, conn)()
 	for {
-		n, from, err := conn.ReadFrom(b[:])
+		n, from, err := readFrom(conn, b[:])
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 
 		if concentrator.String() != from.String() {
@@ -208,38 +497,53 @@ func readPADS(ctx context.Context, conn net.PacketConn, concentrator net.Addr) (
 			continue
 		}
 
-		sessionID, err = parsePADS(b[:n])
+		pkt, err := parsePADS(b[:n], hostUniq)
 		if err == nil {
-			return sessionID, nil
+			return pkt, nil
+		}
+		if _, ok := err.(*ConcentratorError); ok {
+			// The concentrator refused the session.
+			return nil, err
 		}
 
 		// Not a valid PADO, keep waiting
 	}
 }
 
-func parsePADS(buf []byte) (sessionID uint16, err error) {
+// parsePADS parses a raw PADS packet that echoes hostUniq if it's not
+// nil. If the PADS refuses the session with an error tag, parsePADS
+// returns it as a *ConcentratorError.
+func parsePADS(buf []byte, hostUniq []byte) (*discoveryPacket, error) {
 	pkt, err := parseDiscoveryPacket(buf)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	if pkt.Code != pppoePADS {
-		return 0, errors.New("not a PADS packet")
+		return nil, errors.New("not a PADS packet")
+	}
+	if err := checkHostUniq(pkt, hostUniq); err != nil {
+		return nil, err
+	}
+	if err := concentratorError(pkt); err != nil {
+		return nil, err
+	}
+	if pkt.SessionID == 0 {
+		return nil, errors.New("PADS with session ID 0")
 	}
-	return pkt.SessionID, nil
+	return pkt, nil
 }
 
-func readPADT(conn net.PacketConn, concentrator net.HardwareAddr, sessionID uint16) error {
+// readPADT waits for the concentrator to send a PADT for sessionID,
+// and returns it.
+// PADTs for sessionID that come from any other Ethernet address are
+// spoofing attempts: they are ignored, and counted in spoofed.
+func readPADT(conn net.PacketConn, concentrator net.HardwareAddr, sessionID uint16, spoofed *uint64) (*discoveryPacket, error) {
 	var b [pppoeBufferLen]byte
 
 	for {
-		n, from, err := conn.ReadFrom(b[:])
+		n, from, err := readFrom(conn, b[:])
 		if err != nil {
-			return err
-		}
-
-		if concentrator.String() != from.String() {
-			// Wrong peer, keep waiting
-			continue
+			return nil, err
 		}
 
 		pkt, err := parseDiscoveryPacket(b[:n])
@@ -255,9 +559,42 @@ func readPADT(conn net.PacketConn, concentrator net.HardwareAddr, sessionID uint
 			continue
 		}
 
+		if concentrator.String() != from.String() {
+			// Someone other than our concentrator is trying to tear
+			// down our session. Any host on the LAN can craft a PADT,
+			// so only the concentrator gets to do that.
+			atomic.AddUint64(spoofed, 1)
+			continue
+		}
+
 		// Got a PADT.
-		return nil
+		return pkt, nil
+	}
+}
+
+// errorTags are the Discovery error tags, in the order we report them
+// if a packet has several.
+var errorTags = []struct {
+	tag  int
+	name string
+}{
+	{pppoeTagServiceNameError, "Service-Name-Error"},
+	{pppoeTagACSystemError, "AC-System-Error"},
+	{pppoeTagGenericError, "Generic-Error"},
+}
+
+// concentratorError returns a *ConcentratorError for the first error
+// tag in pkt, or nil if pkt has no error tags.
+func concentratorError(pkt *discoveryPacket) error {
+	for _, t := range errorTags {
+		if msg, ok := pkt.Tags[t.tag]; ok {
+			return &ConcentratorError{
+				Tag:     t.name,
+				Message: string(msg),
+			}
+		}
 	}
+	return nil
 }
 
 func sendPADT(conn net.PacketConn, concentrator net.HardwareAddr, sessionID uint16) error {
@@ -265,11 +602,58 @@ func sendPADT(conn net.PacketConn, concentrator net.HardwareAddr, sessionID uint
 		Code:      pppoePADT,
 		SessionID: sessionID,
 	}
-	_, err := conn.WriteTo(encodeDiscoveryPacket(pkt), &raw.Addr{concentrator})
-	conn.Close()
+	_, err := conn.WriteTo(encodeDiscoveryPacket(pkt), &raw.Addr{HardwareAddr: concentrator})
 	return err
 }
 
+// sendPADTs sends count PADTs for sessionID to concentrator, interval
+// apart, since PADTs aren't acknowledged and can get lost. It
+// succeeds if at least one PADT was sent, and stops once ctx is done.
+func sendPADTs(ctx context.Context, conn net.PacketConn, concentrator net.HardwareAddr, sessionID uint16, count int, interval time.Duration) error {
+	var (
+		sent bool
+		err  error
+	)
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			t := time.NewTimer(interval)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return padtResult(sent, ctx.Err())
+			}
+		}
+
+		// Raw sockets ignore write deadlines, so we can't bound the
+		// send itself. Instead, we stop waiting for it, and leave it
+		// to finish in the background. Closing conn doesn't wait for
+		// it either.
+		done := make(chan error, 1)
+		go func() {
+			done <- sendPADT(conn, concentrator, sessionID)
+		}()
+		select {
+		case err = <-done:
+			if err == nil {
+				sent = true
+			}
+		case <-ctx.Done():
+			return padtResult(sent, ctx.Err())
+		}
+	}
+	return padtResult(sent, err)
+}
+
+// padtResult returns the error for a series of PADT sends that ended
+// with err.
+func padtResult(sent bool, err error) error {
+	if sent {
+		return nil
+	}
+	return fmt.Errorf("sending PADT: %v", err)
+}
+
 // discoveryPacket is a parsed PPPoE Discovery packet.
 type discoveryPacket struct {
 	// Code is the kind of PPPoE packet.
@@ -282,70 +666,144 @@ type discoveryPacket struct {
 	Tags map[int][]byte
 }
 
-// parseDiscoveryPacket parses a PPPoE Discovery packet into a discoveryPacket.
-func parseDiscoveryPacket(pkt []byte) (*discoveryPacket, error) {
-	if len(pkt) < 6 {
-		return nil, errors.New("packet too short to be PPPoE Discovery")
+// ParseError describes why a PPPoE Discovery packet couldn't be
+// parsed, and where in the packet the problem is.
+type ParseError struct {
+	// Offset is the byte offset in the packet at which parsing failed.
+	Offset int
+	// Tag is the type of the tag that was being parsed, or -1 if the
+	// error isn't about a specific tag.
+	Tag int
+	// Msg describes the problem.
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	if e.Tag < 0 {
+		return fmt.Sprintf("offset %d: %s", e.Offset, e.Msg)
 	}
-	if pkt[0] != 0x11 {
-		return nil, fmt.Errorf("unknown PPPoE version %x", pkt[0])
+	return fmt.Sprintf("offset %d: tag 0x%04x: %s", e.Offset, e.Tag, e.Msg)
+}
+
+// parseErrorf returns a *ParseError for the given offset and tag type.
+func parseErrorf(offset, tag int, format string, args ...interface{}) error {
+	return &ParseError{
+		Offset: offset,
+		Tag:    tag,
+		Msg:    fmt.Sprintf(format, args...),
 	}
+}
 
-	ret := &discoveryPacket{
-		Code:      int(pkt[1]),
-		SessionID: binary.BigEndian.Uint16(pkt[2:4]),
-		Tags:      map[int][]byte{},
+// discoveryTag is one tag of a raw PPPoE Discovery packet.
+type discoveryTag struct {
+	// Offset is the offset of the tag's header in the packet.
+	Offset int
+	// Type is the tag type.
+	Type int
+	// Value is the tag value.
+	Value []byte
+}
+
+// parseDiscoveryTags checks that pkt is a well-formed PPPoE Discovery
+// packet, and returns its tags in the order they appear in the
+// packet. Unlike parseDiscoveryPacket, it doesn't judge the tags'
+// contents, so it's suitable for code that forwards packets on behalf
+// of others. Parse failures are reported as *ParseError.
+func parseDiscoveryTags(pkt []byte) ([]discoveryTag, error) {
+	if len(pkt) < 6 {
+		return nil, parseErrorf(len(pkt), -1, "packet too short to be PPPoE Discovery")
+	}
+	if pkt[0] != 0x11 {
+		return nil, parseErrorf(0, -1, "unknown PPPoE version %x", pkt[0])
 	}
 
 	tlvLen := int(binary.BigEndian.Uint16(pkt[4:6]))
-	pkt = pkt[6:]
-	if tlvLen != len(pkt) {
-		return nil, fmt.Errorf("Tag array length %v doesn't match remaining packet length %v", tlvLen, len(pkt))
+	if tlvLen > len(pkt)-6 {
+		return nil, parseErrorf(4, -1, "Tag array length %v larger than remaining packet length %v", tlvLen, len(pkt)-6)
 	}
-
-	for len(pkt) > 0 {
-		if len(pkt) < 4 {
-			return nil, fmt.Errorf("%d bytes of trailing garbage at end of packet", len(pkt))
+	// Short discovery packets (e.g. a PADT with no tags) get padded
+	// to the minimum Ethernet frame size on the wire, and the padding
+	// is handed to us along with the packet. The PPPoE length field
+	// tells us where the real payload ends.
+	pkt = pkt[:6+tlvLen]
+
+	ret := []discoveryTag{}
+	for off := 6; off < len(pkt); {
+		if len(pkt)-off < 4 {
+			return nil, parseErrorf(off, -1, "%d bytes of trailing garbage at end of packet", len(pkt)-off)
 		}
 
-		tagType, tagLen := int(binary.BigEndian.Uint16(pkt[:2])), int(binary.BigEndian.Uint16(pkt[2:4]))
-		if len(pkt[4:]) < tagLen {
-			return nil, errors.New("tag declared length larger than remaining packet")
+		tagType, tagLen := int(binary.BigEndian.Uint16(pkt[off:off+2])), int(binary.BigEndian.Uint16(pkt[off+2:off+4]))
+		if len(pkt)-off-4 < tagLen {
+			return nil, parseErrorf(off+2, tagType, "tag declared length %d larger than remaining packet", tagLen)
 		}
 
-		tagValue := pkt[4 : 4+tagLen]
-		pkt = pkt[4+tagLen:]
+		ret = append(ret, discoveryTag{
+			Offset: off,
+			Type:   tagType,
+			Value:  pkt[off+4 : off+4+tagLen],
+		})
+		off += 4 + tagLen
+	}
+
+	return ret, nil
+}
 
-		if tagType == pppoeTagServiceName && tagLen != 0 {
-			return nil, errors.New("unexpected non-nil Service-Name tag")
-		}
+// parseDiscoveryPacket parses a PPPoE Discovery packet into a
+// discoveryPacket. Parse failures are reported as *ParseError.
+func parseDiscoveryPacket(pkt []byte) (*discoveryPacket, error) {
+	tags, err := parseDiscoveryTags(pkt)
+	if err != nil {
+		return nil, err
+	}
 
-		ret.Tags[tagType] = tagValue
+	ret := &discoveryPacket{
+		Code:      int(pkt[1]),
+		SessionID: binary.BigEndian.Uint16(pkt[2:4]),
+		Tags:      map[int][]byte{},
+	}
+	for _, tag := range tags {
+		ret.Tags[tag.Type] = tag.Value
 	}
 
 	return ret, nil
 }
 
-// encodeDiscoveryPacket marshals a PPPoE Discovery packet into raw bytes.
+// encodeDiscoveryPacket marshals a PPPoE Discovery packet into raw
+// bytes. Tags are encoded in ascending tag type order.
 func encodeDiscoveryPacket(pkt *discoveryPacket) []byte {
-	tlvLen, tlvs := 0, []int{}
-	for tlv, val := range pkt.Tags {
+	tlvs := []int{}
+	for tlv := range pkt.Tags {
 		tlvs = append(tlvs, tlv)
-		tlvLen += len(val)
 	}
 	sort.Ints(tlvs)
 
-	var ret bytes.Buffer
-	ret.WriteByte(0x11)            // Protocol version 1, packet type 1
-	ret.WriteByte(uint8(pkt.Code)) // PPPoE packet code
-	binary.Write(&ret, binary.BigEndian, uint16(pkt.SessionID))
-	binary.Write(&ret, binary.BigEndian, uint16(tlvLen+(4*len(pkt.Tags))))
-
+	tags := make([]discoveryTag, 0, len(tlvs))
 	for _, tlv := range tlvs {
-		val := pkt.Tags[tlv]
-		binary.Write(&ret, binary.BigEndian, uint16(tlv))
-		binary.Write(&ret, binary.BigEndian, uint16(len(val)))
-		ret.Write(val)
+		tags = append(tags, discoveryTag{Type: tlv, Value: pkt.Tags[tlv]})
+	}
+	return encodeDiscoveryTags(pkt.Code, pkt.SessionID, tags)
+}
+
+// encodeDiscoveryTags marshals a PPPoE Discovery packet with the given
+// code, session ID and tags into raw bytes. Tags are encoded in the
+// order given.
+func encodeDiscoveryTags(code int, sessionID uint16, tags []discoveryTag) []byte {
+	tlvLen := 0
+	for _, tag := range tags {
+		tlvLen += 4 + len(tag.Value)
+	}
+
+	var ret bytes.Buffer
+	ret.WriteByte(0x11)        // Protocol version 1, packet type 1
+	ret.WriteByte(uint8(code)) // PPPoE packet code
+	binary.Write(&ret, binary.BigEndian, sessionID)
+	binary.Write(&ret, binary.BigEndian, uint16(tlvLen))
+
+	for _, tag := range tags {
+		binary.Write(&ret, binary.BigEndian, uint16(tag.Type))
+		binary.Write(&ret, binary.BigEndian, uint16(len(tag.Value)))
+		ret.Write(tag.Value)
 	}
 
 	return ret.Bytes()
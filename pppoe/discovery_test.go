@@ -1,9 +1,24 @@
 package pppoe
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/mdlayher/raw"
 )
 
 func TestParseDiscovery(t *testing.T) {
@@ -48,6 +63,35 @@ func TestParseDiscovery(t *testing.T) {
 			},
 		},
 
+		{
+			desc: "PADT with Ethernet padding",
+			raw: append(
+				[]byte{0x11, 0xa7, 0x01, 0xeb, 0, 0},
+				make([]byte, 40)...),
+			want: &discoveryPacket{
+				Code:      0xa7,
+				SessionID: 0x01eb,
+				Tags:      map[int][]byte{},
+			},
+			skipUnparse: true, // Padding is not reproduced
+		},
+		{
+			desc: "PADO with Ethernet padding",
+			raw: []byte{
+				0x11, 7, 0, 0, 0, 11, 1, 1, 0, 0, 1, 4, 0, 3, 'N', 'O', 'M',
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			},
+			want: &discoveryPacket{
+				Code: 7,
+				Tags: map[int][]byte{
+					pppoeTagServiceName: []byte{},
+					pppoeTagCookie:      []byte("NOM"),
+				},
+			},
+			skipUnparse: true, // Padding is not reproduced
+		},
+
 		{
 			desc:    "short",
 			raw:     []byte{0x11},
@@ -74,122 +118,906 @@ func TestParseDiscovery(t *testing.T) {
 			wantErr: true,
 		},
 		{
-			desc:    "wrong service name",
-			raw:     []byte{0x11, 7, 0, 0, 0, 5, 1, 1, 0, 1, 'A'},
-			wantErr: true,
+			desc: "PADO with service name",
+			raw:  []byte{0x11, 7, 0, 0, 0, 5, 1, 1, 0, 1, 'A'},
+			want: &discoveryPacket{
+				Code: 7,
+				Tags: map[int][]byte{
+					pppoeTagServiceName: []byte("A"),
+				},
+			},
 		},
 		{
 			desc:    "overflowing Tags",
 			raw:     []byte{0x11, 7, 0, 0, 0, 4, 1, 1, 200, 200},
 			wantErr: true,
 		},
+	}
 
-		// These are some real packets, stolen from real ISP
-		// handshakes.
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			testParseDiscovery(t, test.raw, test.want, test.wantErr, test.skipUnparse)
+		})
+	}
+}
+
+func TestParseDiscoveryErrors(t *testing.T) {
+	tests := []struct {
+		desc string
+		raw  []byte
+		want *ParseError
+	}{
 		{
-			desc: "real isp PADI",
-			raw:  []byte{0x11, 0x09, 0x00, 0x00, 0x00, 0x04, 0x01, 0x01, 0x00, 0x00},
-			want: &discoveryPacket{
-				Code: 0x09,
-				Tags: map[int][]byte{
-					pppoeTagServiceName: []byte{},
-				},
-			},
+			desc: "short",
+			raw:  []byte{0x11},
+			want: &ParseError{Offset: 1, Tag: -1},
 		},
 		{
-			desc: "real isp PADO",
-			raw: []byte{
-				0x11, 0x07, 0x00, 0x00, 0x00, 0x38, 0x01, 0x02, 0x00, 0x1c,
-				0x74, 0x75, 0x6b, 0x77, 0x2d, 0x64, 0x73, 0x6c, 0x2d, 0x67,
-				0x77, 0x30, 0x31, 0x2e, 0x74, 0x75, 0x6b, 0x77, 0x2e, 0x71,
-				0x77, 0x65, 0x73, 0x74, 0x2e, 0x6e, 0x65, 0x74, 0x01, 0x01,
-				0x00, 0x00, 0x01, 0x04, 0x00, 0x10, 0x64, 0xb1, 0x40, 0x19,
-				0xe3, 0x6e, 0x03, 0xb6, 0x5c, 0x2f, 0xdb, 0x9e, 0x63, 0x88,
-				0x34, 0xdb,
-			},
-			want: &discoveryPacket{
-				Code:      0x07,
-				SessionID: 0,
-				Tags: map[int][]byte{
-					pppoeTagServiceName: []byte{},
-					pppoeTagACName:      []byte("tukw-dsl-gw01.tukw.qwest.net"),
-					pppoeTagCookie: []byte{
-						0x64, 0xb1, 0x40, 0x19, 0xe3, 0x6e, 0x03, 0xb6,
-						0x5c, 0x2f, 0xdb, 0x9e, 0x63, 0x88, 0x34, 0xdb,
-					},
-				},
-			},
-			skipUnparse: true, // Not idempotent due to ordering of Tags
+			desc: "not pppoe",
+			raw:  []byte{0, 0, 0, 0, 0, 0, 0, 0, 0},
+			want: &ParseError{Offset: 0, Tag: -1},
 		},
 		{
-			desc: "real isp PADR",
-			raw: []byte{
-				0x11, 0x19, 0x00, 0x00, 0x00, 0x18, 0x01, 0x01, 0x00, 0x00,
-				0x01, 0x04, 0x00, 0x10, 0x64, 0xb1, 0x40, 0x19, 0xe3, 0x6e,
-				0x03, 0xb6, 0x5c, 0x2f, 0xdb, 0x9e, 0x63, 0x88, 0x34, 0xdb,
-			},
-			want: &discoveryPacket{
-				Code:      0x19,
-				SessionID: 0,
-				Tags: map[int][]byte{
-					pppoeTagServiceName: []byte{},
-					pppoeTagCookie: []byte{
-						0x64, 0xb1, 0x40, 0x19, 0xe3, 0x6e, 0x03, 0xb6,
-						0x5c, 0x2f, 0xdb, 0x9e, 0x63, 0x88, 0x34, 0xdb,
-					},
-				},
-			},
+			desc: "long Tags array length",
+			raw:  []byte{0x11, 7, 0, 0, 200, 200, 1, 1, 0, 0},
+			want: &ParseError{Offset: 4, Tag: -1},
 		},
 		{
-			desc: "real isp PADS",
-			raw: []byte{
-				0x11, 0x65, 0x01, 0xeb, 0x00, 0x38, 0x01, 0x01, 0x00, 0x00,
-				0x01, 0x02, 0x00, 0x1c, 0x74, 0x75, 0x6b, 0x77, 0x2d, 0x64,
-				0x73, 0x6c, 0x2d, 0x67, 0x77, 0x30, 0x31, 0x2e, 0x74, 0x75,
-				0x6b, 0x77, 0x2e, 0x71, 0x77, 0x65, 0x73, 0x74, 0x2e, 0x6e,
-				0x65, 0x74, 0x01, 0x04, 0x00, 0x10, 0x64, 0xb1, 0x40, 0x19,
-				0xe3, 0x6e, 0x03, 0xb6, 0x5c, 0x2f, 0xdb, 0x9e, 0x63, 0x88,
-				0x34, 0xdb,
-			},
-			want: &discoveryPacket{
-				Code:      0x65,
-				SessionID: 0x01eb,
-				Tags: map[int][]byte{
-					pppoeTagServiceName: []byte{},
-					pppoeTagACName:      []byte("tukw-dsl-gw01.tukw.qwest.net"),
-					pppoeTagCookie: []byte{
-						0x64, 0xb1, 0x40, 0x19, 0xe3, 0x6e, 0x03, 0xb6,
-						0x5c, 0x2f, 0xdb, 0x9e, 0x63, 0x88, 0x34, 0xdb,
-					},
-				},
-			},
+			desc: "Tags trailing garbage",
+			raw:  []byte{0x11, 7, 0, 0, 0, 5, 1, 1, 0, 0, 0},
+			want: &ParseError{Offset: 10, Tag: -1},
+		},
+		{
+			desc: "overflowing second tag",
+			raw:  []byte{0x11, 7, 0, 0, 0, 8, 1, 1, 0, 0, 1, 4, 0, 1},
+			want: &ParseError{Offset: 12, Tag: pppoeTagCookie},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := parseDiscoveryPacket(test.raw)
+			got, ok := err.(*ParseError)
+			if !ok {
+				t.Fatalf("got error %#v, want a *ParseError", err)
+			}
+			if got.Offset != test.want.Offset || got.Tag != test.want.Tag {
+				t.Fatalf("wrong error location, got offset %d tag %d (%v), want offset %d tag %d", got.Offset, got.Tag, got, test.want.Offset, test.want.Tag)
+			}
+		})
+	}
+}
+
+func TestParsePADO(t *testing.T) {
+	tests := []struct {
+		desc        string
+		pado        *PacketBuilder
+		serviceName string
+		wantService []byte
+		wantErr     bool
+	}{
+		{
+			desc:        "any service",
+			pado:        NewPADO().WithServiceName(""),
+			wantService: []byte{},
+		},
+		{
+			desc:        "any service, named offer",
+			pado:        NewPADO().WithServiceName("isp-a").WithServiceName("isp-b"),
+			wantService: []byte("isp-a"),
+		},
+		{
+			desc:        "any service, exact match preferred",
+			pado:        NewPADO().WithServiceName("isp-a").WithServiceName(""),
+			wantService: []byte{},
+		},
+		{
+			desc:        "any service, no Service-Name",
+			pado:        NewPADO(),
+			wantService: nil,
+		},
+		{
+			desc:        "specific service",
+			pado:        NewPADO().WithServiceName("isp-a").WithServiceName("isp-b"),
+			serviceName: "isp-b",
+			wantService: []byte("isp-b"),
+		},
+		{
+			desc:        "specific service not offered",
+			pado:        NewPADO().WithServiceName("isp-a"),
+			serviceName: "isp-b",
+			wantErr:     true,
+		},
+		{
+			desc:        "specific service, no Service-Name",
+			pado:        NewPADO(),
+			serviceName: "isp-b",
+			wantErr:     true,
+		},
+		{
+			desc:    "error tag",
+			pado:    NewPADO().WithServiceName("").WithGenericError("go away"),
+			wantErr: true,
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.desc, func(t *testing.T) {
-			got, gotErr := parseDiscoveryPacket(test.raw)
-			if gotErr != nil && !test.wantErr {
-				t.Fatalf("unexpected error %v", gotErr)
-			} else if gotErr == nil && test.wantErr {
+			offer, err := parsePADO(test.pado.Bytes(), test.serviceName, nil)
+			if err != nil && !test.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			} else if err == nil && test.wantErr {
 				t.Fatalf("unexpected success")
 			}
 			if test.wantErr {
 				return
 			}
+			if diff := cmp.Diff(test.wantService, offer.service); diff != "" {
+				t.Fatalf("wrong service (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+// goldenHandshake is a captured PPPoE Discovery handshake, as stored
+// in testdata/*.json.
+type goldenHandshake struct {
+	Description string
+	Packets     []struct {
+		Desc        string
+		Raw         string
+		Code        int
+		SessionID   uint16 `json:"session_id"`
+		Tags        map[string]string
+		SkipUnparse bool `json:"skip_unparse"`
+	}
+}
+
+// decodeHex decodes a hex string, ignoring whitespace.
+func decodeHex(s string) ([]byte, error) {
+	return hex.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// TestParseDiscoveryGolden checks that handshakes captured from real
+// ISPs parse and unparse as expected.
+func TestParseDiscoveryGolden(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.json")
+	if err != nil {
+		t.Fatalf("listing golden files: %v", err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no golden files found in testdata/")
+	}
+
+	for _, file := range files {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading %s: %v", file, err)
+		}
+		var handshake goldenHandshake
+		if err := json.Unmarshal(bs, &handshake); err != nil {
+			t.Fatalf("decoding %s: %v", file, err)
+		}
+
+		for _, pkt := range handshake.Packets {
+			t.Run(filepath.Base(file)+"/"+pkt.Desc, func(t *testing.T) {
+				raw, err := decodeHex(pkt.Raw)
+				if err != nil {
+					t.Fatalf("decoding raw packet: %v", err)
+				}
+				want := &discoveryPacket{
+					Code:      pkt.Code,
+					SessionID: pkt.SessionID,
+					Tags:      map[int][]byte{},
+				}
+				for tag, val := range pkt.Tags {
+					tagType, err := strconv.ParseUint(tag, 0, 16)
+					if err != nil {
+						t.Fatalf("decoding tag type %q: %v", tag, err)
+					}
+					tagValue, err := decodeHex(val)
+					if err != nil {
+						t.Fatalf("decoding tag %q: %v", tag, err)
+					}
+					want.Tags[int(tagType)] = tagValue
+				}
+
+				testParseDiscovery(t, raw, want, false, pkt.SkipUnparse)
+			})
+		}
+	}
+}
+
+// testParseDiscovery checks that raw parses into want (or fails to
+// parse, if wantErr), and unless skipUnparse is set, that want
+// encodes back to raw.
+func testParseDiscovery(t *testing.T, raw []byte, want *discoveryPacket, wantErr, skipUnparse bool) {
+	t.Helper()
+
+	got, gotErr := parseDiscoveryPacket(raw)
+	if gotErr != nil && !wantErr {
+		t.Fatalf("unexpected error %v", gotErr)
+	} else if gotErr == nil && wantErr {
+		t.Fatalf("unexpected success")
+	}
+	if wantErr {
+		return
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("wrong parse: (-want +got)\n%s", diff)
+	}
+
+	// Also test that we can unparse the parsed packet back
+	// into their original form.
+	if !skipUnparse {
+		gotRaw := encodeDiscoveryPacket(got)
+		if diff := cmp.Diff(raw, gotRaw); diff != "" {
+			t.Fatalf("wrong unparse: (-want, +got)\n%s", diff)
+		}
+	}
+}
+
+// fakePacket is a packet in flight through a fakeConn. If err is
+// set, the read that receives the fakePacket fails with err instead.
+type fakePacket struct {
+	b    []byte
+	addr net.Addr
+	err  error
+}
+
+// fakeConn is an in-memory net.PacketConn. Packets pushed into In are
+// returned by ReadFrom, and packets passed to WriteTo come out of
+// Out.
+type fakeConn struct {
+	In  chan fakePacket
+	Out chan fakePacket
+
+	mu              sync.Mutex
+	readDeadline    time.Time
+	deadlineChanged chan struct{}
+	closed          chan struct{}
+	closeOnce       sync.Once
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		In:              make(chan fakePacket, 100),
+		Out:             make(chan fakePacket, 100),
+		deadlineChanged: make(chan struct{}),
+		closed:          make(chan struct{}),
+	}
+}
+
+type fakeTimeoutError struct{}
+
+func (fakeTimeoutError) Error() string   { return "i/o timeout" }
+func (fakeTimeoutError) Timeout() bool   { return true }
+func (fakeTimeoutError) Temporary() bool { return true }
+
+func (c *fakeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.readDeadline, c.deadlineChanged
+		c.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, fakeTimeoutError{}
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case pkt := <-c.In:
+			if pkt.err != nil {
+				return 0, nil, pkt.err
+			}
+			return copy(b, pkt.b), pkt.addr, nil
+		case <-timeout:
+			return 0, nil, fakeTimeoutError{}
+		case <-changed:
+			// Deadline changed, recompute.
+		case <-c.closed:
+			return 0, nil, errors.New("use of closed connection")
+		}
+	}
+}
+
+func (c *fakeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errors.New("use of closed connection")
+	default:
+	}
+	select {
+	case c.Out <- fakePacket{append([]byte(nil), b...), addr, nil}:
+		return len(b), nil
+	case <-c.closed:
+		return 0, errors.New("use of closed connection")
+	}
+}
+
+func (c *fakeConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeConn) LocalAddr() net.Addr { return &raw.Addr{} }
+
+func (c *fakeConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+func (c *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// fakeConcentrator answers discovery packets written to conn, as a
+// PPPoE concentrator at addr offering sessionID.
+func fakeConcentrator(conn *fakeConn, addr net.HardwareAddr, sessionID uint16) {
+	from := &raw.Addr{HardwareAddr: addr}
+	for {
+		select {
+		case pkt := <-conn.Out:
+			req, err := parseDiscoveryPacket(pkt.b)
+			if err != nil {
+				continue
+			}
+			var resp *discoveryPacket
+			switch req.Code {
+			case pppoePADI:
+				resp = &discoveryPacket{
+					Code: pppoePADO,
+					Tags: map[int][]byte{
+						pppoeTagServiceName: nil,
+						pppoeTagACName:      []byte("fake"),
+						pppoeTagCookie:      []byte("cookie"),
+					},
+				}
+			case pppoePADR:
+				if string(req.Tags[pppoeTagCookie]) != "cookie" {
+					continue
+				}
+				resp = &discoveryPacket{
+					Code:      pppoePADS,
+					SessionID: sessionID,
+					Tags: map[int][]byte{
+						pppoeTagServiceName: nil,
+					},
+				}
+			default:
+				continue
+			}
+			if hostUniq, ok := req.Tags[pppoeTagHostUniq]; ok {
+				resp.Tags[pppoeTagHostUniq] = hostUniq
+			}
+			if maxPayload, ok := req.Tags[pppoeTagPPPMaxPayload]; ok {
+				resp.Tags[pppoeTagPPPMaxPayload] = maxPayload
+			}
+			conn.In <- fakePacket{encodeDiscoveryPacket(resp), from, nil}
+		case <-conn.closed:
+			return
+		}
+	}
+}
+
+// discardWrites throws away everything written to conn.
+func discardWrites(conn *fakeConn) {
+	for {
+		select {
+		case <-conn.Out:
+		case <-conn.closed:
+			return
+		}
+	}
+}
 
+func TestDiscovery(t *testing.T) {
+	conn := newFakeConn()
+	defer conn.Close()
+	acAddr := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	go fakeConcentrator(conn, acAddr, 42)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	concentrator, sessionID, maxPayload, err := pppoeDiscovery(ctx, conn, nil)
+	if err != nil {
+		t.Fatalf("discovery failed: %v", err)
+	}
+	if concentrator.String() != acAddr.String() {
+		t.Errorf("wrong concentrator, got %s, want %s", concentrator, acAddr)
+	}
+	if sessionID != 42 {
+		t.Errorf("wrong session ID, got %d, want 42", sessionID)
+	}
+	if maxPayload != 1492 {
+		t.Errorf("wrong max payload, got %d, want 1492", maxPayload)
+	}
+
+	_, _, maxPayload, err = pppoeDiscovery(ctx, conn, &Config{MaxPayload: 1500})
+	if err != nil {
+		t.Fatalf("discovery with PPP-Max-Payload failed: %v", err)
+	}
+	if maxPayload != 1500 {
+		t.Errorf("wrong max payload, got %d, want 1500", maxPayload)
+	}
+}
+
+func TestSessionMaxPayload(t *testing.T) {
+	tests := []struct {
+		desc string
+		want int
+		tag  []byte
+		res  int
+	}{
+		{"not asked", 0, []byte{0x05, 0xdc}, 1492},
+		{"not echoed", 1500, nil, 1492},
+		{"agreed", 1500, []byte{0x05, 0xdc}, 1500},
+		{"smaller", 1500, []byte{0x05, 0xd8}, 1496},
+		{"larger", 1500, []byte{0x23, 0x28}, 1500},
+		{"below default", 1500, []byte{0x05, 0x00}, 1492},
+		{"malformed", 1500, []byte{0x05}, 1492},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			pads := NewPADS(42)
+			if test.tag != nil {
+				pads.WithTag(pppoeTagPPPMaxPayload, test.tag)
+			}
+			pkt, err := parsePADS(pads.Bytes(), nil)
+			if err != nil {
+				t.Fatalf("parsing PADS: %v", err)
+			}
+			if got := sessionMaxPayload(pkt, test.want); got != test.res {
+				t.Errorf("sessionMaxPayload(%d) = %d, want %d", test.want, got, test.res)
+			}
+		})
+	}
+}
+
+func TestDiscoveryRefused(t *testing.T) {
+	acAddr := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	tests := []struct {
+		desc string
+		pado *PacketBuilder
+		pads *PacketBuilder
+		want *ConcentratorError
+	}{
+		{
+			desc: "PADO",
+			pado: NewPADO().WithACSystemError("too many sessions"),
+			want: &ConcentratorError{Tag: "AC-System-Error", Message: "too many sessions"},
+		},
+		{
+			desc: "PADS",
+			pado: NewPADO().WithServiceName(""),
+			pads: NewPADS(0).WithServiceNameError("unknown service"),
+			want: &ConcentratorError{Tag: "Service-Name-Error", Message: "unknown service"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			conn := newFakeConn()
+			defer conn.Close()
+			go func() {
+				for {
+					select {
+					case pkt := <-conn.Out:
+						req, err := parseDiscoveryPacket(pkt.b)
+						if err != nil {
+							continue
+						}
+						resp := test.pado
+						if req.Code == pppoePADR {
+							resp = test.pads
+						}
+						resp.WithHostUniq(req.Tags[pppoeTagHostUniq])
+						conn.In <- fakePacket{resp.Bytes(), &raw.Addr{HardwareAddr: acAddr}, nil}
+					case <-conn.closed:
+						return
+					}
+				}
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, _, _, err := pppoeDiscovery(ctx, conn, &Config{HostUniq: []byte("uniq")})
+			if diff := cmp.Diff(test.want, err); diff != "" {
+				t.Fatalf("wrong discovery error (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHostUniq(t *testing.T) {
+	hostUniq := []byte("uniq")
+	tests := []struct {
+		desc    string
+		tag     []byte
+		wantErr bool
+	}{
+		{"echoed", []byte("uniq"), false},
+		{"missing", nil, true},
+		{"wrong", []byte("other"), true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			pado, pads := NewPADO().WithServiceName(""), NewPADS(42).WithServiceName("")
+			if test.tag != nil {
+				pado.WithHostUniq(test.tag)
+				pads.WithHostUniq(test.tag)
+			}
+			if _, err := parsePADO(pado.Bytes(), "", hostUniq); (err != nil) != test.wantErr {
+				t.Errorf("parsePADO returned %v, want error: %v", err, test.wantErr)
+			}
+			if _, err := parsePADS(pads.Bytes(), hostUniq); (err != nil) != test.wantErr {
+				t.Errorf("parsePADS returned %v, want error: %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadOfferSelect(t *testing.T) {
+	conn := newFakeConn()
+	defer conn.Close()
+	ac1 := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	ac2 := net.HardwareAddr{0, 1, 2, 3, 4, 6}
+	pado := func(name string) []byte {
+		return NewPADO().WithServiceName("").WithACName(name).WithCookie([]byte(name)).Bytes()
+	}
+	conn.In <- fakePacket{pado("busy"), &raw.Addr{HardwareAddr: ac1}, nil}
+	conn.In <- fakePacket{pado("busy"), &raw.Addr{HardwareAddr: ac1}, nil}
+	conn.In <- fakePacket{pado("idle"), &raw.Addr{HardwareAddr: ac2}, nil}
+
+	var got []Offer
+	cfg := &Config{
+		OfferWindow: 50 * time.Millisecond,
+		SelectOffer: func(offers []Offer) Offer {
+			got = offers
+			return offers[len(offers)-1]
+		},
+	}
+	offer, err := readOffer(context.Background(), conn, cfg, nil, discoveryTimeout)
+	if err != nil {
+		t.Fatalf("readOffer failed: %v", err)
+	}
+
+	want := []Offer{
+		{
+			Concentrator: ac1,
+			ACName:       "busy",
+			Cookie:       []byte("busy"),
+			Tags: []Tag{
+				{Type: pppoeTagServiceName, Value: []byte{}},
+				{Type: pppoeTagACName, Value: []byte("busy")},
+				{Type: pppoeTagCookie, Value: []byte("busy")},
+			},
+		},
+		{
+			Concentrator: ac2,
+			ACName:       "idle",
+			Cookie:       []byte("idle"),
+			Tags: []Tag{
+				{Type: pppoeTagServiceName, Value: []byte{}},
+				{Type: pppoeTagACName, Value: []byte("idle")},
+				{Type: pppoeTagCookie, Value: []byte("idle")},
+			},
+		},
+	}
+	ignoreUnexported := cmpopts.IgnoreUnexported(Offer{})
+	if diff := cmp.Diff(want, got, ignoreUnexported); diff != "" {
+		t.Fatalf("wrong offers passed to SelectOffer (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff(&want[1], offer, ignoreUnexported); diff != "" {
+		t.Fatalf("wrong offer selected (-want +got)\n%s", diff)
+	}
+
+	// Choosing a concentrator that didn't make an offer is an error.
+	conn.In <- fakePacket{pado("busy"), &raw.Addr{HardwareAddr: ac1}, nil}
+	cfg.SelectOffer = func([]Offer) Offer {
+		return Offer{Concentrator: ac2}
+	}
+	if _, err := readOffer(context.Background(), conn, cfg, nil, discoveryTimeout); err == nil || isTimeout(err) {
+		t.Fatalf("readOffer with bogus selection returned %v, want a non-timeout error", err)
+	}
+
+	// No offers is a timeout, which makes discovery send a new PADI.
+	if _, err := readOffer(context.Background(), conn, cfg, nil, discoveryTimeout); !isTimeout(err) {
+		t.Fatalf("readOffer without offers returned %v, want a timeout", err)
+	}
+}
+
+func TestDiscoveryDeadline(t *testing.T) {
+	conn := newFakeConn()
+	defer conn.Close()
+	go discardWrites(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, _, err := pppoeDiscovery(ctx, conn, nil); err != context.DeadlineExceeded {
+		t.Fatalf("wrong error, got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestDiscoveryCancel(t *testing.T) {
+	conn := newFakeConn()
+	defer conn.Close()
+	go discardWrites(conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, _, _, err := pppoeDiscovery(ctx, conn, nil); err != context.Canceled {
+		t.Fatalf("wrong error, got %v, want %v", err, context.Canceled)
+	}
+	// Cancellation should interrupt the wait for a PADO, rather than
+	// being noticed only at the next retransmission.
+	if elapsed := time.Since(start); elapsed >= discoveryTimeout {
+		t.Fatalf("discovery took %v to notice cancellation", elapsed)
+	}
+}
+
+func TestDiscoveryRetryTimeout(t *testing.T) {
+	tests := []struct {
+		desc  string
+		retry DiscoveryRetry
+		want  []time.Duration
+	}{
+		{
+			desc: "default",
+			want: []time.Duration{time.Second, time.Second, time.Second},
+		},
+		{
+			desc:  "constant",
+			retry: DiscoveryRetry{Timeout: 300 * time.Millisecond, Backoff: 0.5},
+			want:  []time.Duration{300 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond},
+		},
+		{
+			desc:  "backoff",
+			retry: DiscoveryRetry{Timeout: 100 * time.Millisecond, Backoff: 2},
+			want:  []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond},
+		},
+		{
+			desc:  "capped backoff",
+			retry: DiscoveryRetry{Timeout: 100 * time.Millisecond, Backoff: 3, MaxTimeout: 500 * time.Millisecond},
+			want:  []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 500 * time.Millisecond},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			var got []time.Duration
+			for i := range test.want {
+				got = append(got, test.retry.timeout(i))
+			}
 			if diff := cmp.Diff(test.want, got); diff != "" {
-				t.Fatalf("wrong parse: (-want +got)\n%s", diff)
+				t.Fatalf("wrong timeouts (-want +got)\n%s", diff)
 			}
+		})
+	}
+
+	retry := DiscoveryRetry{Timeout: time.Second, Jitter: 2}
+	for i := 0; i < 100; i++ {
+		if got := retry.timeout(0); got < 0 || got > 2*time.Second {
+			t.Fatalf("jittered timeout %v out of bounds", got)
+		}
+	}
+}
 
-			// Also test that we can unparse the parsed packet back
-			// into their original form.
-			if !test.skipUnparse {
-				gotRaw := encodeDiscoveryPacket(got)
-				if diff := cmp.Diff(test.raw, gotRaw); diff != "" {
-					t.Fatalf("wrong unparse: (-want, +got)\n%s", diff)
+func TestDiscoveryAttempts(t *testing.T) {
+	retry := DiscoveryRetry{Timeout: 10 * time.Millisecond, Attempts: 3}
+	tests := []struct {
+		desc    string
+		cfg     *Config
+		ac      bool
+		wantErr string
+		wantOut int
+	}{
+		{
+			desc:    "PADI",
+			cfg:     &Config{Discovery: DiscoveryConfig{PADI: retry}},
+			wantErr: "no PADO after 3 PADIs",
+			wantOut: 3,
+		},
+		{
+			desc:    "PADR",
+			cfg:     &Config{Discovery: DiscoveryConfig{PADR: retry}},
+			ac:      true,
+			wantErr: "no PADS after 3 PADRs",
+			wantOut: 4,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			conn := newFakeConn()
+			defer conn.Close()
+			// A concentrator that offers a session, but never confirms
+			// it.
+			sent := make(chan int, 1)
+			go func() {
+				n := 0
+				defer func() { sent <- n }()
+				for {
+					select {
+					case pkt := <-conn.Out:
+						n++
+						req, err := parseDiscoveryPacket(pkt.b)
+						if err != nil || req.Code != pppoePADI || !test.ac {
+							continue
+						}
+						pado := NewPADO().WithServiceName("").WithHostUniq(req.Tags[pppoeTagHostUniq])
+						conn.In <- fakePacket{pado.Bytes(), &raw.Addr{HardwareAddr: net.HardwareAddr{0, 1, 2, 3, 4, 5}}, nil}
+					case <-conn.closed:
+						return
+					}
 				}
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, _, _, err := pppoeDiscovery(ctx, conn, test.cfg)
+			if err == nil || err.Error() != test.wantErr {
+				t.Fatalf("wrong error, got %v, want %q", err, test.wantErr)
+			}
+			conn.Close()
+			// Packets that the concentrator didn't get to before the
+			// conn closed are still queued.
+			if got := <-sent + len(conn.Out); got != test.wantOut {
+				t.Fatalf("sent %d discovery packets, want %d", got, test.wantOut)
 			}
 		})
 	}
 }
+
+func TestReadPADT(t *testing.T) {
+	conn := newFakeConn()
+	defer conn.Close()
+	acAddr := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	evilAddr := net.HardwareAddr{6, 7, 8, 9, 10, 11}
+	padt := func(sessionID uint16) []byte {
+		return encodeDiscoveryPacket(&discoveryPacket{
+			Code:      pppoePADT,
+			SessionID: sessionID,
+		})
+	}
+
+	// Spoofed PADT for our session.
+	conn.In <- fakePacket{padt(42), &raw.Addr{HardwareAddr: evilAddr}, nil}
+	// Legitimate PADTs for other sessions.
+	conn.In <- fakePacket{padt(43), &raw.Addr{HardwareAddr: acAddr}, nil}
+	conn.In <- fakePacket{padt(42), &raw.Addr{HardwareAddr: evilAddr}, nil}
+	conn.In <- fakePacket{padt(43), &raw.Addr{HardwareAddr: evilAddr}, nil}
+
+	var spoofed uint64
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := readPADT(conn, acAddr, 42, &spoofed); !isTimeout(err) {
+		t.Fatalf("readPADT returned early with %v, want timeout", err)
+	}
+	if spoofed != 2 {
+		t.Errorf("wrong spoofed count, got %d, want 2", spoofed)
+	}
+
+	conn.In <- fakePacket{padt(42), &raw.Addr{HardwareAddr: acAddr}, nil}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	pkt, err := readPADT(conn, acAddr, 42, &spoofed)
+	if err != nil {
+		t.Fatalf("readPADT failed: %v", err)
+	}
+	if pkt.Code != pppoePADT || pkt.SessionID != 42 {
+		t.Errorf("readPADT returned wrong packet %#v", pkt)
+	}
+	if spoofed != 2 {
+		t.Errorf("wrong spoofed count, got %d, want 2", spoofed)
+	}
+}
+
+func TestConcentratorError(t *testing.T) {
+	tests := []struct {
+		desc string
+		tags map[int][]byte
+		want error
+	}{
+		{
+			desc: "no error",
+			tags: map[int][]byte{
+				pppoeTagACName: []byte("foo"),
+			},
+			want: nil,
+		},
+		{
+			desc: "generic error",
+			tags: map[int][]byte{
+				pppoeTagGenericError: []byte("Administrative disconnect"),
+			},
+			want: &ConcentratorError{
+				Tag:     "Generic-Error",
+				Message: "Administrative disconnect",
+			},
+		},
+		{
+			desc: "empty message",
+			tags: map[int][]byte{
+				pppoeTagACSystemError: nil,
+			},
+			want: &ConcentratorError{
+				Tag: "AC-System-Error",
+			},
+		},
+		{
+			desc: "several errors",
+			tags: map[int][]byte{
+				pppoeTagGenericError:     []byte("generic"),
+				pppoeTagServiceNameError: []byte("no such service"),
+			},
+			want: &ConcentratorError{
+				Tag:     "Service-Name-Error",
+				Message: "no such service",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got := concentratorError(&discoveryPacket{Code: pppoePADT, Tags: test.tags})
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Fatalf("wrong error: (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTransientErrors(t *testing.T) {
+	tests := []struct {
+		desc string
+		err  error
+		want bool
+	}{
+		{"ENOBUFS", syscall.ENOBUFS, true},
+		{"EINTR", syscall.EINTR, true},
+		{"wrapped", &net.OpError{Op: "read", Err: os.NewSyscallError("recvfrom", syscall.ENOBUFS)}, true},
+		{"EBADF", syscall.EBADF, false},
+		{"timeout", fakeTimeoutError{}, false},
+	}
+	for _, test := range tests {
+		if got := isTransient(test.err); got != test.want {
+			t.Errorf("isTransient(%s) = %v, want %v", test.desc, got, test.want)
+		}
+	}
+
+	conn := newFakeConn()
+	defer conn.Close()
+	pado := encodeDiscoveryPacket(&discoveryPacket{
+		Code: pppoePADO,
+		Tags: map[int][]byte{
+			pppoeTagServiceName: nil,
+		},
+	})
+	acAddr := &raw.Addr{HardwareAddr: net.HardwareAddr{0, 1, 2, 3, 4, 5}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for i := 0; i < maxTransientErrors; i++ {
+		conn.In <- fakePacket{nil, nil, syscall.ENOBUFS}
+	}
+	conn.In <- fakePacket{pado, acAddr, nil}
+	if _, err := readPADO(ctx, conn, "", nil); err != nil {
+		t.Fatalf("readPADO didn't retry transient errors: %v", err)
+	}
+
+	for i := 0; i <= maxTransientErrors; i++ {
+		conn.In <- fakePacket{nil, nil, syscall.ENOBUFS}
+	}
+	conn.In <- fakePacket{pado, acAddr, nil}
+	if _, err := readPADO(ctx, conn, "", nil); err != syscall.ENOBUFS {
+		t.Fatalf("readPADO returned %v after too many transient errors, want ENOBUFS", err)
+	}
+}
@@ -0,0 +1,356 @@
+package pppoe
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Netlink attributes of VLAN links, stolen from
+// /usr/include/linux/if_link.h.
+const (
+	iflaInfoData         = 2
+	iflaVLANID           = 1
+	iflaVLANEgressQOS    = 3
+	iflaVLANQOSMapping   = 1
+	sizeofVLANQOSMapping = 8
+)
+
+// createVLAN creates the 802.1Q VLAN interface for VLAN id on parent,
+// and brings it up. Frames sent through it are tagged with priority
+// code point pcp. It returns the name of the VLAN interface, and
+// whether it created it: if a VLAN interface of that name already
+// exists, for VLAN id and with priority pcp, createVLAN returns it as
+// is.
+func createVLAN(parent string, id, pcp int) (name string, created bool, err error) {
+	// Map the default socket priority, which all our frames have, to
+	// pcp.
+	qos := make([]byte, sizeofVLANQOSMapping)
+	*(*[2]uint32)(unsafe.Pointer(&qos[0])) = [2]uint32{0, uint32(pcp)}
+
+	name = fmt.Sprintf("%s.%d", parent, id)
+	info := netlinkAttr(iflaInfoData,
+		netlinkAttr(iflaVLANID, netlinkUint16(uint16(id))),
+		netlinkAttr(iflaVLANEgressQOS,
+			netlinkAttr(iflaVLANQOSMapping, qos)))
+	check := func(link *linkInfo) error {
+		if link.vlanID != id {
+			return fmt.Errorf("existing VLAN interface %s is for VLAN %d, not %d", name, link.vlanID, id)
+		}
+		if link.vlanPriority != pcp {
+			return fmt.Errorf("existing VLAN interface %s tags frames with priority %d, not %d", name, link.vlanPriority, pcp)
+		}
+		return nil
+	}
+	created, err = createLink(parent, name, "vlan", info, check)
+	return name, created, err
+}
+
+// createMACVLAN creates a macvlan interface with Ethernet address addr
+// on parent, and brings it up. It returns the name of the macvlan
+// interface, and whether it created it, like createVLAN.
+func createMACVLAN(parent string, addr net.HardwareAddr) (name string, created bool, err error) {
+	name = macvlanName(parent, addr)
+	check := func(link *linkInfo) error {
+		if !bytes.Equal(link.addr, addr) {
+			return fmt.Errorf("existing macvlan interface %s has address %v, not %v", name, link.addr, addr)
+		}
+		return nil
+	}
+	created, err = createLink(parent, name, "macvlan", nil, check, netlinkAttr(unix.IFLA_ADDRESS, addr))
+	return name, created, err
+}
+
+// macvlanName returns the name of the macvlan interface with address
+// addr on parent. Both don't fit in an interface name, so it's named
+// after a hash of them.
+func macvlanName(parent string, addr net.HardwareAddr) string {
+	h := fnv.New32a()
+	h.Write([]byte(parent))
+	h.Write([]byte{0})
+	h.Write(addr)
+	return fmt.Sprintf("pppoe%08x", h.Sum32())
+}
+
+// createLink creates the interface name, of the given kind, on top of
+// parent, with the link info data info and the extra link attributes
+// attrs, and brings it up. If an interface of that name already
+// exists, createLink leaves it alone, and returns false, provided that
+// it's of the same kind, on parent, and that check accepts it.
+func createLink(parent, name, kind string, info []byte, check func(*linkInfo) error, attrs ...[]byte) (created bool, err error) {
+	intf, err := net.InterfaceByName(parent)
+	if err != nil {
+		return false, fmt.Errorf("getting interface %v: %v", parent, err)
+	}
+	if len(name) >= unix.IFNAMSIZ {
+		return false, fmt.Errorf("%s interface name %q is too long", kind, name)
+	}
+
+	ifi := unix.IfInfomsg{
+		Family: unix.AF_UNSPEC,
+		Flags:  unix.IFF_UP,
+		Change: unix.IFF_UP,
+	}
+	attrs = append(attrs,
+		netlinkAttr(unix.IFLA_LINK, netlinkUint32(uint32(intf.Index))),
+		netlinkAttr(unix.IFLA_IFNAME, append([]byte(name), 0)),
+		netlinkAttr(unix.IFLA_LINKINFO, netlinkAttr(unix.IFLA_INFO_KIND, []byte(kind)), info))
+	err = rtnetlink(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, linkMsg(ifi), attrs...)
+	if err == unix.EEXIST {
+		link, err := getLink(name)
+		if err != nil {
+			return false, fmt.Errorf("getting existing interface %s: %v", name, err)
+		}
+		if link.kind != kind || link.parent != intf.Index {
+			return false, fmt.Errorf("existing interface %s isn't a %s interface on %s", name, kind, parent)
+		}
+		return false, check(link)
+	}
+	if err != nil {
+		return false, fmt.Errorf("creating %s interface %s: %v", kind, name, err)
+	}
+	return true, nil
+}
+
+// linkInfo is what getLink reports about an interface.
+type linkInfo struct {
+	// kind is the kind of a virtual interface, e.g. "vlan", and empty
+	// for physical ones.
+	kind string
+	// parent is the index of the interface that a virtual interface
+	// sits on, or 0.
+	parent int
+	addr   net.HardwareAddr
+	// vlanID is the VLAN ID of a VLAN interface, and vlanPriority the
+	// priority code point that it tags our frames with.
+	vlanID, vlanPriority int
+}
+
+// parseVLAN parses the link info data of a VLAN interface. The kernel
+// only reports the egress QoS mappings to non-zero priorities.
+func (l *linkInfo) parseVLAN(b []byte) {
+	for _, attr := range parseNetlinkAttrs(b) {
+		switch attr.Attr.Type {
+		case iflaVLANID:
+			if len(attr.Value) == 2 {
+				l.vlanID = int(*(*uint16)(unsafe.Pointer(&attr.Value[0])))
+			}
+		case iflaVLANEgressQOS:
+			for _, m := range parseNetlinkAttrs(attr.Value) {
+				if m.Attr.Type != iflaVLANQOSMapping || len(m.Value) != sizeofVLANQOSMapping {
+					continue
+				}
+				// Our frames have the default socket priority.
+				if mapping := *(*[2]uint32)(unsafe.Pointer(&m.Value[0])); mapping[0] == 0 {
+					l.vlanPriority = int(mapping[1])
+				}
+			}
+		}
+	}
+}
+
+// getLink returns the attributes of the interface name that
+// createLink cares about.
+func getLink(name string) (*linkInfo, error) {
+	intf, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	ifi := unix.IfInfomsg{
+		Family: unix.AF_UNSPEC,
+		Index:  int32(intf.Index),
+	}
+	msgs, err := rtnetlinkRequest(unix.RTM_GETLINK, 0, linkMsg(ifi))
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWLINK || len(m.Data) < unix.SizeofIfInfomsg {
+			continue
+		}
+		ret := &linkInfo{}
+		for _, attr := range parseNetlinkAttrs(m.Data[unix.SizeofIfInfomsg:]) {
+			switch attr.Attr.Type {
+			case unix.IFLA_ADDRESS:
+				ret.addr = net.HardwareAddr(attr.Value)
+			case unix.IFLA_LINK:
+				if len(attr.Value) == 4 {
+					ret.parent = int(*(*uint32)(unsafe.Pointer(&attr.Value[0])))
+				}
+			case unix.IFLA_LINKINFO:
+				for _, info := range parseNetlinkAttrs(attr.Value) {
+					switch info.Attr.Type {
+					case unix.IFLA_INFO_KIND:
+						ret.kind = string(bytes.TrimRight(info.Value, "\x00"))
+					case iflaInfoData:
+						ret.parseVLAN(info.Value)
+					}
+				}
+			}
+		}
+		return ret, nil
+	}
+	return nil, errors.New("no link in rtnetlink reply")
+}
+
+// deleteLink deletes the interface name.
+func deleteLink(name string) error {
+	intf, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("getting interface %v: %v", name, err)
+	}
+	ifi := unix.IfInfomsg{
+		Family: unix.AF_UNSPEC,
+		Index:  int32(intf.Index),
+	}
+	if err := rtnetlink(unix.RTM_DELLINK, 0, linkMsg(ifi)); err != nil {
+		return fmt.Errorf("deleting interface %s: %v", name, err)
+	}
+	return nil
+}
+
+// rtnetlink sends an rtnetlink request of type typ to the kernel, and
+// waits for its acknowledgement. hdr is the request's fixed header,
+// such as one that linkMsg returns.
+func rtnetlink(typ, flags uint16, hdr []byte, attrs ...[]byte) error {
+	_, err := rtnetlinkRequest(typ, flags, hdr, attrs...)
+	return err
+}
+
+// rtnetlinkRequest is like rtnetlink, but also returns the messages
+// that the kernel replies with before acknowledging the request.
+func rtnetlinkRequest(typ, flags uint16, hdr []byte, attrs ...[]byte) ([]syscall.NetlinkMessage, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(hdr))
+	msg = append(msg, hdr...)
+	for _, attr := range attrs {
+		msg = append(msg, attr...)
+	}
+	*(*unix.NlMsghdr)(unsafe.Pointer(&msg[0])) = unix.NlMsghdr{
+		Len:   uint32(len(msg)),
+		Type:  typ,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK | flags,
+		Seq:   1,
+	}
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var replies []syscall.NetlinkMessage
+	b := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, b, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(b[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != 1 {
+				continue
+			}
+			if m.Header.Type != unix.NLMSG_ERROR {
+				// b is reused by the next read.
+				m.Data = append([]byte(nil), m.Data...)
+				replies = append(replies, m)
+				continue
+			}
+			if len(m.Data) < 4 {
+				return nil, errors.New("truncated netlink ack")
+			}
+			// The ack is an error code, which is zero on success.
+			if errno := *(*int32)(unsafe.Pointer(&m.Data[0])); errno != 0 {
+				return nil, syscall.Errno(-errno)
+			}
+			return replies, nil
+		}
+	}
+}
+
+// linkMsg, addrMsg and routeMsg return the fixed headers of rtnetlink
+// requests about links, addresses and routes.
+func linkMsg(ifi unix.IfInfomsg) []byte {
+	ret := make([]byte, unix.SizeofIfInfomsg)
+	*(*unix.IfInfomsg)(unsafe.Pointer(&ret[0])) = ifi
+	return ret
+}
+
+func addrMsg(ifa unix.IfAddrmsg) []byte {
+	ret := make([]byte, unix.SizeofIfAddrmsg)
+	*(*unix.IfAddrmsg)(unsafe.Pointer(&ret[0])) = ifa
+	return ret
+}
+
+func routeMsg(rtm unix.RtMsg) []byte {
+	ret := make([]byte, unix.SizeofRtMsg)
+	*(*unix.RtMsg)(unsafe.Pointer(&ret[0])) = rtm
+	return ret
+}
+
+// netlinkAttr returns a netlink attribute of type typ, whose value is
+// the concatenation of values.
+func netlinkAttr(typ uint16, values ...[]byte) []byte {
+	ret := make([]byte, unix.SizeofRtAttr)
+	for _, v := range values {
+		ret = append(ret, v...)
+	}
+	*(*unix.RtAttr)(unsafe.Pointer(&ret[0])) = unix.RtAttr{
+		Len:  uint16(len(ret)),
+		Type: typ,
+	}
+	// Attributes are padded to 4 bytes.
+	for len(ret)%4 != 0 {
+		ret = append(ret, 0)
+	}
+	return ret
+}
+
+// parseNetlinkAttrs parses the netlink attributes in b, stopping at
+// the first malformed one.
+func parseNetlinkAttrs(b []byte) []syscall.NetlinkRouteAttr {
+	var ret []syscall.NetlinkRouteAttr
+	for len(b) >= unix.SizeofRtAttr {
+		attr := *(*unix.RtAttr)(unsafe.Pointer(&b[0]))
+		if int(attr.Len) < unix.SizeofRtAttr || int(attr.Len) > len(b) {
+			break
+		}
+		ret = append(ret, syscall.NetlinkRouteAttr{
+			Attr:  syscall.RtAttr{Len: attr.Len, Type: attr.Type &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)},
+			Value: b[unix.SizeofRtAttr:attr.Len],
+		})
+		// Attributes are padded to 4 bytes.
+		l := (int(attr.Len) + 3) &^ 3
+		if l > len(b) {
+			break
+		}
+		b = b[l:]
+	}
+	return ret
+}
+
+// netlinkUint16 and netlinkUint32 encode v in host byte order, like
+// netlink wants.
+func netlinkUint16(v uint16) []byte {
+	ret := make([]byte, 2)
+	*(*uint16)(unsafe.Pointer(&ret[0])) = v
+	return ret
+}
+
+func netlinkUint32(v uint32) []byte {
+	ret := make([]byte, 4)
+	*(*uint32)(unsafe.Pointer(&ret[0])) = v
+	return ret
+}
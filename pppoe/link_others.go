@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package pppoe
+
+import (
+	"net"
+	"runtime"
+)
+
+// VLAN and macvlan interfaces are created over rtnetlink, which only
+// exists on Linux.
+
+func errLinkUnsupported() error {
+	return &UnsupportedError{
+		Op:   "PPPoE over a VLAN or custom Ethernet address",
+		GOOS: runtime.GOOS,
+	}
+}
+
+func createVLAN(parent string, id, pcp int) (name string, created bool, err error) {
+	return "", false, errLinkUnsupported()
+}
+
+func createMACVLAN(parent string, addr net.HardwareAddr) (name string, created bool, err error) {
+	return "", false, errLinkUnsupported()
+}
+
+func deleteLink(name string) error {
+	return errLinkUnsupported()
+}
@@ -0,0 +1,103 @@
+package pppoe
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Logger receives events from a Conn, to show what it's doing: the
+// PPPoE Discovery packets it sends and receives, the progress of
+// discovery, and the setup and teardown of the session.
+//
+// The method set is deliberately small, so that adapters to other
+// logging packages are one-liners, and so that the rest of this
+// module's packages can take the same loggers.
+type Logger interface {
+	// Log records an event. msg says what happened, and keyvals are
+	// alternating keys and values that describe it, e.g. "peer",
+	// the concentrator's net.HardwareAddr, and "session", its
+	// uint16 session ID.
+	Log(msg string, keyvals ...interface{})
+}
+
+// NewStdLogger returns a Logger that prints events to l, one line
+// each, as the message followed by key=value pairs.
+func NewStdLogger(l *log.Logger) Logger {
+	return stdLogger{l}
+}
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (s stdLogger) Log(msg string, keyvals ...interface{}) {
+	var b bytes.Buffer
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var v interface{} = "(missing)"
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		val := fmt.Sprint(v)
+		if val == "" || strings.ContainsAny(val, " \"=") {
+			val = strconv.Quote(val)
+		}
+		fmt.Fprintf(&b, " %v=%s", keyvals[i], val)
+	}
+	s.l.Print(b.String())
+}
+
+// log sends an event to the Config's Logger, if it has one.
+func (c *Config) log(msg string, keyvals ...interface{}) {
+	if c == nil || c.Logger == nil {
+		return
+	}
+	c.Logger.Log(msg, keyvals...)
+}
+
+// discoveryCodeName returns the name of a Discovery packet code.
+func discoveryCodeName(code uint8) string {
+	if name, ok := discoveryCodeNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", code)
+}
+
+// logConn is a discovery conn that logs the packets it sends and
+// receives.
+type logConn struct {
+	net.PacketConn
+	cfg *Config
+}
+
+func (c *logConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, from, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, from, err
+	}
+	c.logPacket("received Discovery packet", "from", from, b[:n])
+	return n, from, err
+}
+
+func (c *logConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if err != nil {
+		c.cfg.log("sending Discovery packet failed", "to", addr, "error", err)
+		return n, err
+	}
+	c.logPacket("sent Discovery packet", "to", addr, b)
+	return n, err
+}
+
+func (c *logConn) logPacket(msg, dir string, addr net.Addr, b []byte) {
+	pkt, err := parseDiscoveryPacket(b)
+	if err != nil {
+		c.cfg.log(msg, dir, addr, "error", err)
+		return
+	}
+	c.cfg.log(msg, dir, addr, "code", discoveryCodeName(uint8(pkt.Code)), "session", pkt.SessionID)
+}
@@ -0,0 +1,81 @@
+package pppoe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"go.universe.tf/ppp/internal/testutil"
+)
+
+func TestStdLogger(t *testing.T) {
+	tests := []struct {
+		msg     string
+		keyvals []interface{}
+		want    string
+	}{
+		{"hello", nil, "hello\n"},
+		{"up", []interface{}{"session", uint16(42), "peer", net.HardwareAddr{2, 0, 0, 0, 0, 1}}, "up session=42 peer=02:00:00:00:00:01\n"},
+		{"down", []interface{}{"error", errors.New("no PADS"), "name", ""}, `down error="no PADS" name=""` + "\n"},
+		{"odd", []interface{}{"a", 1, "b"}, "odd a=1 b=(missing)\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		NewStdLogger(log.New(&buf, "", 0)).Log(test.msg, test.keyvals...)
+		if got := buf.String(); got != test.want {
+			t.Errorf("Log(%q, %v) = %q, want %q", test.msg, test.keyvals, got, test.want)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	ac := testutil.NewFakeAC()
+	defer ac.Close()
+
+	origInterface, origDiscoveryConn, origSessionConn := setupInterface, setupDiscoveryConn, setupSessionConn
+	defer func() {
+		setupInterface, setupDiscoveryConn, setupSessionConn = origInterface, origDiscoveryConn, origSessionConn
+	}()
+	setupInterface = func(string) (*net.Interface, error) { return ac.Interface(), nil }
+	setupDiscoveryConn = func(string) (net.PacketConn, error) { return ac.Discovery(), nil }
+	setupSessionConn = func(string) (net.PacketConn, error) { return ac.Session(), nil }
+
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+
+	var buf bytes.Buffer
+	conn, err := New(ctx, "fakeac0", &Config{
+		Userspace: true,
+		PADTCount: 1,
+		Logger:    NewStdLogger(log.New(&buf, "", 0)),
+	})
+	if err != nil {
+		t.Fatalf("PPPoE session setup failed: %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("closing PPPoE session: %v", err)
+	}
+
+	want := []string{
+		"sent Discovery packet to=ff:ff:ff:ff:ff:ff code=PADI session=0",
+		"received Discovery packet from=02:00:00:00:ac:01 code=PADO session=0",
+		"accepted PADO peer=02:00:00:00:ac:01 ac_name=fake",
+		"sent Discovery packet to=02:00:00:00:ac:01 code=PADR session=0",
+		"received Discovery packet from=02:00:00:00:ac:01 code=PADS session=42",
+		"accepted PADS peer=02:00:00:00:ac:01 session=42",
+		"PPPoE session up interface=fakeac0 peer=02:00:00:00:ac:01 session=42 max_payload=1492 userspace=true",
+		"closing PPPoE session session=42 terminate=true",
+		"sent Discovery packet to=02:00:00:00:ac:01 code=PADT session=42",
+	}
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong log (-want +got)\n%s", diff)
+	}
+}
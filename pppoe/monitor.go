@@ -0,0 +1,252 @@
+package pppoe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/mdlayher/raw"
+
+	"go.universe.tf/ppp/internal/cp"
+)
+
+// DiscoveryEvent is a PPPoE Discovery packet seen by RunMonitor.
+type DiscoveryEvent struct {
+	// Time is when the packet was received.
+	Time time.Time
+	// Source is the Ethernet address of the packet's sender.
+	Source net.HardwareAddr
+	// Code is the kind of Discovery packet, e.g. 0x09 for a PADI.
+	Code uint8
+	// SessionID is the packet's PPPoE session ID.
+	SessionID uint16
+	// Tags are the packet's tags, in the order they appeared.
+	Tags []Tag
+	// Err is why the packet couldn't be parsed, usually a
+	// *ParseError. Code, SessionID and Tags are unset if it's
+	// non-nil.
+	Err error
+	// Packet is the raw packet, without its Ethernet header.
+	Packet []byte
+}
+
+// discoveryCodeNames are the names of the PPPoE Discovery codes.
+var discoveryCodeNames = map[uint8]string{
+	pppoePADI: "PADI",
+	pppoePADO: "PADO",
+	pppoePADR: "PADR",
+	pppoePADS: "PADS",
+	pppoePADT: "PADT",
+}
+
+// discoveryTagNames are the names of the PPPoE Discovery tags, as
+// RFC 2516 and RFC 4638 spell them.
+var discoveryTagNames = map[int]string{
+	pppoeTagServiceName:      "Service-Name",
+	pppoeTagACName:           "AC-Name",
+	pppoeTagHostUniq:         "Host-Uniq",
+	pppoeTagCookie:           "AC-Cookie",
+	pppoeTagVendorSpecific:   "Vendor-Specific",
+	pppoeTagRelaySessionID:   "Relay-Session-Id",
+	pppoeTagPPPMaxPayload:    "PPP-Max-Payload",
+	pppoeTagServiceNameError: "Service-Name-Error",
+	pppoeTagACSystemError:    "AC-System-Error",
+	pppoeTagGenericError:     "Generic-Error",
+}
+
+// wiresharkTagFields maps Discovery tag types to the field names that
+// Wireshark's PPPoE dissector uses for their values. String-valued
+// tags are listed in wiresharkStringTags, and PPP-Max-Payload, which
+// Wireshark decodes as a number, is handled by MarshalJSON.
+var wiresharkTagFields = map[int]string{
+	pppoeTagServiceName:      "pppoed.tags.service_name",
+	pppoeTagACName:           "pppoed.tags.ac_name",
+	pppoeTagHostUniq:         "pppoed.tags.host_uniq",
+	pppoeTagCookie:           "pppoed.tags.ac_cookie",
+	pppoeTagRelaySessionID:   "pppoed.tags.relay_session_id",
+	pppoeTagServiceNameError: "pppoed.tags.service_name_error",
+	pppoeTagACSystemError:    "pppoed.tags.ac_system_error",
+	pppoeTagGenericError:     "pppoed.tags.generic_error",
+}
+
+var wiresharkStringTags = map[int]bool{
+	pppoeTagServiceName:      true,
+	pppoeTagACName:           true,
+	pppoeTagServiceNameError: true,
+	pppoeTagACSystemError:    true,
+	pppoeTagGenericError:     true,
+}
+
+// String describes the event on one line, with string-valued tags
+// quoted and the others in colon-separated hex, e.g.
+//
+//	02:00:00:00:00:02 PADO session 0x0000: Service-Name="" AC-Name="bras1"
+func (e *DiscoveryEvent) String() string {
+	var ret bytes.Buffer
+	ret.WriteString(e.Source.String())
+	if e.Err != nil {
+		fmt.Fprintf(&ret, " malformed Discovery packet: %v", e.Err)
+		return ret.String()
+	}
+
+	name, ok := discoveryCodeNames[e.Code]
+	if !ok {
+		name = fmt.Sprintf("code 0x%02x", e.Code)
+	}
+	fmt.Fprintf(&ret, " %s session 0x%04x:", name, e.SessionID)
+	for _, tag := range e.Tags {
+		name, ok := discoveryTagNames[int(tag.Type)]
+		if !ok {
+			name = fmt.Sprintf("0x%04x", tag.Type)
+		}
+		if wiresharkStringTags[int(tag.Type)] {
+			fmt.Fprintf(&ret, " %s=%s", name, strconv.Quote(string(tag.Value)))
+		} else {
+			fmt.Fprintf(&ret, " %s=%s", name, cp.WiresharkBytes(tag.Value))
+		}
+	}
+	return ret.String()
+}
+
+// MarshalJSON encodes the event's packet using the field names and
+// value formatting of the PPPoE layer of Wireshark's JSON export
+// (tshark -T json), so that our parse can be diffed against
+// Wireshark's. Malformed packets are encoded as a _ws.malformed field
+// holding Err.
+func (e *DiscoveryEvent) MarshalJSON() ([]byte, error) {
+	if e.Err != nil {
+		return json.Marshal(map[string]string{"_ws.malformed": e.Err.Error()})
+	}
+
+	type tag map[string]string
+	ret := struct {
+		Version       string `json:"pppoe.version"`
+		Type          string `json:"pppoe.type"`
+		Code          string `json:"pppoe.code"`
+		SessionID     string `json:"pppoe.session_id"`
+		PayloadLength string `json:"pppoe.payload_length"`
+		Tags          []tag  `json:"pppoed.tags"`
+	}{
+		Version:   "1",
+		Type:      "1",
+		Code:      fmt.Sprintf("0x%02x", e.Code),
+		SessionID: fmt.Sprintf("0x%04x", e.SessionID),
+		Tags:      []tag{},
+	}
+
+	tlvLen := 0
+	for _, t := range e.Tags {
+		tlvLen += 4 + len(t.Value)
+		ret.Tags = append(ret.Tags, tag{
+			"pppoed.tag":        fmt.Sprintf("0x%04x", t.Type),
+			"pppoed.tag_length": strconv.Itoa(len(t.Value)),
+		})
+		field, ok := wiresharkTagFields[int(t.Type)]
+		if !ok {
+			field = "pppoed.tag_unknown_data"
+		}
+		switch {
+		case t.Type == pppoeTagPPPMaxPayload && len(t.Value) == 2:
+			ret.Tags[len(ret.Tags)-1]["pppoed.tags.max_payload"] = strconv.Itoa(int(binary.BigEndian.Uint16(t.Value)))
+		case wiresharkStringTags[int(t.Type)]:
+			ret.Tags[len(ret.Tags)-1][field] = string(t.Value)
+		default:
+			ret.Tags[len(ret.Tags)-1][field] = cp.WiresharkBytes(t.Value)
+		}
+	}
+	// Prefer the length on the wire, which includes any padding
+	// after the last tag.
+	if len(e.Packet) >= 6 {
+		tlvLen = int(binary.BigEndian.Uint16(e.Packet[4:6]))
+	}
+	ret.PayloadLength = strconv.Itoa(tlvLen)
+
+	return json.Marshal(ret)
+}
+
+// newMonitorConn returns a Discovery conn on ifName that also sees
+// packets addressed to other hosts, so that PADOs and PADSs sent to
+// other clients on the segment show up.
+func newMonitorConn(ifName string) (net.PacketConn, error) {
+	conn, err := newDiscoveryConn(ifName)
+	if err != nil {
+		return nil, err
+	}
+	if rc, ok := conn.(*rawConn); ok {
+		if err := rc.SetPromiscuous(true); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("enabling promiscuous mode on %s: %v", ifName, err)
+		}
+	}
+	return conn, nil
+}
+
+// setupMonitorConn is newMonitorConn, as a variable so that tests can
+// monitor fake conns.
+var setupMonitorConn = newMonitorConn
+
+// RunMonitor passively watches PPPoE Discovery on the network
+// interface ifName, and sends every packet it sees to events, until
+// ctx is canceled or reading fails. It never sends anything on the
+// network, so it's safe to run next to live clients and
+// concentrators, to find out why discovery fails on a segment.
+//
+// Malformed packets are reported too, with Err set. While RunMonitor
+// waits for events to take a packet, later ones queue up in the
+// kernel, which drops them once its buffer is full. events isn't
+// closed when RunMonitor returns.
+func RunMonitor(ctx context.Context, ifName string, events chan<- *DiscoveryEvent) error {
+	conn, err := setupMonitorConn(ifName)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return monitor(ctx, conn, events)
+}
+
+// monitor reads Discovery packets from conn and sends them to events,
+// until ctx is canceled or reading fails.
+func monitor(ctx context.Context, conn net.PacketConn, events chan<- *DiscoveryEvent) error {
+	stop := cp.WatchContext(ctx, conn)
+	defer stop()
+
+	var b [pppoeBufferLen]byte
+	for {
+		n, from, err := readFrom(conn, b[:])
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		ev := &DiscoveryEvent{
+			Time:   time.Now(),
+			Packet: append([]byte(nil), b[:n]...),
+		}
+		if addr, ok := from.(*raw.Addr); ok {
+			ev.Source = addr.HardwareAddr
+		}
+		tags, err := parseDiscoveryTags(ev.Packet)
+		if err != nil {
+			ev.Err = err
+		} else {
+			ev.Code = ev.Packet[1]
+			ev.SessionID = binary.BigEndian.Uint16(ev.Packet[2:4])
+			for _, tag := range tags {
+				ev.Tags = append(ev.Tags, Tag{Type: uint16(tag.Type), Value: tag.Value})
+			}
+		}
+
+		select {
+		case events <- ev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package pppoe
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/raw"
+)
+
+func TestMonitor(t *testing.T) {
+	origMonitorConn := setupMonitorConn
+	defer func() { setupMonitorConn = origMonitorConn }()
+	conn := newFakeConn()
+	setupMonitorConn = func(string) (net.PacketConn, error) { return conn, nil }
+
+	client := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	ac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	pkts := []struct {
+		from net.HardwareAddr
+		pkt  []byte
+		want string
+	}{
+		{
+			from: client,
+			pkt:  NewPADI().WithServiceName("").WithHostUniq([]byte{1, 2}).Bytes(),
+			want: `02:00:00:00:00:01 PADI session 0x0000: Service-Name="" Host-Uniq=01:02`,
+		},
+		{
+			from: ac,
+			pkt:  NewPADO().WithServiceName("isp").WithACName("bras1").WithTag(0x0999, []byte{9}).Bytes(),
+			want: `02:00:00:00:00:02 PADO session 0x0000: Service-Name="isp" AC-Name="bras1" 0x0999=09`,
+		},
+		{
+			from: ac,
+			pkt:  NewPADS(42).WithServiceNameError("no such service").Bytes(),
+			want: `02:00:00:00:00:02 PADS session 0x002a: Service-Name-Error="no such service"`,
+		},
+		{
+			from: ac,
+			pkt:  []byte{0x11, 0x42, 0, 0, 0, 0},
+			want: `02:00:00:00:00:02 code 0x42 session 0x0000:`,
+		},
+		{
+			from: client,
+			pkt:  []byte{0x11, pppoePADI, 0, 0, 0, 8, 1, 1},
+			want: `02:00:00:00:00:01 malformed Discovery packet: offset 4: Tag array length 8 larger than remaining packet length 2`,
+		},
+	}
+	for _, p := range pkts {
+		conn.In <- fakePacket{p.pkt, &raw.Addr{HardwareAddr: p.from}, nil}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan *DiscoveryEvent)
+	done := make(chan error, 1)
+	go func() {
+		done <- RunMonitor(ctx, "eth0", events)
+	}()
+
+	for _, p := range pkts {
+		select {
+		case ev := <-events:
+			if got := ev.String(); got != p.want {
+				t.Errorf("wrong event\ngot:  %s\nwant: %s", got, p.want)
+			}
+			if diff := cmp.Diff(p.pkt, ev.Packet); diff != "" {
+				t.Errorf("wrong raw packet (-want +got)\n%s", diff)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for Discovery event")
+		}
+	}
+
+	// The monitor only listens.
+	expectNoPacket(t, conn)
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("RunMonitor returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunMonitor didn't return after cancellation")
+	}
+}
+
+func TestDiscoveryEventJSON(t *testing.T) {
+	// Tags are encoded in the order they appeared in, like Wireshark
+	// does.
+	pkt := NewPADS(0x01eb).
+		WithACName("tukw-dsl-gw01.tukw.qwest.net").
+		WithServiceName("").
+		WithCookie([]byte{0x64, 0xb1, 0x40, 0x19}).
+		WithTag(0x0105, []byte{0, 0, 0x0d, 0xe9}).
+		WithTag(pppoeTagPPPMaxPayload, []byte{0x05, 0xdc}).
+		Bytes()
+	ev := &DiscoveryEvent{
+		Code:      pppoePADS,
+		SessionID: 0x01eb,
+		Tags: []Tag{
+			{pppoeTagACName, []byte("tukw-dsl-gw01.tukw.qwest.net")},
+			{pppoeTagServiceName, []byte{}},
+			{pppoeTagCookie, []byte{0x64, 0xb1, 0x40, 0x19}},
+			{0x0105, []byte{0, 0, 0x0d, 0xe9}},
+			{pppoeTagPPPMaxPayload, []byte{0x05, 0xdc}},
+		},
+		Packet: pkt,
+	}
+	want := `{
+  "pppoe.version": "1",
+  "pppoe.type": "1",
+  "pppoe.code": "0x65",
+  "pppoe.session_id": "0x01eb",
+  "pppoe.payload_length": "58",
+  "pppoed.tags": [
+    {
+      "pppoed.tag": "0x0102",
+      "pppoed.tag_length": "28",
+      "pppoed.tags.ac_name": "tukw-dsl-gw01.tukw.qwest.net"
+    },
+    {
+      "pppoed.tag": "0x0101",
+      "pppoed.tag_length": "0",
+      "pppoed.tags.service_name": ""
+    },
+    {
+      "pppoed.tag": "0x0104",
+      "pppoed.tag_length": "4",
+      "pppoed.tags.ac_cookie": "64:b1:40:19"
+    },
+    {
+      "pppoed.tag": "0x0105",
+      "pppoed.tag_length": "4",
+      "pppoed.tag_unknown_data": "00:00:0d:e9"
+    },
+    {
+      "pppoed.tag": "0x0120",
+      "pppoed.tag_length": "2",
+      "pppoed.tags.max_payload": "1500"
+    }
+  ]
+}`
+
+	got, err := json.MarshalIndent(ev, "", "  ")
+	if err != nil {
+		t.Fatalf("marshaling event: %v", err)
+	}
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Fatalf("wrong JSON: (-want +got)\n%s", diff)
+	}
+
+	ev = &DiscoveryEvent{Err: &ParseError{Offset: 6, Tag: -1, Msg: "truncated"}, Packet: pkt[:7]}
+	got, err = json.Marshal(ev)
+	if err != nil {
+		t.Fatalf("marshaling malformed event: %v", err)
+	}
+	if want := `{"_ws.malformed":"` + ev.Err.Error() + `"}`; string(got) != want {
+		t.Errorf("wrong JSON for malformed event: got %s, want %s", got, want)
+	}
+}
@@ -1,12 +1,29 @@
-// Package pppoe creates a PPPoE session with a remote server.
+// Package pppoe creates a PPPoE session with a remote server. It can
+// also relay PPPoE between two network segments, see RunRelay.
+//
+// By default, sessions rely on the Linux kernel's PPPoE and PPP
+// drivers, which NewUnit hands the session to for IP traffic. With
+// Config.Userspace, the Conn frames the session itself, on a raw
+// socket, which works without those drivers, such as in containers
+// without /dev/ppp, and on other operating systems with raw socket
+// support. On those, New fails with an *UnsupportedError unless
+// Config.Userspace is set, and Config.VLANID and
+// Config.HardwareAddr aren't supported.
 package pppoe // import "go.universe.tf/ppp/pppoe"
 
 import (
 	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,17 +41,334 @@ type Addr struct {
 func (a *Addr) Network() string { return "pppoe" }
 func (a *Addr) String() string  { return a.HardwareAddr.String() }
 
+// UnsupportedError is returned when an operation needs kernel support
+// that is not available on the current operating system.
+type UnsupportedError struct {
+	// Op is the operation that was attempted.
+	Op string
+	// GOOS is the operating system that lacks support for Op.
+	GOOS string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("%s is not supported on %s", e.Op, e.GOOS)
+}
+
+// ConcentratorError is an error reported by the PPPoE concentrator,
+// using one of the error tags defined in RFC 2516. New returns one
+// when the concentrator refuses the session in its PADO or PADS, and
+// CloseReason when it tears the session down with an error.
+type ConcentratorError struct {
+	// Tag is the name of the error tag the concentrator sent:
+	// "Service-Name-Error", "AC-System-Error" or "Generic-Error".
+	Tag string
+	// Message is the human-readable explanation provided by the
+	// concentrator. It may be empty.
+	Message string
+}
+
+func (e *ConcentratorError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("concentrator reported %s", e.Tag)
+	}
+	return fmt.Sprintf("concentrator reported %s: %q", e.Tag, e.Message)
+}
+
+// ErrTerminated is the CloseReason of a session that the concentrator
+// tore down without saying why.
+var ErrTerminated = errors.New("PPPoE session terminated by concentrator")
+
+// Config configures a Conn. A nil *Config is equivalent to the zero
+// Config, which uses sensible defaults for everything.
+type Config struct {
+	// PADTCount is how many PADTs Close sends to tear down the
+	// session. PADTs aren't acknowledged, so sending a few makes it
+	// more likely that the concentrator learns that the session
+	// ended, and doesn't refuse a redial because of a stale session.
+	// Zero means 3.
+	PADTCount int
+	// PADTInterval is how long Close waits between PADTs. Zero means
+	// 100ms.
+	PADTInterval time.Duration
+	// ServiceName is the PPPoE Service-Name to request during
+	// discovery. Concentrators that don't offer it are ignored. Empty
+	// means any service, which is what most ISPs expect, but
+	// multi-service access networks may require a specific one.
+	ServiceName string
+	// SelectOffer, if set, chooses the concentrator to set up the
+	// session with. Discovery collects the PADOs that arrive within
+	// OfferWindow of sending a PADI, and passes them to SelectOffer,
+	// which must return one of them. If it's nil, discovery takes the
+	// first PADO it gets, which may come from an overloaded
+	// concentrator on networks that have several.
+	SelectOffer func([]Offer) Offer
+	// OfferWindow is how long discovery collects PADOs for
+	// SelectOffer. Zero means 1s.
+	OfferWindow time.Duration
+	// Discovery is how discovery retransmits PADIs and PADRs that get
+	// no reply. The zero value retries every second until New's
+	// context is done.
+	Discovery DiscoveryConfig
+	// HostUniq is the value of the Host-Uniq tag that discovery sends
+	// in PADIs and PADRs, and that concentrators must echo back.
+	// Replies that don't are ignored, so that hosts (or Conns) that
+	// run discovery on the same segment at the same time don't pick
+	// up each other's sessions. Empty means a random value.
+	HostUniq []byte
+	// MaxPayload is the largest PPP payload to ask the concentrator
+	// for, with RFC 4638's PPP-Max-Payload tag. Access networks that
+	// carry 1508-byte "baby jumbo" Ethernet frames can run PPP with a
+	// full 1500-byte MTU this way, instead of 1492. The interface's
+	// MTU must be at least MaxPayload+8. Conn.MaxPayload reports what
+	// the concentrator agreed to. Zero, or anything up to 1492, means
+	// standard 1492-byte payloads.
+	//
+	// Attach, which runs no discovery, takes MaxPayload to have been
+	// agreed to when the session was set up.
+	MaxPayload int
+	// VLANID, if not zero, runs PPPoE on that 802.1Q VLAN of the
+	// interface, as many ISPs require (e.g. VLAN 7 or 835). The Conn
+	// creates a VLAN interface for it, named after the interface and
+	// the VLAN ID (e.g. eth0.7), and deletes it when closed, but not
+	// when detached. An existing interface of that name is used, and
+	// left alone, if it's a VLAN interface on the interface for that
+	// VLAN ID and VLANPriority; otherwise New fails. Creating the
+	// VLAN interface requires CAP_NET_ADMIN, and is only supported on
+	// Linux.
+	VLANID int
+	// VLANPriority is the 802.1Q priority code point, from 0 to 7,
+	// of the frames that the Conn sends on its VLAN.
+	VLANPriority int
+	// HardwareAddr, if set, is the Ethernet address to run PPPoE
+	// from, instead of the interface's own, for ISPs that lock
+	// sessions to a registered address. The Conn creates a macvlan
+	// interface with that address on the interface (or its VLAN),
+	// and deletes it like a VLAN interface. It's named pppoe
+	// followed by a hash of the interface's name and the address
+	// (e.g. pppoe5c0d1a2b), and an existing interface of that name
+	// is used, and left alone, if it's a macvlan interface with that
+	// address on the interface; otherwise New fails. This requires
+	// CAP_NET_ADMIN, and is only supported on Linux.
+	HardwareAddr net.HardwareAddr
+	// Userspace makes the Conn do PPPoE session framing itself, on a
+	// raw socket, instead of using the kernel's AF_PPPOX and
+	// /dev/ppp. It works where those are unavailable, such as in
+	// containers without /dev/ppp, or on other OSes than Linux, at
+	// the cost of copying every frame through the process. NewUnit
+	// fails on such Conns.
+	Userspace bool
+	// Capture, if set, receives a pcapng capture of the packets that
+	// the Conn sends and receives, each with its direction and
+	// timestamp, so that failed negotiations can be opened in
+	// Wireshark. It covers PPPoE Discovery, including other hosts'
+	// packets that the discovery socket sees, and the PPP frames of
+	// the session, with the PPPoE and Ethernet headers they have on
+	// the wire. Capture is written one packet at a time, and the
+	// capture stops at the first write error.
+	Capture io.Writer
+	// Logger, if set, receives events describing what the Conn is
+	// doing, from discovery to teardown. It's called synchronously,
+	// from several goroutines, so it must be safe for concurrent use
+	// and shouldn't block.
+	Logger Logger
+}
+
+// DiscoveryConfig configures the retransmission of PPPoE discovery
+// packets. Tuning it trades how quickly discovery converges on a
+// flaky link against how much broadcast noise it makes.
+type DiscoveryConfig struct {
+	// PADI is the retry policy for PADIs. Its Timeout doesn't apply
+	// when Config.SelectOffer is set, since discovery then waits for
+	// OfferWindow after each PADI.
+	PADI DiscoveryRetry
+	// PADR is the retry policy for PADRs.
+	PADR DiscoveryRetry
+}
+
+// DiscoveryRetry is the retry policy for one kind of discovery
+// packet.
+type DiscoveryRetry struct {
+	// Timeout is how long to wait for a reply to the first packet.
+	// Zero means 1s.
+	Timeout time.Duration
+	// Backoff is the factor by which the timeout grows after each
+	// unanswered packet. Values of 1 or less keep it constant.
+	Backoff float64
+	// MaxTimeout caps the timeout as it grows. Zero means no cap.
+	MaxTimeout time.Duration
+	// Jitter is the fraction of each timeout by which it's randomly
+	// lengthened or shortened, so that hosts that lost their link at
+	// the same time don't retransmit in lockstep. It's clamped to
+	// [0, 1]. Zero means no jitter.
+	Jitter float64
+	// Attempts is how many packets to send before giving up. Zero
+	// means no limit.
+	Attempts int
+}
+
+// timeout returns how long to wait for a reply to the attempt'th
+// packet, counting from 0.
+func (r DiscoveryRetry) timeout(attempt int) time.Duration {
+	ret := float64(r.Timeout)
+	if ret <= 0 {
+		ret = float64(discoveryTimeout)
+	}
+	if r.Backoff > 1 {
+		ret *= math.Pow(r.Backoff, float64(attempt))
+	}
+	if r.MaxTimeout > 0 && ret > float64(r.MaxTimeout) {
+		ret = float64(r.MaxTimeout)
+	}
+	if jitter := math.Min(r.Jitter, 1); jitter > 0 {
+		jitterMu.Lock()
+		ret *= 1 + jitter*(2*jitterRand.Float64()-1)
+		jitterMu.Unlock()
+	}
+	return time.Duration(ret)
+}
+
+// jitterRand is the source of DiscoveryRetry jitter. The global
+// math/rand source starts out the same in every process, which would
+// put hosts that lost their link together back in lockstep, so it's
+// seeded from crypto/rand, or failing that the time.
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(jitterSeed()))
+)
+
+func jitterSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.BigEndian.Uint64(b[:]))
+}
+
+func (c *Config) discovery() DiscoveryConfig {
+	if c == nil {
+		return DiscoveryConfig{}
+	}
+	return c.Discovery
+}
+
+func (c *Config) serviceName() string {
+	if c == nil {
+		return ""
+	}
+	return c.ServiceName
+}
+
+func (c *Config) offerWindow() time.Duration {
+	if c == nil || c.OfferWindow <= 0 {
+		return time.Second
+	}
+	return c.OfferWindow
+}
+
+// maxPayload returns the PPP-Max-Payload to ask for, or zero if the
+// Conn should stick to defaultMaxPayload.
+func (c *Config) maxPayload() int {
+	if c == nil || c.MaxPayload <= defaultMaxPayload {
+		return 0
+	}
+	return c.MaxPayload
+}
+
+func (c *Config) vlan() (id, priority int) {
+	if c == nil {
+		return 0, 0
+	}
+	return c.VLANID, c.VLANPriority
+}
+
+func (c *Config) hardwareAddr() net.HardwareAddr {
+	if c == nil {
+		return nil
+	}
+	return c.HardwareAddr
+}
+
+func (c *Config) userspace() bool {
+	return c != nil && c.Userspace
+}
+
+func (c *Config) capture() io.Writer {
+	if c == nil {
+		return nil
+	}
+	return c.Capture
+}
+
+func (c *Config) padtCount() int {
+	if c == nil || c.PADTCount <= 0 {
+		return 3
+	}
+	return c.PADTCount
+}
+
+func (c *Config) padtInterval() time.Duration {
+	if c == nil || c.PADTInterval <= 0 {
+		return 100 * time.Millisecond
+	}
+	return c.PADTInterval
+}
+
+// FrameSizeBuckets are the inclusive upper bounds, in bytes, of the
+// buckets in Stats.FrameSizes. The final bucket of FrameSizes counts
+// frames larger than the last bound.
+var FrameSizeBuckets = [...]int{64, 128, 256, 512, 1024, 1492}
+
+// Stats are counters for a Conn.
+type Stats struct {
+	// SpoofedPADTs is the number of PADTs for this session that came
+	// from an Ethernet address other than the concentrator's. They are
+	// ignored, since any host on the LAN can send them.
+	SpoofedPADTs uint64
+	// FrameSizes counts the PPP frames received by Read, by size. See
+	// FrameSizeBuckets for the bucket bounds.
+	FrameSizes [len(FrameSizeBuckets) + 1]uint64
+	// Protocols counts the PPP frames received by Read, by PPP
+	// protocol number.
+	Protocols map[uint16]uint64
+	// Jitter is the smoothed variation in the time between
+	// consecutive data frames (IPv4, IPv6...) received by Read. It's
+	// computed like the interarrival jitter of RFC 3550 section
+	// 6.4.1, with the change in inter-frame gap standing in for the
+	// change in transit time, since PPP frames carry no timestamps. It
+	// only reflects the access link, not the path to remote hosts.
+	//
+	// Jitter is zero until Read got three data frames. Frames that the
+	// kernel delivers to a PPP unit (see NewUnit) bypass Read, and
+	// aren't measured.
+	Jitter time.Duration
+}
+
 // Conn is a PPPoE connection.
 type Conn struct {
+	// spoofedPADTs counts PADTs for our session that didn't come from
+	// the concentrator. Accessed atomically, so it must stay first in
+	// the struct to be 64-bit aligned on 32-bit platforms.
+	spoofedPADTs uint64
+
 	// session is the PPPoE framer/deframer kernel object. We need to
 	// keep this open to keep the kernel object alive, but we don't
-	// talk to it through this fd. For talking, see the next fd.
+	// talk to it through this fd. For talking, see the next fd. It's
+	// -1 for userspace Conns, which have no kernel session.
 	sessionFd int
-	// channel is the PPP channel that sends over PPPoE. This is a
-	// handle to the generic PPP channel object in the kernel that
-	// wraps the above PPPoE session object. We can use this to
+	// channel is the PPP channel that sends over PPPoE. This is
+	// usually an *os.File handle to the generic PPP channel object in
+	// the kernel that wraps the above PPPoE session object, or a
+	// *userspaceChannel if cfg.Userspace is set. We can use this to
 	// send/receive control packets.
-	channel *os.File
+	channel sessionChannel
+	// unit is the PPP unit that channel is connected to, if NewUnit
+	// created one, and unitName the name of its pppN network
+	// interface.
+	unit     *os.File
+	unitName string
+	// unitPeer is the peer's IPv4 address that SetUnitIPv4 gave the
+	// unit, or nil if the link is unnumbered.
+	unitPeer net.IP
 	// discovery is a raw ethernet PacketConn that we use to speak the
 	// PPPoE discovery protocol. We use this to set up a session, and
 	// to tear it down when we close the Conn.
@@ -46,77 +380,330 @@ type Conn struct {
 	// use it during session teardown, but mostly it exists to provide
 	// if someone asks for RemoteAddr.
 	remoteAddr *Addr
+	// maxPayload is the largest PPP payload that the session carries.
+	maxPayload int
+	// links are the names of the VLAN and macvlan interfaces that
+	// the Conn created for its session, innermost first. They're
+	// deleted when the Conn closes.
+	links []string
+	// cfg is the Conn's configuration. It's never nil.
+	cfg *Config
+
+	statsMu sync.Mutex
+	// frameSizes and protocols are the Read counters reported in
+	// Stats.
+	frameSizes [len(FrameSizeBuckets) + 1]uint64
+	protocols  map[uint16]uint64
+	// lastData and lastGap are the arrival time of the last data
+	// frame, and the time between it and the one before, if haveGap.
+	// They feed jitter, the Jitter reported in Stats.
+	lastData time.Time
+	lastGap  time.Duration
+	haveGap  bool
+	jitter   time.Duration
+
+	// transcript records the control packets of the session's
+	// bring-up. It's nil for Conns that don't record one.
+	transcript *transcript
+	// capture is the Config.Capture of the Conn, or nil.
+	capture *capture
 
 	closedMu sync.Mutex
 	// closed is a tombstone for closed Conns, so that double-closes
 	// are safe.
 	closed bool
+	// closeReason is why the concentrator tore down the session, or
+	// nil if it didn't.
+	closeReason error
+	// done is closed once the Conn is closed.
+	done chan struct{}
+	// unitOps counts the withUnit calls in progress, which Close
+	// waits for before closing the unit.
+	unitOps sync.WaitGroup
+}
+
+// sessionChannel is the PPP channel of a Conn.
+type sessionChannel interface {
+	io.ReadWriteCloser
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
 }
 
 // New runs PPPoE discovery on the given interface, and creates a Conn
-// that can send PPP frames on the resulting PPPoE session.
-func New(ctx context.Context, ifName string) (*Conn, error) {
-	intf, err := net.InterfaceByName(ifName)
+// that can send PPP frames on the resulting PPPoE session. cfg may be
+// nil.
+func New(ctx context.Context, ifName string, cfg *Config) (*Conn, error) {
+	setup, err := newSessionSetup(ifName, cfg)
 	if err != nil {
 		return nil, err
 	}
-	if len(intf.HardwareAddr) != 6 {
-		return nil, fmt.Errorf("%q has a non-ethernet hardware type", ifName)
+
+	tr := &transcript{}
+	concentratorAddr, sessionID, maxPayload, err := setupDiscovery(ctx, &transcriptConn{setup.disco, tr}, cfg)
+	if err != nil {
+		setup.close()
+		return nil, err
+	}
+
+	return setup.connect(concentratorAddr, sessionID, maxPayload, cfg, tr)
+}
+
+// Attach creates a Conn for an existing PPPoE session with
+// concentrator on ifName, without running PPPoE discovery. It's meant
+// for taking over a session set up by another process, such as one
+// handed over by Detach. cfg may be nil.
+//
+// The kernel only allows one socket per PPPoE session, so the process
+// that set up the session must have released it first. pppd releases
+// it when it exits, unless told to send a PADT on the way out.
+func Attach(ifName string, concentrator net.HardwareAddr, sessionID uint16, cfg *Config) (*Conn, error) {
+	if sessionID == 0 {
+		return nil, errors.New("PPPoE session ID 0 is reserved")
+	}
+	if len(concentrator) != 6 {
+		return nil, fmt.Errorf("invalid concentrator address %s", concentrator)
 	}
 
-	disco, err := newDiscoveryConn(ifName)
+	setup, err := newSessionSetup(ifName, cfg)
 	if err != nil {
 		return nil, err
 	}
+	maxPayload := cfg.maxPayload()
+	if maxPayload == 0 {
+		maxPayload = defaultMaxPayload
+	}
+	return setup.connect(concentrator, sessionID, maxPayload, cfg, &transcript{})
+}
 
-	// Create the session file descriptor before executing PPPoE
-	// discovery, because the concentrator will immediately start
-	// sending PPP packets, and having the session fd open means we
-	// catch those packets.
-	sessionFd, err := newSessionFd(ifName)
+// The steps of session setup, and teardownLink, which undoes the
+// first two, as variables so that tests can make each of them fail
+// and check that nothing leaks.
+var (
+	setupVLAN          = createVLAN
+	setupMACVLAN       = createMACVLAN
+	setupInterface     = net.InterfaceByName
+	setupDiscoveryConn = newDiscoveryConn
+	setupSessionFd     = newSessionFd
+	setupSessionConn   = newSessionConn
+	setupDiscovery     = pppoeDiscovery
+	setupConnect       = connectSessionFd
+	setupChannel       = newChannel
+	teardownLink       = deleteLink
+)
+
+// sessionSetup holds the resources of a PPPoE session that is being
+// set up. Until they're handed over to a Conn, the sessionSetup owns
+// them, and releases them all if setup fails.
+type sessionSetup struct {
+	intf      *net.Interface
+	disco     net.PacketConn
+	sessionFd int
+	// sess is the raw socket for session frames of a userspace setup,
+	// which has no sessionFd.
+	sess net.PacketConn
+	// links are the names of the interfaces that the setup created,
+	// innermost first.
+	links []string
+	// capture is where the packets of the session are captured, or
+	// nil.
+	capture *capture
+}
+
+// newSessionSetup opens the resources needed to set up a PPPoE
+// session on ifName, or on VLAN and macvlan interfaces on top of it,
+// with the kernel's session support or in userspace, as cfg says.
+func newSessionSetup(ifName string, cfg *Config) (*sessionSetup, error) {
+	ifName, links, err := setupLinks(ifName, cfg)
 	if err != nil {
-		disco.Close()
 		return nil, err
 	}
+	s, err := newInterfaceSetup(ifName, cfg)
+	if err != nil {
+		teardownLinks(links)
+		return nil, err
+	}
+	s.links = links
+	return s, nil
+}
+
+// setupLinks creates the VLAN and macvlan interfaces on top of ifName
+// that cfg asks for, and returns the name of the interface to run
+// PPPoE on, and the names of the interfaces that it created,
+// innermost first.
+func setupLinks(ifName string, cfg *Config) (string, []string, error) {
+	id, priority := cfg.vlan()
+	if id != 0 && (id < 1 || id > 4094) {
+		return "", nil, fmt.Errorf("invalid VLAN ID %d", id)
+	}
+	if priority < 0 || priority > 7 {
+		return "", nil, fmt.Errorf("invalid VLAN priority %d", priority)
+	}
+	addr := cfg.hardwareAddr()
+	if addr != nil && (len(addr) != 6 || addr[0]&1 != 0) {
+		return "", nil, fmt.Errorf("invalid unicast Ethernet address %s", addr)
+	}
+
+	var links []string
+	if id != 0 {
+		name, created, err := setupVLAN(ifName, id, priority)
+		if err != nil {
+			return "", nil, err
+		}
+		ifName = name
+		if created {
+			cfg.log("created VLAN interface", "interface", name, "vlan", id, "priority", priority)
+			links = append(links, name)
+		}
+	}
+	if addr != nil {
+		name, created, err := setupMACVLAN(ifName, addr)
+		if err != nil {
+			teardownLinks(links)
+			return "", nil, err
+		}
+		ifName = name
+		if created {
+			cfg.log("created macvlan interface", "interface", name, "addr", addr)
+			links = append(links, name)
+		}
+	}
+	return ifName, links, nil
+}
+
+// teardownLinks deletes the interfaces that setupLinks created.
+func teardownLinks(links []string) {
+	for i := len(links) - 1; i >= 0; i-- {
+		teardownLink(links[i])
+	}
+}
 
-	concentratorAddr, sessionID, err := pppoeDiscovery(ctx, disco)
+// newInterfaceSetup is newSessionSetup, once the interface to run
+// PPPoE on is known.
+func newInterfaceSetup(ifName string, cfg *Config) (*sessionSetup, error) {
+	intf, err := setupInterface(ifName)
 	if err != nil {
-		closeSessionFd(sessionFd)
-		disco.Close()
 		return nil, err
 	}
+	if len(intf.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("%q has a non-ethernet hardware type", ifName)
+	}
+	if mp := cfg.maxPayload(); mp > 0 && (mp > 0xffff || mp+8 > intf.MTU) {
+		return nil, fmt.Errorf("PPP payloads of %d bytes don't fit in the %d-byte MTU of %q", mp, intf.MTU, ifName)
+	}
 
-	// Connect the session fd. This doesn't do much, other than allow
-	// a few more ioctl()s to be applied later on.
-	if err = connectSessionFd(sessionFd, ifName, concentratorAddr, sessionID); err != nil {
-		closeSessionFd(sessionFd)
-		disco.Close()
+	disco, err := setupDiscoveryConn(ifName)
+	if err != nil {
 		return nil, err
 	}
+	capture := newCapture(cfg.capture(), intf)
+	if capture != nil {
+		disco = &captureConn{disco, capture}
+	}
+	if cfg != nil && cfg.Logger != nil {
+		disco = &logConn{disco, cfg}
+	}
 
-	// Create the channel.
-	f, err := newChannel(sessionFd)
+	// Create the session file descriptor before executing PPPoE
+	// discovery, because the concentrator will immediately start
+	// sending PPP packets, and having the session fd open means we
+	// catch those packets. The same goes for the userspace session
+	// socket.
+	if cfg.userspace() {
+		sess, err := setupSessionConn(ifName)
+		if err != nil {
+			disco.Close()
+			return nil, err
+		}
+		return &sessionSetup{
+			intf:      intf,
+			disco:     disco,
+			sessionFd: -1,
+			sess:      sess,
+			capture:   capture,
+		}, nil
+	}
+	sessionFd, err := setupSessionFd(ifName)
 	if err != nil {
-		closeSessionFd(sessionFd)
 		disco.Close()
 		return nil, err
 	}
 
-	ret := &Conn{
+	return &sessionSetup{
+		intf:      intf,
+		disco:     disco,
 		sessionFd: sessionFd,
-		channel:   f,
-		discovery: disco,
+		capture:   capture,
+	}, nil
+}
+
+// close releases the resources of a failed setup.
+func (s *sessionSetup) close() {
+	if s.sess != nil {
+		s.sess.Close()
+	} else {
+		closeSessionFd(s.sessionFd)
+	}
+	s.disco.Close()
+	teardownLinks(s.links)
+}
+
+// connect connects the setup to the PPPoE session sessionID with
+// concentratorAddr, which carries PPP payloads of up to maxPayload
+// bytes, and returns a Conn for it that keeps recording the bring-up
+// in tr. Either way, the setup no longer owns any resources once
+// connect returns.
+func (s *sessionSetup) connect(concentratorAddr net.HardwareAddr, sessionID uint16, maxPayload int, cfg *Config, tr *transcript) (*Conn, error) {
+	var channel sessionChannel
+	if s.sess != nil {
+		channel = &userspaceChannel{
+			conn:         s.sess,
+			concentrator: concentratorAddr,
+			sessionID:    sessionID,
+			maxPayload:   maxPayload,
+		}
+	} else {
+		// Connect the session fd. This doesn't do much, other than
+		// allow a few more ioctl()s to be applied later on.
+		if err := setupConnect(s.sessionFd, s.intf.Name, concentratorAddr, sessionID); err != nil {
+			s.close()
+			return nil, err
+		}
+
+		// Create the channel.
+		f, err := setupChannel(s.sessionFd)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		channel = f
+	}
+
+	ret := &Conn{
+		sessionFd: s.sessionFd,
+		channel:   channel,
+		discovery: s.disco,
 		localAddr: &Addr{
-			Interface:    ifName,
+			Interface:    s.intf.Name,
 			SessionID:    sessionID,
-			HardwareAddr: intf.HardwareAddr,
+			HardwareAddr: s.intf.HardwareAddr,
 		},
 		remoteAddr: &Addr{
-			Interface:    ifName,
+			Interface:    s.intf.Name,
 			SessionID:    sessionID,
 			HardwareAddr: concentratorAddr,
 		},
+		maxPayload: maxPayload,
+		links:      s.links,
+		cfg:        &Config{},
+		transcript: tr,
+		capture:    s.capture,
+		done:       make(chan struct{}),
+	}
+	if cfg != nil {
+		*ret.cfg = *cfg
 	}
+	ret.cfg.log("PPPoE session up", "interface", s.intf.Name, "peer", concentratorAddr, "session", sessionID, "max_payload", maxPayload, "userspace", s.sess != nil)
 	go ret.closeOnPADT()
 
 	return ret, nil
@@ -127,14 +714,56 @@ func (c *Conn) closeOnPADT() {
 	// everything tied to it on the way out.
 	defer c.Close()
 
-	// Discard the error. We can't usefully propagate it from here,
-	// and in practice the only errors we would get relate to
-	// c.discovery getting closed by another goroutine - in which case
-	// our course of action is still "tear everything down".
-	//
-	// TODO: consider having a way to propagate the error into a log
-	// anyway, just in case it's interesting?
-	readPADT(c.discovery, c.remoteAddr.HardwareAddr, c.remoteAddr.SessionID)
+	// We can't usefully propagate errors from here, and in practice
+	// the only errors we would get relate to c.discovery getting
+	// closed by another goroutine - in which case our course of
+	// action is still "tear everything down". Errors on Conns that
+	// are still open are logged, just in case they're interesting.
+	padt, err := readPADT(c.discovery, c.remoteAddr.HardwareAddr, c.remoteAddr.SessionID, &c.spoofedPADTs)
+
+	c.closedMu.Lock()
+	defer c.closedMu.Unlock()
+	if c.closed {
+		return
+	}
+	if err != nil {
+		c.cfg.log("watching for PADTs failed, closing session", "session", c.remoteAddr.SessionID, "error", err)
+		return
+	}
+	c.closeReason = concentratorError(padt)
+	if c.closeReason == nil {
+		c.closeReason = ErrTerminated
+	}
+	c.cfg.log("concentrator terminated session", "peer", c.remoteAddr.HardwareAddr, "session", c.remoteAddr.SessionID, "reason", c.closeReason)
+}
+
+// CloseReason returns why the concentrator tore down the session: a
+// *ConcentratorError if it sent an error tag with its PADT, or
+// ErrTerminated if it didn't. It returns nil if the session is still
+// up, or if it was closed locally.
+func (c *Conn) CloseReason() error {
+	c.closedMu.Lock()
+	defer c.closedMu.Unlock()
+	return c.closeReason
+}
+
+// Done returns a channel that's closed once the Conn is closed,
+// either locally or because the concentrator sent a PADT. In the
+// latter case, CloseReason says why. It lets callers that aren't
+// blocked in Read, such as ones that handed the session to a PPP
+// unit with NewUnit, learn that the ISP tore the session down.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// closedError returns the error to report for a Read or Write that
+// failed with err: the CloseReason, if the concentrator tore down the
+// session, or err itself.
+func (c *Conn) closedError(err error) error {
+	if reason := c.CloseReason(); reason != nil {
+		return reason
+	}
+	return err
 }
 
 // LocalAddr returns the local address of the PPPoE connection. PPPoE
@@ -150,22 +779,413 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.remoteAddr
 }
 
-// Close closes the PPPoE session.
-func (c *Conn) Close() error {
+// MaxPayload returns the largest PPP payload that the session
+// carries: 1492 bytes, or more if Config.MaxPayload asked for it and
+// the concentrator agreed. It's the MRU to request with LCP, and the
+// MTU to give the PPP interface.
+func (c *Conn) MaxPayload() int {
+	return c.maxPayload
+}
+
+// Stats returns a snapshot of the Conn's counters.
+func (c *Conn) Stats() Stats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	protocols := make(map[uint16]uint64, len(c.protocols))
+	for proto, n := range c.protocols {
+		protocols[proto] = n
+	}
+	return Stats{
+		SpoofedPADTs: atomic.LoadUint64(&c.spoofedPADTs),
+		FrameSizes:   c.frameSizes,
+		Protocols:    protocols,
+		Jitter:       c.jitter,
+	}
+}
+
+// Transcript returns the control packets that the Conn exchanged with
+// the concentrator while bringing up the session, in order: PPPoE
+// discovery, then LCP, authentication and the network control
+// protocols. Recording stops at the first data frame, once the
+// session is up. The transcript is meant to be attached to bug
+// reports, and can be encoded with encoding/json. Authentication
+// packets are redacted, so it doesn't leak credentials.
+func (c *Conn) Transcript() []TranscriptEntry {
+	return c.transcript.get()
+}
+
+// countFrame updates the Read counters for frame.
+func (c *Conn) countFrame(frame []byte, now time.Time) {
+	bucket := len(FrameSizeBuckets)
+	for i, max := range FrameSizeBuckets {
+		if len(frame) <= max {
+			bucket = i
+			break
+		}
+	}
+
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.frameSizes[bucket]++
+	proto, ok := frameProtocol(frame)
+	if !ok {
+		return
+	}
+	if c.protocols == nil {
+		c.protocols = map[uint16]uint64{}
+	}
+	c.protocols[proto]++
+
+	// Network layer protocols are below 0x4000 (RFC 1661 section 2).
+	if proto >= 0x4000 {
+		return
+	}
+	if !c.lastData.IsZero() {
+		gap := now.Sub(c.lastData)
+		if c.haveGap {
+			d := gap - c.lastGap
+			if d < 0 {
+				d = -d
+			}
+			c.jitter += (d - c.jitter) / 16
+		}
+		c.lastGap, c.haveGap = gap, true
+	}
+	c.lastData = now
+}
+
+// frameProtocol returns the PPP protocol number of frame, which may be
+// compressed to a single byte (RFC 1661 section 6.5).
+func frameProtocol(frame []byte) (proto uint16, ok bool) {
+	switch {
+	case len(frame) >= 1 && frame[0]&1 == 1:
+		return uint16(frame[0]), true
+	case len(frame) >= 2:
+		return binary.BigEndian.Uint16(frame), true
+	default:
+		return 0, false
+	}
+}
+
+// NewUnit creates a kernel PPP unit, connects the session to it, and
+// returns the name of the unit's network interface (e.g. "ppp0"). IP
+// traffic then flows through the kernel, once the interface is
+// configured with the addresses that IPCP or IPv6CP negotiated.
+//
+// NewUnit is meant to be called once control negotiation is done. From
+// then on, the kernel delivers NCP frames to the unit, and Read only
+// returns LCP and authentication frames. The unit and its interface
+// are destroyed when the Conn is closed.
+func (c *Conn) NewUnit() (string, error) {
 	c.closedMu.Lock()
 	defer c.closedMu.Unlock()
 	if c.closed {
+		return "", errClosed
+	}
+	if c.unit != nil {
+		return "", errors.New("PPPoE session already has a PPP unit")
+	}
+
+	f, ok := c.channel.(*os.File)
+	if !ok {
+		return "", errors.New("PPP units need a kernel PPPoE session, not a userspace one")
+	}
+	unit, name, err := newUnit(f)
+	if err != nil {
+		return "", err
+	}
+	c.unit, c.unitName = unit, name
+	return name, nil
+}
+
+// UnitFlags are flags of a PPP unit, from the SC_* flags of Linux's
+// ppp_generic driver.
+type UnitFlags uint32
+
+// PPP unit flags.
+const (
+	// UnitMultilink makes the unit speak RFC 1990 multilink PPP, once
+	// LCP negotiated it.
+	UnitMultilink UnitFlags = 0x400
+	// UnitMPShortSeq makes multilink use 12-bit sequence numbers, as
+	// negotiated with the Short-Sequence-Number-Header-Format option,
+	// rather than 24-bit ones.
+	UnitMPShortSeq UnitFlags = 0x800
+)
+
+// withUnit calls fn with the Conn's PPP unit, or returns an error if
+// the Conn has none. fn runs outside closedMu, since ioctls and
+// netlink requests mustn't block CloseReason and friends, but Close
+// waits for it before closing the unit.
+func (c *Conn) withUnit(fn func(unit *os.File, name string) error) error {
+	c.closedMu.Lock()
+	if c.closed {
+		c.closedMu.Unlock()
+		return errClosed
+	}
+	if c.unit == nil {
+		c.closedMu.Unlock()
+		return errors.New("PPPoE session has no PPP unit")
+	}
+	unit, name := c.unit, c.unitName
+	c.unitOps.Add(1)
+	c.closedMu.Unlock()
+
+	defer c.unitOps.Done()
+	return fn(unit, name)
+}
+
+// UnitFlags returns the flags of the PPP unit that NewUnit created.
+func (c *Conn) UnitFlags() (UnitFlags, error) {
+	var ret UnitFlags
+	err := c.withUnit(func(unit *os.File, _ string) error {
+		flags, err := unitFlags(unit)
+		ret = UnitFlags(flags)
+		return err
+	})
+	return ret, err
+}
+
+// SetUnitFlags sets the flags of the PPP unit that NewUnit created.
+// Flags that this package has no constant for are kernel-internal,
+// and should be left as UnitFlags returned them.
+func (c *Conn) SetUnitFlags(flags UnitFlags) error {
+	return c.withUnit(func(unit *os.File, _ string) error {
+		return setUnitFlags(unit, uint32(flags))
+	})
+}
+
+// UnitDebugFlags are the debug flags of a PPP unit, as pppd's kdebug
+// option sets them.
+type UnitDebugFlags uint32
+
+// PPP unit debug flags.
+const (
+	// UnitDebugMessages makes ppp_generic log, at KERN_DEBUG level,
+	// some of the frames it drops between the channel and the unit's
+	// network interface, and why. The other bits of pppd's kdebug
+	// only apply to serial channels, and are ignored for PPPoE.
+	UnitDebugMessages UnitDebugFlags = 1
+)
+
+// UnitDebug returns the debug flags of the PPP unit that NewUnit
+// created.
+func (c *Conn) UnitDebug() (UnitDebugFlags, error) {
+	var ret UnitDebugFlags
+	err := c.withUnit(func(unit *os.File, _ string) error {
+		flags, err := unitDebug(unit)
+		ret = UnitDebugFlags(flags)
+		return err
+	})
+	return ret, err
+}
+
+// SetUnitDebug sets the debug flags of the PPP unit that NewUnit
+// created, to help find out why frames that the session receives
+// don't come out of the unit's network interface. The kernel logs
+// the resulting messages, which WatchUnitKernelLog collects.
+func (c *Conn) SetUnitDebug(flags UnitDebugFlags) error {
+	return c.withUnit(func(unit *os.File, _ string) error {
+		return setUnitDebug(unit, uint32(flags))
+	})
+}
+
+// WatchUnitKernelLog sends the kernel's log messages about the PPP
+// unit that NewUnit created to lines, such as the ones that
+// SetUnitDebug enables, until ctx is done or the Conn is closed. Only
+// messages logged after WatchUnitKernelLog starts are sent. Reading
+// the kernel log requires CAP_SYSLOG, unless the kernel.dmesg_restrict
+// sysctl is 0. lines isn't closed when WatchUnitKernelLog returns.
+//
+// Kernel messages that don't name a unit, such as ppp_generic's
+// "PPP: " ones, aren't sent, since they may be about any unit.
+func (c *Conn) WatchUnitKernelLog(ctx context.Context, lines chan<- string) error {
+	var name string
+	if err := c.withUnit(func(_ *os.File, n string) error {
+		name = n
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return watchUnitKernelLog(ctx, name, lines)
+}
+
+// SetUnitMRU sets the largest frame that the PPP unit that NewUnit
+// created accepts from the peer. It should match the MRU that LCP
+// negotiated for our side of the link.
+func (c *Conn) SetUnitMRU(mru int) error {
+	return c.withUnit(func(unit *os.File, _ string) error {
+		return setUnitMRU(unit, mru)
+	})
+}
+
+// SetUnitMTU sets the MTU of the network interface of the PPP unit
+// that NewUnit created. It should be no larger than the MRU that LCP
+// negotiated for the peer's side of the link, nor than MaxPayload.
+func (c *Conn) SetUnitMTU(mtu int) error {
+	return c.withUnit(func(_ *os.File, name string) error {
+		return setUnitMTU(name, mtu)
+	})
+}
+
+// SetUnitIPv4 gives the network interface of the PPP unit that
+// NewUnit created the IPv4 address local, with peer at the other end
+// of the link, as IPCP negotiated them. If the link is unnumbered, as
+// ipcp.Result.Unnumbered reports when peer is nil, 0.0.0.0 or local,
+// the interface only gets local.
+func (c *Conn) SetUnitIPv4(local, peer net.IP) error {
+	if local.To4() == nil || local.IsUnspecified() {
+		return fmt.Errorf("invalid local IPv4 address %v", local)
+	}
+	local, peer = local.To4(), peer.To4()
+	if peer.IsUnspecified() || peer.Equal(local) {
+		peer = nil
+	}
+	return c.withUnit(func(_ *os.File, name string) error {
+		if err := setUnitIPv4(name, local, peer); err != nil {
+			return err
+		}
+		c.unitPeer = peer
 		return nil
+	})
+}
+
+// AddUnitRoute routes dst over the network interface of the PPP unit
+// that NewUnit created. A nil dst is the IPv4 default route. On
+// numbered links, the route goes via the peer address given to
+// SetUnitIPv4. On unnumbered ones, there is no usable gateway, so it
+// goes straight out the interface, as an onlink route.
+func (c *Conn) AddUnitRoute(dst *net.IPNet) error {
+	if dst == nil {
+		dst = &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+	}
+	if dst.IP.To4() == nil || len(dst.Mask) != net.IPv4len {
+		return fmt.Errorf("invalid IPv4 route destination %v", dst)
+	}
+	return c.withUnit(func(_ *os.File, name string) error {
+		return addUnitRoute(name, dst, c.unitPeer)
+	})
+}
+
+// Close closes the PPPoE session.
+func (c *Conn) Close() error {
+	return c.CloseContext(context.Background())
+}
+
+// CloseContext closes the PPPoE session, like Close, but gives up on
+// telling the concentrator once ctx is done, even if fewer than
+// Config.PADTCount PADTs went out. The Conn's resources are
+// released either way, so that shutdown paths don't hang on a stuck
+// network interface.
+func (c *Conn) CloseContext(ctx context.Context) error {
+	if err := c.close(ctx, true); err != errClosed {
+		return err
+	}
+	return nil
+}
+
+// Session describes an established PPPoE session.
+type Session struct {
+	// Interface is the name of the network interface the session
+	// runs on.
+	Interface string
+	// Concentrator is the Ethernet address of the PPPoE concentrator.
+	Concentrator net.HardwareAddr
+	// SessionID is the PPPoE session ID.
+	SessionID uint16
+}
+
+// PPPDOptions returns the pppd options that make its rp-pppoe plugin
+// (pppoe.so) take over the session, skipping PPPoE discovery.
+func (s *Session) PPPDOptions() []string {
+	return []string{
+		"plugin", "pppoe.so",
+		"rp_pppoe_sess", fmt.Sprintf("%d:%s", s.SessionID, s.Concentrator),
+		s.Interface,
+	}
+}
+
+// Detach closes the Conn without tearing down the PPPoE session, and
+// returns the session's parameters so that another process, such as
+// pppd, can take it over. This makes it possible to use this package
+// only for discovery, and leave PPP negotiation to pppd.
+//
+// The kernel only allows one socket per PPPoE session, so Detach must
+// return before the other process attaches to the session. Until
+// then, PPP frames from the concentrator are dropped.
+func (c *Conn) Detach() (*Session, error) {
+	if err := c.close(context.Background(), false); err != nil {
+		return nil, err
 	}
+	return &Session{
+		Interface:    c.remoteAddr.Interface,
+		Concentrator: c.remoteAddr.HardwareAddr,
+		SessionID:    c.remoteAddr.SessionID,
+	}, nil
+}
 
+// errClosed is returned by operations on a closed Conn.
+var errClosed = errors.New("PPPoE session already closed")
+
+// close closes the Conn, sending a PADT to the concentrator if
+// terminate is true and ctx allows, unless the concentrator already
+// terminated the session.
+//
+// Only marking the Conn closed happens under closedMu. Sending PADTs
+// can take a while, and mustn't block CloseReason and friends in the
+// meantime.
+func (c *Conn) close(ctx context.Context, terminate bool) error {
+	c.closedMu.Lock()
+	if c.closed {
+		c.closedMu.Unlock()
+		return errClosed
+	}
 	c.closed = true
+	sendPADT := terminate && c.closeReason == nil
+	c.closedMu.Unlock()
+
+	defer close(c.done)
+	c.cfg.log("closing PPPoE session", "session", c.remoteAddr.SessionID, "terminate", terminate)
 	// Read, Write and deadline ops all pass through to c.channel,
-	// which is an os.File that will behave cleanly when closed. So,
-	// we can just close asynchronously here.
+	// which is either a kernel PPP channel (an os.File) or a
+	// userspaceChannel on a rawConn. Both make operations in progress
+	// fail cleanly when closed, so we can just close asynchronously
+	// here. Unit ops use the unit's raw fd, which could be reused
+	// once closed, so they're waited for.
+	var unitErr error
+	if c.unit != nil {
+		c.unitOps.Wait()
+		unitErr = c.unit.Close()
+	}
 	channelErr := c.channel.Close()
-	sessErr := closeSessionFd(c.sessionFd)
-	padtErr := sendPADT(c.discovery, c.remoteAddr.HardwareAddr, c.remoteAddr.SessionID)
+	var sessErr error
+	if c.sessionFd >= 0 {
+		sessErr = closeSessionFd(c.sessionFd)
+	}
+	var padtErr error
+	if sendPADT {
+		padtErr = sendPADTs(ctx, c.discovery, c.remoteAddr.HardwareAddr, c.remoteAddr.SessionID, c.cfg.padtCount(), c.cfg.padtInterval())
+	}
 	discErr := c.discovery.Close()
+	var linkErr error
+	for i := len(c.links) - 1; i >= 0 && terminate; i-- {
+		if err := teardownLink(c.links[i]); err != nil && linkErr == nil {
+			linkErr = err
+		}
+	}
+	if unitErr != nil {
+		return unitErr
+	}
 	if channelErr != nil {
 		return channelErr
 	}
@@ -178,17 +1198,82 @@ func (c *Conn) Close() error {
 	if discErr != nil {
 		return discErr
 	}
+	if linkErr != nil {
+		return linkErr
+	}
 	return nil
 }
 
-// Read reads a packet from the PPPoE session.
+// Terminate sends a PADT on ifName for the PPPoE session sessionID,
+// asking concentrator to tear the session down. It is meant for
+// clearing sessions left behind by processes that exited without
+// closing their Conn. There is no reply to a PADT, so a nil error
+// only means that the PADT was sent.
+//
+// The PADT goes out the way the session's Conn would have sent it, on
+// the VLAN and from the Ethernet address that cfg asks for, since
+// concentrators ignore PADTs from elsewhere. Other fields of cfg are
+// unused, and it may be nil.
+func Terminate(ifName string, concentrator net.HardwareAddr, sessionID uint16, cfg *Config) error {
+	if len(concentrator) != 6 {
+		return fmt.Errorf("invalid concentrator Ethernet address %s", concentrator)
+	}
+	ifName, links, err := setupLinks(ifName, cfg)
+	if err != nil {
+		return err
+	}
+	defer teardownLinks(links)
+	disco, err := setupDiscoveryConn(ifName)
+	if err != nil {
+		return err
+	}
+	defer disco.Close()
+	return sendPADT(disco, concentrator, sessionID)
+}
+
+// Read reads a packet from the PPPoE session. Once the concentrator
+// has torn down the session, it returns the CloseReason.
 func (c *Conn) Read(b []byte) (int, error) {
-	return c.channel.Read(b)
+	n, err := c.channel.Read(b)
+	if n > 0 {
+		c.countFrame(b[:n], time.Now())
+		c.transcript.addFrame(false, b[:n])
+		c.capture.session(false, c.remoteAddr, b[:n])
+	}
+	if err != nil {
+		err = c.closedError(err)
+	}
+	return n, err
 }
 
-// Write writes a packet to the PPPoE session.
+// Write writes a packet to the PPPoE session. Once the concentrator
+// has torn down the session, it returns the CloseReason.
 func (c *Conn) Write(b []byte) (int, error) {
-	return c.channel.Write(b)
+	n, err := c.channel.Write(b)
+	if err != nil {
+		return n, c.closedError(err)
+	}
+	c.transcript.addFrame(true, b)
+	c.capture.session(true, c.remoteAddr, b)
+	return n, nil
+}
+
+// WriteProtocol writes a PPP frame carrying payload for protocol
+// proto to the PPPoE session. It's meant for diagnostic tools that
+// need to send handcrafted frames to the peer.
+//
+// proto must be a valid PPP protocol number as defined in RFC 1661:
+// the least significant bit of its low byte must be 1, and that of
+// its high byte must be 0.
+func (c *Conn) WriteProtocol(proto uint16, payload []byte) error {
+	if proto&0x0001 == 0 || proto&0x0100 != 0 {
+		return fmt.Errorf("invalid PPP protocol number 0x%04x", proto)
+	}
+	b := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(b, proto)
+	copy(b[2:], payload)
+	_, err := c.Write(b)
+	return err
 }
 
 // SetDeadline sets both the read and write deadlines for future Read
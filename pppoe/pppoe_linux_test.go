@@ -0,0 +1,1100 @@
+package pppoe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/raw"
+	"golang.org/x/sys/unix"
+)
+
+// newTestConn returns a Conn for session 42 with concentrator ac on
+// eth0, backed by pipes and a fakeConn instead of kernel PPPoE
+// objects.
+func newTestConn(t *testing.T, ac net.HardwareAddr) *Conn {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("creating pipe: %v", err)
+	}
+	defer r.Close()
+	sessionFd, err := unix.Dup(int(r.Fd()))
+	if err != nil {
+		t.Fatalf("duplicating pipe fd: %v", err)
+	}
+	return &Conn{
+		sessionFd: sessionFd,
+		channel:   w,
+		discovery: newFakeConn(),
+		remoteAddr: &Addr{
+			Interface:    "eth0",
+			SessionID:    42,
+			HardwareAddr: ac,
+		},
+		cfg: &Config{
+			PADTInterval: time.Millisecond,
+		},
+		done: make(chan struct{}),
+	}
+}
+
+func TestDetach(t *testing.T) {
+	ac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	conn := newTestConn(t, ac)
+
+	sess, err := conn.Detach()
+	if err != nil {
+		t.Fatalf("detaching: %v", err)
+	}
+	select {
+	case pkt := <-conn.discovery.(*fakeConn).Out:
+		t.Fatalf("Detach sent packet %x", pkt.b)
+	default:
+	}
+
+	want := &Session{
+		Interface:    "eth0",
+		Concentrator: ac,
+		SessionID:    42,
+	}
+	if diff := cmp.Diff(want, sess); diff != "" {
+		t.Fatalf("wrong session (-want +got)\n%s", diff)
+	}
+	wantOpts := []string{"plugin", "pppoe.so", "rp_pppoe_sess", "42:02:00:00:00:00:02", "eth0"}
+	if diff := cmp.Diff(wantOpts, sess.PPPDOptions()); diff != "" {
+		t.Fatalf("wrong pppd options (-want +got)\n%s", diff)
+	}
+
+	if _, err := conn.Detach(); err == nil {
+		t.Fatal("second Detach succeeded")
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close after Detach: %v", err)
+	}
+}
+
+func TestCloseContext(t *testing.T) {
+	ac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+
+	conn := newTestConn(t, ac)
+	if err := conn.CloseContext(context.Background()); err != nil {
+		t.Fatalf("closing: %v", err)
+	}
+	want := encodeDiscoveryPacket(&discoveryPacket{
+		Code:      pppoePADT,
+		SessionID: 42,
+	})
+	// PADTs are retransmitted, for lossy links.
+	for i := 0; i < 3; i++ {
+		if diff := cmp.Diff(want, expectPacket(t, conn.discovery, ac)); diff != "" {
+			t.Fatalf("wrong PADT (-want +got)\n%s", diff)
+		}
+	}
+	expectNoPacket(t, conn.discovery)
+
+	// A single failed send doesn't make Close fail.
+	conn = newTestConn(t, ac)
+	conn.cfg.PADTCount = 2
+	conn.discovery = &failingConn{fakeConn: newFakeConn(), failures: 1}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("closing with one failed PADT: %v", err)
+	}
+	expectPacket(t, conn.discovery.(*failingConn).fakeConn, ac)
+
+	// With a discovery conn that never finishes sending, CloseContext
+	// still returns once ctx expires, and releases everything.
+	conn = newTestConn(t, ac)
+	disco := conn.discovery.(*fakeConn)
+	disco.Out = make(chan fakePacket)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := conn.CloseContext(ctx); err == nil {
+		t.Fatal("CloseContext with stuck PADT send succeeded")
+	}
+	select {
+	case <-disco.closed:
+	default:
+		t.Fatal("discovery conn not closed")
+	}
+	if _, err := conn.Write([]byte{0xc0, 0x21}); err == nil {
+		t.Fatal("channel still open after CloseContext")
+	}
+
+	// While CloseContext is busy sending PADTs, the Conn's other
+	// methods don't wait for it.
+	conn = newTestConn(t, ac)
+	disco = conn.discovery.(*fakeConn)
+	disco.Out = make(chan fakePacket)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go conn.CloseContext(ctx)
+	<-disco.Out
+	errc := make(chan error, 1)
+	go func() {
+		conn.CloseReason()
+		errc <- conn.Close()
+	}()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("concurrent Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("concurrent Close blocked while PADTs were being sent")
+	}
+}
+
+func TestCloseOnPADT(t *testing.T) {
+	ac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	conn := newTestConn(t, ac)
+	go conn.closeOnPADT()
+
+	select {
+	case <-conn.Done():
+		t.Fatal("Conn done before the concentrator sent a PADT")
+	default:
+	}
+
+	padt := NewPADT(42).WithGenericError("idle timeout").Bytes()
+	conn.discovery.(*fakeConn).In <- fakePacket{padt, &raw.Addr{HardwareAddr: ac}, nil}
+	select {
+	case <-conn.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Conn not done after the concentrator sent a PADT")
+	}
+
+	want := &ConcentratorError{Tag: "Generic-Error", Message: "idle timeout"}
+	if diff := cmp.Diff(want, conn.CloseReason()); diff != "" {
+		t.Fatalf("wrong close reason (-want +got)\n%s", diff)
+	}
+	if _, err := conn.Write([]byte{0xc0, 0x21}); err != conn.CloseReason() {
+		t.Fatalf("Write after PADT returned %v, want the close reason", err)
+	}
+	// The concentrator already tore the session down, there's no
+	// point in sending our own PADTs.
+	expectNoPacket(t, conn.discovery)
+}
+
+func TestNewAny(t *testing.T) {
+	defer func(orig func(context.Context, string, *Config) (*Conn, error)) {
+		anyNew = orig
+	}(anyNew)
+
+	ac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	conns := map[string]*Conn{}
+	for _, ifName := range []string{"eth1", "eth2"} {
+		conns[ifName] = newTestConn(t, ac)
+	}
+	anyNew = func(ctx context.Context, ifName string, cfg *Config) (*Conn, error) {
+		switch ifName {
+		case "eth0":
+			return nil, errors.New("no such interface")
+		case "eth1":
+			time.Sleep(10 * time.Millisecond)
+			return conns[ifName], nil
+		case "eth2":
+			// Too late, and doesn't notice cancellation.
+			time.Sleep(50 * time.Millisecond)
+			return conns[ifName], nil
+		default:
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+	}
+
+	conn, err := NewAny(context.Background(), []string{"eth0", "eth1", "eth2", "eth3"}, nil)
+	if err != nil {
+		t.Fatalf("NewAny: %v", err)
+	}
+	if conn != conns["eth1"] {
+		t.Fatal("NewAny didn't return the first session")
+	}
+	select {
+	case <-conns["eth1"].Done():
+		t.Fatal("winning Conn closed")
+	default:
+	}
+	select {
+	case <-conns["eth2"].Done():
+	default:
+		t.Fatal("losing Conn not closed")
+	}
+	conn.Close()
+
+	if _, err := NewAny(context.Background(), []string{"eth0"}, nil); err == nil {
+		t.Fatal("NewAny succeeded with no sessions")
+	}
+	if _, err := NewAny(context.Background(), nil, nil); err == nil {
+		t.Fatal("NewAny succeeded with no interfaces")
+	}
+}
+
+// failingConn is a fakeConn whose first writes fail.
+type failingConn struct {
+	*fakeConn
+	failures int
+}
+
+func (c *failingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.failures > 0 {
+		c.failures--
+		return 0, errors.New("write failed")
+	}
+	return c.fakeConn.WriteTo(b, addr)
+}
+
+func TestDeadlines(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("creating socketpair: %v", err)
+	}
+	for _, fd := range fds {
+		if err := unix.SetNonblock(fd, true); err != nil {
+			t.Fatalf("making socket non-blocking: %v", err)
+		}
+	}
+	// Non-blocking fds get registered with the runtime poller, like
+	// the /dev/ppp channel of a real Conn.
+	local, peer := os.NewFile(uintptr(fds[0]), "local"), os.NewFile(uintptr(fds[1]), "peer")
+	defer local.Close()
+	defer peer.Close()
+	conn := &Conn{channel: local}
+
+	// An expired read deadline fails reads, but not writes.
+	if err := conn.SetReadDeadline(time.Unix(1, 0)); err != nil {
+		t.Fatalf("setting read deadline: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 10)); !os.IsTimeout(err) {
+		t.Fatalf("Read with expired deadline returned %v, want timeout", err)
+	}
+	if _, err := conn.Write([]byte{0xc0, 0x21}); err != nil {
+		t.Fatalf("Write with expired read deadline: %v", err)
+	}
+
+	// And vice versa.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		t.Fatalf("clearing deadlines: %v", err)
+	}
+	if err := conn.SetWriteDeadline(time.Unix(1, 0)); err != nil {
+		t.Fatalf("setting write deadline: %v", err)
+	}
+	if _, err := conn.Write([]byte{0xc0, 0x21}); !os.IsTimeout(err) {
+		t.Fatalf("Write with expired deadline returned %v, want timeout", err)
+	}
+	if _, err := peer.Write([]byte{0xc0, 0x21}); err != nil {
+		t.Fatalf("writing to peer: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 10)); err != nil {
+		t.Fatalf("Read with expired write deadline: %v", err)
+	}
+}
+
+// openFds returns the number of open file descriptors in the process.
+func openFds(t *testing.T) int {
+	t.Helper()
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatalf("listing open fds: %v", err)
+	}
+	return len(fds)
+}
+
+func TestRawConn(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatalf("getting loopback interface: %v", err)
+	}
+	conn, err := listenRaw(lo, protoPPPoEDiscovery)
+	if err != nil {
+		t.Skipf("can't open raw sockets: %v", err)
+	}
+	defer conn.Close()
+
+	read := func() <-chan error {
+		ret := make(chan error, 1)
+		go func() {
+			_, _, err := conn.ReadFrom(make([]byte, pppoeBufferLen))
+			ret <- err
+		}()
+		return ret
+	}
+
+	// A deadline set during a read cuts it short.
+	errs := read()
+	time.Sleep(50 * time.Millisecond)
+	conn.SetReadDeadline(time.Now())
+	select {
+	case err := <-errs:
+		if !isTimeout(err) {
+			t.Fatalf("read returned %v, want timeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read didn't notice its deadline")
+	}
+
+	// Close waits for reads in progress, so that they don't go on
+	// with a file descriptor that a new socket may reuse.
+	conn.SetReadDeadline(time.Time{})
+	errs = read()
+	time.Sleep(50 * time.Millisecond)
+	if err := conn.Close(); err != nil {
+		t.Fatalf("closing conn: %v", err)
+	}
+	select {
+	case err := <-errs:
+		if err != errRawClosed {
+			t.Fatalf("read returned %v, want %v", err, errRawClosed)
+		}
+	default:
+		t.Fatal("Close returned before read in progress")
+	}
+
+	if err := conn.Close(); err != errRawClosed {
+		t.Errorf("second Close returned %v, want %v", err, errRawClosed)
+	}
+	if _, err := conn.WriteTo([]byte{0x11}, ethernetBroadcast); err != errRawClosed {
+		t.Errorf("WriteTo on closed conn returned %v, want %v", err, errRawClosed)
+	}
+}
+
+// TestRawConnReuse checks that a read in progress on a closed rawConn
+// doesn't steal the packets of a socket that reuses its file
+// descriptor, which is how a closed Conn's PADT watcher used to
+// swallow the next Conn's PADOs.
+func TestRawConnReuse(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatalf("getting loopback interface: %v", err)
+	}
+	old, err := listenRaw(lo, protoPPPoEDiscovery)
+	if err != nil {
+		t.Skipf("can't open raw sockets: %v", err)
+	}
+	stale := make(chan error, 1)
+	go func() {
+		_, _, err := old.ReadFrom(make([]byte, pppoeBufferLen))
+		stale <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := old.Close(); err != nil {
+		t.Fatalf("closing conn: %v", err)
+	}
+
+	conn, err := listenRaw(lo, protoPPPoEDiscovery)
+	if err != nil {
+		t.Fatalf("opening raw socket: %v", err)
+	}
+	defer conn.Close()
+	pkt := padiPacket("", []byte("reuse"), 0)
+	if _, err := conn.WriteTo(pkt, ethernetBroadcast); err != nil {
+		t.Fatalf("sending packet: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, pppoeBufferLen)
+	for {
+		n, _, err := conn.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("new conn didn't get its packet: %v", err)
+		}
+		if bytes.Equal(b[:n], pkt) {
+			break
+		}
+	}
+	if err := <-stale; err != errRawClosed {
+		t.Errorf("stale read returned %v, want %v", err, errRawClosed)
+	}
+}
+
+// stuckSocket is a rawSocket whose writes block until unstick is
+// closed.
+type stuckSocket struct {
+	net.PacketConn
+	writing chan struct{}
+	unstick chan struct{}
+	closed  chan struct{}
+}
+
+func (s *stuckSocket) WriteTo(b []byte, addr net.Addr) (int, error) {
+	close(s.writing)
+	<-s.unstick
+	return len(b), nil
+}
+
+func (s *stuckSocket) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func (s *stuckSocket) SetPromiscuous(bool) error { return nil }
+
+// TestRawConnStuckWrite checks that Close doesn't wait for a write
+// that's stuck in the kernel, which is what bounds the PADT sends of
+// CloseContext, and that the socket stays open until the write
+// returns.
+func TestRawConnStuckWrite(t *testing.T) {
+	sock := &stuckSocket{
+		writing: make(chan struct{}),
+		unstick: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	conn := &rawConn{rawSocket: sock}
+	wrote := make(chan error, 1)
+	go func() {
+		_, err := conn.WriteTo([]byte{0x11}, ethernetBroadcast)
+		wrote <- err
+	}()
+	<-sock.writing
+
+	closed := make(chan error, 1)
+	go func() { closed <- conn.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("closing conn: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for a stuck write")
+	}
+	select {
+	case <-sock.closed:
+		t.Fatal("socket closed while a write was in progress")
+	default:
+	}
+	if _, err := conn.WriteTo([]byte{0x11}, ethernetBroadcast); err != errRawClosed {
+		t.Errorf("WriteTo on closed conn returned %v, want %v", err, errRawClosed)
+	}
+
+	close(sock.unstick)
+	if err := <-wrote; err != nil {
+		t.Errorf("stuck write returned %v", err)
+	}
+	select {
+	case <-sock.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("socket not closed after the stuck write returned")
+	}
+}
+
+func TestSetupLeaks(t *testing.T) {
+	origInterface, origDiscoveryConn, origSessionFd := setupInterface, setupDiscoveryConn, setupSessionFd
+	origDiscovery, origConnect, origChannel := setupDiscovery, setupConnect, setupChannel
+	origSessionConn := setupSessionConn
+	defer func() {
+		setupInterface, setupDiscoveryConn, setupSessionFd = origInterface, origDiscoveryConn, origSessionFd
+		setupDiscovery, setupConnect, setupChannel = origDiscovery, origConnect, origChannel
+		setupSessionConn = origSessionConn
+	}()
+
+	// Replace every setup step with one that allocates real fds, and
+	// fails if it's step fail.
+	errInjected := errors.New("injected failure")
+	install := func(fail int) {
+		setupInterface = func(ifName string) (*net.Interface, error) {
+			if fail == 0 {
+				return nil, errInjected
+			}
+			return &net.Interface{Name: ifName, HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}, nil
+		}
+		setupDiscoveryConn = func(string) (net.PacketConn, error) {
+			if fail == 1 {
+				return nil, errInjected
+			}
+			return net.ListenPacket("udp", "127.0.0.1:0")
+		}
+		setupSessionConn = func(string) (net.PacketConn, error) {
+			if fail == 2 {
+				return nil, errInjected
+			}
+			return net.ListenPacket("udp", "127.0.0.1:0")
+		}
+		setupSessionFd = func(string) (int, error) {
+			if fail == 2 {
+				return -1, errInjected
+			}
+			return unix.Socket(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+		}
+		setupDiscovery = func(context.Context, net.PacketConn, *Config) (net.HardwareAddr, uint16, int, error) {
+			if fail == 3 {
+				return nil, 0, 0, errInjected
+			}
+			return net.HardwareAddr{2, 0, 0, 0, 0, 2}, 42, defaultMaxPayload, nil
+		}
+		setupConnect = func(int, string, net.HardwareAddr, uint16) error {
+			if fail == 4 {
+				return errInjected
+			}
+			return nil
+		}
+		setupChannel = func(int) (*os.File, error) {
+			if fail == 5 {
+				return nil, errInjected
+			}
+			return os.Open(os.DevNull)
+		}
+	}
+
+	// Close fails to send PADTs over UDP, which is fine here.
+	cfg := &Config{PADTCount: 1}
+
+	// A successful setup and teardown, to let the runtime allocate
+	// whatever fds it needs (e.g. the poller's) before we start
+	// counting.
+	install(-1)
+	conn, err := New(context.Background(), "eth0", cfg)
+	if err != nil {
+		t.Fatalf("New with no failures: %v", err)
+	}
+	conn.Close()
+
+	for fail := 0; fail < 6; fail++ {
+		install(fail)
+		before := openFds(t)
+		conn, err := New(context.Background(), "eth0", cfg)
+		if err != errInjected {
+			if err == nil {
+				conn.Close()
+			}
+			t.Fatalf("New with failure at step %d returned %v, want injected failure", fail, err)
+		}
+		if after := openFds(t); after != before {
+			t.Errorf("New with failure at step %d leaked %d fds", fail, after-before)
+		}
+
+		if fail == 3 {
+			// Attach doesn't run discovery.
+			continue
+		}
+		before = openFds(t)
+		conn, err = Attach("eth0", net.HardwareAddr{2, 0, 0, 0, 0, 2}, 42, cfg)
+		if err != errInjected {
+			if err == nil {
+				conn.Close()
+			}
+			t.Fatalf("Attach with failure at step %d returned %v, want injected failure", fail, err)
+		}
+		if after := openFds(t); after != before {
+			t.Errorf("Attach with failure at step %d leaked %d fds", fail, after-before)
+		}
+	}
+
+	// Userspace setups open a session socket at step 2, and have no
+	// steps past discovery.
+	userspaceCfg := &Config{PADTCount: 1, Userspace: true}
+	for fail := 0; fail < 4; fail++ {
+		install(fail)
+		before := openFds(t)
+		conn, err := New(context.Background(), "eth0", userspaceCfg)
+		if err != errInjected {
+			if err == nil {
+				conn.Close()
+			}
+			t.Fatalf("userspace New with failure at step %d returned %v, want injected failure", fail, err)
+		}
+		if after := openFds(t); after != before {
+			t.Errorf("userspace New with failure at step %d leaked %d fds", fail, after-before)
+		}
+	}
+
+	// A Conn releases everything when closed.
+	install(-1)
+	for _, cfg := range []*Config{cfg, userspaceCfg} {
+		before := openFds(t)
+		conn, err = New(context.Background(), "eth0", cfg)
+		if err != nil {
+			t.Fatalf("New with no failures: %v", err)
+		}
+		conn.Close()
+		if after := openFds(t); after != before {
+			t.Errorf("closed Conn (userspace %v) leaked %d fds", cfg.Userspace, after-before)
+		}
+	}
+}
+
+func TestLinks(t *testing.T) {
+	origVLAN, origMACVLAN, origTeardown := setupVLAN, setupMACVLAN, teardownLink
+	origInterface, origDiscoveryConn := setupInterface, setupDiscoveryConn
+	origSessionConn, origDiscovery := setupSessionConn, setupDiscovery
+	defer func() {
+		setupVLAN, setupMACVLAN, teardownLink = origVLAN, origMACVLAN, origTeardown
+		setupInterface, setupDiscoveryConn = origInterface, origDiscoveryConn
+		setupSessionConn, setupDiscovery = origSessionConn, origDiscovery
+	}()
+
+	var (
+		exists     bool
+		failMAC    bool
+		failDisco  bool
+		created    []string
+		tornDown   []string
+		interfaces []string
+	)
+	setupVLAN = func(parent string, id, priority int) (string, bool, error) {
+		name := fmt.Sprintf("%s.%d/%d", parent, id, priority)
+		if exists {
+			return name, false, nil
+		}
+		created = append(created, name)
+		return name, true, nil
+	}
+	setupMACVLAN = func(parent string, addr net.HardwareAddr) (string, bool, error) {
+		if failMAC {
+			return "", false, errors.New("no macvlan support")
+		}
+		name := fmt.Sprintf("%s/%s", parent, addr)
+		if exists {
+			return name, false, nil
+		}
+		created = append(created, name)
+		return name, true, nil
+	}
+	teardownLink = func(name string) error {
+		tornDown = append(tornDown, name)
+		return nil
+	}
+	setupInterface = func(ifName string) (*net.Interface, error) {
+		interfaces = append(interfaces, ifName)
+		return &net.Interface{Name: ifName, HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}, nil
+	}
+	setupDiscoveryConn = func(string) (net.PacketConn, error) { return newFakeConn(), nil }
+	setupSessionConn = func(string) (net.PacketConn, error) { return newFakeConn(), nil }
+	setupDiscovery = func(context.Context, net.PacketConn, *Config) (net.HardwareAddr, uint16, int, error) {
+		if failDisco {
+			return nil, 0, 0, errors.New("no concentrator")
+		}
+		return net.HardwareAddr{2, 0, 0, 0, 0, 2}, 42, defaultMaxPayload, nil
+	}
+
+	mac := net.HardwareAddr{2, 0, 0, 0xa, 0xb, 0xc}
+	tests := []struct {
+		desc      string
+		addr      net.HardwareAddr
+		exists    bool
+		failMAC   bool
+		failDisco bool
+		detach    bool
+		wantIntf  string
+		wantErr   bool
+		wantTorn  []string
+	}{
+		{
+			desc:     "VLAN",
+			wantIntf: "eth0.7/5",
+			wantTorn: []string{"eth0.7/5"},
+		},
+		{
+			desc:     "VLAN and address",
+			addr:     mac,
+			wantIntf: "eth0.7/5/02:00:00:0a:0b:0c",
+			wantTorn: []string{"eth0.7/5/02:00:00:0a:0b:0c", "eth0.7/5"},
+		},
+		{
+			desc:     "existing",
+			addr:     mac,
+			exists:   true,
+			wantIntf: "eth0.7/5/02:00:00:0a:0b:0c",
+		},
+		{
+			desc:     "detached",
+			addr:     mac,
+			detach:   true,
+			wantIntf: "eth0.7/5/02:00:00:0a:0b:0c",
+		},
+		{
+			desc:     "address failure",
+			addr:     mac,
+			failMAC:  true,
+			wantErr:  true,
+			wantTorn: []string{"eth0.7/5"},
+		},
+		{
+			desc:      "discovery failure",
+			addr:      mac,
+			failDisco: true,
+			wantIntf:  "eth0.7/5/02:00:00:0a:0b:0c",
+			wantErr:   true,
+			wantTorn:  []string{"eth0.7/5/02:00:00:0a:0b:0c", "eth0.7/5"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			exists, failMAC, failDisco = test.exists, test.failMAC, test.failDisco
+			created, tornDown, interfaces = nil, nil, nil
+			cfg := &Config{
+				VLANID:       7,
+				VLANPriority: 5,
+				HardwareAddr: test.addr,
+				Userspace:    true,
+				PADTCount:    1,
+			}
+			conn, err := New(context.Background(), "eth0", cfg)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("New returned %v, want error: %v", err, test.wantErr)
+			}
+			if err == nil {
+				if test.detach {
+					conn.Detach()
+				} else {
+					conn.Close()
+				}
+			}
+			var wantIntfs []string
+			if test.wantIntf != "" {
+				wantIntfs = []string{test.wantIntf}
+			}
+			if diff := cmp.Diff(wantIntfs, interfaces); diff != "" {
+				t.Errorf("wrong interfaces used (-want +got)\n%s", diff)
+			}
+			if diff := cmp.Diff(test.wantTorn, tornDown); diff != "" {
+				t.Errorf("wrong interfaces torn down (-want +got)\n%s", diff)
+			}
+		})
+	}
+
+	invalid := []*Config{
+		{VLANID: 4095},
+		{VLANID: 7, VLANPriority: 8},
+		{HardwareAddr: net.HardwareAddr{1, 0, 0, 0, 0, 1}},
+		{HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 0, 0, 1}},
+	}
+	for _, cfg := range invalid {
+		created = nil
+		if _, err := New(context.Background(), "eth0", cfg); err == nil {
+			t.Errorf("New with VLAN %d priority %d address %s succeeded", cfg.VLANID, cfg.VLANPriority, cfg.HardwareAddr)
+		}
+		if len(created) != 0 {
+			t.Errorf("New with VLAN %d priority %d address %s created interfaces", cfg.VLANID, cfg.VLANPriority, cfg.HardwareAddr)
+		}
+	}
+}
+
+func TestNewUnit(t *testing.T) {
+	conn := newTestConn(t, net.HardwareAddr{2, 0, 0, 0, 0, 2})
+	defer conn.Close()
+
+	// The test Conn's channel is a pipe, which the kernel refuses to
+	// connect to a unit. That must not leak the unit's fd.
+	before := openFds(t)
+	if _, err := conn.NewUnit(); err == nil {
+		t.Fatal("NewUnit on a pipe channel succeeded")
+	}
+	if after := openFds(t); after != before {
+		t.Fatalf("failed NewUnit leaked %d fds", after-before)
+	}
+	if conn.unit != nil {
+		t.Fatal("failed NewUnit left a unit on the Conn")
+	}
+
+	conn.Close()
+	if _, err := conn.NewUnit(); err != errClosed {
+		t.Fatalf("NewUnit on closed Conn returned %v, want %v", err, errClosed)
+	}
+}
+
+func TestNewUnitName(t *testing.T) {
+	origDevice, origIoctl := openPPPDevice, ioctlPtr
+	defer func() { openPPPDevice, ioctlPtr = origDevice, origIoctl }()
+	openPPPDevice = func() (*os.File, error) { return os.Open(os.DevNull) }
+	// The kernel reads and writes unit numbers as 32-bit ints.
+	var connected int32
+	ioctlPtr = func(fd int, req uint, arg unsafe.Pointer) error {
+		switch req {
+		case unix.PPPIOCNEWUNIT:
+			if got := *(*int32)(arg); got != -1 {
+				return fmt.Errorf("PPPIOCNEWUNIT asked for unit %d, want -1", got)
+			}
+			*(*int32)(arg) = 3
+		case unix.PPPIOCCONNECT:
+			connected = *(*int32)(arg)
+		default:
+			return fmt.Errorf("unexpected ioctl %#x", req)
+		}
+		return nil
+	}
+
+	conn := newTestConn(t, net.HardwareAddr{2, 0, 0, 0, 0, 2})
+	defer conn.Close()
+	name, err := conn.NewUnit()
+	if err != nil {
+		t.Fatalf("NewUnit failed: %v", err)
+	}
+	if name != "ppp3" {
+		t.Errorf("NewUnit returned %q, want ppp3", name)
+	}
+	if connected != 3 {
+		t.Errorf("channel connected to unit %d, want 3", connected)
+	}
+}
+
+func TestUnitSettings(t *testing.T) {
+	conn := newTestConn(t, net.HardwareAddr{2, 0, 0, 0, 0, 2})
+	defer conn.Close()
+
+	calls := map[string]func() error{
+		"UnitFlags":    func() error { _, err := conn.UnitFlags(); return err },
+		"SetUnitFlags": func() error { return conn.SetUnitFlags(UnitMultilink) },
+		"UnitDebug":    func() error { _, err := conn.UnitDebug(); return err },
+		"SetUnitDebug": func() error { return conn.SetUnitDebug(UnitDebugMessages) },
+		"SetUnitMRU":   func() error { return conn.SetUnitMRU(1500) },
+		"SetUnitMTU":   func() error { return conn.SetUnitMTU(1500) },
+		"SetUnitIPv4":  func() error { return conn.SetUnitIPv4(net.IP{100, 64, 0, 2}, nil) },
+		"AddUnitRoute": func() error { return conn.AddUnitRoute(nil) },
+	}
+	for name, call := range calls {
+		if err := call(); err == nil {
+			t.Errorf("%s without a PPP unit succeeded", name)
+		}
+	}
+	if err := conn.WatchUnitKernelLog(context.Background(), nil); err == nil {
+		t.Error("WatchUnitKernelLog without a PPP unit succeeded")
+	}
+
+	// A unit that isn't a /dev/ppp unit makes the ioctls fail, rather
+	// than do something else.
+	unit, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("opening %s: %v", os.DevNull, err)
+	}
+	conn.unit, conn.unitName = unit, "ppp-nonexistent"
+	for name, call := range calls {
+		if err := call(); err == nil {
+			t.Errorf("%s on a bogus PPP unit succeeded", name)
+		}
+	}
+
+	// Addresses and routes that aren't IPv4 are rejected before
+	// touching the unit.
+	if err := conn.SetUnitIPv4(net.IPv4zero, nil); err == nil {
+		t.Error("SetUnitIPv4 with 0.0.0.0 succeeded")
+	}
+	if err := conn.SetUnitIPv4(net.ParseIP("2001:db8::1"), nil); err == nil {
+		t.Error("SetUnitIPv4 with an IPv6 address succeeded")
+	}
+	_, v6, _ := net.ParseCIDR("2001:db8::/32")
+	if err := conn.AddUnitRoute(v6); err == nil {
+		t.Error("AddUnitRoute with an IPv6 destination succeeded")
+	}
+
+	conn.Close()
+	for name, call := range calls {
+		if err := call(); err != errClosed {
+			t.Errorf("%s on closed Conn returned %v, want %v", name, err, errClosed)
+		}
+	}
+	if err := conn.WatchUnitKernelLog(context.Background(), nil); err != errClosed {
+		t.Errorf("WatchUnitKernelLog on closed Conn returned %v, want %v", err, errClosed)
+	}
+}
+
+// TestWithUnitUnlocked checks that unit operations don't hold the
+// Conn's lock while they run, and that Close waits for them before
+// closing the unit.
+func TestWithUnitUnlocked(t *testing.T) {
+	conn := newTestConn(t, net.HardwareAddr{2, 0, 0, 0, 0, 2})
+	unit, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("opening %s: %v", os.DevNull, err)
+	}
+	conn.unit, conn.unitName = unit, "ppp-nonexistent"
+
+	started, release := make(chan struct{}), make(chan struct{})
+	opDone := make(chan error, 1)
+	go func() {
+		opDone <- conn.withUnit(func(unit *os.File, _ string) error {
+			close(started)
+			<-release
+			_, err := unit.Stat()
+			return err
+		})
+	}()
+	<-started
+
+	reason := make(chan error, 1)
+	go func() { reason <- conn.CloseReason() }()
+	select {
+	case <-reason:
+	case <-time.After(5 * time.Second):
+		t.Fatal("CloseReason blocked behind a unit operation")
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- conn.Close() }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned %v during a unit operation", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-opDone; err != nil {
+		t.Errorf("unit operation failed: %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't return after the unit operation")
+	}
+	if _, err := unit.Stat(); err == nil {
+		t.Error("unit still open after Close")
+	}
+}
+
+func TestUnitDebugWidth(t *testing.T) {
+	origIoctl := ioctlPtr
+	defer func() { ioctlPtr = origIoctl }()
+	// The kernel writes the debug flags as a 32-bit int.
+	ioctlPtr = func(fd int, req uint, arg unsafe.Pointer) error {
+		if req != unix.PPPIOCGDEBUG {
+			return fmt.Errorf("unexpected ioctl %#x", req)
+		}
+		*(*uint32)(arg) = 0x80000001
+		return nil
+	}
+
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := unitDebug(f)
+	if err != nil {
+		t.Fatalf("unitDebug failed: %v", err)
+	}
+	if want := uint32(0x80000001); got != want {
+		t.Errorf("unitDebug = %#x, want %#x", got, want)
+	}
+}
+
+func TestUnitKernelMessage(t *testing.T) {
+	tests := []struct {
+		rec  string
+		want string
+		ok   bool
+	}{
+		{"7,1234,5678,-;ppp0: PPP: reconstructed packet is too long (1600)\n", "ppp0: PPP: reconstructed packet is too long (1600)", true},
+		{"3,1235,5679,-;ppp0: ppp_decompress_frame: no memory\n SUBSYSTEM=net\n DEVICE=n42\n", "ppp0: ppp_decompress_frame: no memory", true},
+		{"3,1236,5680,-;PPP: no memory (VJ comp pkt)\n", "", false},
+		{"7,1237,5681,-;ppp1: PPP: reconstructed packet is too long (1600)\n", "", false},
+		{"6,1238,5682,-;ppp00: something else\n", "", false},
+		{"6,1239,5683,-;eth0: link up\n", "", false},
+		{"garbage", "", false},
+	}
+	for _, test := range tests {
+		got, ok := unitKernelMessage([]byte(test.rec), "ppp0")
+		if got != test.want || ok != test.ok {
+			t.Errorf("unitKernelMessage(%q) = %q, %v, want %q, %v", test.rec, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestMACVLANName(t *testing.T) {
+	addr := net.HardwareAddr{2, 0, 0, 0x0a, 0x0b, 0x0c}
+	names := map[string]bool{}
+	for _, parent := range []string{"eth0", "eth1", "eth0.7"} {
+		for _, a := range []net.HardwareAddr{addr, {4, 0, 0, 0x0a, 0x0b, 0x0c}} {
+			name := macvlanName(parent, a)
+			if len(name) >= unix.IFNAMSIZ {
+				t.Errorf("macvlanName(%q, %v) = %q, too long for an interface name", parent, a, name)
+			}
+			if names[name] {
+				t.Errorf("macvlanName(%q, %v) = %q, which another parent or address already has", parent, a, name)
+			}
+			names[name] = true
+		}
+	}
+	if a, b := macvlanName("eth0", addr), macvlanName("eth0", addr); a != b {
+		t.Errorf("macvlanName isn't stable: %q, then %q", a, b)
+	}
+}
+
+func TestGetLink(t *testing.T) {
+	link, err := getLink("lo")
+	if err != nil {
+		t.Fatalf("getLink(lo): %v", err)
+	}
+	if link.kind != "" || link.parent != 0 {
+		t.Errorf("lo is a %q interface on interface %d, want a physical one", link.kind, link.parent)
+	}
+	if want := (net.HardwareAddr{0, 0, 0, 0, 0, 0}); !bytes.Equal(link.addr, want) {
+		t.Errorf("lo has address %v, want %v", link.addr, want)
+	}
+}
+
+func TestCreateLinkExisting(t *testing.T) {
+	// An interface of another kind squatting on the macvlan's name
+	// must make createMACVLAN fail, rather than run PPPoE from it.
+	addr := net.HardwareAddr{2, 0, 0, 0x0a, 0x0b, 0x0c}
+	name := macvlanName("lo", addr)
+	created, err := createLink("lo", name, "veth", nil, nil)
+	if err != nil {
+		t.Skipf("can't create interfaces: %v", err)
+	}
+	if !created {
+		t.Fatalf("test interface %s already exists", name)
+	}
+	defer deleteLink(name)
+
+	if _, err := createLink("lo", name, "veth", nil, nil); err == nil {
+		t.Errorf("reusing veth %s, whose parent isn't lo, succeeded", name)
+	}
+	if _, _, err := createMACVLAN("lo", addr); err == nil {
+		t.Errorf("createMACVLAN over veth %s succeeded", name)
+	}
+
+	// Likewise for createVLAN.
+	if _, err := createLink("lo", "lo.7", "veth", nil, nil); err != nil {
+		t.Fatalf("creating veth lo.7: %v", err)
+	}
+	defer deleteLink("lo.7")
+	if _, _, err := createVLAN("lo", 7, 0); err == nil {
+		t.Error("createVLAN over veth lo.7 succeeded")
+	}
+}
+
+func TestParseVLAN(t *testing.T) {
+	mapping := func(from, to uint32) []byte {
+		ret := make([]byte, sizeofVLANQOSMapping)
+		*(*[2]uint32)(unsafe.Pointer(&ret[0])) = [2]uint32{from, to}
+		return netlinkAttr(iflaVLANQOSMapping, ret)
+	}
+	tests := []struct {
+		desc         string
+		data         []byte
+		wantID       int
+		wantPriority int
+	}{
+		{
+			desc:   "no egress mappings",
+			data:   netlinkAttr(iflaVLANID, netlinkUint16(7)),
+			wantID: 7,
+		},
+		{
+			desc: "priority",
+			data: append(netlinkAttr(iflaVLANID, netlinkUint16(835)),
+				netlinkAttr(iflaVLANEgressQOS, mapping(3, 1), mapping(0, 5))...),
+			wantID:       835,
+			wantPriority: 5,
+		},
+		{
+			desc: "other priorities only",
+			data: append(netlinkAttr(iflaVLANID, netlinkUint16(7)),
+				netlinkAttr(iflaVLANEgressQOS, mapping(6, 6))...),
+			wantID: 7,
+		},
+	}
+	for _, test := range tests {
+		var got linkInfo
+		got.parseVLAN(test.data)
+		if got.vlanID != test.wantID || got.vlanPriority != test.wantPriority {
+			t.Errorf("%s: got VLAN %d with priority %d, want VLAN %d with priority %d", test.desc, got.vlanID, got.vlanPriority, test.wantID, test.wantPriority)
+		}
+	}
+}
@@ -1,15 +1,162 @@
 package pppoe
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/raw"
+
 	"go.universe.tf/ppp/internal/testutil"
+	"go.universe.tf/ppp/lcp"
 )
 
 func TestNew(t *testing.T) {
+	ac := testutil.NewFakeAC()
+	defer ac.Close()
+
+	origInterface, origDiscoveryConn, origSessionConn := setupInterface, setupDiscoveryConn, setupSessionConn
+	defer func() {
+		setupInterface, setupDiscoveryConn, setupSessionConn = origInterface, origDiscoveryConn, origSessionConn
+	}()
+	setupInterface = func(string) (*net.Interface, error) { return ac.Interface(), nil }
+	setupDiscoveryConn = func(string) (net.PacketConn, error) { return ac.Discovery(), nil }
+	setupSessionConn = func(string) (net.PacketConn, error) { return ac.Session(), nil }
+
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+
+	conn, err := New(ctx, "fakeac0", &Config{Userspace: true})
+	if err != nil {
+		t.Fatalf("PPPoE session setup failed: %v", err)
+	}
+	defer conn.Close()
+	if got, want := conn.RemoteAddr().(*Addr).SessionID, ac.SessionID; got != want {
+		t.Errorf("wrong session ID, got %d, want %d", got, want)
+	}
+
+	if _, err := lcp.Negotiate(ctx, conn, nil); err != nil {
+		t.Fatalf("LCP negotiation failed: %v", err)
+	}
+	if !ac.LCPOpened() {
+		t.Error("concentrator didn't see LCP open")
+	}
+
+	frame := []byte{0x00, 0x21, 0x45, 0, 0, 20}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatalf("writing to PPPoE session: %v", err)
+	}
+	if diff := cmp.Diff([][]byte{frame}, ac.Frames()); diff != "" {
+		t.Errorf("wrong frames at concentrator (-want +got)\n%s", diff)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("closing PPPoE session: %v", err)
+	}
+	if !ac.Terminated() {
+		t.Error("concentrator didn't get a PADT")
+	}
+}
+
+// TestHeaderCompression runs LCP over a PPPoE session with
+// concentrators that do and don't ask for PFC and ACFC, and checks
+// that the session's frames stay uncompressed both ways. pppd's PPPoE
+// server asks for both by default, but TestNewPPPD needs Docker and
+// root, so CI runs this matrix against a FakeAC instead.
+func TestHeaderCompression(t *testing.T) {
+	type compression struct{ pfc, acfc bool }
+	var combos []compression
+	for _, pfc := range []bool{false, true} {
+		for _, acfc := range []bool{false, true} {
+			combos = append(combos, compression{pfc, acfc})
+		}
+	}
+
+	for _, acs := range combos {
+		for _, ours := range combos {
+			t.Run(fmt.Sprintf("ac=%+v/client=%+v", acs, ours), func(t *testing.T) {
+				ac := testutil.NewFakeAC()
+				defer ac.Close()
+				ac.PFC, ac.ACFC = acs.pfc, acs.acfc
+
+				origInterface, origDiscoveryConn, origSessionConn := setupInterface, setupDiscoveryConn, setupSessionConn
+				defer func() {
+					setupInterface, setupDiscoveryConn, setupSessionConn = origInterface, origDiscoveryConn, origSessionConn
+				}()
+				setupInterface = func(string) (*net.Interface, error) { return ac.Interface(), nil }
+				setupDiscoveryConn = func(string) (net.PacketConn, error) { return ac.Discovery(), nil }
+				setupSessionConn = func(string) (net.PacketConn, error) { return ac.Session(), nil }
+
+				ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+				defer done()
+
+				conn, err := New(ctx, "fakeac0", &Config{Userspace: true, PADTCount: 1})
+				if err != nil {
+					t.Fatalf("PPPoE session setup failed: %v", err)
+				}
+				defer conn.Close()
+
+				neg, err := lcp.Negotiate(ctx, conn, &lcp.Options{PFC: ours.pfc, ACFC: ours.acfc})
+				if ours.pfc || ours.acfc {
+					if err == nil {
+						t.Fatal("LCP negotiation requesting compression succeeded")
+					}
+					if ac.LCPOpened() {
+						t.Error("concentrator saw LCP open")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("LCP negotiation failed: %v", err)
+				}
+				if neg.Local.PFC || neg.Local.ACFC || neg.Peer.PFC || neg.Peer.ACFC {
+					t.Errorf("compression negotiated: %+v", neg)
+				}
+				var wantRejected []uint8
+				if acs.pfc {
+					wantRejected = append(wantRejected, uint8(lcp.OptPFC))
+				}
+				if acs.acfc {
+					wantRejected = append(wantRejected, uint8(lcp.OptACFC))
+				}
+				if diff := cmp.Diff(wantRejected, ac.LCPRejected()); diff != "" {
+					t.Errorf("wrong options rejected (-want +got)\n%s", diff)
+				}
+
+				frame := []byte{0x00, 0x21, 0x45, 0, 0, 20}
+				if _, err := conn.Write(frame); err != nil {
+					t.Fatalf("writing to PPPoE session: %v", err)
+				}
+				if diff := cmp.Diff([][]byte{frame}, ac.Frames()); diff != "" {
+					t.Errorf("wrong frames at concentrator (-want +got)\n%s", diff)
+				}
+
+				ac.SendFrame(frame)
+				if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+					t.Fatalf("setting read deadline: %v", err)
+				}
+				b := make([]byte, 1500)
+				n, err := conn.Read(b)
+				if err != nil {
+					t.Fatalf("reading from PPPoE session: %v", err)
+				}
+				if diff := cmp.Diff(frame, b[:n]); diff != "" {
+					t.Errorf("wrong frame at client (-want +got)\n%s", diff)
+				}
+			})
+		}
+	}
+}
+
+// TestNewPPPD checks interoperability with pppd's PPPoE server, in a
+// container.
+func TestNewPPPD(t *testing.T) {
 	if err := testutil.CheckPrivilegeForContainerTests(); err != nil {
 		t.Skipf("can't run privileged tests: %v", err)
 	}
@@ -23,7 +170,7 @@ func TestNew(t *testing.T) {
 	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
 	defer done()
 
-	conn, err := New(ctx, "docker0")
+	conn, err := New(ctx, "docker0", nil)
 	if err != nil {
 		t.Fatalf("PPPoE session setup failed: %v", err)
 	}
@@ -59,3 +206,188 @@ func TestNew(t *testing.T) {
 		t.Fatalf("wrong PPP protocol, got %4x, want c021", proto)
 	}
 }
+
+func TestWriteProtocol(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("creating pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+	conn := &Conn{channel: w}
+
+	if err := conn.WriteProtocol(0xc021, []byte{9, 1, 0, 8, 0, 0, 0, 0}); err != nil {
+		t.Fatalf("writing LCP frame: %v", err)
+	}
+	want := []byte{0xc0, 0x21, 9, 1, 0, 8, 0, 0, 0, 0}
+	got := make([]byte, len(want))
+	if _, err := r.Read(got); err != nil {
+		t.Fatalf("reading back frame: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("wrong frame written: (-want +got)\n%s", diff)
+	}
+
+	for _, proto := range []uint16{0xc020, 0x0121, 0} {
+		if err := conn.WriteProtocol(proto, nil); err == nil {
+			t.Errorf("WriteProtocol accepted invalid protocol 0x%04x", proto)
+		}
+	}
+}
+
+func TestAttachErrors(t *testing.T) {
+	ac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	tests := []struct {
+		desc         string
+		concentrator net.HardwareAddr
+		sessionID    uint16
+	}{
+		{"reserved session ID", ac, 0},
+		{"no concentrator", nil, 42},
+		{"non-Ethernet concentrator", net.HardwareAddr{1, 2, 3, 4, 5, 6, 7, 8}, 42},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			conn, err := Attach("lo", test.concentrator, test.sessionID, nil)
+			if err == nil {
+				conn.Close()
+				t.Fatal("Attach succeeded")
+			}
+		})
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	origVLAN, origMACVLAN, origTeardown, origDiscoveryConn := setupVLAN, setupMACVLAN, teardownLink, setupDiscoveryConn
+	defer func() {
+		setupVLAN, setupMACVLAN, teardownLink, setupDiscoveryConn = origVLAN, origMACVLAN, origTeardown, origDiscoveryConn
+	}()
+
+	var calls []string
+	setupVLAN = func(parent string, id, priority int) (string, bool, error) {
+		name := fmt.Sprintf("%s.%d", parent, id)
+		calls = append(calls, "create "+name)
+		return name, true, nil
+	}
+	setupMACVLAN = func(parent string, addr net.HardwareAddr) (string, bool, error) {
+		name := fmt.Sprintf("%s/%s", parent, addr)
+		calls = append(calls, "create "+name)
+		return name, true, nil
+	}
+	teardownLink = func(name string) error {
+		calls = append(calls, "delete "+name)
+		return nil
+	}
+	conn := newFakeConn()
+	setupDiscoveryConn = func(ifName string) (net.PacketConn, error) {
+		calls = append(calls, "padt on "+ifName)
+		return conn, nil
+	}
+
+	ac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	cfg := &Config{
+		VLANID:       7,
+		HardwareAddr: net.HardwareAddr{2, 0, 0, 0x0a, 0x0b, 0x0c},
+	}
+	if err := Terminate("eth0", ac, 0x01eb, cfg); err != nil {
+		t.Fatalf("Terminate failed: %v", err)
+	}
+	want := []string{
+		"create eth0.7",
+		"create eth0.7/02:00:00:0a:0b:0c",
+		"padt on eth0.7/02:00:00:0a:0b:0c",
+		"delete eth0.7/02:00:00:0a:0b:0c",
+		"delete eth0.7",
+	}
+	if diff := cmp.Diff(want, calls); diff != "" {
+		t.Errorf("wrong interface setup (-want +got)\n%s", diff)
+	}
+	select {
+	case pkt := <-conn.Out:
+		padt := []byte{0x11, pppoePADT, 0x01, 0xeb, 0, 0}
+		if diff := cmp.Diff(padt, pkt.b); diff != "" {
+			t.Errorf("wrong PADT (-want +got)\n%s", diff)
+		}
+		if got := pkt.addr.(*raw.Addr).HardwareAddr; !bytes.Equal(got, ac) {
+			t.Errorf("PADT sent to %s, want %s", got, ac)
+		}
+	default:
+		t.Fatal("no PADT sent")
+	}
+
+	// Addresses that net.ParseMAC accepts, but aren't Ethernet
+	// addresses, are refused before touching any interface.
+	calls = nil
+	for _, addr := range []net.HardwareAddr{nil, {2, 0, 0, 0, 0, 0, 0, 2}} {
+		if err := Terminate("eth0", addr, 0x01eb, cfg); err == nil {
+			t.Errorf("Terminate to %s succeeded", addr)
+		}
+	}
+	if len(calls) != 0 {
+		t.Errorf("Terminate to invalid addresses touched interfaces: %v", calls)
+	}
+}
+
+func TestReadStats(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("creating pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+	conn := &Conn{channel: r}
+
+	frames := [][]byte{
+		{0xc0, 0x21, 9, 1, 0, 4},                          // LCP Echo-Request
+		{0xc0, 0x21, 10, 1, 0, 4},                         // LCP Echo-Reply
+		append([]byte{0x21}, make([]byte, 99)...),         // IPv4, compressed protocol
+		append([]byte{0x00, 0x57}, make([]byte, 1498)...), // IPv6
+	}
+	b := make([]byte, 2000)
+	for _, frame := range frames {
+		if _, err := w.Write(frame); err != nil {
+			t.Fatalf("writing frame: %v", err)
+		}
+		if _, err := conn.Read(b); err != nil {
+			t.Fatalf("reading frame: %v", err)
+		}
+	}
+
+	want := Stats{
+		FrameSizes: [len(FrameSizeBuckets) + 1]uint64{2, 1, 0, 0, 0, 0, 1},
+		Protocols: map[uint16]uint64{
+			0xc021: 2,
+			0x0021: 1,
+			0x0057: 1,
+		},
+	}
+	if diff := cmp.Diff(want, conn.Stats()); diff != "" {
+		t.Fatalf("wrong stats (-want +got)\n%s", diff)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	conn := &Conn{}
+	ipv4 := []byte{0x00, 0x21, 0x45}
+	lcp := []byte{0xc0, 0x21, 9, 1, 0, 4}
+
+	start := time.Unix(1000, 0)
+	// Control frames don't count, and the first two data frames only
+	// establish a baseline gap.
+	conn.countFrame(ipv4, start)
+	conn.countFrame(lcp, start.Add(3*time.Millisecond))
+	conn.countFrame(ipv4, start.Add(20*time.Millisecond))
+	if got := conn.Stats().Jitter; got != 0 {
+		t.Fatalf("jitter after two data frames is %v, want 0", got)
+	}
+
+	// The gap changes by 16ms, then by 32ms.
+	conn.countFrame(ipv4, start.Add(56*time.Millisecond))
+	if got, want := conn.Stats().Jitter, time.Millisecond; got != want {
+		t.Fatalf("wrong jitter, got %v, want %v", got, want)
+	}
+	conn.countFrame(ipv4, start.Add(124*time.Millisecond))
+	if got, want := conn.Stats().Jitter, time.Millisecond+(31*time.Millisecond)/16; got != want {
+		t.Fatalf("wrong jitter, got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,174 @@
+package pppoe
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/raw"
+)
+
+// rawReadSlice is the longest that a rawConn read waits on its socket
+// before checking for deadline changes and Close.
+const rawReadSlice = 100 * time.Millisecond
+
+// errRawClosed is returned by operations on a closed rawConn.
+var errRawClosed = errors.New("use of closed raw socket")
+
+// rawTimeoutError is the error of rawConn reads, and userspace
+// session writes, that hit their deadline.
+type rawTimeoutError struct{}
+
+func (rawTimeoutError) Error() string   { return "i/o timeout" }
+func (rawTimeoutError) Timeout() bool   { return true }
+func (rawTimeoutError) Temporary() bool { return true }
+
+// rawSocket is the part of a mdlayher/raw conn that rawConn uses.
+type rawSocket interface {
+	net.PacketConn
+	SetPromiscuous(b bool) error
+}
+
+// rawConn wraps a mdlayher/raw conn, whose reads are blocking
+// syscalls rather than going through the runtime's poller. That has
+// two consequences. A read only looks at the read deadline when it
+// starts, so setting a deadline doesn't cut short a read in progress.
+// And Close doesn't interrupt reads, which carry on with the closed
+// socket's file descriptor number. Once the process opens another
+// socket, which usually gets the same number, the stale read steals
+// its packets. That's what happens to the discovery conn of a new Conn
+// while a closed Conn is still waiting for a PADT.
+//
+// rawConn reads in slices of rawReadSlice, so that reads notice
+// deadline changes and Close, and Close waits for reads in progress
+// to return before closing the socket. Writes can block for as long
+// as the interface's queue is full, so Close doesn't wait for them:
+// it leaves the socket open until the last write in progress returns,
+// so that the write doesn't go out on a socket that reuses its file
+// descriptor number.
+type rawConn struct {
+	rawSocket
+
+	mu       sync.Mutex
+	deadline time.Time
+	closed   bool
+	// reads counts the reads in progress.
+	reads sync.WaitGroup
+	// writes is the number of writes in progress.
+	writes int
+	// closeOnWrite is set if Close left the socket to the last write
+	// in progress to close.
+	closeOnWrite bool
+}
+
+// listenRaw returns a rawConn for Ethernet frames of type proto on
+// intf.
+func listenRaw(intf *net.Interface, proto uint16) (*rawConn, error) {
+	conn, err := raw.ListenPacket(intf, proto, &raw.Config{LinuxSockDGRAM: true})
+	if err != nil {
+		return nil, err
+	}
+	return &rawConn{rawSocket: conn}, nil
+}
+
+// ReadFrom reads a packet from the socket, until the read deadline
+// passes or c is closed.
+func (c *rawConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, nil, errRawClosed
+	}
+	c.reads.Add(1)
+	c.mu.Unlock()
+	defer c.reads.Done()
+
+	for {
+		c.mu.Lock()
+		deadline, closed := c.deadline, c.closed
+		c.mu.Unlock()
+		if closed {
+			return 0, nil, errRawClosed
+		}
+
+		now := time.Now()
+		slice := now.Add(rawReadSlice)
+		if !deadline.IsZero() {
+			if !now.Before(deadline) {
+				return 0, nil, rawTimeoutError{}
+			}
+			if deadline.Before(slice) {
+				slice = deadline
+			}
+		}
+		c.rawSocket.SetReadDeadline(slice)
+		n, from, err := c.rawSocket.ReadFrom(b)
+		if err != nil && isTimeout(err) {
+			continue
+		}
+		return n, from, err
+	}
+}
+
+// WriteTo writes a packet to addr.
+func (c *rawConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, errRawClosed
+	}
+	c.writes++
+	c.mu.Unlock()
+
+	n, err := c.rawSocket.WriteTo(b, addr)
+
+	c.mu.Lock()
+	c.writes--
+	last := c.writes == 0 && c.closeOnWrite
+	c.mu.Unlock()
+	if last {
+		c.rawSocket.Close()
+	}
+	return n, err
+}
+
+// SetDeadline sets the read deadline, like raw.Conn does; writes
+// don't time out.
+func (c *rawConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline, which also applies to reads
+// in progress.
+func (c *rawConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+// Close closes the socket, once reads in progress have returned,
+// which takes up to rawReadSlice. If writes are in progress, the
+// socket is closed when the last of them returns instead, and Close
+// returns without waiting for them.
+func (c *rawConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return errRawClosed
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	c.reads.Wait()
+
+	c.mu.Lock()
+	if c.writes > 0 {
+		c.closeOnWrite = true
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+	return c.rawSocket.Close()
+}
@@ -0,0 +1,616 @@
+package pppoe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/raw"
+)
+
+// RelayConfig configures a PPPoE relay.
+type RelayConfig struct {
+	// Subscribers are the ports facing PPPoE clients.
+	Subscribers []RelayPort
+	// ConcentratorInterface is the name of the network interface
+	// facing PPPoE concentrators.
+	ConcentratorInterface string
+}
+
+// RelayPort is a subscriber-facing port of a PPPoE relay.
+type RelayPort struct {
+	// Interface is the name of the port's network interface.
+	Interface string
+	// CircuitID and RemoteID, if set, are inserted into PADI and PADR
+	// packets relayed from this port, as the Agent-Circuit-ID and
+	// Agent-Remote-ID of a DSL Forum Vendor-Specific tag, like DSLAM
+	// relay agents do (see TR-101). They're limited to 63 bytes each.
+	CircuitID string
+	RemoteID  string
+}
+
+// RunRelay relays PPPoE between clients on cfg.Subscribers and
+// concentrators on cfg.ConcentratorInterface, until ctx is canceled
+// or relaying fails.
+//
+// The relay behaves as described in RFC 2516 section 4.2: clients see
+// the relay as their concentrator, and the relay uses Relay-Session-Id
+// tags to route Discovery replies back to the right peer. Session
+// frames are forwarded as-is between the two sides. Discovery packets
+// that already carry a Relay-Session-Id from a client (i.e. chains of
+// relays) are not supported, and are dropped, as are PADRs for
+// concentrators that didn't send the client a PADO in the last
+// minute. Sessions are forgotten when either side sends a PADT, or
+// after an hour without frames.
+func RunRelay(ctx context.Context, cfg *RelayConfig) error {
+	r, err := newRelay(cfg)
+	if err != nil {
+		return err
+	}
+	return r.run(ctx)
+}
+
+// relay is a running PPPoE relay.
+type relay struct {
+	// ports are the subscriber-facing ports. Their index in this
+	// slice identifies them in Relay-Session-Id tags.
+	ports []*relayPort
+	// acDisc and acSess are the Discovery and Session conns on the
+	// concentrator side, and acMTU the MTU of its interface.
+	acDisc, acSess net.PacketConn
+	acMTU          int
+	// now is time.Now, as a field so that tests can age offers and
+	// sessions.
+	now func() time.Time
+
+	mu sync.Mutex
+	// bySubscriber maps client-side sessions to the concentrator
+	// serving them.
+	bySubscriber map[relaySessionKey]net.HardwareAddr
+	// byConcentrator maps concentrator-side sessions to the client
+	// they belong to.
+	byConcentrator map[relaySessionKey]relayClient
+	// lastSeen is when each session, keyed like byConcentrator, last
+	// carried a frame.
+	lastSeen map[relaySessionKey]time.Time
+	// offers is when each concentrator last sent a PADO to each
+	// client.
+	offers map[relayOffer]time.Time
+	// lastExpiry is when expire last ran.
+	lastExpiry time.Time
+}
+
+// relayPort is a subscriber-facing port of a running relay.
+type relayPort struct {
+	// disc and sess are the port's Discovery and Session conns, and
+	// mtu the MTU of its interface.
+	disc, sess net.PacketConn
+	mtu        int
+	// vendorTag is the DSL Forum Vendor-Specific tag value to insert
+	// into PADIs and PADRs, or nil.
+	vendorTag []byte
+}
+
+// relayClient is a PPPoE client behind one of the relay's ports.
+type relayClient struct {
+	port int
+	addr net.HardwareAddr
+}
+
+// relaySessionKey identifies a PPPoE session from one side of the
+// relay: the port it's on (always 0 on the concentrator side), the
+// peer's Ethernet address, and the session ID.
+type relaySessionKey struct {
+	port      int
+	peer      string
+	sessionID uint16
+}
+
+// relayOffer is a concentrator that sent a PADO to a client.
+type relayOffer struct {
+	client       relayClientKey
+	concentrator string
+}
+
+// relayClientKey identifies a client: the port it's on, and its
+// Ethernet address.
+type relayClientKey struct {
+	port int
+	addr string
+}
+
+// How long the relay remembers PADOs, so that it can check where
+// PADRs go, and sessions that carry no frames. PPP peers that check
+// their link send LCP Echo-Requests far more often than
+// relaySessionTimeout, so only sessions whose ends vanished without a
+// PADT go quiet for that long. Forgotten offers and sessions are
+// cleaned up at most every relayExpiryInterval.
+const (
+	relayOfferTimeout   = time.Minute
+	relaySessionTimeout = time.Hour
+	relayExpiryInterval = time.Minute
+)
+
+// relayTagLen is the length of the Relay-Session-Id values we
+// generate: the index of the client's port, the client's Ethernet
+// address, and the concentrator's (or zeros, before we know which
+// concentrator the client will pick).
+const relayTagLen = 14
+
+// dslForumVendorID is the IANA enterprise number of the DSL Forum
+// (formerly ADSL Forum), used in relay agent Vendor-Specific tags.
+const dslForumVendorID = 3561
+
+func newRelay(cfg *RelayConfig) (*relay, error) {
+	if len(cfg.Subscribers) == 0 {
+		return nil, errors.New("relay has no subscriber ports")
+	}
+	if len(cfg.Subscribers) > 0xffff {
+		return nil, errors.New("too many subscriber ports")
+	}
+
+	var conns []net.PacketConn
+	closeAll := func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	listen := func(ifName string) (disc, sess net.PacketConn, mtu int, err error) {
+		intf, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("getting interface %v: %v", ifName, err)
+		}
+		if disc, err = newDiscoveryConn(ifName); err != nil {
+			return nil, nil, 0, err
+		}
+		conns = append(conns, disc)
+		if sess, err = newSessionConn(ifName); err != nil {
+			return nil, nil, 0, err
+		}
+		conns = append(conns, sess)
+		return disc, sess, intf.MTU, nil
+	}
+
+	r := &relay{
+		now:            time.Now,
+		bySubscriber:   map[relaySessionKey]net.HardwareAddr{},
+		byConcentrator: map[relaySessionKey]relayClient{},
+		lastSeen:       map[relaySessionKey]time.Time{},
+		offers:         map[relayOffer]time.Time{},
+	}
+	for _, sub := range cfg.Subscribers {
+		vendorTag, err := relayVendorTag(sub.CircuitID, sub.RemoteID)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("subscriber port %s: %v", sub.Interface, err)
+		}
+		disc, sess, mtu, err := listen(sub.Interface)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		r.ports = append(r.ports, &relayPort{
+			disc:      disc,
+			sess:      sess,
+			mtu:       mtu,
+			vendorTag: vendorTag,
+		})
+	}
+	var err error
+	if r.acDisc, r.acSess, r.acMTU, err = listen(cfg.ConcentratorInterface); err != nil {
+		closeAll()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// relayVendorTag returns the value of a DSL Forum Vendor-Specific tag
+// carrying circuitID and remoteID, or nil if both are empty.
+func relayVendorTag(circuitID, remoteID string) ([]byte, error) {
+	if circuitID == "" && remoteID == "" {
+		return nil, nil
+	}
+
+	var ret bytes.Buffer
+	binary.Write(&ret, binary.BigEndian, uint32(dslForumVendorID))
+	for _, sub := range []struct {
+		typ  byte
+		name string
+		val  string
+	}{
+		{0x01, "circuit ID", circuitID},
+		{0x02, "remote ID", remoteID},
+	} {
+		if sub.val == "" {
+			continue
+		}
+		if len(sub.val) > 63 {
+			return nil, fmt.Errorf("%s %q is longer than 63 bytes", sub.name, sub.val)
+		}
+		ret.WriteByte(sub.typ)
+		ret.WriteByte(byte(len(sub.val)))
+		ret.WriteString(sub.val)
+	}
+	return ret.Bytes(), nil
+}
+
+// newSessionConn creates a net.PacketConn that can send and receive
+// raw PPPoE Session frames.
+func newSessionConn(ifName string) (net.PacketConn, error) {
+	intf, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("getting interface %v: %v", ifName, err)
+	}
+	conn, err := listenRaw(intf, protoPPPoESession)
+	if err != nil {
+		return nil, fmt.Errorf("creating PPPoE Session listener: %v", err)
+	}
+	return conn, nil
+}
+
+// run forwards traffic until ctx is canceled or one of the relay's
+// conns fails, then closes all conns.
+func (r *relay) run(ctx context.Context) error {
+	type loop struct {
+		conn   net.PacketConn
+		mtu    int
+		handle func([]byte, net.HardwareAddr) error
+	}
+	loops := []loop{
+		{r.acDisc, r.acMTU, r.handleConcentratorDiscovery},
+		{r.acSess, r.acMTU, r.handleConcentratorSession},
+	}
+	for i, port := range r.ports {
+		i := i
+		loops = append(loops,
+			loop{port.disc, port.mtu, func(pkt []byte, from net.HardwareAddr) error {
+				return r.handleSubscriberDiscovery(i, pkt, from)
+			}},
+			loop{port.sess, port.mtu, func(pkt []byte, from net.HardwareAddr) error {
+				return r.handleSubscriberSession(i, pkt, from)
+			}})
+	}
+
+	errs := make(chan error, len(loops))
+	for _, l := range loops {
+		go func(l loop) {
+			errs <- relayLoop(l.conn, l.mtu, l.handle)
+		}(l)
+	}
+
+	pending := len(loops)
+	var err error
+	select {
+	case err = <-errs:
+		pending--
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// Closing the conns makes the remaining loops exit.
+	for _, l := range loops {
+		l.conn.Close()
+	}
+	for ; pending > 0; pending-- {
+		<-errs
+	}
+	return err
+}
+
+// relayLoop reads packets of up to mtu bytes from conn and passes
+// them to handle, until reading or handling fails.
+func relayLoop(conn net.PacketConn, mtu int, handle func([]byte, net.HardwareAddr) error) error {
+	if mtu < pppoeBufferLen {
+		mtu = pppoeBufferLen
+	}
+	b := make([]byte, mtu)
+	for {
+		n, from, err := readFrom(conn, b)
+		if err != nil {
+			return err
+		}
+		if err := handle(b[:n], from.(*raw.Addr).HardwareAddr); err != nil {
+			return err
+		}
+	}
+}
+
+// writeTo sends pkt to dst on conn. Transient errors are treated as
+// a lost packet, which the endpoints' retransmissions will deal with.
+func writeTo(conn net.PacketConn, pkt []byte, dst net.HardwareAddr) error {
+	_, err := conn.WriteTo(pkt, &raw.Addr{HardwareAddr: dst})
+	if err != nil && !isTransient(err) {
+		return err
+	}
+	return nil
+}
+
+// handleSubscriberDiscovery relays a Discovery packet received from
+// client on subscriber port portIdx.
+func (r *relay) handleSubscriberDiscovery(portIdx int, pkt []byte, client net.HardwareAddr) error {
+	tags, err := parseDiscoveryTags(pkt)
+	if err != nil {
+		return nil
+	}
+	code, sessionID := int(pkt[1]), binary.BigEndian.Uint16(pkt[2:4])
+	relayTag, hasRelayTag := findDiscoveryTag(tags, pppoeTagRelaySessionID)
+
+	switch code {
+	case pppoePADI:
+		if hasRelayTag {
+			return nil
+		}
+		tags = append(r.addVendorTag(portIdx, tags), discoveryTag{
+			Type:  pppoeTagRelaySessionID,
+			Value: relayTagValue(relayClient{portIdx, client}, nil),
+		})
+		return r.forwardDiscovery(r.acDisc, r.acMTU, code, sessionID, tags, ethernetBroadcast.HardwareAddr)
+	case pppoePADR:
+		// The client must echo the Relay-Session-Id we put in the
+		// PADO, which tells us which concentrator it picked. It can
+		// only pick one that made it an offer, so that it can't make
+		// us send PADRs to arbitrary hosts.
+		if !hasRelayTag || len(relayTag) != relayTagLen {
+			return nil
+		}
+		tagClient, concentrator := parseRelayTag(relayTag)
+		if tagClient.port != portIdx || !bytes.Equal(tagClient.addr, client) {
+			return nil
+		}
+		r.mu.Lock()
+		offered, ok := r.offers[relayOffer{relayClientKey{portIdx, client.String()}, concentrator.String()}]
+		r.mu.Unlock()
+		if !ok || r.now().Sub(offered) > relayOfferTimeout {
+			return nil
+		}
+		return r.forwardDiscovery(r.acDisc, r.acMTU, code, sessionID, r.addVendorTag(portIdx, tags), concentrator)
+	case pppoePADT:
+		r.mu.Lock()
+		concentrator := r.bySubscriber[relaySessionKey{portIdx, client.String(), sessionID}]
+		if concentrator != nil {
+			r.removeSession(relaySessionKey{0, concentrator.String(), sessionID})
+		}
+		r.mu.Unlock()
+		if concentrator == nil {
+			return nil
+		}
+		return r.forwardDiscovery(r.acDisc, r.acMTU, code, sessionID, tags, concentrator)
+	default:
+		// Clients have no business sending anything else.
+		return nil
+	}
+}
+
+// addVendorTag returns tags with any DSL Forum Vendor-Specific tags
+// removed, and the vendor tag of port portIdx added if it has one.
+// Clients' own DSL Forum tags are always removed, so that they can't
+// impersonate another line.
+func (r *relay) addVendorTag(portIdx int, tags []discoveryTag) []discoveryTag {
+	ret := make([]discoveryTag, 0, len(tags)+1)
+	for _, tag := range tags {
+		if tag.Type == pppoeTagVendorSpecific && len(tag.Value) >= 4 && binary.BigEndian.Uint32(tag.Value) == dslForumVendorID {
+			continue
+		}
+		ret = append(ret, tag)
+	}
+	if vendorTag := r.ports[portIdx].vendorTag; vendorTag != nil {
+		ret = append(ret, discoveryTag{
+			Type:  pppoeTagVendorSpecific,
+			Value: vendorTag,
+		})
+	}
+	return ret
+}
+
+// handleConcentratorDiscovery relays a Discovery packet received from
+// concentrator on the concentrator side.
+func (r *relay) handleConcentratorDiscovery(pkt []byte, concentrator net.HardwareAddr) error {
+	tags, err := parseDiscoveryTags(pkt)
+	if err != nil {
+		return nil
+	}
+	code, sessionID := int(pkt[1]), binary.BigEndian.Uint16(pkt[2:4])
+
+	if code == pppoePADT {
+		key := relaySessionKey{0, concentrator.String(), sessionID}
+		r.mu.Lock()
+		client, ok := r.byConcentrator[key]
+		r.removeSession(key)
+		r.mu.Unlock()
+		if !ok {
+			return nil
+		}
+		port := r.ports[client.port]
+		return r.forwardDiscovery(port.disc, port.mtu, code, sessionID, tags, client.addr)
+	}
+
+	relayTag, ok := findDiscoveryTag(tags, pppoeTagRelaySessionID)
+	if !ok || len(relayTag) != relayTagLen {
+		// Not a reply to something we relayed.
+		return nil
+	}
+	client, tagConcentrator := parseRelayTag(relayTag)
+	if client.port >= len(r.ports) {
+		return nil
+	}
+	port := r.ports[client.port]
+
+	switch code {
+	case pppoePADO:
+		// Rewrite the Relay-Session-Id to also name this
+		// concentrator, so that we know where to send the client's
+		// PADR.
+		setDiscoveryTag(tags, pppoeTagRelaySessionID, relayTagValue(client, concentrator))
+		now := r.now()
+		r.mu.Lock()
+		r.expire(now)
+		r.offers[relayOffer{relayClientKey{client.port, client.addr.String()}, concentrator.String()}] = now
+		r.mu.Unlock()
+		return r.forwardDiscovery(port.disc, port.mtu, code, sessionID, tags, client.addr)
+	case pppoePADS:
+		if !bytes.Equal(tagConcentrator, concentrator) {
+			return nil
+		}
+		if sessionID != 0 {
+			key := relaySessionKey{0, concentrator.String(), sessionID}
+			now := r.now()
+			r.mu.Lock()
+			r.expire(now)
+			// The concentrator may have reused the ID of a session
+			// whose PADT we missed.
+			r.removeSession(key)
+			r.bySubscriber[relaySessionKey{client.port, client.addr.String(), sessionID}] = concentrator
+			r.byConcentrator[key] = client
+			r.lastSeen[key] = now
+			r.mu.Unlock()
+		}
+		return r.forwardDiscovery(port.disc, port.mtu, code, sessionID, tags, client.addr)
+	default:
+		return nil
+	}
+}
+
+// removeSession forgets the session that the concentrator side knows
+// as key. r.mu must be held.
+func (r *relay) removeSession(key relaySessionKey) {
+	if client, ok := r.byConcentrator[key]; ok {
+		delete(r.bySubscriber, relaySessionKey{client.port, client.addr.String(), key.sessionID})
+	}
+	delete(r.byConcentrator, key)
+	delete(r.lastSeen, key)
+}
+
+// expire forgets the offers and sessions that timed out, unless it
+// already ran in the last relayExpiryInterval. r.mu must be held.
+func (r *relay) expire(now time.Time) {
+	if now.Sub(r.lastExpiry) < relayExpiryInterval {
+		return
+	}
+	r.lastExpiry = now
+	for offer, t := range r.offers {
+		if now.Sub(t) > relayOfferTimeout {
+			delete(r.offers, offer)
+		}
+	}
+	for key, t := range r.lastSeen {
+		if now.Sub(t) > relaySessionTimeout {
+			r.removeSession(key)
+		}
+	}
+}
+
+// forwardDiscovery encodes a Discovery packet and sends it to dst on
+// conn, whose interface has the given MTU. Packets that grew too
+// large from our added tags are dropped.
+func (r *relay) forwardDiscovery(conn net.PacketConn, mtu int, code int, sessionID uint16, tags []discoveryTag, dst net.HardwareAddr) error {
+	pkt := encodeDiscoveryTags(code, sessionID, tags)
+	if len(pkt) > mtu {
+		return nil
+	}
+	return writeTo(conn, pkt, dst)
+}
+
+// handleSubscriberSession relays a Session frame received from client
+// on subscriber port portIdx.
+func (r *relay) handleSubscriberSession(portIdx int, pkt []byte, client net.HardwareAddr) error {
+	pkt, sessionID, err := trimSessionFrame(pkt)
+	if err != nil {
+		return nil
+	}
+	now := r.now()
+	r.mu.Lock()
+	concentrator := r.bySubscriber[relaySessionKey{portIdx, client.String(), sessionID}]
+	if concentrator != nil {
+		r.lastSeen[relaySessionKey{0, concentrator.String(), sessionID}] = now
+	}
+	r.mu.Unlock()
+	if concentrator == nil {
+		return nil
+	}
+	return writeTo(r.acSess, pkt, concentrator)
+}
+
+// handleConcentratorSession relays a Session frame received from
+// concentrator on the concentrator side.
+func (r *relay) handleConcentratorSession(pkt []byte, concentrator net.HardwareAddr) error {
+	pkt, sessionID, err := trimSessionFrame(pkt)
+	if err != nil {
+		return nil
+	}
+	key := relaySessionKey{0, concentrator.String(), sessionID}
+	now := r.now()
+	r.mu.Lock()
+	client, ok := r.byConcentrator[key]
+	if ok {
+		r.lastSeen[key] = now
+	}
+	r.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return writeTo(r.ports[client.port].sess, pkt, client.addr)
+}
+
+// trimSessionFrame checks that pkt is a PPPoE Session frame, and
+// returns it stripped of any Ethernet padding, along with its session
+// ID.
+func trimSessionFrame(pkt []byte) ([]byte, uint16, error) {
+	if len(pkt) < 6 {
+		return nil, 0, errors.New("packet too short to be PPPoE Session")
+	}
+	if pkt[0] != 0x11 || pkt[1] != 0 {
+		return nil, 0, errors.New("not a PPPoE Session frame")
+	}
+	l := int(binary.BigEndian.Uint16(pkt[4:6]))
+	if l > len(pkt)-6 {
+		return nil, 0, errors.New("payload length larger than packet")
+	}
+	return pkt[:6+l], binary.BigEndian.Uint16(pkt[2:4]), nil
+}
+
+// relayTagValue returns a Relay-Session-Id value naming client and
+// concentrator. concentrator may be nil if it's not known yet.
+func relayTagValue(client relayClient, concentrator net.HardwareAddr) []byte {
+	ret := make([]byte, relayTagLen)
+	binary.BigEndian.PutUint16(ret, uint16(client.port))
+	copy(ret[2:], client.addr)
+	copy(ret[8:], concentrator)
+	return ret
+}
+
+// parseRelayTag parses a Relay-Session-Id value generated by
+// relayTagValue.
+func parseRelayTag(tag []byte) (client relayClient, concentrator net.HardwareAddr) {
+	client = relayClient{
+		port: int(binary.BigEndian.Uint16(tag[:2])),
+		addr: net.HardwareAddr(tag[2:8]),
+	}
+	return client, net.HardwareAddr(tag[8:14])
+}
+
+// findDiscoveryTag returns the value of the first tag of type tagType
+// in tags.
+func findDiscoveryTag(tags []discoveryTag, tagType int) ([]byte, bool) {
+	for _, tag := range tags {
+		if tag.Type == tagType {
+			return tag.Value, true
+		}
+	}
+	return nil, false
+}
+
+// setDiscoveryTag replaces the value of every tag of type tagType in
+// tags with value.
+func setDiscoveryTag(tags []discoveryTag, tagType int, value []byte) {
+	for i := range tags {
+		if tags[i].Type == tagType {
+			tags[i].Value = value
+		}
+	}
+}
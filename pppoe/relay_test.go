@@ -0,0 +1,542 @@
+package pppoe
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/raw"
+)
+
+func newTestRelay() *relay {
+	return &relay{
+		ports: []*relayPort{
+			{disc: newFakeConn(), sess: newFakeConn(), mtu: 1500},
+			{disc: newFakeConn(), sess: newFakeConn(), mtu: 1500},
+		},
+		acDisc:         newFakeConn(),
+		acSess:         newFakeConn(),
+		acMTU:          1500,
+		now:            time.Now,
+		bySubscriber:   map[relaySessionKey]net.HardwareAddr{},
+		byConcentrator: map[relaySessionKey]relayClient{},
+		lastSeen:       map[relaySessionKey]time.Time{},
+		offers:         map[relayOffer]time.Time{},
+	}
+}
+
+// expectPacket checks that conn sent a single packet to dst, and
+// returns it.
+func expectPacket(t *testing.T, conn net.PacketConn, dst net.HardwareAddr) []byte {
+	t.Helper()
+	select {
+	case pkt := <-conn.(*fakeConn).Out:
+		if got := pkt.addr.(*raw.Addr).HardwareAddr; got.String() != dst.String() {
+			t.Fatalf("packet sent to %s, want %s", got, dst)
+		}
+		return pkt.b
+	default:
+		t.Fatal("no packet sent")
+		return nil
+	}
+}
+
+// expectNoPacket checks that conn didn't send anything.
+func expectNoPacket(t *testing.T, conn net.PacketConn) {
+	t.Helper()
+	select {
+	case pkt := <-conn.(*fakeConn).Out:
+		t.Fatalf("unexpected packet %x sent to %s", pkt.b, pkt.addr)
+	default:
+	}
+}
+
+func TestRelay(t *testing.T) {
+	r := newTestRelay()
+	client := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	ac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	otherAC := net.HardwareAddr{2, 0, 0, 0, 0, 3}
+	port := r.ports[1]
+	tagClient := relayClient{1, client}
+
+	// PADI goes out on the concentrator side, tagged with the client.
+	padi := encodeDiscoveryPacket(&discoveryPacket{
+		Code: pppoePADI,
+		Tags: map[int][]byte{pppoeTagServiceName: nil},
+	})
+	if err := r.handleSubscriberDiscovery(1, padi, client); err != nil {
+		t.Fatal(err)
+	}
+	got := expectPacket(t, r.acDisc, ethernetBroadcast.HardwareAddr)
+	want := encodeDiscoveryPacket(&discoveryPacket{
+		Code: pppoePADI,
+		Tags: map[int][]byte{
+			pppoeTagServiceName:    nil,
+			pppoeTagRelaySessionID: relayTagValue(tagClient, nil),
+		},
+	})
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("wrong relayed PADI: (-want +got)\n%s", diff)
+	}
+
+	// Both concentrators answer, the PADOs go back to the client,
+	// tagged with the concentrator that sent them.
+	for _, addr := range []net.HardwareAddr{ac, otherAC} {
+		pado := encodeDiscoveryPacket(&discoveryPacket{
+			Code: pppoePADO,
+			Tags: map[int][]byte{
+				pppoeTagServiceName:    nil,
+				pppoeTagCookie:         []byte("cookie"),
+				pppoeTagRelaySessionID: relayTagValue(tagClient, nil),
+			},
+		})
+		if err := r.handleConcentratorDiscovery(pado, addr); err != nil {
+			t.Fatal(err)
+		}
+		got = expectPacket(t, port.disc, client)
+		want = encodeDiscoveryPacket(&discoveryPacket{
+			Code: pppoePADO,
+			Tags: map[int][]byte{
+				pppoeTagServiceName:    nil,
+				pppoeTagCookie:         []byte("cookie"),
+				pppoeTagRelaySessionID: relayTagValue(tagClient, addr),
+			},
+		})
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("wrong relayed PADO: (-want +got)\n%s", diff)
+		}
+	}
+
+	// The client picks the first concentrator, the PADR goes to it.
+	padr := encodeDiscoveryPacket(&discoveryPacket{
+		Code: pppoePADR,
+		Tags: map[int][]byte{
+			pppoeTagServiceName:    nil,
+			pppoeTagCookie:         []byte("cookie"),
+			pppoeTagRelaySessionID: relayTagValue(tagClient, ac),
+		},
+	})
+	if err := r.handleSubscriberDiscovery(1, padr, client); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(padr, expectPacket(t, r.acDisc, ac)); diff != "" {
+		t.Fatalf("wrong relayed PADR: (-want +got)\n%s", diff)
+	}
+
+	// The PADS goes back to the client, and sets up the session.
+	pads := encodeDiscoveryPacket(&discoveryPacket{
+		Code:      pppoePADS,
+		SessionID: 42,
+		Tags: map[int][]byte{
+			pppoeTagServiceName:    nil,
+			pppoeTagRelaySessionID: relayTagValue(tagClient, ac),
+		},
+	})
+	if err := r.handleConcentratorDiscovery(pads, ac); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(pads, expectPacket(t, port.disc, client)); diff != "" {
+		t.Fatalf("wrong relayed PADS: (-want +got)\n%s", diff)
+	}
+
+	// Session traffic flows both ways, minus Ethernet padding.
+	frame := []byte{0x11, 0, 0, 42, 0, 4, 0xc0, 0x21, 1, 2}
+	padded := append(append([]byte(nil), frame...), 0, 0, 0, 0)
+	if err := r.handleSubscriberSession(1, padded, client); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(frame, expectPacket(t, r.acSess, ac)); diff != "" {
+		t.Fatalf("wrong relayed session frame: (-want +got)\n%s", diff)
+	}
+	if err := r.handleConcentratorSession(frame, ac); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(frame, expectPacket(t, port.sess, client)); diff != "" {
+		t.Fatalf("wrong relayed session frame: (-want +got)\n%s", diff)
+	}
+
+	// Traffic for the session from the same client on another port,
+	// or from the wrong concentrator, goes nowhere.
+	if err := r.handleSubscriberSession(0, frame, client); err != nil {
+		t.Fatal(err)
+	}
+	expectNoPacket(t, r.acSess)
+	if err := r.handleConcentratorSession(frame, otherAC); err != nil {
+		t.Fatal(err)
+	}
+	expectNoPacket(t, port.sess)
+
+	// The concentrator tears down the session.
+	padt := encodeDiscoveryPacket(&discoveryPacket{
+		Code:      pppoePADT,
+		SessionID: 42,
+	})
+	if err := r.handleConcentratorDiscovery(padt, ac); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(padt, expectPacket(t, port.disc, client)); diff != "" {
+		t.Fatalf("wrong relayed PADT: (-want +got)\n%s", diff)
+	}
+
+	// Session traffic no longer flows.
+	if err := r.handleSubscriberSession(1, frame, client); err != nil {
+		t.Fatal(err)
+	}
+	expectNoPacket(t, r.acSess)
+}
+
+func TestRelayDrops(t *testing.T) {
+	client := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	ac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+
+	tests := []struct {
+		desc         string
+		pkt          *discoveryPacket
+		concentrator bool
+	}{
+		{
+			desc: "PADI with existing relay tag",
+			pkt: &discoveryPacket{
+				Code: pppoePADI,
+				Tags: map[int][]byte{
+					pppoeTagRelaySessionID: []byte("other relay"),
+				},
+			},
+		},
+		{
+			desc: "PADR without relay tag",
+			pkt: &discoveryPacket{
+				Code: pppoePADR,
+				Tags: map[int][]byte{},
+			},
+		},
+		{
+			desc: "PADR with another client's relay tag",
+			pkt: &discoveryPacket{
+				Code: pppoePADR,
+				Tags: map[int][]byte{
+					pppoeTagRelaySessionID: relayTagValue(relayClient{0, net.HardwareAddr{2, 0, 0, 0, 0, 9}}, ac),
+				},
+			},
+		},
+		{
+			desc: "PADR with another port's relay tag",
+			pkt: &discoveryPacket{
+				Code: pppoePADR,
+				Tags: map[int][]byte{
+					pppoeTagRelaySessionID: relayTagValue(relayClient{1, client}, ac),
+				},
+			},
+		},
+		{
+			desc: "PADR to a concentrator that made no offer",
+			pkt: &discoveryPacket{
+				Code: pppoePADR,
+				Tags: map[int][]byte{
+					pppoeTagRelaySessionID: relayTagValue(relayClient{0, client}, ac),
+				},
+			},
+		},
+		{
+			desc: "PADR without concentrator",
+			pkt: &discoveryPacket{
+				Code: pppoePADR,
+				Tags: map[int][]byte{
+					pppoeTagRelaySessionID: relayTagValue(relayClient{0, client}, nil),
+				},
+			},
+		},
+		{
+			desc: "PADO from client",
+			pkt: &discoveryPacket{
+				Code: pppoePADO,
+				Tags: map[int][]byte{
+					pppoeTagRelaySessionID: relayTagValue(relayClient{0, client}, ac),
+				},
+			},
+		},
+		{
+			desc: "PADT for unknown session",
+			pkt: &discoveryPacket{
+				Code:      pppoePADT,
+				SessionID: 42,
+			},
+		},
+		{
+			desc: "PADO without relay tag",
+			pkt: &discoveryPacket{
+				Code: pppoePADO,
+				Tags: map[int][]byte{},
+			},
+			concentrator: true,
+		},
+		{
+			desc: "PADO for unknown port",
+			pkt: &discoveryPacket{
+				Code: pppoePADO,
+				Tags: map[int][]byte{
+					pppoeTagRelaySessionID: relayTagValue(relayClient{5, client}, nil),
+				},
+			},
+			concentrator: true,
+		},
+		{
+			desc: "PADS for another concentrator",
+			pkt: &discoveryPacket{
+				Code:      pppoePADS,
+				SessionID: 42,
+				Tags: map[int][]byte{
+					pppoeTagRelaySessionID: relayTagValue(relayClient{0, client}, net.HardwareAddr{2, 0, 0, 0, 0, 9}),
+				},
+			},
+			concentrator: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			r := newTestRelay()
+			pkt := encodeDiscoveryPacket(test.pkt)
+			var err error
+			if test.concentrator {
+				err = r.handleConcentratorDiscovery(pkt, ac)
+			} else {
+				err = r.handleSubscriberDiscovery(0, pkt, client)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, port := range r.ports {
+				expectNoPacket(t, port.disc)
+			}
+			expectNoPacket(t, r.acDisc)
+			if len(r.bySubscriber) != 0 || len(r.byConcentrator) != 0 {
+				t.Fatal("relay created a session")
+			}
+		})
+	}
+}
+
+func TestRelayVendorTag(t *testing.T) {
+	r := newTestRelay()
+	var err error
+	if r.ports[1].vendorTag, err = relayVendorTag("dslam1 atm 3/1:8.35", "line42"); err != nil {
+		t.Fatal(err)
+	}
+	client := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	ac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+
+	wantVendorTag := append([]byte{
+		0x00, 0x00, 0x0d, 0xe9, // DSL Forum
+		0x01, 19, // Agent-Circuit-ID
+	}, "dslam1 atm 3/1:8.35"...)
+	wantVendorTag = append(wantVendorTag, 0x02, 6) // Agent-Remote-ID
+	wantVendorTag = append(wantVendorTag, "line42"...)
+
+	tests := []struct {
+		desc    string
+		port    int
+		code    int
+		clientV []byte
+		wantV   []byte
+	}{
+		{
+			desc:  "PADI",
+			port:  1,
+			code:  pppoePADI,
+			wantV: wantVendorTag,
+		},
+		{
+			desc:  "PADR",
+			port:  1,
+			code:  pppoePADR,
+			wantV: wantVendorTag,
+		},
+		{
+			desc:    "PADI with client DSL Forum tag",
+			port:    1,
+			code:    pppoePADI,
+			clientV: []byte{0x00, 0x00, 0x0d, 0xe9, 0x01, 4, 'f', 'a', 'k', 'e'},
+			wantV:   wantVendorTag,
+		},
+		{
+			desc:    "PADI with client DSL Forum tag on untagged port",
+			port:    0,
+			code:    pppoePADI,
+			clientV: []byte{0x00, 0x00, 0x0d, 0xe9, 0x01, 4, 'f', 'a', 'k', 'e'},
+		},
+		{
+			desc:    "PADI with other vendor tag",
+			port:    0,
+			code:    pppoePADI,
+			clientV: []byte{0x00, 0x00, 0x00, 0x01, 0x42},
+			wantV:   []byte{0x00, 0x00, 0x00, 0x01, 0x42},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			tags := map[int][]byte{pppoeTagServiceName: nil}
+			wantTags := map[int][]byte{pppoeTagServiceName: nil}
+			dst := ethernetBroadcast.HardwareAddr
+			if test.code == pppoePADR {
+				// The concentrator made the client an offer.
+				r.offers[relayOffer{relayClientKey{test.port, client.String()}, ac.String()}] = time.Now()
+				tags[pppoeTagRelaySessionID] = relayTagValue(relayClient{test.port, client}, ac)
+				wantTags[pppoeTagRelaySessionID] = tags[pppoeTagRelaySessionID]
+				dst = ac
+			} else {
+				wantTags[pppoeTagRelaySessionID] = relayTagValue(relayClient{test.port, client}, nil)
+			}
+			if test.clientV != nil {
+				tags[pppoeTagVendorSpecific] = test.clientV
+			}
+			if test.wantV != nil {
+				wantTags[pppoeTagVendorSpecific] = test.wantV
+			}
+
+			pkt := encodeDiscoveryPacket(&discoveryPacket{Code: test.code, Tags: tags})
+			if err := r.handleSubscriberDiscovery(test.port, pkt, client); err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseDiscoveryTags(expectPacket(t, r.acDisc, dst))
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotTags := map[int][]byte{}
+			for _, tag := range got {
+				if len(tag.Value) == 0 {
+					tag.Value = nil
+				}
+				gotTags[tag.Type] = tag.Value
+			}
+			if diff := cmp.Diff(wantTags, gotTags); diff != "" {
+				t.Fatalf("wrong relayed tags: (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRelayVendorTagErrors(t *testing.T) {
+	if tag, err := relayVendorTag("", ""); err != nil || tag != nil {
+		t.Errorf("relayVendorTag with no IDs = %x, %v, want nil, nil", tag, err)
+	}
+	long := string(make([]byte, 64))
+	if _, err := relayVendorTag(long, ""); err == nil {
+		t.Error("relayVendorTag accepted a 64-byte circuit ID")
+	}
+	if _, err := relayVendorTag("", long); err == nil {
+		t.Error("relayVendorTag accepted a 64-byte remote ID")
+	}
+}
+
+func TestRelayExpiry(t *testing.T) {
+	r := newTestRelay()
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	client := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	ac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	tagClient := relayClient{0, client}
+
+	offer := func() {
+		t.Helper()
+		pado := encodeDiscoveryPacket(&discoveryPacket{
+			Code: pppoePADO,
+			Tags: map[int][]byte{pppoeTagRelaySessionID: relayTagValue(tagClient, nil)},
+		})
+		if err := r.handleConcentratorDiscovery(pado, ac); err != nil {
+			t.Fatal(err)
+		}
+		expectPacket(t, r.ports[0].disc, client)
+	}
+	request := func() bool {
+		t.Helper()
+		padr := encodeDiscoveryPacket(&discoveryPacket{
+			Code: pppoePADR,
+			Tags: map[int][]byte{pppoeTagRelaySessionID: relayTagValue(tagClient, ac)},
+		})
+		if err := r.handleSubscriberDiscovery(0, padr, client); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-r.acDisc.(*fakeConn).Out:
+			return true
+		default:
+			return false
+		}
+	}
+	frame := []byte{0x11, 0, 0, 42, 0, 2, 0xc0, 0x21}
+	relayed := func() bool {
+		t.Helper()
+		if err := r.handleSubscriberSession(0, frame, client); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-r.acSess.(*fakeConn).Out:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// PADRs are only relayed while the offer is fresh.
+	offer()
+	now = now.Add(relayOfferTimeout / 2)
+	if !request() {
+		t.Fatal("PADR for a fresh offer not relayed")
+	}
+	now = now.Add(relayOfferTimeout)
+	if request() {
+		t.Fatal("PADR for a stale offer relayed")
+	}
+
+	// Sessions live on as long as they carry frames.
+	pads := encodeDiscoveryPacket(&discoveryPacket{
+		Code:      pppoePADS,
+		SessionID: 42,
+		Tags:      map[int][]byte{pppoeTagRelaySessionID: relayTagValue(tagClient, ac)},
+	})
+	if err := r.handleConcentratorDiscovery(pads, ac); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, r.ports[0].disc, client)
+	for i := 0; i < 3; i++ {
+		now = now.Add(relaySessionTimeout / 2)
+		offer()
+		if !relayed() {
+			t.Fatalf("frame %d of a live session not relayed", i)
+		}
+	}
+
+	// Once they've been quiet for too long, the next expiry run
+	// forgets them.
+	now = now.Add(relaySessionTimeout + time.Second)
+	offer()
+	if relayed() {
+		t.Fatal("frame of an expired session relayed")
+	}
+	if len(r.bySubscriber) != 0 || len(r.byConcentrator) != 0 || len(r.lastSeen) != 0 {
+		t.Fatal("relay still remembers the expired session")
+	}
+}
+
+func TestRelayLoopMTU(t *testing.T) {
+	conn := newFakeConn()
+	from := &raw.Addr{HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+	// A baby jumbo frame, as RFC 4638 allows.
+	conn.In <- fakePacket{make([]byte, 1508), from, nil}
+	errDone := errors.New("done")
+	var got int
+	err := relayLoop(conn, 1508, func(pkt []byte, _ net.HardwareAddr) error {
+		got = len(pkt)
+		return errDone
+	})
+	if err != errDone {
+		t.Fatalf("relayLoop returned %v, want %v", err, errDone)
+	}
+	if got != 1508 {
+		t.Errorf("relayLoop read %d bytes of a 1508-byte packet", got)
+	}
+}
@@ -0,0 +1,162 @@
+package pppoe
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Replay is a PPP link that plays back the concentrator's side of a
+// transcript, so that a negotiation captured in the field with
+// Conn.Transcript can be reproduced in a test. It implements the Conn
+// interfaces of the lcp, ipcp and ipv6cp packages.
+//
+// Read returns the PPP frames that the concentrator sent, in order,
+// each one once as much time has passed since the replay started as
+// had passed between the first PPP packet of the transcript and that
+// frame. The replay starts at its first Read or write. Discovery
+// packets are skipped, since the session is taken to be up already.
+// Once the transcript is exhausted, the link goes silent.
+//
+// What the client writes doesn't affect the replay, but is recorded,
+// so that tests can compare it with what was sent in the field. PAP
+// and CHAP packets are redacted in transcripts, so replaying
+// authentication exchanges isn't meaningful.
+type Replay struct {
+	// frames are the concentrator's PPP packets from the transcript,
+	// and base the time of the transcript's first PPP packet.
+	frames []TranscriptEntry
+	base   time.Time
+
+	mu              sync.Mutex
+	start           time.Time
+	next            int
+	sent            []TranscriptEntry
+	deadline        time.Time
+	deadlineChanged chan struct{}
+}
+
+// NewReplay returns a Replay of the transcript entries.
+func NewReplay(entries []TranscriptEntry) *Replay {
+	ret := &Replay{
+		deadlineChanged: make(chan struct{}),
+	}
+	for _, e := range entries {
+		if e.Protocol == 0 {
+			continue
+		}
+		if ret.base.IsZero() {
+			ret.base = e.Time
+		}
+		if !e.Sent {
+			ret.frames = append(ret.frames, e)
+		}
+	}
+	return ret
+}
+
+// replayTimeoutError is the error of Reads that hit their deadline.
+type replayTimeoutError struct{}
+
+func (replayTimeoutError) Error() string   { return "i/o timeout" }
+func (replayTimeoutError) Timeout() bool   { return true }
+func (replayTimeoutError) Temporary() bool { return true }
+
+// startLocked starts the replay clock, if it's not running yet. r.mu
+// must be held.
+func (r *Replay) startLocked() {
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+}
+
+// Read reads the next PPP frame that the concentrator sent, waiting
+// until it's due.
+func (r *Replay) Read(b []byte) (int, error) {
+	for {
+		r.mu.Lock()
+		r.startLocked()
+		deadline, changed := r.deadline, r.deadlineChanged
+		wait := time.Duration(-1)
+		if r.next < len(r.frames) {
+			frame := r.frames[r.next]
+			wait = time.Until(r.start.Add(frame.Time.Sub(r.base)))
+			if wait <= 0 {
+				r.next++
+				r.mu.Unlock()
+				buf := make([]byte, 2+len(frame.Packet))
+				binary.BigEndian.PutUint16(buf, frame.Protocol)
+				copy(buf[2:], frame.Packet)
+				return copy(b, buf), nil
+			}
+		}
+		r.mu.Unlock()
+
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, replayTimeoutError{}
+			}
+			if wait < 0 || d < wait {
+				wait = d
+			}
+		}
+
+		if wait < 0 {
+			// Nothing left to replay, and no deadline.
+			<-changed
+			continue
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-changed:
+			t.Stop()
+		}
+	}
+}
+
+// Write records the PPP frame b as sent by the client.
+func (r *Replay) Write(b []byte) (int, error) {
+	if len(b) < 2 {
+		return len(b), nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.startLocked()
+	r.sent = append(r.sent, TranscriptEntry{
+		Time:     r.base.Add(time.Since(r.start)),
+		Sent:     true,
+		Protocol: binary.BigEndian.Uint16(b),
+		Packet:   append([]byte(nil), b[2:]...),
+	})
+	return len(b), nil
+}
+
+// WriteProtocol records a PPP frame carrying payload for protocol
+// proto as sent by the client.
+func (r *Replay) WriteProtocol(proto uint16, payload []byte) error {
+	b := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(b, proto)
+	copy(b[2:], payload)
+	_, err := r.Write(b)
+	return err
+}
+
+// SetReadDeadline sets the deadline for future Read operations.
+func (r *Replay) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deadline = t
+	close(r.deadlineChanged)
+	r.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// Sent returns the frames that the client wrote, timestamped on the
+// transcript's clock.
+func (r *Replay) Sent() []TranscriptEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]TranscriptEntry(nil), r.sent...)
+}
@@ -0,0 +1,71 @@
+package pppoe
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.universe.tf/ppp/lcp"
+)
+
+func TestReplay(t *testing.T) {
+	// A field transcript of an LCP negotiation, where the
+	// concentrator takes a while to ack our request.
+	base := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	theirReq := []byte{1, 1, 0, 14, 1, 4, 0x05, 0xd4, 5, 6, 0x11, 0x11, 0x11, 0x11}
+	ourReq := []byte{1, 1, 0, 14, 1, 4, 0x05, 0xd4, 5, 6, 0x22, 0x22, 0x22, 0x22}
+	theirAck := append([]byte{2}, ourReq[1:]...)
+	ourAck := append([]byte{2}, theirReq[1:]...)
+	transcript := []TranscriptEntry{
+		{Time: base, Packet: NewPADS(42).WithServiceName("").Bytes()},
+		{Time: base.Add(10 * time.Millisecond), Sent: true, Protocol: lcp.Protocol, Packet: ourReq},
+		{Time: base.Add(12 * time.Millisecond), Protocol: lcp.Protocol, Packet: theirReq},
+		{Time: base.Add(13 * time.Millisecond), Sent: true, Protocol: lcp.Protocol, Packet: ourAck},
+		{Time: base.Add(60 * time.Millisecond), Protocol: lcp.Protocol, Packet: theirAck},
+	}
+	// Transcripts come from bug reports, as JSON.
+	bs, err := json.Marshal(transcript)
+	if err != nil {
+		t.Fatalf("marshaling transcript: %v", err)
+	}
+	var entries []TranscriptEntry
+	if err := json.Unmarshal(bs, &entries); err != nil {
+		t.Fatalf("unmarshaling transcript: %v", err)
+	}
+	if diff := cmp.Diff(transcript, entries); diff != "" {
+		t.Fatalf("transcript didn't survive JSON (-want +got)\n%s", diff)
+	}
+
+	replay := NewReplay(entries)
+	magic, mru := uint32(0x22222222), uint16(1492)
+	start := time.Now()
+	if _, err := lcp.Negotiate(context.Background(), replay, &lcp.Options{MRU: &mru, Magic: &magic}); err != nil {
+		t.Fatalf("replayed negotiation failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("replayed negotiation took %v, faster than the transcript's 50ms", elapsed)
+	}
+
+	var got [][]byte
+	for _, e := range replay.Sent() {
+		if e.Protocol != lcp.Protocol {
+			t.Errorf("client sent protocol 0x%04x, want LCP", e.Protocol)
+		}
+		got = append(got, e.Packet)
+	}
+	if diff := cmp.Diff([][]byte{ourReq, ourAck}, got); diff != "" {
+		t.Fatalf("client sent different packets than in the field (-want +got)\n%s", diff)
+	}
+}
+
+func TestReplayDeadline(t *testing.T) {
+	replay := NewReplay(nil)
+	replay.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := replay.Read(make([]byte, 1500)); err == nil {
+		t.Fatal("read from exhausted replay succeeded")
+	} else if nerr, ok := err.(interface{ Timeout() bool }); !ok || !nerr.Timeout() {
+		t.Fatalf("read from exhausted replay returned %v, want a timeout", err)
+	}
+}
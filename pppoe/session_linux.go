@@ -0,0 +1,302 @@
+package pppoe
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const protoPPPoE = 0 // Stolen from /usr/include/linux/if_pppox.h
+
+func newSessionFd(ifName string) (int, error) {
+	return unix.Socket(unix.AF_PPPOX, unix.SOCK_STREAM, protoPPPoE)
+}
+
+func closeSessionFd(fd int) error {
+	return unix.Close(fd)
+}
+
+func connectSessionFd(fd int, ifName string, remote net.HardwareAddr, sessionID uint16) error {
+	sa := &unix.SockaddrPPPoE{
+		SID:    sessionID,
+		Remote: remote,
+		Dev:    ifName,
+	}
+	return unix.Connect(fd, sa)
+}
+
+func newChannel(sessionFd int) (*os.File, error) {
+	f, err := os.OpenFile("/dev/ppp", os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	channelID, err := unix.IoctlGetInt(sessionFd, unix.PPPIOCGCHAN)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// At this point sessionFd is kinda horked, because reading the
+	// channel ID switches the channel to the BOUND state, where it
+	// will only talk to the ppp generic driver. So, we need to bind
+	// that channel to the /dev/ppp File we just opened.
+
+	if err := unix.IoctlSetInt(int(f.Fd()), unix.PPPIOCATTCHAN, int(uintptr(unsafe.Pointer(&channelID)))); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// We're passing a pointer to the channelID int into the
+	// kernel. It needs to stay alive until the syscall
+	// completes. This is what runtime.Keepalive does.
+	//
+	// In theory it's overkill because channelID is on the stack
+	// frame, but who knows, the compiler might decide to put it on
+	// the heap for some reason. Worst case, it does nothing, but it's
+	// not actively harmful, so it's fine.
+	runtime.KeepAlive(&channelID)
+
+	return f, nil
+}
+
+// The /dev/ppp device and the ioctls of newUnit, as variables so
+// that tests can stand in for the kernel.
+var (
+	openPPPDevice = func() (*os.File, error) {
+		return os.OpenFile("/dev/ppp", os.O_RDWR, 0600)
+	}
+	ioctlPtr = func(fd int, req uint, arg unsafe.Pointer) error {
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg)); errno != 0 {
+			return errno
+		}
+		return nil
+	}
+)
+
+func newUnit(channel *os.File) (unit *os.File, name string, err error) {
+	f, err := openPPPDevice()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Ask for a new unit. -1 lets the kernel pick the unit number,
+	// which it writes back into unitNum. The kernel's unit numbers
+	// are C ints, so unitNum must be 32 bits even where Go's int
+	// isn't.
+	unitNum := int32(-1)
+	if err := ioctlPtr(int(f.Fd()), unix.PPPIOCNEWUNIT, unsafe.Pointer(&unitNum)); err != nil {
+		f.Close()
+		return nil, "", fmt.Errorf("creating PPP unit: %v", err)
+	}
+
+	// Connect our channel to the unit, so that the unit's network
+	// interface sends and receives through the PPPoE session.
+	if err := ioctlPtr(int(channel.Fd()), unix.PPPIOCCONNECT, unsafe.Pointer(&unitNum)); err != nil {
+		f.Close()
+		return nil, "", fmt.Errorf("connecting channel to PPP unit %d: %v", unitNum, err)
+	}
+
+	return f, fmt.Sprintf("ppp%d", unitNum), nil
+}
+
+func unitFlags(unit *os.File) (uint32, error) {
+	// As with unitDebug, the kernel writes a 32-bit int.
+	var flags uint32
+	if err := ioctlPtr(int(unit.Fd()), unix.PPPIOCGFLAGS, unsafe.Pointer(&flags)); err != nil {
+		return 0, fmt.Errorf("getting PPP unit flags: %v", err)
+	}
+	return flags, nil
+}
+
+func setUnitFlags(unit *os.File, flags uint32) error {
+	if err := unix.IoctlSetInt(int(unit.Fd()), unix.PPPIOCSFLAGS, int(uintptr(unsafe.Pointer(&flags)))); err != nil {
+		return fmt.Errorf("setting PPP unit flags: %v", err)
+	}
+	runtime.KeepAlive(&flags)
+	return nil
+}
+
+func unitDebug(unit *os.File) (uint32, error) {
+	// The kernel writes a 32-bit int, which IoctlGetInt would misread
+	// on big-endian 64-bit hosts.
+	var flags uint32
+	if err := ioctlPtr(int(unit.Fd()), unix.PPPIOCGDEBUG, unsafe.Pointer(&flags)); err != nil {
+		return 0, fmt.Errorf("getting PPP unit debug flags: %v", err)
+	}
+	return flags, nil
+}
+
+func setUnitDebug(unit *os.File, flags uint32) error {
+	if err := unix.IoctlSetInt(int(unit.Fd()), unix.PPPIOCSDEBUG, int(uintptr(unsafe.Pointer(&flags)))); err != nil {
+		return fmt.Errorf("setting PPP unit debug flags: %v", err)
+	}
+	runtime.KeepAlive(&flags)
+	return nil
+}
+
+func setUnitMRU(unit *os.File, mru int) error {
+	v := int32(mru)
+	if err := unix.IoctlSetInt(int(unit.Fd()), unix.PPPIOCSMRU, int(uintptr(unsafe.Pointer(&v)))); err != nil {
+		return fmt.Errorf("setting PPP unit MRU: %v", err)
+	}
+	runtime.KeepAlive(&v)
+	return nil
+}
+
+// setUnitMTU sets the MTU of the network interface name.
+func setUnitMTU(name string, mtu int) error {
+	intf, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("getting interface %v: %v", name, err)
+	}
+	ifi := unix.IfInfomsg{
+		Family: unix.AF_UNSPEC,
+		Index:  int32(intf.Index),
+	}
+	if err := rtnetlink(unix.RTM_NEWLINK, 0, linkMsg(ifi), netlinkAttr(unix.IFLA_MTU, netlinkUint32(uint32(mtu)))); err != nil {
+		return fmt.Errorf("setting MTU of %s: %v", name, err)
+	}
+	return nil
+}
+
+// setUnitIPv4 gives the network interface name the IPv4 address local,
+// as a /32. If peer isn't nil, it's the address of the other end of
+// the point-to-point link, to which the kernel adds a host route.
+func setUnitIPv4(name string, local, peer net.IP) error {
+	intf, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("getting interface %v: %v", name, err)
+	}
+	ifa := unix.IfAddrmsg{
+		Family:    unix.AF_INET,
+		Prefixlen: 32,
+		Scope:     unix.RT_SCOPE_UNIVERSE,
+		Index:     uint32(intf.Index),
+	}
+	address := local
+	if peer != nil {
+		address = peer
+	}
+	attrs := [][]byte{
+		netlinkAttr(unix.IFA_LOCAL, local),
+		netlinkAttr(unix.IFA_ADDRESS, address),
+	}
+	if err := rtnetlink(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, addrMsg(ifa), attrs...); err != nil {
+		return fmt.Errorf("setting IPv4 address of %s: %v", name, err)
+	}
+	return nil
+}
+
+// addUnitRoute routes dst over the network interface name, via peer,
+// or as an onlink route if peer is nil.
+func addUnitRoute(name string, dst *net.IPNet, peer net.IP) error {
+	intf, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("getting interface %v: %v", name, err)
+	}
+	ones, _ := dst.Mask.Size()
+	rtm := unix.RtMsg{
+		Family:   unix.AF_INET,
+		Dst_len:  uint8(ones),
+		Table:    unix.RT_TABLE_MAIN,
+		Protocol: unix.RTPROT_BOOT,
+		Scope:    unix.RT_SCOPE_LINK,
+		Type:     unix.RTN_UNICAST,
+	}
+	attrs := [][]byte{
+		netlinkAttr(unix.RTA_OIF, netlinkUint32(uint32(intf.Index))),
+	}
+	if ones > 0 {
+		attrs = append(attrs, netlinkAttr(unix.RTA_DST, dst.IP.Mask(dst.Mask)))
+	}
+	if peer != nil {
+		rtm.Scope = unix.RT_SCOPE_UNIVERSE
+		attrs = append(attrs, netlinkAttr(unix.RTA_GATEWAY, peer))
+	}
+	if err := rtnetlink(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, routeMsg(rtm), attrs...); err != nil {
+		return fmt.Errorf("adding route to %v over %s: %v", dst, name, err)
+	}
+	return nil
+}
+
+// watchUnitKernelLog sends the kernel log messages about the PPP unit
+// name that are logged from now on to lines, until ctx is done.
+func watchUnitKernelLog(ctx context.Context, name string, lines chan<- string) error {
+	f, err := os.OpenFile("/dev/kmsg", os.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return fmt.Errorf("opening kernel log: %v", err)
+	}
+	defer f.Close()
+	// Skip the messages that are already in the log.
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return fmt.Errorf("seeking to the end of the kernel log: %v", err)
+	}
+	if err := f.SetReadDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("kernel log can't be read with deadlines: %v", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.SetReadDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	// Each read returns one log record, which is at most a page.
+	buf := make([]byte, 8192)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if perr, ok := err.(*os.PathError); ok && perr.Err == unix.EPIPE {
+				// Records were overwritten before we read them. The
+				// next read returns the oldest remaining one.
+				continue
+			}
+			return fmt.Errorf("reading kernel log: %v", err)
+		}
+		msg, ok := unitKernelMessage(buf[:n], name)
+		if !ok {
+			continue
+		}
+		select {
+		case lines <- msg:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// unitKernelMessage returns the message of the /dev/kmsg record rec,
+// if it's about the PPP unit name, which ppp_generic prefixes its
+// messages with. Messages that ppp_generic logs with a bare "PPP: "
+// prefix, when it has no unit at hand, can't be attributed to a unit
+// and are skipped.
+func unitKernelMessage(rec []byte, name string) (string, bool) {
+	// A record is "priority,sequence,timestamp,flags;message", then
+	// key=value lines that start with a space.
+	i := bytes.IndexByte(rec, ';')
+	if i < 0 {
+		return "", false
+	}
+	msg := rec[i+1:]
+	if j := bytes.IndexByte(msg, '\n'); j >= 0 {
+		msg = msg[:j]
+	}
+	if !bytes.HasPrefix(msg, []byte(name+": ")) {
+		return "", false
+	}
+	return string(msg), true
+}
@@ -0,0 +1,79 @@
+//go:build !linux
+// +build !linux
+
+package pppoe
+
+import (
+	"context"
+	"net"
+	"os"
+	"runtime"
+)
+
+// PPPoE sessions are handled by the kernel's AF_PPPOX and ppp_generic
+// drivers, which only exist on Linux. Elsewhere, the package still
+// builds, but session setup fails with an *UnsupportedError unless
+// Config.Userspace is set.
+
+func errSessionUnsupported() error {
+	return &UnsupportedError{
+		Op:   "PPPoE session",
+		GOOS: runtime.GOOS,
+	}
+}
+
+func newSessionFd(ifName string) (int, error) {
+	return -1, errSessionUnsupported()
+}
+
+func closeSessionFd(fd int) error {
+	return errSessionUnsupported()
+}
+
+func connectSessionFd(fd int, ifName string, remote net.HardwareAddr, sessionID uint16) error {
+	return errSessionUnsupported()
+}
+
+func newChannel(sessionFd int) (*os.File, error) {
+	return nil, errSessionUnsupported()
+}
+
+func newUnit(channel *os.File) (unit *os.File, name string, err error) {
+	return nil, "", errSessionUnsupported()
+}
+
+func unitFlags(unit *os.File) (uint32, error) {
+	return 0, errSessionUnsupported()
+}
+
+func setUnitFlags(unit *os.File, flags uint32) error {
+	return errSessionUnsupported()
+}
+
+func unitDebug(unit *os.File) (uint32, error) {
+	return 0, errSessionUnsupported()
+}
+
+func setUnitDebug(unit *os.File, flags uint32) error {
+	return errSessionUnsupported()
+}
+
+func setUnitMRU(unit *os.File, mru int) error {
+	return errSessionUnsupported()
+}
+
+func setUnitMTU(name string, mtu int) error {
+	return errSessionUnsupported()
+}
+
+func setUnitIPv4(name string, local, peer net.IP) error {
+	return errSessionUnsupported()
+}
+
+func addUnitRoute(name string, dst *net.IPNet, peer net.IP) error {
+	return errSessionUnsupported()
+}
+
+func watchUnitKernelLog(ctx context.Context, name string, lines chan<- string) error {
+	return errSessionUnsupported()
+}
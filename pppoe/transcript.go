@@ -0,0 +1,200 @@
+package pppoe
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.universe.tf/ppp/internal/cp"
+)
+
+// TranscriptEntry is a control packet that a Conn sent or received
+// while bringing up its session.
+type TranscriptEntry struct {
+	// Time is when the packet was sent or received.
+	Time time.Time
+	// Sent is true for packets we sent, false for packets the
+	// concentrator sent.
+	Sent bool
+	// Protocol is the PPP protocol of the packet, or 0 for PPPoE
+	// Discovery packets.
+	Protocol uint16
+	// Packet is the packet, without its PPP protocol field. The
+	// contents of PAP and CHAP packets are redacted, leaving only
+	// their header.
+	Packet []byte
+}
+
+// MarshalJSON encodes the entry with the packet bytes formatted as
+// colon-separated hex, like Wireshark does, so that transcripts are
+// readable as is.
+func (e TranscriptEntry) MarshalJSON() ([]byte, error) {
+	ret := struct {
+		Time      time.Time `json:"time"`
+		Direction string    `json:"direction"`
+		Protocol  string    `json:"protocol"`
+		Packet    string    `json:"packet"`
+	}{
+		Time:      e.Time,
+		Direction: "received",
+		Protocol:  fmt.Sprintf("0x%04x", e.Protocol),
+		Packet:    cp.WiresharkBytes(e.Packet),
+	}
+	if e.Sent {
+		ret.Direction = "sent"
+	}
+	if e.Protocol == 0 {
+		ret.Protocol = "discovery"
+	}
+	return json.Marshal(ret)
+}
+
+// UnmarshalJSON decodes an entry encoded by MarshalJSON, so that
+// transcripts attached to bug reports can be loaded back, e.g. into a
+// Replay.
+func (e *TranscriptEntry) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Time      time.Time `json:"time"`
+		Direction string    `json:"direction"`
+		Protocol  string    `json:"protocol"`
+		Packet    string    `json:"packet"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	ret := TranscriptEntry{Time: raw.Time}
+	switch raw.Direction {
+	case "sent":
+		ret.Sent = true
+	case "received":
+	default:
+		return fmt.Errorf("unknown transcript direction %q", raw.Direction)
+	}
+	if raw.Protocol != "discovery" {
+		proto, err := strconv.ParseUint(raw.Protocol, 0, 16)
+		if err != nil {
+			return fmt.Errorf("invalid transcript protocol %q: %v", raw.Protocol, err)
+		}
+		ret.Protocol = uint16(proto)
+	}
+	if raw.Packet != "" {
+		packet, err := hex.DecodeString(strings.Replace(raw.Packet, ":", "", -1))
+		if err != nil {
+			return fmt.Errorf("invalid transcript packet %q: %v", raw.Packet, err)
+		}
+		ret.Packet = packet
+	}
+	*e = ret
+	return nil
+}
+
+// maxTranscriptEntries bounds the size of a transcript, in case the
+// session never gets to exchanging data.
+const maxTranscriptEntries = 256
+
+// Protocol numbers of the authentication protocols, whose packets get
+// redacted in transcripts.
+const (
+	protoPAP  = 0xc023
+	protoCHAP = 0xc223
+)
+
+// transcript records the control packets of a session's bring-up. It
+// stops recording when the first data frame goes by, since the
+// session is then up. A nil *transcript records nothing.
+type transcript struct {
+	mu      sync.Mutex
+	entries []TranscriptEntry
+	done    bool
+}
+
+// add records packet, which was sent or received for protocol proto.
+func (t *transcript) add(sent bool, proto uint16, packet []byte) {
+	if t == nil {
+		return
+	}
+	packet = append([]byte(nil), packet...)
+	if (proto == protoPAP || proto == protoCHAP) && len(packet) > 4 {
+		packet = packet[:4]
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done || len(t.entries) == maxTranscriptEntries {
+		return
+	}
+	t.entries = append(t.entries, TranscriptEntry{
+		Time:     time.Now(),
+		Sent:     sent,
+		Protocol: proto,
+		Packet:   packet,
+	})
+}
+
+// addFrame records the PPP frame, if it's a control frame. A data
+// frame ends the recording.
+func (t *transcript) addFrame(sent bool, frame []byte) {
+	if t == nil {
+		return
+	}
+	proto, ok := frameProtocol(frame)
+	if !ok {
+		return
+	}
+	// Protocol numbers 0x8000 and up are control protocols (RFC 1661
+	// section 2).
+	if proto < 0x8000 {
+		t.mu.Lock()
+		t.done = true
+		t.mu.Unlock()
+		return
+	}
+	t.add(sent, proto, frame[2:])
+}
+
+func (t *transcript) get() []TranscriptEntry {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TranscriptEntry(nil), t.entries...)
+}
+
+// transcriptConn is a discovery conn that records the packets of
+// PPPoE discovery in a transcript.
+type transcriptConn struct {
+	net.PacketConn
+	t *transcript
+}
+
+func (c *transcriptConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, from, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, from, err
+	}
+	// The discovery conn sees all the discovery traffic on the
+	// network, including other hosts' PADIs. Only record the packets
+	// that concentrators send.
+	if pkt, err := parseDiscoveryPacket(b[:n]); err == nil {
+		switch pkt.Code {
+		case pppoePADO, pppoePADS, pppoePADT:
+			c.t.add(false, 0, b[:n])
+		}
+	}
+	return n, from, err
+}
+
+func (c *transcriptConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if err == nil {
+		c.t.add(true, 0, b)
+	}
+	return n, err
+}
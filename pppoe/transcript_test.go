@@ -0,0 +1,105 @@
+package pppoe
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTranscript(t *testing.T) {
+	disco := newFakeConn()
+	defer disco.Close()
+	go fakeConcentrator(disco, net.HardwareAddr{0, 1, 2, 3, 4, 5}, 42)
+
+	// Another host's PADI, which shouldn't end up in the transcript.
+	disco.In <- fakePacket{padiPacket("", []byte("other host"), 0), &net.UnixAddr{}, nil}
+
+	tr := &transcript{}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, _, err := pppoeDiscovery(ctx, &transcriptConn{disco, tr}, &Config{HostUniq: []byte("uniq")}); err != nil {
+		t.Fatalf("discovery failed: %v", err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("creating pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+	// Two Conns sharing a transcript, so that frames written by one
+	// are recorded as sent, then as received when the other reads
+	// them.
+	rc, wc := &Conn{channel: r, transcript: tr}, &Conn{channel: w, transcript: tr}
+
+	b := make([]byte, 1500)
+	send := func(proto uint16, payload []byte) {
+		t.Helper()
+		if err := wc.WriteProtocol(proto, payload); err != nil {
+			t.Fatalf("writing frame: %v", err)
+		}
+		if _, err := rc.Read(b); err != nil {
+			t.Fatalf("reading frame: %v", err)
+		}
+	}
+	send(0xc021, []byte{1, 1, 0, 8, 1, 4, 0x05, 0xd4})       // LCP Configure-Request
+	send(protoCHAP, []byte{2, 1, 0, 10, 4, 1, 2, 3, 4, 'a'}) // CHAP Response
+	send(0x0021, make([]byte, 20))                           // IPv4
+	send(0xc021, []byte{9, 2, 0, 8, 0, 0, 0, 0})             // LCP Echo-Request
+
+	want := []TranscriptEntry{
+		{Sent: true, Packet: padiPacket("", []byte("uniq"), 0)},
+		{Sent: false, Packet: []byte{pppoePADO}},
+		{Sent: true, Packet: []byte{pppoePADR}},
+		{Sent: false, Packet: []byte{pppoePADS}},
+		{Sent: true, Protocol: 0xc021, Packet: []byte{1, 1, 0, 8, 1, 4, 0x05, 0xd4}},
+		{Sent: false, Protocol: 0xc021, Packet: []byte{1, 1, 0, 8, 1, 4, 0x05, 0xd4}},
+		{Sent: true, Protocol: protoCHAP, Packet: []byte{2, 1, 0, 10}},
+		{Sent: false, Protocol: protoCHAP, Packet: []byte{2, 1, 0, 10}},
+	}
+	got := rc.Transcript()
+	for i := range got {
+		if got[i].Time.IsZero() {
+			t.Errorf("entry %d has no timestamp", i)
+		}
+		got[i].Time = time.Time{}
+		// Discovery packets other than the PADI are summarized by
+		// their code, since their tag order isn't stable.
+		if got[i].Protocol == 0 && i > 0 {
+			got[i].Packet = []byte{got[i].Packet[1]}
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("wrong transcript (-want +got)\n%s", diff)
+	}
+}
+
+func TestTranscriptJSON(t *testing.T) {
+	entries := []TranscriptEntry{
+		{
+			Time:     time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC),
+			Sent:     true,
+			Protocol: 0,
+			Packet:   []byte{0x11, 0x09, 0, 0},
+		},
+		{
+			Time:     time.Date(2019, 1, 2, 3, 4, 6, 0, time.UTC),
+			Protocol: 0xc021,
+			Packet:   []byte{9, 2, 0, 4},
+		},
+	}
+	got, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("marshaling transcript: %v", err)
+	}
+	want := `[{"time":"2019-01-02T03:04:05Z","direction":"sent","protocol":"discovery","packet":"11:09:00:00"},` +
+		`{"time":"2019-01-02T03:04:06Z","direction":"received","protocol":"0xc021","packet":"09:02:00:04"}]`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Fatalf("wrong JSON (-want +got)\n%s", diff)
+	}
+}
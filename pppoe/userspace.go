@@ -0,0 +1,108 @@
+package pppoe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/raw"
+)
+
+// userspaceChannel is a PPP channel that does PPPoE session framing
+// itself, over a raw socket for the PPPoE Session EtherType. It stands
+// in for the kernel's AF_PPPOX and /dev/ppp objects on hosts that lack
+// them, at the cost of copying every frame through the process.
+type userspaceChannel struct {
+	conn         net.PacketConn
+	concentrator net.HardwareAddr
+	sessionID    uint16
+	// maxPayload is the largest PPP payload that the session carries.
+	maxPayload int
+
+	// readMu serializes Reads, which share readBuf.
+	readMu  sync.Mutex
+	readBuf []byte
+
+	// writeDeadline is the deadline set by SetWriteDeadline. Writes
+	// to a raw socket only block while the kernel queues the frame,
+	// so it's checked before each write, rather than interrupting
+	// writes in progress.
+	mu            sync.Mutex
+	writeDeadline time.Time
+}
+
+// Read reads the next PPP frame of the session. Session frames from
+// other hosts, or for other sessions, are discarded.
+func (c *userspaceChannel) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.readBuf) < 8+c.maxPayload {
+		c.readBuf = make([]byte, 8+c.maxPayload)
+	}
+	buf := c.readBuf
+	for {
+		n, from, err := readFrom(c.conn, buf)
+		if err != nil {
+			return 0, err
+		}
+		addr, ok := from.(*raw.Addr)
+		if !ok || !bytes.Equal(addr.HardwareAddr, c.concentrator) {
+			continue
+		}
+		pkt, sessionID, err := trimSessionFrame(buf[:n])
+		if err != nil || sessionID != c.sessionID {
+			continue
+		}
+		return copy(b, pkt[6:]), nil
+	}
+}
+
+// Write sends the PPP frame b to the concentrator, wrapped in a PPPoE
+// session header. It fails with a timeout error if the write deadline
+// has passed.
+func (c *userspaceChannel) Write(b []byte) (int, error) {
+	if len(b) > 2+c.maxPayload {
+		return 0, errors.New("PPP frame too large for PPPoE session")
+	}
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, rawTimeoutError{}
+	}
+	pkt := make([]byte, 6+len(b))
+	pkt[0] = 0x11 // Protocol version 1, packet type 1
+	// pkt[1] is the code, always zero for session frames.
+	binary.BigEndian.PutUint16(pkt[2:4], c.sessionID)
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(b)))
+	copy(pkt[6:], b)
+	if _, err := c.conn.WriteTo(pkt, &raw.Addr{HardwareAddr: c.concentrator}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *userspaceChannel) Close() error {
+	return c.conn.Close()
+}
+
+func (c *userspaceChannel) SetDeadline(t time.Time) error {
+	c.SetWriteDeadline(t)
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *userspaceChannel) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline. The raw socket's own
+// write deadline is a no-op, so the channel keeps track of it.
+func (c *userspaceChannel) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,100 @@
+package pppoe
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/raw"
+)
+
+func TestUserspaceChannel(t *testing.T) {
+	ac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	evil := net.HardwareAddr{2, 0, 0, 0, 0, 3}
+	conn := newFakeConn()
+	ch := &userspaceChannel{conn: conn, concentrator: ac, sessionID: 42, maxPayload: defaultMaxPayload}
+
+	if _, err := ch.Write([]byte{0xc0, 0x21, 1, 2}); err != nil {
+		t.Fatalf("writing frame: %v", err)
+	}
+	want := []byte{0x11, 0, 0, 42, 0, 4, 0xc0, 0x21, 1, 2}
+	if diff := cmp.Diff(want, expectPacket(t, conn, ac)); diff != "" {
+		t.Fatalf("wrong session frame (-want +got)\n%s", diff)
+	}
+
+	// Frames from other hosts, for other sessions, and malformed ones
+	// are skipped. Ethernet padding is trimmed.
+	send := func(from net.HardwareAddr, pkt []byte) {
+		conn.In <- fakePacket{pkt, &raw.Addr{HardwareAddr: from}, nil}
+	}
+	send(evil, []byte{0x11, 0, 0, 42, 0, 2, 0xc0, 0x21})
+	send(ac, []byte{0x11, 0, 0, 43, 0, 2, 0xc0, 0x21})
+	send(ac, []byte{0x11, 0, 0, 42, 0, 9, 0xc0, 0x21})
+	send(ac, []byte{0x11, 0, 0, 42, 0, 3, 0xc0, 0x21, 9, 0, 0, 0})
+
+	var b [pppoeBufferLen]byte
+	n, err := ch.Read(b[:])
+	if err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	if diff := cmp.Diff([]byte{0xc0, 0x21, 9}, b[:n]); diff != "" {
+		t.Fatalf("wrong PPP frame (-want +got)\n%s", diff)
+	}
+
+	if _, err := ch.Write(make([]byte, pppoeBufferLen)); err == nil {
+		t.Fatal("writing oversized frame succeeded")
+	}
+	expectNoPacket(t, conn)
+
+	// Sessions with a larger PPP-Max-Payload carry larger frames.
+	ch.maxPayload = 1500
+	if _, err := ch.Write(make([]byte, 1502)); err != nil {
+		t.Fatalf("writing baby jumbo frame: %v", err)
+	}
+	if got := len(expectPacket(t, conn, ac)); got != 1508 {
+		t.Fatalf("wrote %d-byte session frame, want 1508", got)
+	}
+	send(ac, append([]byte{0x11, 0, 0, 42, 0x05, 0xde}, make([]byte, 1502)...))
+	if n, err := ch.Read(make([]byte, 2000)); err != nil || n != 1502 {
+		t.Fatalf("reading baby jumbo frame got %d bytes, %v, want 1502 bytes", n, err)
+	}
+}
+
+func TestUserspaceChannelWriteDeadline(t *testing.T) {
+	ac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	conn := newFakeConn()
+	ch := &userspaceChannel{conn: conn, concentrator: ac, sessionID: 42, maxPayload: defaultMaxPayload}
+	frame := []byte{0xc0, 0x21, 1, 2}
+
+	if err := ch.SetWriteDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("setting write deadline: %v", err)
+	}
+	if _, err := ch.Write(frame); !isTimeout(err) {
+		t.Fatalf("write past deadline returned %v, want a timeout", err)
+	}
+	expectNoPacket(t, conn)
+
+	if err := ch.SetDeadline(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("setting deadline: %v", err)
+	}
+	if _, err := ch.Write(frame); err != nil {
+		t.Fatalf("write before deadline: %v", err)
+	}
+	expectPacket(t, conn, ac)
+
+	if err := ch.SetDeadline(time.Unix(1, 0)); err != nil {
+		t.Fatalf("setting deadline: %v", err)
+	}
+	if _, err := ch.Write(frame); !isTimeout(err) {
+		t.Fatalf("write past deadline set by SetDeadline returned %v, want a timeout", err)
+	}
+
+	if err := ch.SetWriteDeadline(time.Time{}); err != nil {
+		t.Fatalf("clearing write deadline: %v", err)
+	}
+	if _, err := ch.Write(frame); err != nil {
+		t.Fatalf("write without deadline: %v", err)
+	}
+	expectPacket(t, conn, ac)
+}